@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+Admin endpoint
+
+A small HTTP server for operators, started by "users serve -admin-addr 127.0.0.1:8081" (it listens on
+localhost by default, it has no authentication of its own) :
+
+	GET    /admin/gorm-logger   : {"level": "warn", "configured_level": "warn", "slow_threshold": "1s"}
+	PUT    /admin/gorm-logger   : {"level": "info"} and / or {"slow_threshold": "200ms"}, returns the new settings
+	GET    /admin/slow-queries  : the slow query report, slowest first (see gorm_logger.go)
+	DELETE /admin/slow-queries  : clears the report
+
+	GET  /admin/webhooks/dead-letters?subscription_id=..&tenant=..&limit=100 : the dead webhook deliveries
+	POST /admin/webhooks/replay  : {"tenant": "acme", "subscription_id": "wh_..."} and / or {"ids": [1, 2]},
+	                               puts dead deliveries back in the queue (see webhook.go)
+
+tenant defaults to all tenants.
+*/
+
+type gormLoggerSettingsResponse struct {
+	Level           string `json:"level"`
+	ConfiguredLevel string `json:"configured_level"`
+	SlowThreshold   string `json:"slow_threshold"`
+}
+
+type gormLoggerSettingsRequest struct {
+	Level         *string `json:"level"`
+	SlowThreshold *string `json:"slow_threshold"`
+}
+
+func currentGormLoggerSettings() gormLoggerSettingsResponse {
+	return gormLoggerSettingsResponse{
+		Level:           gormLogLevelName(gormSettings.Level()),
+		ConfiguredLevel: gormLogLevelName(gormSettings.ConfiguredLevel()),
+		SlowThreshold:   gormSettings.SlowThreshold().String(),
+	}
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		appLog.Error(context.Background(), "admin : could not write response", "error", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSONResponse(w, status, map[string]string{"error": message})
+}
+
+func handleGormLoggerSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSONResponse(w, http.StatusOK, currentGormLoggerSettings())
+	case http.MethodPut, http.MethodPost:
+		var req gormLoggerSettingsRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		// validate everything before changing anything
+		level := gormSettings.Level()
+		if req.Level != nil {
+			level, err = parseGormLogLevel(*req.Level)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		threshold := gormSettings.SlowThreshold()
+		if req.SlowThreshold != nil {
+			threshold, err = time.ParseDuration(*req.SlowThreshold)
+			if err != nil || threshold < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid slow_threshold , please use a duration like 200ms")
+				return
+			}
+		}
+
+		gormSettings.SetLevel(level)
+		gormSettings.SetSlowThreshold(threshold)
+		appLog.Info(r.Context(), "gorm logger settings changed", "level", gormLogLevelName(level), "slow_threshold", threshold)
+		writeJSONResponse(w, http.StatusOK, currentGormLoggerSettings())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func handleSlowQueries(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"slow_threshold": gormSettings.SlowThreshold().String(),
+			"queries":        slowQueries.Top(),
+		})
+	case http.MethodDelete:
+		slowQueries.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+type webhookReplayRequest struct {
+	Tenant         string  `json:"tenant"`
+	SubscriptionID string  `json:"subscription_id"`
+	IDs            []int64 `json:"ids"`
+}
+
+// adminTenantContext scopes an admin request to tenant, all tenants when it is empty
+func adminTenantContext(ctx context.Context, tenant string) (context.Context, error) {
+	if tenant == "" {
+		return contextWithTenant(ctx, allTenants), nil
+	}
+	err := validateTenantID(tenant, true)
+	if err != nil {
+		return nil, err
+	}
+	return contextWithTenant(ctx, tenant), nil
+}
+
+func handleWebhookDeadLetters(dispatcher *WebhookDispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		query := r.URL.Query()
+		ctx, err := adminTenantContext(r.Context(), query.Get("tenant"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit := 0
+		if value := query.Get("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid limit , please use a positive number")
+				return
+			}
+		}
+
+		deliveries, err := dispatcher.DeadLetters(ctx, query.Get("subscription_id"), limit)
+		if err != nil {
+			appLog.Error(ctx, "admin : could not list the dead webhook deliveries", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, map[string]interface{}{"deliveries": deliveries})
+	}
+}
+
+func handleWebhookReplay(dispatcher *WebhookDispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var req webhookReplayRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		ctx, err := adminTenantContext(r.Context(), req.Tenant)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		replayed, err := dispatcher.Replay(ctx, req.SubscriptionID, req.IDs)
+		if errors.Is(err, ErrInvalidArgument) {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			appLog.Error(ctx, "admin : could not replay the webhook deliveries", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, map[string]int64{"replayed": replayed})
+	}
+}
+
+func newAdminHandler(db *gorm.DB) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/gorm-logger", handleGormLoggerSettings)
+	mux.HandleFunc("/admin/slow-queries", handleSlowQueries)
+
+	dispatcher := NewWebhookDispatcher(db, WebhookOptions{})
+	mux.HandleFunc("/admin/webhooks/dead-letters", handleWebhookDeadLetters(dispatcher))
+	mux.HandleFunc("/admin/webhooks/replay", handleWebhookReplay(dispatcher))
+	return mux
+}
+
+func serveAdmin(ctx context.Context, db *gorm.DB, addr string) error {
+	appLog.Info(ctx, "admin endpoint listening", "addr", addr, "path", "/admin/")
+	return serveHTTP(ctx, addr, newAdminHandler(db))
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"os"
+	"regexp"
+	"strings"
+)
+
+/*
+Authentication and authorization (gRPC and GraphQL)
+
+Every call of "users serve" carries one of :
+
+	authorization: Bearer <jwt>     (gRPC metadata or HTTP header)
+	x-api-key: <api key>
+
+API keys (USERS_API_KEYS_FILE) : only the SHA-256 of a key is stored, "users apikey" creates one
+
+	[
+	    {"name": "ci", "sha256": "5e88...", "role": "editor", "tenant": "acme"}
+	]
+
+JWT, verified locally (no call to the issuer) :
+
+	USERS_JWT_HS256_SECRET_FILE     : file with the shared secret (HS256)
+	USERS_JWT_RS256_PUBLIC_KEY_FILE : PEM public key (RS256)
+	USERS_JWT_ISSUER                : optional, the "iss" claim must match
+	USERS_JWT_AUDIENCE              : optional, the "aud" claim must contain it
+
+"exp" is required, the role comes from the "role" claim (or the highest one of "roles"), the subject
+from "sub", the tenant from "tenant". Only the algorithms with a configured key are accepted.
+
+Every call runs in the tenant of its caller (see tenant.go), "default" when the key / token has none,
+"*" gives access to every tenant.
+
+Roles :
+
+	reader : get, list, search           phone and balance are masked in every response
+	editor : reader + create, upsert, bulk import
+	admin  : editor + delete, migrate
+
+A role that gets the phone masked can't look it up either : filters on phone and search terms that
+could match a phone number (digits and + - . ( ) and spaces only) are denied.
+
+"users serve" refuses to start without any credentials configured, -no-auth serves without
+authentication (every caller is admin), for local testing only.
+*/
+
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleReader
+	RoleEditor
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleReader:
+		return "reader"
+	case RoleEditor:
+		return "editor"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+func parseRole(role string) (Role, error) {
+	switch strings.ToLower(role) {
+	case "reader":
+		return RoleReader, nil
+	case "editor":
+		return RoleEditor, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return RoleNone, fmt.Errorf("invalid role ( %v ) , please use reader, editor or admin", role)
+	}
+}
+
+type Permission string
+
+const (
+	PermRead    Permission = "read"    // get, batch get, list
+	PermSearch  Permission = "search"  // search
+	PermWrite   Permission = "write"   // create, upsert, bulk import
+	PermDelete  Permission = "delete"  // delete
+	PermMigrate Permission = "migrate" // migrate (over all tenants)
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleReader: {PermRead, PermSearch},
+	RoleEditor: {PermRead, PermSearch, PermWrite},
+	RoleAdmin:  {PermRead, PermSearch, PermWrite, PermDelete, PermMigrate},
+}
+
+// roleMaskedColumns are the columns masked in the responses sent to a role
+var roleMaskedColumns = map[Role][]string{
+	RoleReader: {"phone", "balance"},
+}
+
+var (
+	ErrUnauthenticated  = errors.New("unauthenticated")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// Principal is the authenticated caller
+type Principal struct {
+	Subject string // api key name or jwt "sub"
+	Role    Role
+	Tenant  string // the tenant every call of the principal runs in, see tenant.go
+	Method  string // api_key, jwt or none (-no-auth)
+}
+
+func (p Principal) Can(permission Permission) bool {
+	for _, allowed := range rolePermissions[p.Role] {
+		if allowed == permission {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// contextWithPrincipal also scopes ctx to the tenant of principal
+func contextWithPrincipal(ctx context.Context, principal Principal) context.Context {
+	ctx = context.WithValue(ctx, principalKey{}, principal)
+	return contextWithTenant(ctx, principal.Tenant)
+}
+
+func principalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// authorize checks that the caller in ctx has permission
+func authorize(ctx context.Context, permission Permission) error {
+	principal, ok := principalFromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !principal.Can(permission) {
+		appLog.Warn(ctx, "permission denied", "subject", principal.Subject, "role", principal.Role.String(), "permission", string(permission))
+		return fmt.Errorf("%w : role %v can't %v", ErrPermissionDenied, principal.Role, permission)
+	}
+	return nil
+}
+
+// columnMasked tells whether column has to be masked for the caller in ctx
+func columnMasked(ctx context.Context, column string) bool {
+	principal, ok := principalFromContext(ctx)
+	if !ok {
+		return true
+	}
+	for _, masked := range roleMaskedColumns[principal.Role] {
+		if masked == column {
+			return true
+		}
+	}
+	return false
+}
+
+// phoneSearchTerm matches the search terms that can match (a part of) a phone number
+var phoneSearchTerm = regexp.MustCompile(`^[0-9+\-.() ]*[0-9][0-9+\-.() ]*$`)
+
+// authorizeSearchTerms denies the terms that could match the phone when it is masked for the caller in
+// ctx : a search would tell whether a number (or its digits) belongs to a user, through string_rep or the
+// phone blind index
+func authorizeSearchTerms(ctx context.Context, terms []string) error {
+	if !columnMasked(ctx, "phone") {
+		return nil
+	}
+	for _, term := range terms {
+		if phoneSearchTerm.MatchString(strings.TrimSpace(term)) {
+			return fmt.Errorf("%w : role can't search for phone numbers", ErrPermissionDenied)
+		}
+	}
+	return nil
+}
+
+// maskColumn returns value as the caller in ctx may see it
+func maskColumn(ctx context.Context, column string, value string) string {
+	if !columnMasked(ctx, column) {
+		return value
+	}
+	switch column {
+	case "phone":
+		return maskPhone(value)
+	default:
+		return redacted
+	}
+}
+
+// maskUser masks the columns the caller in ctx may not see
+func maskUser(ctx context.Context, user User) User {
+	user.Phone = maskColumn(ctx, "phone", user.Phone)
+	user.Balance = maskColumn(ctx, "balance", user.Balance)
+	return user
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// authenticator
+
+type apiKeyEntry struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"` // default : "default"
+}
+
+type apiKey struct {
+	name   string
+	hash   []byte
+	role   Role
+	tenant string
+}
+
+type jwtClaims struct {
+	Role   string   `json:"role"`
+	Roles  []string `json:"roles"`
+	Tenant string   `json:"tenant"`
+	jwt.RegisteredClaims
+}
+
+type Authenticator struct {
+	apiKeys    []apiKey
+	hsSecret   []byte
+	rsKey      *rsa.PublicKey
+	issuer     string
+	audience   string
+	noAuth     bool
+	jwtMethods []string
+}
+
+// newAuthenticator reads the credentials from the environment, noAuth makes every caller admin
+func newAuthenticator(noAuth bool) (*Authenticator, error) {
+	a := &Authenticator{
+		noAuth:   noAuth,
+		issuer:   os.Getenv("USERS_JWT_ISSUER"),
+		audience: os.Getenv("USERS_JWT_AUDIENCE"),
+	}
+	if noAuth {
+		return a, nil
+	}
+
+	if fileName := os.Getenv("USERS_API_KEYS_FILE"); fileName != "" {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("could not read api keys : %w", err)
+		}
+		var entries []apiKeyEntry
+		err = json.Unmarshal(data, &entries)
+		if err != nil {
+			return nil, fmt.Errorf("invalid api keys file ( %v ) : %w", fileName, err)
+		}
+		for _, entry := range entries {
+			hash, err := hex.DecodeString(entry.SHA256)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid sha256 for api key ( %v )", entry.Name)
+			}
+			role, err := parseRole(entry.Role)
+			if err != nil {
+				return nil, fmt.Errorf("api key ( %v ) : %w", entry.Name, err)
+			}
+			tenant, err := principalTenant(entry.Tenant)
+			if err != nil {
+				return nil, fmt.Errorf("api key ( %v ) : %w", entry.Name, err)
+			}
+			a.apiKeys = append(a.apiKeys, apiKey{name: entry.Name, hash: hash, role: role, tenant: tenant})
+		}
+	}
+
+	if fileName := os.Getenv("USERS_JWT_HS256_SECRET_FILE"); fileName != "" {
+		secret, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("could not read jwt secret : %w", err)
+		}
+		a.hsSecret = []byte(strings.TrimSpace(string(secret)))
+		if len(a.hsSecret) < 32 {
+			return nil, errors.New("jwt HS256 secret is too short , please use at least 32 bytes")
+		}
+		a.jwtMethods = append(a.jwtMethods, jwt.SigningMethodHS256.Alg())
+	}
+
+	if fileName := os.Getenv("USERS_JWT_RS256_PUBLIC_KEY_FILE"); fileName != "" {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("could not read jwt public key : %w", err)
+		}
+		a.rsKey, err = jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt public key ( %v ) : %w", fileName, err)
+		}
+		a.jwtMethods = append(a.jwtMethods, jwt.SigningMethodRS256.Alg())
+	}
+
+	return a, nil
+}
+
+// configured tells whether any credentials (or -no-auth) are set up
+func (a *Authenticator) configured() bool {
+	return a.noAuth || len(a.apiKeys) > 0 || len(a.jwtMethods) > 0
+}
+
+// authenticate checks the "authorization" (Bearer token) or "x-api-key" value of a call
+func (a *Authenticator) authenticate(authorization string, key string) (Principal, error) {
+	if a.noAuth {
+		return Principal{Subject: "anonymous", Role: RoleAdmin, Tenant: defaultTenantID, Method: "none"}, nil
+	}
+
+	if key != "" {
+		return a.authenticateAPIKey(key)
+	}
+
+	token := strings.TrimSpace(authorization)
+	if len(token) > len("bearer ") && strings.EqualFold(token[:len("bearer ")], "bearer ") {
+		return a.authenticateJWT(strings.TrimSpace(token[len("bearer "):]))
+	}
+	return Principal{}, fmt.Errorf("%w : please provide a bearer token or an api key", ErrUnauthenticated)
+}
+
+func (a *Authenticator) authenticateAPIKey(key string) (Principal, error) {
+	hash := sha256.Sum256([]byte(key))
+	for _, candidate := range a.apiKeys {
+		if subtle.ConstantTimeCompare(hash[:], candidate.hash) == 1 {
+			return Principal{Subject: candidate.name, Role: candidate.role, Tenant: candidate.tenant, Method: "api_key"}, nil
+		}
+	}
+	return Principal{}, fmt.Errorf("%w : invalid api key", ErrUnauthenticated)
+}
+
+func (a *Authenticator) authenticateJWT(token string) (Principal, error) {
+	if len(a.jwtMethods) == 0 {
+		return Principal{}, fmt.Errorf("%w : bearer tokens are not accepted", ErrUnauthenticated)
+	}
+
+	var claims jwtClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.Alg() {
+		case jwt.SigningMethodHS256.Alg():
+			return a.hsSecret, nil
+		case jwt.SigningMethodRS256.Alg():
+			return a.rsKey, nil
+		default:
+			return nil, fmt.Errorf("unexpected signing method ( %v )", token.Method.Alg())
+		}
+	}, jwt.WithValidMethods(a.jwtMethods))
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w : invalid token : %v", ErrUnauthenticated, err.Error())
+	}
+
+	if claims.ExpiresAt == nil {
+		return Principal{}, fmt.Errorf("%w : token has no exp claim", ErrUnauthenticated)
+	}
+	if a.issuer != "" && !claims.VerifyIssuer(a.issuer, true) {
+		return Principal{}, fmt.Errorf("%w : unexpected token issuer", ErrUnauthenticated)
+	}
+	if a.audience != "" && !claims.VerifyAudience(a.audience, true) {
+		return Principal{}, fmt.Errorf("%w : unexpected token audience", ErrUnauthenticated)
+	}
+
+	role := RoleNone
+	for _, name := range append([]string{claims.Role}, claims.Roles...) {
+		if parsed, err := parseRole(name); err == nil && parsed > role {
+			role = parsed
+		}
+	}
+	if role == RoleNone {
+		return Principal{}, fmt.Errorf("%w : token has no known role", ErrUnauthenticated)
+	}
+	tenant, err := principalTenant(claims.Tenant)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w : %v", ErrUnauthenticated, err.Error())
+	}
+	return Principal{Subject: claims.Subject, Role: role, Tenant: tenant, Method: "jwt"}, nil
+}
+
+// principalTenant is the tenant of an api key or token, "default" when it has none
+func principalTenant(tenant string) (string, error) {
+	if tenant == "" {
+		return defaultTenantID, nil
+	}
+	err := validateTenantID(tenant, true)
+	if err != nil {
+		return "", err
+	}
+	return tenant, nil
+}
+
+// newAPIKey returns a new random api key and the entry of USERS_API_KEYS_FILE for it
+func newAPIKey(name string, role Role, tenant string) (string, apiKeyEntry, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", apiKeyEntry{}, err
+	}
+	key := "usr_" + hex.EncodeToString(b)
+	hash := sha256.Sum256([]byte(key))
+	return key, apiKeyEntry{Name: name, SHA256: hex.EncodeToString(hash[:]), Role: role.String(), Tenant: tenant}, nil
+}
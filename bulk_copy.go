@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+/*
+Bulk Load via COPY
+
+db.Create(userList) / db.CreateInBatches(userList, n) send multi-row INSERTs, which is fine for a handful of
+users but far too slow for multi-million row loads. bulkLoadUsers streams users from a UserReader straight
+into Postgres with COPY FROM STDIN (through the pgx connection underneath gorm) :
+
+	UserReader --> validate --> string_rep (computed in Go) --> COPY --> user_records_staging (temp table)
+	                                                                           |
+	                                                     INSERT ... SELECT ... ON CONFLICT (merge)
+	                                                                           |
+	                                                                           v
+	                                                                      user_records
+
+The input is processed in chunks (ChunkSize rows), each chunk in its own transaction :
+
+	1. COPY the chunk into the staging table (ON COMMIT DELETE ROWS, so it is empty again after every chunk)
+	2. merge staging into user_records, keeping the last occurrence of a user_id within the chunk
+	   (every user goes to the tenant of the context, see tenant.go)
+	3. count inserted vs updated rows with RETURNING (xmax = 0), which is true only for freshly inserted rows
+
+With USERS_OUTBOX=true every chunk also writes the user.created / user.updated event of each merged user
+(see outbox.go) : the chunk takes the advisory lock of its tenant, reads the users it is about to update
+(for "before"), merges with RETURNING user_id, (xmax = 0) and COPYs the events into user_outbox before
+it commits.
+
+Rows that fail validation are never sent to Postgres, they are counted as rejected and handed to OnReject.
+
+FYI : a load that fails (ConflictFail on an existing user_id included) only rolls back the failing chunk,
+      the chunks before it stay committed : the error tells how many users they wrote, and so do the
+      returned stats. Load with a ChunkSize over the input size for all or nothing.
+*/
+
+type ConflictMode int
+
+const (
+	ConflictUpdate ConflictMode = iota // update all columns of the existing row
+	ConflictSkip                       // keep the existing row, count the incoming one as skipped
+	ConflictFail                       // abort the load on the first existing user_id (earlier chunks stay committed)
+)
+
+const (
+	defaultBulkLoadChunkSize = 50000
+	userStagingTable         = "user_records_staging"
+	stagingSeqColumn         = "staging_seq"
+)
+
+/*
+UserReader is a stream of users, Next returns io.EOF once there are no more users.
+
+A *RecordError means that only the current record is bad (it is rejected and reading goes on),
+any other error aborts the load.
+*/
+type UserReader interface {
+	Next() (UserBasic, error)
+}
+
+type sliceUserReader struct {
+	users []UserBasic
+	pos   int
+}
+
+func newSliceUserReader(users []UserBasic) *sliceUserReader {
+	return &sliceUserReader{users: users}
+}
+
+func (r *sliceUserReader) Next() (UserBasic, error) {
+	if r.pos >= len(r.users) {
+		return UserBasic{}, io.EOF
+	}
+	user := r.users[r.pos]
+	r.pos++
+	return user, nil
+}
+
+type BulkLoadStats struct {
+	Read     int64 // users read from the UserReader
+	Inserted int64 // new rows in user_records
+	Updated  int64 // existing rows overwritten (ConflictUpdate)
+	Skipped  int64 // existing rows left alone (ConflictSkip) and duplicate user_ids within a chunk
+	Rejected int64 // users that failed validation or could not be decoded
+}
+
+type BulkLoadOptions struct {
+	Conflict   ConflictMode
+	ChunkSize  int                             // rows per COPY + merge transaction, defaults to 50000
+	OnProgress func(stats BulkLoadStats)       // called after every committed chunk
+	OnChunk    func(userIDs []string)          // called after every committed chunk, with the user_ids it loaded
+	OnReject   func(user UserBasic, err error) // called for every user failing validation or decoding
+}
+
+func validateUserBasic(user UserBasic) error {
+	if strings.TrimSpace(user.UserID) == "" {
+		return errors.New("user_id is empty")
+	}
+	return nil
+}
+
+/*
+applyUserDefaults fills in the same defaults as the gorm tags on UserBasic.
+
+FYI : gorm leaves zero-value fields out of the INSERT so that Postgres applies the column defaults,
+COPY on the other hand writes every column as-is. We apply the defaults in Go so that bulk loaded
+rows (and their "string_rep") look the same as the ones created through gorm.
+*/
+func applyUserDefaults(user *UserBasic) {
+	if user.FirstName == "" {
+		user.FirstName = "NA"
+	}
+	if user.LastName == "" {
+		user.LastName = "NA"
+	}
+	if user.Email == "" {
+		user.Email = "no-reply@none.com"
+	}
+	if user.Phone == "" {
+		user.Phone = "000-000-0000"
+	}
+	if user.Balance == "" {
+		user.Balance = "0"
+	}
+}
+
+// getUserSchema returns gorm's parsed schema for User (table name, columns, primary keys)
+func getUserSchema(db *gorm.DB) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: db}
+	err := stmt.Parse(&User{})
+	if err != nil {
+		return nil, fmt.Errorf("could not parse user schema : %w", err)
+	}
+	return stmt.Schema, nil
+}
+
+// plainFieldValue is the value of field in user, field.ValueOf would wrap the serializer:encrypted fields
+// in their serializer (and encrypt them)
+func plainFieldValue(ctx context.Context, field *schema.Field, user reflect.Value) interface{} {
+	return field.ReflectValueOf(ctx, user).Interface()
+}
+
+// isDerivedColumn reports whether column is computed from the other columns (string_rep, the blind indexes)
+func isDerivedColumn(column string) bool {
+	return column == "string_rep" || column == "email_bidx" || column == "phone_bidx"
+}
+
+func bulkLoadUsers(ctx context.Context, db *gorm.DB, reader UserReader, opts BulkLoadOptions) (BulkLoadStats, error) {
+	var stats BulkLoadStats
+
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultBulkLoadChunkSize
+	}
+
+	userSchema, err := getUserSchema(db)
+	if err != nil {
+		return stats, err
+	}
+
+	// every loaded user goes to the tenant of ctx
+	tenantID, err := writeTenant(ctx)
+	if err != nil {
+		return stats, invalidArgument("%v", err.Error())
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return stats, err
+	}
+
+	// COPY needs the pgx connection itself, so we pin one connection from the pool for the whole load
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return stats, err
+	}
+	defer func(conn *sql.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("bulk load needs a pgx connection, got ( %T )", driverConn)
+		}
+		loader := &userBulkLoader{
+			conn:     stdlibConn.Conn(),
+			schema:   userSchema,
+			tenantID: tenantID,
+			reader:   reader,
+			opts:     opts,
+			stats:    &stats,
+		}
+		return loader.run(ctx)
+	})
+
+	return stats, timeoutError(ctx, err)
+}
+
+type userBulkLoader struct {
+	conn     *pgx.Conn
+	schema   *schema.Schema
+	tenantID string
+	reader   UserReader
+	opts     BulkLoadOptions
+	stats    *BulkLoadStats
+	seq      int64
+	chunk    map[string]UserBasic // the users of the chunk by user_id (last occurrence), for the outbox events
+	chunkIDs []string             // the user_ids of the chunk, for OnChunk
+}
+
+func (l *userBulkLoader) run(ctx context.Context) error {
+	createStaging := fmt.Sprintf(
+		"CREATE TEMP TABLE IF NOT EXISTS %v (LIKE %v INCLUDING DEFAULTS, %v bigint NOT NULL) ON COMMIT DELETE ROWS",
+		pgx.Identifier{userStagingTable}.Sanitize(),
+		pgx.Identifier{l.schema.Table}.Sanitize(),
+		stagingSeqColumn,
+	)
+	if _, err := l.conn.Exec(ctx, createStaging); err != nil {
+		return fmt.Errorf("could not create staging table : %w", err)
+	}
+	defer func() {
+		// the connection goes back to the pool, don't leave the temp table behind
+		_, _ = l.conn.Exec(context.Background(), "DROP TABLE IF EXISTS "+pgx.Identifier{userStagingTable}.Sanitize())
+	}()
+
+	mergeQuery := l.mergeQuery()
+
+	for {
+		source := &userCopySource{
+			loader: l,
+			limit:  l.opts.ChunkSize,
+		}
+		if outboxEnabled {
+			l.chunk = make(map[string]UserBasic)
+		}
+		l.chunkIDs = l.chunkIDs[:0]
+
+		err := l.loadChunk(ctx, source, mergeQuery)
+		if err != nil {
+			if committed := l.stats.Inserted + l.stats.Updated; committed > 0 {
+				return fmt.Errorf("%w ( %v users of the earlier chunks are committed )", err, committed)
+			}
+			return err
+		}
+
+		if l.opts.OnChunk != nil && len(l.chunkIDs) > 0 {
+			l.opts.OnChunk(l.chunkIDs)
+		}
+		if l.opts.OnProgress != nil {
+			l.opts.OnProgress(*l.stats)
+		}
+
+		if source.eof {
+			return nil
+		}
+	}
+}
+
+func (l *userBulkLoader) loadChunk(ctx context.Context, source *userCopySource, mergeQuery string) error {
+	tx, err := l.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	// the statement_timeout applies per chunk (COPY and merge)
+	if timeout := statementTimeout(ctx, OpBulk); timeout > 0 {
+		_, err = tx.Exec(ctx, setLocalStatementTimeout(timeout))
+		if err != nil {
+			return err
+		}
+	}
+	err = setLocalTenantPgx(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	columns := append(append([]string{}, l.schema.DBNames...), stagingSeqColumn)
+
+	copied, err := tx.CopyFrom(ctx, pgx.Identifier{userStagingTable}, columns, source)
+	if err != nil {
+		return fmt.Errorf("could not copy users into staging table : %w", err)
+	}
+	if copied == 0 {
+		return tx.Commit(ctx)
+	}
+
+	var inserted, updated int64
+	if l.chunk != nil {
+		inserted, updated, err = l.mergeWithEvents(ctx, tx, mergeQuery)
+	} else {
+		err = tx.QueryRow(ctx, mergeQuery).Scan(&inserted, &updated)
+	}
+	if err != nil {
+		return fmt.Errorf("could not merge staging table into %v : %w", l.schema.Table, err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.stats.Inserted += inserted
+	l.stats.Updated += updated
+	l.stats.Skipped += copied - inserted - updated
+	return nil
+}
+
+func (l *userBulkLoader) mergeQuery() string {
+	columns := make([]string, 0, len(l.schema.DBNames))
+	for _, name := range l.schema.DBNames {
+		columns = append(columns, pgx.Identifier{name}.Sanitize())
+	}
+
+	primaryKeys := make([]string, 0, len(l.schema.PrimaryFieldDBNames))
+	for _, name := range l.schema.PrimaryFieldDBNames {
+		primaryKeys = append(primaryKeys, pgx.Identifier{name}.Sanitize())
+	}
+
+	onConflict := ""
+	switch l.opts.Conflict {
+	case ConflictUpdate:
+		assignments := make([]string, 0, len(columns))
+		for _, field := range l.schema.Fields {
+			if field.DBName == "" || field.PrimaryKey {
+				continue
+			}
+			column := pgx.Identifier{field.DBName}.Sanitize()
+			assignments = append(assignments, fmt.Sprintf("%v = EXCLUDED.%v", column, column))
+		}
+		onConflict = fmt.Sprintf("ON CONFLICT (%v) DO UPDATE SET %v", strings.Join(primaryKeys, ", "), strings.Join(assignments, ", "))
+	case ConflictSkip:
+		onConflict = fmt.Sprintf("ON CONFLICT (%v) DO NOTHING", strings.Join(primaryKeys, ", "))
+	case ConflictFail:
+		onConflict = ""
+	}
+
+	// the counts, or every merged user for its outbox event
+	result := "SELECT count(*) FILTER (WHERE inserted), count(*) FILTER (WHERE NOT inserted) FROM merged"
+	if outboxEnabled {
+		result = "SELECT user_id, inserted FROM merged"
+	}
+
+	// DISTINCT ON keeps the last occurrence of each key within the chunk, ON CONFLICT DO UPDATE
+	// can't touch the same row twice in one statement
+	return fmt.Sprintf(`WITH merged AS (
+	INSERT INTO %v (%v)
+	SELECT DISTINCT ON (%v) %v FROM %v ORDER BY %v, %v DESC
+	%v
+	RETURNING user_id, (xmax = 0) AS inserted
+)
+%v`,
+		pgx.Identifier{l.schema.Table}.Sanitize(), strings.Join(columns, ", "),
+		strings.Join(primaryKeys, ", "), strings.Join(columns, ", "), pgx.Identifier{userStagingTable}.Sanitize(),
+		strings.Join(primaryKeys, ", "), stagingSeqColumn,
+		onConflict,
+		result,
+	)
+}
+
+// outboxColumns are the columns of user_outbox written by a bulk load
+var outboxColumns = []string{"tenant_id", "user_id", "type", "payload", "status", "attempts", "next_attempt_at", "last_error", "created_at"}
+
+// mergeWithEvents merges the chunk and writes the outbox event of every user it inserted or updated
+func (l *userBulkLoader) mergeWithEvents(ctx context.Context, tx pgx.Tx, mergeQuery string) (inserted int64, updated int64, err error) {
+	// single user writes of the tenant wait for the chunk, see outbox.go
+	_, err = tx.Exec(ctx, lockTenantChangesSQL, l.tenantID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	before, err := l.existingUsers(ctx, tx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rows, err := tx.Query(ctx, mergeQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	now := time.Now().UTC()
+	events := make([][]interface{}, 0, len(l.chunk))
+	for rows.Next() {
+		var userID string
+		var isInserted bool
+		err = rows.Scan(&userID, &isInserted)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+
+		after := l.chunk[userID]
+		payload := outboxPayload{After: &after}
+		eventType := EventUserCreated
+		if isInserted {
+			inserted++
+		} else {
+			updated++
+			eventType = EventUserUpdated
+			payload.Before = before[userID]
+		}
+
+		event, err := l.outboxEventValues(userID, eventType, payload, now)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		events = append(events, event)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{OutboxEvent{}.TableName()}, outboxColumns, pgx.CopyFromRows(events))
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not write the outbox events : %w", err)
+	}
+	return inserted, updated, nil
+}
+
+// existingUsers are the users of the chunk that already exist, by user_id, as they are before the merge
+func (l *userBulkLoader) existingUsers(ctx context.Context, tx pgx.Tx) (map[string]*UserBasic, error) {
+	users := make(map[string]*UserBasic)
+	if l.opts.Conflict != ConflictUpdate {
+		// nothing is updated
+		return users, nil
+	}
+
+	rows, err := tx.Query(ctx, fmt.Sprintf(
+		"SELECT user_id, first_name, last_name, email, phone, active, balance FROM %v WHERE tenant_id = $1 AND user_id IN (SELECT user_id FROM %v)",
+		pgx.Identifier{l.schema.Table}.Sanitize(), pgx.Identifier{userStagingTable}.Sanitize(),
+	), l.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user UserBasic
+		err = rows.Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Phone, &user.Active, &user.Balance)
+		if err != nil {
+			return nil, err
+		}
+		user.Email, err = decryptStored("email", user.Email)
+		if err != nil {
+			return nil, err
+		}
+		user.Phone, err = decryptStored("phone", user.Phone)
+		if err != nil {
+			return nil, err
+		}
+		users[user.UserID] = &user
+	}
+	return users, rows.Err()
+}
+
+// outboxEventValues is the row of outboxColumns of an event
+func (l *userBulkLoader) outboxEventValues(userID string, eventType EventType, payload outboxPayload, now time.Time) ([]interface{}, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	storedPayload, err := encryptStored("payload", string(data))
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{l.tenantID, userID, string(eventType), storedPayload, string(OutboxPending), 0, now, "", now}, nil
+}
+
+// userCopySource feeds COPY straight from the UserReader, it stops after "limit" valid users
+type userCopySource struct {
+	loader *userBulkLoader
+	limit  int
+	copied int
+	values []interface{}
+	eof    bool
+	err    error
+}
+
+func (s *userCopySource) Next() bool {
+	l := s.loader
+	for s.copied < s.limit {
+		userBasic, err := l.reader.Next()
+		if err == io.EOF {
+			s.eof = true
+			return false
+		}
+
+		var recordErr *RecordError
+		if err != nil && !errors.As(err, &recordErr) {
+			s.err = err
+			return false
+		}
+		l.stats.Read++
+
+		if err == nil {
+			err = validateUserBasic(userBasic)
+		}
+		if err != nil {
+			l.stats.Rejected++
+			if l.opts.OnReject != nil {
+				l.opts.OnReject(userBasic, err)
+			}
+			continue
+		}
+
+		applyUserDefaults(&userBasic)
+		if l.chunk != nil {
+			l.chunk[userBasic.UserID] = userBasic
+		}
+		if l.opts.OnChunk != nil {
+			l.chunkIDs = append(l.chunkIDs, userBasic.UserID)
+		}
+		user := getUserFromBasic(userBasic)
+		user.TenantID = l.tenantID
+
+		l.seq++
+		s.values, err = s.rowValues(&user, l.seq)
+		if err != nil {
+			s.err = err
+			return false
+		}
+		s.copied++
+		return true
+	}
+	return false
+}
+
+// rowValues are the column values as they are stored, the serializer:encrypted fields are encrypted here
+func (s *userCopySource) rowValues(user *User, seq int64) ([]interface{}, error) {
+	reflectValue := reflect.ValueOf(user).Elem()
+	values := make([]interface{}, 0, len(s.loader.schema.DBNames)+1)
+	for _, name := range s.loader.schema.DBNames {
+		value, _ := s.loader.schema.FieldsByDBName[name].ValueOf(context.Background(), reflectValue)
+		if valuer, ok := value.(driver.Valuer); ok {
+			var err error
+			value, err = valuer.Value()
+			if err != nil {
+				return nil, err
+			}
+		}
+		values = append(values, value)
+	}
+	return append(values, seq), nil
+}
+
+func (s *userCopySource) Values() ([]interface{}, error) {
+	return s.values, nil
+}
+
+func (s *userCopySource) Err() error {
+	return s.err
+}
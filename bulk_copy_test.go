@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBulkLoadConflictModes(t *testing.T) {
+	db := openTestDB(t)
+	ctx := testTenant(t, db)
+	repo := NewUserRepository(db)
+
+	_, err := repo.Create(ctx, UserBasic{UserID: "u1", FirstName: "Existing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// u2 twice : the last occurrence within a chunk wins
+	users := []UserBasic{{UserID: "u1", FirstName: "Loaded"}, {UserID: "u2", FirstName: "First"}, {UserID: "u2", FirstName: "Last"}}
+
+	stats, err := bulkLoadUsers(ctx, db, newSliceUserReader(users), BulkLoadOptions{Conflict: ConflictSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Inserted != 1 || stats.Updated != 0 || stats.Skipped != 2 {
+		t.Errorf("skip : unexpected stats %+v", stats)
+	}
+	if user, err := repo.Get(ctx, "u1"); err != nil || user.FirstName != "Existing" {
+		t.Errorf("skip : existing user overwritten ( %v , %v )", user.FirstName, err)
+	}
+	if user, err := repo.Get(ctx, "u2"); err != nil || user.FirstName != "Last" {
+		t.Errorf("skip : expected the last occurrence of u2 , got ( %v , %v )", user.FirstName, err)
+	}
+
+	stats, err = bulkLoadUsers(ctx, db, newSliceUserReader(users), BulkLoadOptions{Conflict: ConflictUpdate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Inserted != 0 || stats.Updated != 2 || stats.Skipped != 1 {
+		t.Errorf("update : unexpected stats %+v", stats)
+	}
+	if user, err := repo.Get(ctx, "u1"); err != nil || user.FirstName != "Loaded" {
+		t.Errorf("update : existing user not overwritten ( %v , %v )", user.FirstName, err)
+	}
+
+	// fail : the chunk with an existing user_id is rolled back, the chunks before it stay
+	users = []UserBasic{{UserID: "u3"}, {UserID: "u4"}, {UserID: "u1"}, {UserID: "u5"}}
+	stats, err = bulkLoadUsers(ctx, db, newSliceUserReader(users), BulkLoadOptions{Conflict: ConflictFail, ChunkSize: 2})
+	if err == nil {
+		t.Fatal("fail : load of an existing user_id succeeded")
+	}
+	if !strings.Contains(err.Error(), "2 users of the earlier chunks are committed") {
+		t.Errorf("fail : the error doesn't tell the committed users ( %v )", err)
+	}
+	if stats.Inserted != 2 {
+		t.Errorf("fail : expected the 2 users of the first chunk , got %+v", stats)
+	}
+	for userID, exists := range map[string]bool{"u3": true, "u4": true, "u5": false} {
+		_, err := repo.Get(ctx, userID)
+		if exists != (err == nil) {
+			t.Errorf("fail : %v exists = %v ( %v )", userID, !exists, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Bulk insert benchmark
+
+Inserts b.N generated users with CreateInBatches inside a transaction (rolled back at the end, so the
+table is left untouched) and counts every statement gorm sends to Postgres.
+
+Since "string_rep" is computed in User.BeforeCreate, we expect :
+
+	INSERT statements = ceil(N / batchSize)
+	UPDATE statements = 0 (no per-row follow-up writes)
+
+Run it with (skipped without USERS_TEST_DSN, see main_test.go) :
+
+	USERS_TEST_DSN="host=localhost user=postgres password=... dbname=testdb" go test -run '^$' -bench BulkInsert -benchtime 100000x
+*/
+
+const benchmarkBatchSize = 1000
+
+func BenchmarkBulkInsert(b *testing.B) {
+	db := openTestDB(b)
+	ctx := testTenant(b, db)
+
+	b.ResetTimer()
+	result, err := runBulkInsertBenchmark(ctx, db, b.N, benchmarkBatchSize)
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportMetric(result.RowsPerSec, "rows/s")
+	b.ReportMetric(float64(result.Inserts), "inserts")
+	b.ReportMetric(float64(result.Others), "other_statements")
+}
+
+var errBenchmarkRollback = errors.New("benchmark : rolling back inserted rows")
+
+type BulkInsertBenchmarkResult struct {
+	Rows       int
+	BatchSize  int
+	Inserts    int
+	Updates    int
+	Others     int
+	Duration   time.Duration
+	RowsPerSec float64
+}
+
+// statementCounter wraps a gorm logger and counts the statements going through Trace()
+type statementCounter struct {
+	logger.Interface
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newStatementCounter(base logger.Interface) *statementCounter {
+	return &statementCounter{
+		Interface: base,
+		counts:    make(map[string]int),
+	}
+}
+
+func (c *statementCounter) LogMode(level logger.LogLevel) logger.Interface {
+	c.Interface = c.Interface.LogMode(level)
+	return c
+}
+
+func (c *statementCounter) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	sql, rowsAffected := fc()
+	verb := strings.ToUpper(strings.SplitN(strings.TrimSpace(sql), " ", 2)[0])
+	c.mu.Lock()
+	c.counts[verb]++
+	c.mu.Unlock()
+	c.Interface.Trace(ctx, begin, func() (string, int64) { return sql, rowsAffected }, err)
+}
+
+func (c *statementCounter) count(verb string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[verb]
+}
+
+func (c *statementCounter) total() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := 0
+	for _, n := range c.counts {
+		total += n
+	}
+	return total
+}
+
+// generateBenchmarkUsers cycles through the seed users, giving each copy a unique user_id
+func generateBenchmarkUsers(numRecords int) []User {
+	seedUsers := GetUserRecords()
+	users := make([]User, 0, numRecords)
+	for i := 0; i < numRecords; i++ {
+		userBasic := seedUsers[i%len(seedUsers)].UserBasic
+		userBasic.UserID = fmt.Sprintf("bench%019d", i)
+		users = append(users, User{UserBasic: userBasic})
+	}
+	return users
+}
+
+func runBulkInsertBenchmark(ctx context.Context, db *gorm.DB, numRecords int, batchSize int) (BulkInsertBenchmarkResult, error) {
+	result := BulkInsertBenchmarkResult{
+		Rows:      numRecords,
+		BatchSize: batchSize,
+	}
+
+	if numRecords <= 0 || batchSize <= 0 {
+		return result, errors.New("numRecords and batchSize must be greater than 0")
+	}
+
+	users := generateBenchmarkUsers(numRecords)
+
+	counter := newStatementCounter(db.Logger)
+	benchDB := db.Session(&gorm.Session{Logger: counter, Context: ctx})
+
+	start := time.Now()
+	err := benchDB.Transaction(func(tx *gorm.DB) error {
+		// the BEGIN issued by Transaction() does not go through the logger, so only the batch work is counted
+		if err := tx.CreateInBatches(users, batchSize).Error; err != nil {
+			return err
+		}
+		return errBenchmarkRollback
+	})
+	result.Duration = time.Since(start)
+	if err != nil && !errors.Is(err, errBenchmarkRollback) {
+		return result, err
+	}
+
+	result.Inserts = counter.count("INSERT")
+	result.Updates = counter.count("UPDATE")
+	result.Others = counter.total() - result.Inserts - result.Updates
+	if result.Duration > 0 {
+		result.RowsPerSec = float64(numRecords) / result.Duration.Seconds()
+	}
+
+	expectedInserts := (numRecords + batchSize - 1) / batchSize
+	if result.Inserts != expectedInserts || result.Updates != 0 {
+		return result, fmt.Errorf(
+			"unexpected statement count : inserts ( %v ) expected ( %v ) , updates ( %v ) expected ( 0 )",
+			result.Inserts, expectedInserts, result.Updates,
+		)
+	}
+
+	return result, nil
+}
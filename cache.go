@@ -0,0 +1,212 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+User cache
+
+UserRepository.Get and BatchGet read through a UserCache when the repository has one
+(repo.WithCache(cache)), keyed by tenant and user_id :
+
+	repo := NewUserRepository(db).WithCache(NewLRUCache(10000, time.Minute))
+
+Create, upsert and delete drop the user from the cache of their repository once written, so does the
+gRPC BulkImport after every committed chunk (BulkLoadOptions.OnChunk). Other processes (and writes that
+don't go through a repository : import, reindex, reencrypt) reach the cache through the change feed (see
+change_feed.go) :
+
+	go invalidateOnChanges(ctx, feed, cache)
+
+a "resync" of the feed (reconnect, or the cache not keeping up) empties the whole cache.
+
+"users serve" puts an LRUCache in front of the gRPC and GraphQL repository, sized by USERS_CACHE_SIZE
+(default : 10000 users, 0 : no cache) with entries expiring after USERS_CACHE_TTL (default : 1m). The
+TTL is the bound on staleness when USERS_CHANGE_FEED is off (or a notification is late) : with several
+"serve" processes, keep it short or turn the feed on.
+
+Any other cache (redis, memcached ...) plugs in by implementing UserCache. A cache that fails (network
+...) should log and report a miss, the repository then reads postgres as if there were no cache.
+
+FYI : only reads scoped to a single tenant are cached, reads across all tenants ("*") always hit postgres.
+    : a read that races a write can put the old row back right after the write dropped it, for at most
+      the TTL (or until the change notification of that write drops it again).
+    : cached users are the decrypted rows, Email and Phone included (see field_encryption.go).
+*/
+
+const (
+	defaultCacheSize = 10000
+	defaultCacheTTL  = time.Minute
+)
+
+// UserCache is the cache in front of UserRepository.Get and BatchGet
+type UserCache interface {
+	Get(ctx context.Context, tenantID, userID string) (User, bool)
+	Set(ctx context.Context, user User)
+	Invalidate(ctx context.Context, tenantID, userID string)
+	Purge(ctx context.Context)
+}
+
+// cacheSize and cacheTTL are set from USERS_CACHE_SIZE and USERS_CACHE_TTL
+var (
+	cacheSize = defaultCacheSize
+	cacheTTL  = defaultCacheTTL
+)
+
+func loadCacheSettings() error {
+	if value := os.Getenv("USERS_CACHE_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid value for environment variable USERS_CACHE_SIZE ( %v ) , please use a number of users (0 : no cache)", value)
+		}
+		cacheSize = size
+	}
+	if value := os.Getenv("USERS_CACHE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid duration for environment variable USERS_CACHE_TTL ( %v )", value)
+		}
+		cacheTTL = ttl
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// in-process LRU
+
+type LRUCache struct {
+	lock     sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[userCacheKey]*list.Element
+	order    *list.List // front : most recently used
+}
+
+type userCacheKey struct {
+	tenantID string
+	userID   string
+}
+
+type lruEntry struct {
+	key     userCacheKey
+	user    User
+	expires time.Time
+}
+
+// NewLRUCache keeps up to capacity users, each for ttl at most
+func NewLRUCache(capacity int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[userCacheKey]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+func (c *LRUCache) Get(ctx context.Context, tenantID, userID string) (User, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[userCacheKey{tenantID: tenantID, userID: userID}]
+	if !ok {
+		return User{}, false
+	}
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return User{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.user, true
+}
+
+func (c *LRUCache) Set(ctx context.Context, user User) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := userCacheKey{tenantID: user.TenantID, userID: user.UserID}
+	expires := time.Now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.user, entry.expires = user, expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, user: user, expires: expires})
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *LRUCache) Invalidate(ctx context.Context, tenantID, userID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[userCacheKey{tenantID: tenantID, userID: userID}]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *LRUCache) Purge(ctx context.Context) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = make(map[userCacheKey]*list.Element, c.capacity)
+	c.order.Init()
+}
+
+func (c *LRUCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*lruEntry).key)
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// invalidation
+
+// invalidateOnChanges drops the users of the change feed from cache until ctx is done
+func invalidateOnChanges(ctx context.Context, feed *ChangeFeed, cache UserCache) {
+	for change := range feed.Subscribe(ctx, allTenants) {
+		if change.Op == ChangeResync {
+			cache.Purge(ctx)
+			cacheInvalidations.WithLabelValues("resync").Inc()
+			continue
+		}
+		cache.Invalidate(ctx, change.TenantID, change.UserID)
+		cacheInvalidations.WithLabelValues("feed").Inc()
+	}
+}
+
+// cacheTenant is the tenant of the cache entries read with ctx, false : no cache or a read across tenants
+func (r *UserRepository) cacheTenant(ctx context.Context) (string, bool) {
+	if r.cache == nil {
+		return "", false
+	}
+	tenantID := scopeTenant(ctx)
+	if tenantID == allTenants {
+		return "", false
+	}
+	return tenantID, true
+}
+
+// invalidate drops a user written with ctx from the cache of the repository
+func (r *UserRepository) invalidate(ctx context.Context, userID string) {
+	if r.cache == nil {
+		return
+	}
+	tenantID, err := writeTenant(ctx)
+	if err != nil {
+		return
+	}
+	r.cache.Invalidate(ctx, tenantID, userID)
+	cacheInvalidations.WithLabelValues("local").Inc()
+}
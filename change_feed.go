@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Live change feed
+
+With USERS_CHANGE_FEED=true, "users migrate" adds a trigger on user_records that NOTIFYs every insert,
+update and delete on the user_records_changes channel (without the trigger otherwise) :
+
+	{"op": "update", "tenant_id": "default", "user_id": "628558706b92ac31676d779b"}
+
+An update that doesn't change anything (a reindex of an up to date row) is not notified. The payload only
+has the key, subscribers read the user again when they need it (NOTIFY payloads are limited to 8000 bytes,
+and never carry the encrypted fields that way).
+
+ChangeFeed listens on one connection of the pool and hands the changes to its subscribers :
+
+	feed := NewChangeFeed(db)
+	go feed.Run(ctx)
+
+	for change := range feed.Subscribe(ctx, "acme") {
+		// change.Op, change.UserID
+	}
+
+Run reconnects (1s, 2s, 4s ... up to 30s) when the connection is lost. Notifications sent while it was
+gone are lost, so every subscriber gets a "resync" change after a reconnect : read again what you show.
+A subscriber that doesn't keep up (its buffer is full) misses changes as well and gets a "resync" too,
+the feed never waits for a subscriber.
+
+"users serve" streams the feed as server-sent events on GET /changes of -http-addr (same credentials as
+/graphql, a caller only gets the changes of its tenant) :
+
+	event: update
+	data: {"op":"update","tenant_id":"default","user_id":"628558706b92ac31676d779b"}
+
+with a ": ping" comment every 15s to keep proxies from closing an idle stream.
+
+FYI : browsers' EventSource can't send the Authorization / X-API-Key headers, use a fetch based SSE client.
+    : bulk imports notify every row, like any other insert / update.
+*/
+
+const (
+	userChangesChannel   = "user_records_changes"
+	userChangesFunction  = "user_records_notify"
+	changeFeedBuffer     = 256
+	changeFeedMaxBackoff = 30 * time.Second
+	changeFeedHeartbeat  = 15 * time.Second
+)
+
+type ChangeOp string
+
+const (
+	ChangeInsert ChangeOp = "insert"
+	ChangeUpdate ChangeOp = "update"
+	ChangeDelete ChangeOp = "delete"
+	ChangeResync ChangeOp = "resync" // changes may have been missed, read again
+)
+
+type FeedChange struct {
+	Op       ChangeOp `json:"op"`
+	TenantID string   `json:"tenant_id,omitempty"`
+	UserID   string   `json:"user_id,omitempty"`
+}
+
+// changeFeedEnabled is set from USERS_CHANGE_FEED
+var changeFeedEnabled = false
+
+func loadChangeFeedSettings() error {
+	value := os.Getenv("USERS_CHANGE_FEED")
+	if value == "" {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for environment variable USERS_CHANGE_FEED ( %v ) , please use true or false", value)
+	}
+	changeFeedEnabled = enabled
+	return nil
+}
+
+// migrateChangeTrigger (re)creates the NOTIFY trigger on user_records, or drops it when the feed is disabled
+func migrateChangeTrigger(tx *gorm.DB) error {
+	table := pgx.Identifier{User{}.TableName()}.Sanitize()
+	function := pgx.Identifier{userChangesFunction}.Sanitize()
+
+	statements := []string{fmt.Sprintf("DROP TRIGGER IF EXISTS %v ON %v", function, table)}
+	if changeFeedEnabled {
+		statements = append(statements,
+			fmt.Sprintf(`CREATE OR REPLACE FUNCTION %v() RETURNS trigger AS $$
+DECLARE
+	changed record;
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		changed := OLD;
+	ELSIF TG_OP = 'UPDATE' AND OLD IS NOT DISTINCT FROM NEW THEN
+		RETURN NULL;
+	ELSE
+		changed := NEW;
+	END IF;
+	PERFORM pg_notify('%v', json_build_object('op', lower(TG_OP), 'tenant_id', changed.tenant_id, 'user_id', changed.user_id)::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`, function, userChangesChannel),
+			fmt.Sprintf("CREATE TRIGGER %v AFTER INSERT OR UPDATE OR DELETE ON %v FOR EACH ROW EXECUTE FUNCTION %v()", function, table, function),
+		)
+	}
+
+	for _, statement := range statements {
+		err := tx.Exec(statement).Error
+		if err != nil {
+			return fmt.Errorf("could not migrate the change trigger : %w", err)
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// feed
+
+type ChangeFeed struct {
+	db          *gorm.DB
+	lock        sync.Mutex
+	subscribers map[*changeSubscriber]struct{}
+}
+
+type changeSubscriber struct {
+	changes  chan FeedChange
+	tenantID string // "*" : every tenant
+	lagged   bool   // a change was dropped, a resync is due
+}
+
+func NewChangeFeed(db *gorm.DB) *ChangeFeed {
+	return &ChangeFeed{db: db, subscribers: make(map[*changeSubscriber]struct{})}
+}
+
+// Subscribe returns the changes of tenantID ("*" : every tenant), the channel is closed once ctx is done
+func (f *ChangeFeed) Subscribe(ctx context.Context, tenantID string) <-chan FeedChange {
+	subscriber := &changeSubscriber{changes: make(chan FeedChange, changeFeedBuffer), tenantID: tenantID}
+
+	f.lock.Lock()
+	f.subscribers[subscriber] = struct{}{}
+	changeFeedSubscribers.Inc()
+	f.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		delete(f.subscribers, subscriber)
+		changeFeedSubscribers.Dec()
+		close(subscriber.changes)
+	}()
+	return subscriber.changes
+}
+
+func (f *ChangeFeed) publish(change FeedChange) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for subscriber := range f.subscribers {
+		if change.Op == ChangeResync || subscriber.tenantID == allTenants || subscriber.tenantID == change.TenantID {
+			subscriber.send(change)
+		}
+	}
+}
+
+// send never blocks : a full buffer drops the change and the subscriber gets a resync once there is room
+func (s *changeSubscriber) send(change FeedChange) {
+	if s.lagged {
+		select {
+		case s.changes <- FeedChange{Op: ChangeResync}:
+			s.lagged = false
+		default:
+			changeFeedDropped.Inc()
+			return
+		}
+	}
+	select {
+	case s.changes <- change:
+	default:
+		s.lagged = true
+		changeFeedDropped.Inc()
+	}
+}
+
+// Run listens for changes until ctx is done, it reconnects with backoff when the connection is lost
+func (f *ChangeFeed) Run(ctx context.Context) error {
+	failures := 0
+	connected := false
+	for {
+		err := f.listen(ctx, func() {
+			if connected {
+				// whatever was notified while we were gone is lost
+				f.publish(FeedChange{Op: ChangeResync})
+				appLog.Info(ctx, "change feed reconnected")
+			}
+			connected = true
+			failures = 0
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		failures++
+		wait := outboxBackoff(failures)
+		if wait > changeFeedMaxBackoff {
+			wait = changeFeedMaxBackoff
+		}
+		appLog.Warn(ctx, "change feed disconnected , reconnecting", "error", err, "retry_in", wait.String())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// listen pins a connection of the pool, LISTENs and publishes the notifications until an error
+func (f *ChangeFeed) listen(ctx context.Context, onListening func()) error {
+	sqlDB, err := f.db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("change feed needs a pgx connection, got ( %T )", driverConn)
+		}
+		pgxConn := stdlibConn.Conn()
+
+		_, err := pgxConn.Exec(ctx, "LISTEN "+pgx.Identifier{userChangesChannel}.Sanitize())
+		if err != nil {
+			return fmt.Errorf("%w : %v", driver.ErrBadConn, err.Error())
+		}
+		onListening()
+
+		for {
+			notification, err := pgxConn.WaitForNotification(ctx)
+			if err != nil {
+				// the connection is not reusable (a cancelled wait closes it too), ErrBadConn keeps it out of the pool
+				return fmt.Errorf("%w : %v", driver.ErrBadConn, err.Error())
+			}
+
+			var change FeedChange
+			err = json.Unmarshal([]byte(notification.Payload), &change)
+			if err != nil {
+				appLog.Warn(ctx, "invalid change notification skipped", "payload", notification.Payload, "error", err)
+				continue
+			}
+			f.publish(change)
+		}
+	})
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// server-sent events
+
+// changeFeedHandler streams the changes of the caller's tenant as server-sent events, the streams end
+// when serverCtx is done (they would hold up the shutdown of the server otherwise)
+func changeFeedHandler(serverCtx context.Context, feed *ChangeFeed, auth *Authenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		ctx := contextWithRequestID(r.Context(), newRequestID())
+		principal, err := auth.authenticate(r.Header.Get("Authorization"), r.Header.Get("X-API-Key"))
+		if err != nil {
+			appLog.Warn(ctx, "change feed request not authenticated", "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="users"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		ctx = contextWithPrincipal(ctx, principal)
+		err = authorize(ctx, PermRead)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		changes := feed.Subscribe(ctx, principal.Tenant)
+		heartbeat := time.NewTicker(changeFeedHeartbeat)
+		defer heartbeat.Stop()
+		appLog.Info(ctx, "change feed client connected", "subject", principal.Subject, "tenant", principal.Tenant)
+
+		for {
+			select {
+			case <-serverCtx.Done():
+				return
+			case change, ok := <-changes:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(change)
+				if err != nil {
+					return
+				}
+				_, err = fmt.Fprintf(w, "event: %v\ndata: %v\n\n", change.Op, string(data))
+				if err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				_, err := fmt.Fprint(w, ": ping\n\n")
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	})
+}
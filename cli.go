@@ -0,0 +1,1047 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+Command-line client
+
+	users create  -id ID [-first-name ..] [-last-name ..] [-email ..] [-phone ..] [-active] [-balance ..]
+	users get     ID
+	users upsert  -id ID [-first-name ..] [-last-name ..] [-email ..] [-phone ..] [-active] [-balance ..]
+	users delete  ID
+	users list    [-limit N] [-offset N | -after ID]
+	users search  [-mode exact|pattern] [-op and|or] [-limit N] TERM [TERM ...]
+	users import  -file FILE [-format ..] [-mapping ..] [-reject-file ..] [-conflict ..] [-dry-run]
+	users export  [-file FILE] [-format ..] [-columns ..] [-search ..] [-mode ..] [-op ..]
+	users migrate
+	users reindex
+	users keygen    -file FILE [-id KEY_ID]
+	users reencrypt [-chunk-size N]
+	users partition [-partitions N] [-batch-size N] [-pause 0s] [-lock-timeout 5s]
+	users apikey    -name NAME -role reader|editor|admin [-tenant TENANT]
+	users relay     -sink file|webhook|webhooks [-file FILE] [-url URL] [-batch N] [-interval 1s] [-max-attempts N] [-retention 24h]
+	users webhook   add -url URL [-secret SECRET] [-filter op=delete,field=balance,user=ID] | list | delete ID
+	users webhook   dead [-subscription ID] [-limit N] | replay [-subscription ID] [DELIVERY_ID ...]
+	users serve   [-grpc-addr :50051] [-http-addr :8080] [-admin-addr 127.0.0.1:8081] [-metrics-addr :9090] [-no-auth]
+	users demo    -yes
+
+create, get, upsert, list and search take -o table|json|yaml|csv (default : table).
+
+The database connection comes from PGSQLMETADATAHOST, PGSQLMETADATAUSER and PGSQLMETADATAPASS.
+The statement timeouts per kind of operation come from USERS_STATEMENT_TIMEOUT_* (see timeout.go),
+the log level and format from USERS_LOG_LEVEL and USERS_LOG_FORMAT (see logging.go), the gorm logger
+settings from USERS_GORM_LOG_LEVEL, USERS_GORM_SLOW_THRESHOLD and USERS_SLOW_QUERY_TOP_N (see gorm_logger.go),
+the trace exporter from USERS_TRACES_EXPORTER and USERS_TRACES_FILE (see tracing.go), the field
+encryption keyring from USERS_KEYRING_FILE (see field_encryption.go), the credentials accepted by
+"serve" from USERS_API_KEYS_FILE and USERS_JWT_* (see auth.go), the row-level security switch from
+USERS_TENANT_RLS (see tenant.go), the change events from USERS_OUTBOX (see outbox.go), the live
+change feed of "serve" (GET /changes) from USERS_CHANGE_FEED (see change_feed.go), the user cache of
+"serve" from USERS_CACHE_SIZE and USERS_CACHE_TTL (see cache.go), the read replicas of list, search
+and export from USERS_REPLICA_HOSTS and USERS_REPLICA_MAX_LAG (see replica.go).
+
+Every command runs in the tenant USERS_TENANT (default : "default", "*" : all tenants, read-only),
+except migrate, reindex, reencrypt, partition and relay which always cover all tenants.
+
+"serve" runs until Ctrl-C / SIGTERM (or until one of its servers fails) : the servers stop accepting
+calls and the calls in flight get up to 30s to finish, the streams of /changes are closed right away.
+
+"demo" is the original walk-through from main(), it deletes all rows and drops user_records, so it
+refuses to run without -yes.
+
+Exit codes :
+
+	0 : success
+	1 : any other error (database error, failed import ...)
+	2 : usage error (unknown command, bad flag, invalid argument)
+	3 : user not found
+	4 : user already exists
+	5 : configuration error (missing environment variable)
+	6 : could not connect to the database
+*/
+
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitNotFound    = 3
+	exitConflict    = 4
+	exitConfig      = 5
+	exitUnavailable = 6
+)
+
+var (
+	errUsage       = errors.New("usage error")
+	errConfig      = errors.New("configuration error")
+	errUnavailable = errors.New("database unavailable")
+)
+
+func usageErrorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w : %v", errUsage, fmt.Sprintf(format, args...))
+}
+
+func exitCodeForError(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage), errors.Is(err, ErrInvalidArgument):
+		return exitUsage
+	case errors.Is(err, ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, ErrAlreadyExists):
+		return exitConflict
+	case errors.Is(err, errConfig):
+		return exitConfig
+	case errors.Is(err, errUnavailable):
+		return exitUnavailable
+	default:
+		return exitFailure
+	}
+}
+
+type cliCommand struct {
+	summary string
+	run     func(c *cli, args []string) error
+}
+
+var cliCommands map[string]cliCommand
+
+func init() {
+	cliCommands = map[string]cliCommand{
+		"create":    {"create a user", runCreateCommand},
+		"get":       {"get a user by user_id", runGetCommand},
+		"upsert":    {"create a user, or overwrite it if the user_id exists", runUpsertCommand},
+		"delete":    {"delete a user by user_id", runDeleteCommand},
+		"list":      {"list users ordered by user_id", runListCommand},
+		"search":    {"exact or pattern search over string_rep", runSearchCommand},
+		"import":    {"import users from json, ndjson or csv", runImportCLICommand},
+		"export":    {"export users to json, ndjson, csv or parquet", runExportCLICommand},
+		"migrate":   {"create / update the user_records table", runMigrateCommand},
+		"reindex":   {"recompute string_rep and the blind indexes for every user", runReindexCommand},
+		"keygen":    {"add a new primary key to the field encryption keyring (creates the keyring)", runKeygenCommand},
+		"reencrypt": {"re-encrypt email and phone with the primary key of the keyring", runReencryptCommand},
+		"partition": {"move user_records to hash partitions online", runPartitionCommand},
+		"apikey":    {"create an api key for users serve", runAPIKeyCommand},
+		"relay":     {"deliver the outbox change events to a file, a webhook or the webhook subscriptions", runRelayCommand},
+		"webhook":   {"manage the webhook subscriptions and their dead deliveries", runWebhookCommand},
+		"serve":     {"serve the gRPC UserService and the GraphQL endpoint", runServeCommand},
+		"demo":      {"run the original gorm walk-through (destructive)", runDemoCommand},
+	}
+}
+
+type cli struct {
+	ctx      context.Context
+	stdout   io.Writer
+	stderr   io.Writer
+	db       *gorm.DB
+	replicas *ReplicaSet // nil : no USERS_REPLICA_HOSTS
+}
+
+func runCLI(args []string) int {
+	// Ctrl-C cancels the running statement instead of leaving it running on the server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := &cli{
+		ctx:    contextWithRequestID(ctx, newRequestID()),
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+
+	err := InitializeLogger()
+	if err != nil {
+		_, _ = fmt.Fprintf(c.stderr, "error : %v\n", err.Error())
+		return exitConfig
+	}
+
+	tenantID := os.Getenv("USERS_TENANT")
+	if tenantID == "" {
+		tenantID = defaultTenantID
+	}
+	err = validateTenantID(tenantID, true)
+	if err != nil {
+		_, _ = fmt.Fprintf(c.stderr, "error : USERS_TENANT : %v\n", err.Error())
+		return exitConfig
+	}
+	c.ctx = contextWithTenant(c.ctx, tenantID)
+
+	shutdownTracing, err := initTracing(c.ctx)
+	if err != nil {
+		_, _ = fmt.Fprintf(c.stderr, "error : %v\n", err.Error())
+		return exitConfig
+	}
+	defer func() {
+		// flush the spans that are still buffered, without hanging on an unreachable collector
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := shutdownTracing(ctx)
+		if err != nil {
+			appLog.Warn(ctx, "could not flush traces", "error", err)
+		}
+	}()
+
+	if len(args) == 0 {
+		c.printUsage()
+		return exitUsage
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		c.printUsage()
+		return exitOK
+	}
+
+	command, ok := cliCommands[args[0]]
+	if !ok {
+		_, _ = fmt.Fprintf(c.stderr, "error : unknown command ( %v )\n\n", args[0])
+		c.printUsage()
+		return exitUsage
+	}
+
+	err = command.run(c, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(c.stderr, "error : %v : %v\n", args[0], err.Error())
+	}
+	return exitCodeForError(err)
+}
+
+func (c *cli) printUsage() {
+	names := []string{"create", "get", "upsert", "delete", "list", "search", "import", "export", "migrate", "reindex", "keygen", "reencrypt", "partition", "apikey", "relay", "webhook", "serve", "demo"}
+	_, _ = fmt.Fprintf(c.stderr, "usage : users <command> [flags]\n\ncommands :\n\n")
+	for _, name := range names {
+		_, _ = fmt.Fprintf(c.stderr, "  %-10v %v\n", name, cliCommands[name].summary)
+	}
+	_, _ = fmt.Fprintf(c.stderr, "\nrun \"users <command> -h\" for the flags of a command\n")
+}
+
+// connect opens the database on first use, so that usage errors don't need a database
+func (c *cli) connect() (*gorm.DB, error) {
+	if c.db != nil {
+		return c.db, nil
+	}
+
+	err := Initialize()
+	if err != nil {
+		return nil, fmt.Errorf("%w : %v", errConfig, err.Error())
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		return nil, fmt.Errorf("%w : %v", errUnavailable, err.Error())
+	}
+	if len(replicaHosts) > 0 {
+		c.replicas, err = connectReplicas(c.ctx, db, replicaHosts, replicaMaxLag)
+		if err != nil {
+			return nil, fmt.Errorf("%w : %v", errUnavailable, err.Error())
+		}
+		go c.replicas.Run(c.ctx)
+	}
+	c.db = db
+	return db, nil
+}
+
+func (c *cli) repository() (*UserRepository, error) {
+	db, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	return NewUserRepository(db).WithReplicas(c.replicas), nil
+}
+
+func newCommandFlags(name string, c *cli) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	return flags
+}
+
+// parseCommandFlags turns flag errors into usage errors (and leaves -h alone)
+func parseCommandFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		return fmt.Errorf("%w : %v", errUsage, err.Error())
+	}
+	return err
+}
+
+func outputFormatFlag(flags *flag.FlagSet) *string {
+	return flags.String("o", "table", "output format : table, json, yaml or csv")
+}
+
+func parseOutputFormat(format string) (ExportFormat, error) {
+	switch ExportFormat(strings.ToLower(format)) {
+	case ExportTable, ExportJSON, ExportYAML, ExportCSV:
+		return ExportFormat(strings.ToLower(format)), nil
+	default:
+		return "", usageErrorf("invalid output format ( %v ) , please use table, json, yaml or csv", format)
+	}
+}
+
+// userIDArg takes the user_id from -id or from the first positional argument
+func userIDArg(flags *flag.FlagSet, idFlag string) (string, error) {
+	userID := idFlag
+	if userID == "" && flags.NArg() > 0 {
+		userID = flags.Arg(0)
+	}
+	if userID == "" {
+		return "", usageErrorf("please provide a user_id")
+	}
+	return userID, nil
+}
+
+type userFlags struct {
+	id        *string
+	firstName *string
+	lastName  *string
+	email     *string
+	phone     *string
+	active    *bool
+	balance   *string
+}
+
+func newUserFlags(flags *flag.FlagSet) userFlags {
+	return userFlags{
+		id:        flags.String("id", "", "user_id (required)"),
+		firstName: flags.String("first-name", "", "first name"),
+		lastName:  flags.String("last-name", "", "last name"),
+		email:     flags.String("email", "", "email"),
+		phone:     flags.String("phone", "", "phone"),
+		active:    flags.Bool("active", false, "mark the user active"),
+		balance:   flags.String("balance", "", "balance"),
+	}
+}
+
+func (f userFlags) userBasic() UserBasic {
+	return UserBasic{
+		UserID:    *f.id,
+		FirstName: *f.firstName,
+		LastName:  *f.lastName,
+		Email:     *f.email,
+		Phone:     *f.phone,
+		Active:    *f.active,
+		Balance:   *f.balance,
+	}
+}
+
+func (c *cli) printUsers(format ExportFormat, users []User, single bool) error {
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+	return writeUsers(db, c.stdout, format, users, single)
+}
+
+func runCreateCommand(c *cli, args []string) error {
+	return runWriteCommand(c, "create", args, func(repo *UserRepository, userBasic UserBasic) (User, error) {
+		return repo.Create(c.ctx, userBasic)
+	})
+}
+
+func runUpsertCommand(c *cli, args []string) error {
+	return runWriteCommand(c, "upsert", args, func(repo *UserRepository, userBasic UserBasic) (User, error) {
+		return repo.Upsert(c.ctx, userBasic)
+	})
+}
+
+func runWriteCommand(c *cli, name string, args []string, write func(repo *UserRepository, userBasic UserBasic) (User, error)) error {
+	flags := newCommandFlags(name, c)
+	user := newUserFlags(flags)
+	output := outputFormatFlag(flags)
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	format, err := parseOutputFormat(*output)
+	if err != nil {
+		return err
+	}
+	if *user.id == "" {
+		return usageErrorf("please provide -id")
+	}
+
+	repo, err := c.repository()
+	if err != nil {
+		return err
+	}
+
+	saved, err := write(repo, user.userBasic())
+	if err != nil {
+		return err
+	}
+	return c.printUsers(format, []User{saved}, true)
+}
+
+func runGetCommand(c *cli, args []string) error {
+	flags := newCommandFlags("get", c)
+	id := flags.String("id", "", "user_id (or pass it as the first argument)")
+	output := outputFormatFlag(flags)
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	format, err := parseOutputFormat(*output)
+	if err != nil {
+		return err
+	}
+	userID, err := userIDArg(flags, *id)
+	if err != nil {
+		return err
+	}
+
+	repo, err := c.repository()
+	if err != nil {
+		return err
+	}
+
+	user, err := repo.Get(c.ctx, userID)
+	if err != nil {
+		return err
+	}
+	return c.printUsers(format, []User{user}, true)
+}
+
+func runDeleteCommand(c *cli, args []string) error {
+	flags := newCommandFlags("delete", c)
+	id := flags.String("id", "", "user_id (or pass it as the first argument)")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	userID, err := userIDArg(flags, *id)
+	if err != nil {
+		return err
+	}
+
+	repo, err := c.repository()
+	if err != nil {
+		return err
+	}
+
+	err = repo.Delete(c.ctx, userID)
+	if err != nil {
+		return err
+	}
+	appLog.Info(c.ctx, "user deleted", "user_id", userID)
+	return nil
+}
+
+func runListCommand(c *cli, args []string) error {
+	flags := newCommandFlags("list", c)
+	limit := flags.Int("limit", defaultListLimit, "maximum number of users")
+	offset := flags.Int("offset", 0, "skip this many users")
+	after := flags.String("after", "", "only users with a user_id after this one (keyset pagination)")
+	output := outputFormatFlag(flags)
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	format, err := parseOutputFormat(*output)
+	if err != nil {
+		return err
+	}
+
+	repo, err := c.repository()
+	if err != nil {
+		return err
+	}
+
+	users, err := repo.List(c.ctx, ListOptions{Limit: *limit, Offset: *offset, AfterUserID: *after})
+	if err != nil {
+		return err
+	}
+	return c.printUsers(format, users, false)
+}
+
+func runSearchCommand(c *cli, args []string) error {
+	flags := newCommandFlags("search", c)
+	mode := flags.String("mode", "exact", "search mode : exact or pattern")
+	operator := flags.String("op", "or", "search operator : and or or")
+	limit := flags.Int("limit", 0, "maximum number of users (0 : no limit)")
+	output := outputFormatFlag(flags)
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	format, err := parseOutputFormat(*output)
+	if err != nil {
+		return err
+	}
+	exact, err := parseSearchMode(*mode)
+	if err != nil {
+		return usageErrorf("%v", err.Error())
+	}
+	searchType, err := parseSearchType(*operator)
+	if err != nil {
+		return usageErrorf("%v", err.Error())
+	}
+	if flags.NArg() == 0 {
+		return usageErrorf("please provide at least one search term")
+	}
+
+	repo, err := c.repository()
+	if err != nil {
+		return err
+	}
+
+	users, err := repo.Search(c.ctx, SearchOptions{
+		Terms:    flags.Args(),
+		Exact:    exact,
+		Operator: searchType,
+		Limit:    *limit,
+	})
+	if err != nil {
+		return err
+	}
+	return c.printUsers(format, users, false)
+}
+
+func runImportCLICommand(c *cli, args []string) error {
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+	return runImportCommand(c.ctx, db, args)
+}
+
+func runExportCLICommand(c *cli, args []string) error {
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+	if c.replicas != nil {
+		db = c.replicas.Reader(c.ctx)
+	}
+	return runExportCommand(c.ctx, db, args)
+}
+
+func runMigrateCommand(c *cli, args []string) error {
+	flags := newCommandFlags("migrate", c)
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	repo, err := c.repository()
+	if err != nil {
+		return err
+	}
+
+	err = repo.Migrate(contextWithTenant(c.ctx, allTenants))
+	if err != nil {
+		return err
+	}
+	appLog.Info(c.ctx, "user_records is up to date")
+	return nil
+}
+
+func runReindexCommand(c *cli, args []string) error {
+	flags := newCommandFlags("reindex", c)
+	chunkSize := flags.Int("chunk-size", defaultIterateChunkSize, "rows per FETCH / UPDATE")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = reindexStringRep(contextWithTenant(c.ctx, allTenants), db, *chunkSize)
+	return err
+}
+
+func runKeygenCommand(c *cli, args []string) error {
+	flags := newCommandFlags("keygen", c)
+	file := flags.String("file", "", "keyring file, created if it does not exist")
+	keyID := flags.String("id", "", "id of the new key (default : the current UTC time)")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if *file == "" {
+		return usageErrorf("please provide -file")
+	}
+
+	err = addKeyringKey(*file, *keyID)
+	if err != nil {
+		return err
+	}
+	appLog.Info(c.ctx, "new primary key added to the keyring , run users reencrypt to rewrite the existing rows", "file", *file)
+	return nil
+}
+
+func runReencryptCommand(c *cli, args []string) error {
+	flags := newCommandFlags("reencrypt", c)
+	chunkSize := flags.Int("chunk-size", defaultIterateChunkSize, "rows per SELECT / transaction")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = reencryptUsers(contextWithTenant(c.ctx, allTenants), db, *chunkSize)
+	return err
+}
+
+func runPartitionCommand(c *cli, args []string) error {
+	flags := newCommandFlags("partition", c)
+	partitions := flags.Int("partitions", 0, "number of hash partitions (default : USERS_PARTITIONS)")
+	batchSize := flags.Int("batch-size", defaultPartitionBatchSize, "rows per copy transaction")
+	pause := flags.Duration("pause", 0, "pause between batches")
+	lockTimeout := flags.Duration("lock-timeout", defaultPartitionLockWait, "how long the swap waits for its lock before giving up")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+	if *partitions == 0 {
+		*partitions = userPartitions
+	}
+	if *partitions < 2 || *partitions > maxPartitions {
+		return usageErrorf("please provide -partitions (2 to %v) or set USERS_PARTITIONS", maxPartitions)
+	}
+
+	_, err = partitionUsers(contextWithTenant(c.ctx, allTenants), db, PartitionOptions{
+		Partitions:  *partitions,
+		BatchSize:   *batchSize,
+		Pause:       *pause,
+		LockTimeout: *lockTimeout,
+	})
+	return err
+}
+
+func runAPIKeyCommand(c *cli, args []string) error {
+	flags := newCommandFlags("apikey", c)
+	name := flags.String("name", "", "name of the key (the subject in the logs)")
+	roleName := flags.String("role", "reader", "role of the key : reader, editor or admin")
+	tenant := flags.String("tenant", "", "tenant of the key (default : \"default\", \"*\" : all tenants)")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if *tenant != "" {
+		err = validateTenantID(*tenant, true)
+		if err != nil {
+			return usageErrorf("%v", err.Error())
+		}
+	}
+	if *name == "" {
+		return usageErrorf("please provide -name")
+	}
+	role, err := parseRole(*roleName)
+	if err != nil {
+		return usageErrorf("%v", err.Error())
+	}
+
+	key, entry, err := newAPIKey(*name, role, *tenant)
+	if err != nil {
+		return err
+	}
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// the key is shown once, only its hash goes into USERS_API_KEYS_FILE
+	_, _ = fmt.Fprintf(c.stdout, "api key : %v\nadd to USERS_API_KEYS_FILE : %v\n", key, string(entryJSON))
+	return nil
+}
+
+func runRelayCommand(c *cli, args []string) error {
+	flags := newCommandFlags("relay", c)
+	sinkName := flags.String("sink", "", "where to deliver the events : file, webhook or webhooks (the subscriptions, see users webhook)")
+	fileName := flags.String("file", "events.ndjson", "file the events are appended to (-sink file)")
+	webhookURL := flags.String("url", "", "url the events are POSTed to (-sink webhook)")
+	batchSize := flags.Int("batch", defaultOutboxBatchSize, "events claimed per transaction")
+	interval := flags.Duration("interval", defaultOutboxPollInterval, "wait between polls when there is nothing to deliver")
+	maxAttempts := flags.Int("max-attempts", defaultOutboxMaxAttempts, "deliveries before an event is marked failed")
+	retention := flags.Duration("retention", defaultOutboxRetention, "delivered events are deleted after (negative : never)")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	var sink OutboxSink
+	var dispatcher *WebhookDispatcher
+	switch *sinkName {
+	case "file":
+		fileSink, err := NewFileSink(*fileName)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = fileSink.Close()
+		}()
+		sink = fileSink
+	case "webhook":
+		sink, err = NewWebhookSink(*webhookURL)
+		if err != nil {
+			return usageErrorf("%v", err.Error())
+		}
+	case "webhooks":
+	default:
+		return usageErrorf("invalid sink ( %v ) , please use -sink file, -sink webhook or -sink webhooks", *sinkName)
+	}
+
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+	if *sinkName == "webhooks" {
+		dispatcher = NewWebhookDispatcher(db, WebhookOptions{
+			BatchSize:    *batchSize,
+			PollInterval: *interval,
+			MaxAttempts:  *maxAttempts,
+		})
+		sink = dispatcher
+	}
+	if !outboxEnabled {
+		appLog.Warn(c.ctx, "USERS_OUTBOX is not set , only the events already in user_outbox are delivered")
+	}
+
+	// Ctrl-C stops the relay, an event being delivered is delivered again by the next run
+	relay := NewOutboxRelay(db, sink, OutboxRelayOptions{
+		BatchSize:    *batchSize,
+		PollInterval: *interval,
+		MaxAttempts:  *maxAttempts,
+		Retention:    *retention,
+	})
+	ctx := contextWithTenant(c.ctx, allTenants)
+	if dispatcher == nil {
+		return relay.Run(ctx)
+	}
+
+	// the relay queues the deliveries, the dispatcher sends them
+	done := make(chan error, 1)
+	go func() {
+		done <- dispatcher.Run(ctx)
+	}()
+	err = relay.Run(ctx)
+	dispatcherErr := <-done
+	if err != nil {
+		return err
+	}
+	return dispatcherErr
+}
+
+func runWebhookCommand(c *cli, args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("please provide a webhook command : add, list, delete, dead or replay")
+	}
+	switch args[0] {
+	case "add":
+		return runWebhookAddCommand(c, args[1:])
+	case "list":
+		return runWebhookListCommand(c, args[1:])
+	case "delete":
+		return runWebhookDeleteCommand(c, args[1:])
+	case "dead":
+		return runWebhookDeadCommand(c, args[1:])
+	case "replay":
+		return runWebhookReplayCommand(c, args[1:])
+	default:
+		return usageErrorf("invalid webhook command ( %v ) , please use add, list, delete, dead or replay", args[0])
+	}
+}
+
+func (c *cli) webhookRepository() (*Repository[WebhookSubscription], error) {
+	db, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	return webhookSubscriptionModel.Repository(db), nil
+}
+
+func runWebhookAddCommand(c *cli, args []string) error {
+	flags := newCommandFlags("webhook add", c)
+	webhookURL := flags.String("url", "", "url the events are POSTed to (required)")
+	secret := flags.String("secret", "", "signing secret (default : a random one, shown once)")
+	filters := flags.String("filter", "", "filters, e.g. op=delete or op=update,field=balance (default : every event)")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if *webhookURL == "" {
+		return usageErrorf("please provide -url")
+	}
+
+	subscription, err := newWebhookSubscription(*webhookURL, *secret, *filters)
+	if err != nil {
+		return usageErrorf("%v", err.Error())
+	}
+	repo, err := c.webhookRepository()
+	if err != nil {
+		return err
+	}
+	saved, err := repo.Create(c.ctx, subscription)
+	if err != nil {
+		return err
+	}
+	// the secret is shown once, like the api keys
+	_, _ = fmt.Fprintf(c.stdout, "webhook : %v\nsecret : %v\n", saved.ID, subscription.Secret)
+	return nil
+}
+
+func runWebhookListCommand(c *cli, args []string) error {
+	flags := newCommandFlags("webhook list", c)
+	limit := flags.Int("limit", defaultListLimit, "maximum number of subscriptions")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	repo, err := c.webhookRepository()
+	if err != nil {
+		return err
+	}
+	subscriptions, err := repo.List(c.ctx, ModelListOptions{Limit: *limit})
+	if err != nil {
+		return err
+	}
+	return printJSONLines(c.stdout, subscriptions)
+}
+
+func runWebhookDeleteCommand(c *cli, args []string) error {
+	flags := newCommandFlags("webhook delete", c)
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageErrorf("please provide the id of the webhook")
+	}
+
+	repo, err := c.webhookRepository()
+	if err != nil {
+		return err
+	}
+	return repo.Delete(c.ctx, flags.Arg(0))
+}
+
+func runWebhookDeadCommand(c *cli, args []string) error {
+	flags := newCommandFlags("webhook dead", c)
+	subscriptionID := flags.String("subscription", "", "only the dead deliveries of this webhook")
+	limit := flags.Int("limit", defaultWebhookDeadLimit, "maximum number of deliveries")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+	deliveries, err := NewWebhookDispatcher(db, WebhookOptions{}).DeadLetters(c.ctx, *subscriptionID, *limit)
+	if err != nil {
+		return err
+	}
+	return printJSONLines(c.stdout, deliveries)
+}
+
+func runWebhookReplayCommand(c *cli, args []string) error {
+	flags := newCommandFlags("webhook replay", c)
+	subscriptionID := flags.String("subscription", "", "replay every dead delivery of this webhook")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, 0, flags.NArg())
+	for _, arg := range flags.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return usageErrorf("invalid delivery id ( %v )", arg)
+		}
+		ids = append(ids, id)
+	}
+
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+	replayed, err := NewWebhookDispatcher(db, WebhookOptions{}).Replay(c.ctx, *subscriptionID, ids)
+	if err != nil {
+		return err
+	}
+	appLog.Info(c.ctx, "dead deliveries queued again", "deliveries", replayed)
+	return nil
+}
+
+// printJSONLines writes one JSON object per line
+func printJSONLines[T any](w io.Writer, values []T) error {
+	encoder := json.NewEncoder(w)
+	for _, value := range values {
+		err := encoder.Encode(value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runServeCommand(c *cli, args []string) error {
+	flags := newCommandFlags("serve", c)
+	grpcAddr := flags.String("grpc-addr", ":50051", "gRPC listen address (empty : no gRPC)")
+	httpAddr := flags.String("http-addr", ":8080", "GraphQL listen address, served on /graphql (empty : no GraphQL)")
+	adminAddr := flags.String("admin-addr", "127.0.0.1:8081", "admin endpoint listen address (empty : no admin endpoint)")
+	metricsAddr := flags.String("metrics-addr", ":9090", "Prometheus metrics listen address, served on /metrics (empty : no metrics)")
+	noAuth := flags.Bool("no-auth", false, "serve without authentication, every caller is admin (local testing only)")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if *grpcAddr == "" && *httpAddr == "" {
+		return usageErrorf("please provide -grpc-addr and / or -http-addr")
+	}
+
+	auth, err := newAuthenticator(*noAuth)
+	if err != nil {
+		return fmt.Errorf("%w : %v", errConfig, err.Error())
+	}
+	if !auth.configured() {
+		return fmt.Errorf("%w : no credentials configured ( USERS_API_KEYS_FILE , USERS_JWT_HS256_SECRET_FILE , USERS_JWT_RS256_PUBLIC_KEY_FILE ) , please configure some or use -no-auth", errConfig)
+	}
+	if *noAuth {
+		appLog.Warn(c.ctx, "serving without authentication , every caller is admin")
+	}
+
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	watchGormLogSignals(c.ctx)
+
+	// Ctrl-C / SIGTERM (c.ctx), or the first server that fails, shuts every server down
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	// gRPC and GraphQL share the repository, and its cache (see cache.go)
+	repo := NewUserRepository(db).WithReplicas(c.replicas)
+	var feed *ChangeFeed
+	if changeFeedEnabled {
+		feed = NewChangeFeed(db)
+		go func() {
+			_ = feed.Run(ctx)
+		}()
+	}
+	if cacheSize > 0 {
+		cache := NewLRUCache(cacheSize, cacheTTL)
+		repo = repo.WithCache(cache)
+		if feed != nil {
+			go invalidateOnChanges(ctx, feed, cache)
+		} else {
+			appLog.Info(c.ctx, "USERS_CHANGE_FEED is not set , cached users only expire with USERS_CACHE_TTL", "ttl", cacheTTL.String())
+		}
+	}
+
+	servers := make([]func() error, 0, 4)
+	if *grpcAddr != "" {
+		servers = append(servers, func() error { return serveGRPC(ctx, db, repo, auth, *grpcAddr) })
+	}
+	if *httpAddr != "" {
+		servers = append(servers, func() error { return serveGraphQL(ctx, repo, feed, auth, *httpAddr) })
+	}
+	if *adminAddr != "" {
+		servers = append(servers, func() error { return serveAdmin(ctx, db, *adminAddr) })
+	}
+	if *metricsAddr != "" {
+		servers = append(servers, func() error { return serveMetrics(ctx, *metricsAddr) })
+	}
+
+	errs := make(chan error, len(servers))
+	for _, serve := range servers {
+		go func(serve func() error) {
+			errs <- serve()
+		}(serve)
+	}
+
+	var firstErr error
+	for range servers {
+		err := <-errs
+		if err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	if firstErr == nil {
+		appLog.Info(c.ctx, "servers stopped")
+	}
+	return firstErr
+}
+
+// serveShutdownTimeout is how long the calls in flight get to finish once "serve" is stopped
+const serveShutdownTimeout = 30 * time.Second
+
+// serveHTTP serves handler on addr until ctx is done, then waits for the requests in flight (up to serveShutdownTimeout)
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		_ = server.Close()
+		return fmt.Errorf("could not shut down ( %v ) in time : %w", addr, err)
+	}
+	<-errs // http.ErrServerClosed
+	return nil
+}
+
+func runDemoCommand(c *cli, args []string) error {
+	flags := newCommandFlags("demo", c)
+	yes := flags.Bool("yes", false, "confirm : the demo deletes all rows and drops user_records")
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if !*yes {
+		return usageErrorf("the demo deletes all rows and drops user_records, run it with -yes")
+	}
+
+	db, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	runDemo(c.ctx, db)
+	return nil
+}
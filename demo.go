@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+runDemo is the original walk-through of gorm against user_records :
+
+create table, insert, bulk insert, delete all rows, drop table, re-create it, batch insert, upserts,
+limit / offset, queries with structs and maps, and the string_rep searches.
+
+FYI : it deletes all rows and drops user_records, so it only runs with "demo -yes"
+*/
+func runDemo(ctx context.Context, db *gorm.DB) {
+	var err error
+
+	// ----------------------------------------------------------------------------------------------------
+
+	db = db.WithContext(ctx)
+
+	appLog.Info(ctx, "---[Create/Initialize Table]---")
+
+	err = InitializeTables(ctx, db)
+	if err != nil {
+		appLog.Error(ctx, "could not create tables", "error", err)
+		return
+	}
+
+	// Create a single record
+	sampleUser := getUser()
+	_, _ = createRecord(ctx, sampleUser, db)
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// Bulk Insert
+
+	appLog.Info(ctx, "---[Bulk Insert]---")
+	userList := GetUserRecords()
+	db.Create(userList)
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// Delete all the rows
+
+	appLog.Info(ctx, "---[Deleting All Rows]---")
+
+	db.Exec("DELETE FROM users")
+
+	// ----------------------------------------------------------------------------------------------------
+
+	appLog.Info(ctx, "---[Dropping Table]---")
+
+	err = db.Migrator().DropTable(&User{})
+	if err != nil {
+		appLog.Error(ctx, "could not drop table", "error", err)
+	}
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// Again, re-create the table
+
+	appLog.Info(ctx, "---[Creating Table]---")
+
+	err = InitializeTables(ctx, db)
+	if err != nil {
+		appLog.Error(ctx, "could not create tables", "error", err)
+		return
+	}
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// Insert Using Batch Pool Size
+	appLog.Info(ctx, "---[Insert In Batches]---")
+	db.CreateInBatches(userList, 4)
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// Bulk Load via COPY (the seed users already exist, so this goes through the ON CONFLICT update path)
+
+	appLog.Info(ctx, "---[Bulk Load via COPY]---")
+
+	userBasicList := make([]UserBasic, 0, len(userList))
+	for _, user := range userList {
+		userBasicList = append(userBasicList, user.UserBasic)
+	}
+
+	loadStats, err := bulkLoadUsers(ctx, db, newSliceUserReader(userBasicList), BulkLoadOptions{
+		Conflict:  ConflictUpdate,
+		ChunkSize: 10,
+		OnProgress: func(stats BulkLoadStats) {
+			appLog.Info(ctx, "bulk load progress", "read", stats.Read, "inserted", stats.Inserted, "updated", stats.Updated)
+		},
+	})
+	if err != nil {
+		appLog.Error(ctx, "bulk load failed", "error", err)
+	}
+	appLog.Info(ctx, "bulk load finished", "read", loadStats.Read, "inserted", loadStats.Inserted, "updated", loadStats.Updated, "skipped", loadStats.Skipped, "rejected", loadStats.Rejected)
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// Get all records
+
+	appLog.Info(ctx, "---[Get All Records]---")
+
+	var users []User
+
+	_ = db.Find(&users)
+
+	//for _, user := range users {
+	//
+	//	log.Printf("user.UserID    : %v", user.UserID)
+	//	log.Printf("user.FirstName : %v", user.FirstName)
+	//	log.Printf("user.LastName  : %v", user.LastName)
+	//
+	//	prettyPrintData(user)
+	//}
+
+	appLog.Info(ctx, "total number of records", "count", len(users))
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// Upsert / On Conflict
+
+	appLog.Info(ctx, "---[Upsert / On Conflict]---")
+
+	user1basic := UserBasic{
+		UserID:    "628555772a8b7b9926ffb917",
+		FirstName: "Wendy-1",
+		LastName:  "Lawson-1",
+		Email:     "wendylawson@hinway.com",
+		Phone:     "+1 (907) 523-2723",
+		Active:    false,
+		Balance:   "$200,000.00",
+	}
+
+	appLog.Info(ctx, "user1basic >")
+	prettyPrintData(user1basic)
+
+	user1 := getUserFromBasic(user1basic)
+
+	appLog.Info(ctx, "user1 >")
+	prettyPrintData(user1)
+
+	// Update all columns, except primary keys, to new value on conflict
+
+	result1 := db.Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).Create(&user1)
+
+	appLog.Info(ctx, "upsert / on conflict", "rows_affected", result1.RowsAffected)
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// Upsert / On Conflict
+
+	appLog.Info(ctx, "---[Upsert / On Conflict]---")
+
+	user2basic := UserBasic{
+		UserID:  "628555772a8b7b9926ffb917",
+		Email:   "wendylawson@hinway.com",
+		Active:  false,
+		Balance: "$200,000.00",
+	}
+
+	appLog.Info(ctx, "user2basic >")
+	prettyPrintData(user2basic)
+
+	user2 := getUserFromBasic(user2basic)
+
+	appLog.Info(ctx, "user2 >")
+	prettyPrintData(user2)
+
+	// Update all columns, except primary keys, to new value on conflict
+
+	result2 := db.Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).Create(&user2)
+
+	appLog.Info(ctx, "upsert / on conflict", "rows_affected", result2.RowsAffected)
+
+	//updateStringRepForUser(db, user2basic.UserID)
+
+	// ----------------------------------------------------------------------------------------------------
+
+	user3basic := UserBasic{
+		UserID:    "628555772a8b7b9926ffb917",
+		FirstName: "Wendy--2",
+		LastName:  "Lawson--2",
+	}
+
+	appLog.Info(ctx, "user3basic >")
+	prettyPrintData(user3basic)
+
+	user3 := getUserFromBasic(user3basic)
+
+	appLog.Info(ctx, "user3 >")
+	prettyPrintData(user3)
+
+	// Update specific fields
+	result3 := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "tenant_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"first_name", "last_name"}),
+	}).Create(&user3)
+
+	//updateStringRepForUser(db, user3.UserID)
+
+	appLog.Info(ctx, "upsert / on conflict", "rows_affected", result3.RowsAffected)
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// Limit and Offset
+
+	appLog.Info(ctx, "---[Limit / Offset]---")
+
+	var partialUsers []User
+
+	// SELECT * FROM users OFFSET 5 LIMIT 3;
+
+	db.Limit(3).Offset(5).Find(&partialUsers)
+
+	for _, user := range partialUsers {
+		prettyPrintData(user)
+	}
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// query with primary key
+
+	appLog.Info(ctx, "---[Query Users With List of Primary Keys]---")
+	users = make([]User, 0)
+	db.Where("user_id IN ?", []string{"628555772a8b7b9926ffb917", "6285557743a8bdeb2aa5dc07"}).Find(&users)
+	for _, user := range users {
+		prettyPrintData(user)
+	}
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// query using structs
+
+	// FYI : When querying with struct, GORM will only query with non-zero fields, that means if your field’s
+	// value is 0, '', false or other zero values, it won’t be used to build query conditions,
+
+	// for example:
+	// 		db.Where(&User{Name: "jinzhu", Age: 0}).Find(&users)
+	//		translates to >
+	// 		SELECT * FROM users WHERE name = "jinzhu";
+
+	// To include zero values in the query conditions, you can use a map, which will
+	// include all key-values as query conditions, for example:
+
+	// 		db.Where(map[string]interface{}{"Name": "jinzhu", "Age": 0}).Find(&users)
+	//		translates to >
+	// 		SELECT * FROM users WHERE name = "jinzhu" AND age = 0;
+
+	appLog.Info(ctx, "---[Query Using structs]---")
+	var searchData User
+	var user User
+	searchData.Email = "sonialivingston@hinway.com"
+	db.Where(&searchData).First(&user)
+	prettyPrintData(user)
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// query using maps
+
+	appLog.Info(ctx, "---[Query Using maps]---")
+
+	users = make([]User, 0)
+	db.Where(map[string]interface{}{"first_name": "Stacy", "last_name": "Mason"}).Find(&users)
+	for _, user := range users {
+		prettyPrintData(user)
+	}
+
+	// ----------------------------------------------------------------------------------------------------
+
+	// get columne names for model
+
+	appLog.Info(ctx, "---[Column names for 'User']---")
+
+	columnNames := getColumnNamesForModel(ctx, db, &User{})
+
+	prettyPrintData(columnNames)
+
+	// ----------------------------------------------------------------------------------------------------
+
+	appLog.Info(ctx, "---[Non Exact Search | Query Using 'string_rep' column | AND search]---")
+	searchStrings := []string{"772", "none.com"}
+	users = make([]User, 0)
+	searchType := SearchAND
+	sqlQuery, err := getSQLQueryForNonExactPatternSearch(searchStrings, searchType)
+	if err != nil {
+		appLog.Error(ctx, "search failed", "error", err)
+		return
+	}
+	db.Where(sqlQuery).Find(&users)
+	for _, user := range users {
+		prettyPrintData(user)
+	}
+	if len(users) == 0 {
+		appLog.Info(ctx, "no record found", "search_type", searchType, "search_strings", searchStrings)
+	}
+
+	// ----------------------------------------------------------------------------------------------------
+
+	appLog.Info(ctx, "---[Non Exact Search | Query Using 'string_rep' column | OR search]---")
+	searchStrings = []string{"Marisol", "Davidson"}
+	users = make([]User, 0)
+	searchType = SearchOR
+	sqlQuery, err = getSQLQueryForNonExactPatternSearch(searchStrings, searchType)
+	if err != nil {
+		appLog.Error(ctx, "search failed", "error", err)
+		return
+	}
+	db.Where(sqlQuery).Find(&users)
+	for _, user := range users {
+		prettyPrintData(user)
+	}
+	if len(users) == 0 {
+		appLog.Info(ctx, "no record found", "search_type", searchType, "search_strings", searchStrings)
+	}
+
+	// ----------------------------------------------------------------------------------------------------
+
+	appLog.Info(ctx, "---[Exact Search | Query For Search | OR]---")
+	searchStrings = []string{"Marisol", "Davidson", "466-3255", "62855577fc3729572a693d79", "62855577fc3", "DONAcampos@hinway.COM"}
+	users = make([]User, 0)
+
+	//users, err = getRecordsForExactSearchOR(ctx, db, searchStrings)
+	//if err != nil {
+	//	appLog.Error(ctx, "search failed", "error", err)
+	//	return
+	//}
+
+	searchType = SearchOR
+	sqlQuery, err = getSQLQueryForExactSearch(searchStrings, searchType)
+	if err != nil {
+		appLog.Error(ctx, "search failed", "error", err)
+		return
+	}
+	db.Where(sqlQuery).Find(&users)
+
+	for _, user := range users {
+		prettyPrintData(user)
+	}
+	if len(users) == 0 {
+		appLog.Info(ctx, "no record found for exact search", "search_strings", searchStrings)
+	}
+
+	// ----------------------------------------------------------------------------------------------------
+
+	appLog.Info(ctx, "---[Exact Search | Query For Search | AND]---")
+	searchStrings = []string{"Wendy", "wendylawson@hinway2.com", "628555772a8b7b9926ffb919"}
+	users = make([]User, 0)
+
+	//users, err = getRecordsForExactSearchAND(ctx, db, searchStrings)
+	//if err != nil {
+	//	appLog.Error(ctx, "search failed", "error", err)
+	//	return
+	//}
+
+	searchType = SearchAND
+	sqlQuery, err = getSQLQueryForExactSearch(searchStrings, searchType)
+	if err != nil {
+		appLog.Error(ctx, "search failed", "error", err)
+		return
+	}
+	db.Where(sqlQuery).Find(&users)
+	for _, user := range users {
+		prettyPrintData(user)
+	}
+	if len(users) == 0 {
+		appLog.Info(ctx, "no record found for exact search", "search_strings", searchStrings)
+	}
+
+	// ----------------------------------------------------------------------------------------------------
+
+}
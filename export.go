@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/xitongsys/parquet-go/writer"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+Export users to JSON, NDJSON, CSV and Parquet
+
+exportUsers streams user_records (optionally filtered) to a writer :
+
+	json    : a JSON array of objects
+	ndjson  : one JSON object per line
+	csv     : a header row with the column names, then one row per user
+	parquet : one column per selected column (string -> UTF8 byte array, bool -> boolean), snappy compressed
+	table   : aligned columns, for the terminal
+	yaml    : a YAML list of mappings
+
+Rows are read through a UserIterator (server-side cursor) and written one at a time, ordered by the
+primary key so that two exports of the same data produce the same file. Memory use does not depend on
+the size of the table (for parquet it is bounded by the row group size).
+
+By default every column except "string_rep" and the blind indexes (email_bidx, phone_bidx) is exported, -columns picks (and orders) the columns.
+
+Usage :
+
+	gorm-pgsql export -format csv -file users.csv -columns user_id,first_name,email
+	gorm-pgsql export -format parquet -file wendy.parquet -search Wendy -mode exact
+	gorm-pgsql export -format ndjson -search "772,none.com" -mode pattern -op and
+*/
+
+type ExportFormat string
+
+const (
+	ExportJSON    ExportFormat = "json"
+	ExportNDJSON  ExportFormat = "ndjson"
+	ExportCSV     ExportFormat = "csv"
+	ExportParquet ExportFormat = "parquet"
+	ExportTable   ExportFormat = "table"
+	ExportYAML    ExportFormat = "yaml"
+)
+
+// parquetRowGroupSize keeps the parquet writer from buffering the default 128M per row group
+const parquetRowGroupSize = 16 * 1024 * 1024
+
+type ExportOptions struct {
+	Format    ExportFormat
+	Columns   []string                   // default : all columns except string_rep and the blind indexes
+	Filter    func(db *gorm.DB) *gorm.DB // optional, e.g. a search or list query
+	Operation Operation                  // statement_timeout of the export, OpRead or OpSearch
+}
+
+// userRecordWriter writes one exported row at a time, values are in the order of the selected columns
+type userRecordWriter interface {
+	Write(values []interface{}) error
+	Close() error
+}
+
+func newUserRecordWriter(w io.Writer, format ExportFormat, fields []*schema.Field) (userRecordWriter, error) {
+	switch format {
+	case ExportJSON:
+		return newJSONRecordWriter(w, fields, true), nil
+	case ExportNDJSON:
+		return newJSONRecordWriter(w, fields, false), nil
+	case ExportCSV:
+		return newCSVRecordWriter(w, fields)
+	case ExportParquet:
+		return newParquetRecordWriter(w, fields)
+	case ExportTable:
+		return newTableRecordWriter(w, fields), nil
+	case ExportYAML:
+		return newYAMLRecordWriter(w, fields, true), nil
+	default:
+		return nil, fmt.Errorf("unsupported export format ( %v ) , please use json, ndjson, csv, parquet, table or yaml", format)
+	}
+}
+
+// exportFields resolves the requested column names against the User schema
+func exportFields(userSchema *schema.Schema, columns []string) ([]*schema.Field, error) {
+	fields := make([]*schema.Field, 0)
+
+	if len(columns) == 0 {
+		for _, name := range userSchema.DBNames {
+			// tenant_id is the same for every user of a scoped export, ask for it with -columns
+			if isDerivedColumn(name) || name == tenantColumn {
+				continue
+			}
+			fields = append(fields, userSchema.FieldsByDBName[name])
+		}
+		return fields, nil
+	}
+
+	for _, column := range columns {
+		field, ok := userSchema.FieldsByDBName[strings.TrimSpace(column)]
+		if !ok {
+			return nil, fmt.Errorf("unknown column ( %v ) , available columns are ( %v )", column, strings.Join(userSchema.DBNames, ","))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// writeUsers prints users that are already in memory (command-line output), single prints one object instead of a list
+func writeUsers(db *gorm.DB, w io.Writer, format ExportFormat, users []User, single bool) error {
+	userSchema, err := getUserSchema(db)
+	if err != nil {
+		return err
+	}
+
+	fields, err := exportFields(userSchema, nil)
+	if err != nil {
+		return err
+	}
+
+	var recordWriter userRecordWriter
+	switch {
+	case single && format == ExportJSON:
+		recordWriter = newJSONRecordWriter(w, fields, false)
+	case single && format == ExportYAML:
+		recordWriter = newYAMLRecordWriter(w, fields, false)
+	default:
+		recordWriter, err = newUserRecordWriter(w, format, fields)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range users {
+		userValue := reflect.ValueOf(&users[i]).Elem()
+		values := make([]interface{}, 0, len(fields))
+		for _, field := range fields {
+			values = append(values, plainFieldValue(context.Background(), field, userValue))
+		}
+		err = recordWriter.Write(values)
+		if err != nil {
+			return err
+		}
+	}
+	return recordWriter.Close()
+}
+
+func exportUsers(ctx context.Context, db *gorm.DB, w io.Writer, opts ExportOptions) (int64, error) {
+	var exported int64
+
+	userSchema, err := getUserSchema(db)
+	if err != nil {
+		return exported, err
+	}
+
+	fields, err := exportFields(userSchema, opts.Columns)
+	if err != nil {
+		return exported, err
+	}
+
+	columns := make([]string, 0, len(fields))
+	for _, field := range fields {
+		columns = append(columns, field.DBName)
+	}
+
+	recordWriter, err := newUserRecordWriter(w, opts.Format, fields)
+	if err != nil {
+		return exported, err
+	}
+
+	err = forEachUser(ctx, db, IterateOptions{Columns: columns, Filter: opts.Filter, Operation: opts.Operation}, func(user User) error {
+		userValue := reflect.ValueOf(&user).Elem()
+		values := make([]interface{}, 0, len(fields))
+		for _, field := range fields {
+			values = append(values, plainFieldValue(ctx, field, userValue))
+		}
+		err := recordWriter.Write(values)
+		if err != nil {
+			return err
+		}
+		exported++
+		return nil
+	})
+	if err != nil {
+		return exported, err
+	}
+
+	return exported, recordWriter.Close()
+}
+
+// jsonRecordWriter writes objects with the keys in column order (a map would sort them)
+type jsonRecordWriter struct {
+	w       *bufio.Writer
+	keys    [][]byte
+	array   bool
+	written int64
+}
+
+func newJSONRecordWriter(w io.Writer, fields []*schema.Field, array bool) *jsonRecordWriter {
+	keys := make([][]byte, 0, len(fields))
+	for _, field := range fields {
+		key, _ := json.Marshal(field.DBName)
+		keys = append(keys, key)
+	}
+	return &jsonRecordWriter{
+		w:     bufio.NewWriter(w),
+		keys:  keys,
+		array: array,
+	}
+}
+
+func (j *jsonRecordWriter) Write(values []interface{}) error {
+	if j.array {
+		if j.written == 0 {
+			_, _ = j.w.WriteString("[\n")
+		} else {
+			_, _ = j.w.WriteString(",\n")
+		}
+	}
+
+	_ = j.w.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			_ = j.w.WriteByte(',')
+		}
+		valueBytes, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, _ = j.w.Write(j.keys[i])
+		_ = j.w.WriteByte(':')
+		_, _ = j.w.Write(valueBytes)
+	}
+	_ = j.w.WriteByte('}')
+
+	if !j.array {
+		_ = j.w.WriteByte('\n')
+	}
+	j.written++
+	return nil
+}
+
+func (j *jsonRecordWriter) Close() error {
+	if j.array {
+		if j.written == 0 {
+			_, _ = j.w.WriteString("[")
+		}
+		_, _ = j.w.WriteString("\n]\n")
+	}
+	return j.w.Flush()
+}
+
+type csvRecordWriter struct {
+	w   *csv.Writer
+	row []string
+}
+
+func newCSVRecordWriter(w io.Writer, fields []*schema.Field) (*csvRecordWriter, error) {
+	csvWriter := csv.NewWriter(w)
+	header := make([]string, 0, len(fields))
+	for _, field := range fields {
+		header = append(header, field.DBName)
+	}
+	err := csvWriter.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &csvRecordWriter{
+		w:   csvWriter,
+		row: make([]string, len(fields)),
+	}, nil
+}
+
+func (c *csvRecordWriter) Write(values []interface{}) error {
+	for i, value := range values {
+		switch v := value.(type) {
+		case nil:
+			c.row[i] = ""
+		case bool:
+			c.row[i] = strconv.FormatBool(v)
+		default:
+			c.row[i] = fmt.Sprintf("%v", v)
+		}
+	}
+	return c.w.Write(c.row)
+}
+
+func (c *csvRecordWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type tableRecordWriter struct {
+	w   *tabwriter.Writer
+	row []string
+}
+
+func newTableRecordWriter(w io.Writer, fields []*schema.Field) *tableRecordWriter {
+	tableWriter := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := make([]string, 0, len(fields))
+	for _, field := range fields {
+		header = append(header, strings.ToUpper(field.DBName))
+	}
+	_, _ = fmt.Fprintln(tableWriter, strings.Join(header, "\t"))
+	return &tableRecordWriter{
+		w:   tableWriter,
+		row: make([]string, len(fields)),
+	}
+}
+
+func (t *tableRecordWriter) Write(values []interface{}) error {
+	for i, value := range values {
+		if value == nil {
+			t.row[i] = ""
+		} else {
+			t.row[i] = fmt.Sprintf("%v", value)
+		}
+	}
+	_, err := fmt.Fprintln(t.w, strings.Join(t.row, "\t"))
+	return err
+}
+
+func (t *tableRecordWriter) Close() error {
+	return t.w.Flush()
+}
+
+// yamlRecordWriter writes a list item per user (or a single mapping), keys in column order
+type yamlRecordWriter struct {
+	w       io.Writer
+	keys    []string
+	list    bool
+	written int64
+}
+
+func newYAMLRecordWriter(w io.Writer, fields []*schema.Field, list bool) *yamlRecordWriter {
+	keys := make([]string, 0, len(fields))
+	for _, field := range fields {
+		keys = append(keys, field.DBName)
+	}
+	return &yamlRecordWriter{
+		w:    w,
+		keys: keys,
+		list: list,
+	}
+}
+
+func (y *yamlRecordWriter) Write(values []interface{}) error {
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	for i, value := range values {
+		valueNode := &yaml.Node{Kind: yaml.ScalarNode}
+		switch v := value.(type) {
+		case nil:
+			valueNode.Tag, valueNode.Value = "!!null", "null"
+		case bool:
+			valueNode.Tag, valueNode.Value = "!!bool", strconv.FormatBool(v)
+		default:
+			valueNode.Tag, valueNode.Value = "!!str", fmt.Sprintf("%v", v)
+		}
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: y.keys[i]}, valueNode)
+	}
+
+	node := mapping
+	if y.list {
+		node = &yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{mapping}}
+	}
+
+	out, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	_, err = y.w.Write(out)
+	y.written++
+	return err
+}
+
+func (y *yamlRecordWriter) Close() error {
+	if y.list && y.written == 0 {
+		_, err := io.WriteString(y.w, "[]\n")
+		return err
+	}
+	return nil
+}
+
+type parquetRecordWriter struct {
+	w *writer.CSVWriter
+}
+
+func newParquetRecordWriter(w io.Writer, fields []*schema.Field) (*parquetRecordWriter, error) {
+	metadata := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if field.FieldType.Kind() == reflect.Bool {
+			metadata = append(metadata, fmt.Sprintf("name=%v, type=BOOLEAN, repetitiontype=OPTIONAL", field.DBName))
+		} else {
+			metadata = append(metadata, fmt.Sprintf("name=%v, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL", field.DBName))
+		}
+	}
+
+	parquetWriter, err := writer.NewCSVWriterFromWriter(metadata, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	parquetWriter.RowGroupSize = parquetRowGroupSize
+
+	return &parquetRecordWriter{w: parquetWriter}, nil
+}
+
+func (p *parquetRecordWriter) Write(values []interface{}) error {
+	return p.w.Write(values)
+}
+
+func (p *parquetRecordWriter) Close() error {
+	return p.w.WriteStop()
+}
+
+func runExportCommand(ctx context.Context, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	fileName := flags.String("file", "-", "output file, - for stdout")
+	format := flags.String("format", "json", "output format : json, ndjson, csv, parquet, table or yaml")
+	columns := flags.String("columns", "", "comma separated columns to export (default : all except string_rep and the blind indexes)")
+	search := flags.String("search", "", "comma separated search strings, only matching users are exported")
+	mode := flags.String("mode", "exact", "search mode : exact or pattern")
+	operator := flags.String("op", "or", "search operator : and or or")
+
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	opts := ExportOptions{
+		Format: ExportFormat(strings.ToLower(*format)),
+	}
+
+	if *columns != "" {
+		opts.Columns = strings.Split(*columns, ",")
+	}
+
+	if *search != "" {
+		searchType, err := parseSearchType(*operator)
+		if err != nil {
+			return usageErrorf("%v", err.Error())
+		}
+		exact, err := parseSearchMode(*mode)
+		if err != nil {
+			return usageErrorf("%v", err.Error())
+		}
+		opts.Filter, err = searchFilter(ctx, strings.Split(*search, ","), exact, searchType)
+		if err != nil {
+			return usageErrorf("%v", err.Error())
+		}
+		opts.Operation = OpSearch
+	}
+
+	if opts.Format == ExportParquet && *fileName == "-" {
+		return usageErrorf("please provide -file for parquet exports")
+	}
+
+	output := os.Stdout
+	if *fileName != "-" {
+		output, err = os.Create(*fileName)
+		if err != nil {
+			return err
+		}
+		defer func(output *os.File) {
+			_ = output.Close()
+		}(output)
+	}
+
+	exported, err := exportUsers(ctx, db, output, opts)
+	if err != nil {
+		return err
+	}
+
+	appLog.Info(ctx, "export finished", "users", exported, "format", string(opts.Format))
+	return nil
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+/*
+Field-level encryption
+
+The UserBasic fields tagged with serializer:encrypted (email and phone) are encrypted by the
+application before they are written, Postgres only ever sees :
+
+	email | enc:v1:2022-06:<wrapped data key>:<nonce + ciphertext>
+
+Envelope encryption : every value gets its own random data key (AES-256-GCM), the data key is
+wrapped with a key encryption key of the keyring (AES-256-GCM too) and stored next to the value,
+with the id of that key. The column name is the additional data of the value, a ciphertext copied
+into another column does not decrypt.
+
+Keyring (USERS_KEYRING_FILE, a JSON file, create it with "users keygen -file keyring.json") :
+
+	{
+	    "primary": "2022-06",
+	    "keys": {"2022-01": "<base64, 32 bytes>", "2022-06": "<base64, 32 bytes>"},
+	    "blind_index_key": "<base64, 32 bytes>"
+	}
+
+New values are encrypted with the primary key, any key of "keys" decrypts. Rotating :
+
+	users keygen -file keyring.json   : adds a key and makes it the primary one
+	users reencrypt                   : rewrites every value that is not under the primary key
+	                                    (and encrypts the rows still in plaintext, with their
+	                                    string_rep and blind indexes)
+
+after that the old key can be removed from the file.
+
+Blind indexes : email_bidx / phone_bidx hold HMAC-SHA256(blind_index_key, column + normalized value),
+so that exact lookups still work without decrypting anything :
+
+	email : lower case, trimmed
+	phone : digits only, "+1 (957) 570-2414" and "19575702414" are the same phone
+
+The blind index key can't be rotated like the other keys, a new one means "users reindex".
+
+string_rep leaves the encrypted fields out. Exact search terms are also matched against the blind
+indexes (see blindIndexAlternatives), pattern search does not look into encrypted fields.
+
+Without USERS_KEYRING_FILE nothing is encrypted and string_rep has every field, as before. Values
+written in plaintext stay readable once a keyring is configured ("users reencrypt" encrypts them).
+*/
+
+const (
+	encryptedValuePrefix = "enc:v1:"
+	encryptionKeySize    = 32
+	blindIndexSize       = 16 // bytes of the HMAC kept, hex encoded in the column
+)
+
+// encryptedColumns are the columns of the fields tagged serializer:encrypted, each with its blind index column
+var encryptedColumns = map[string]string{
+	"email": "email_bidx",
+	"phone": "phone_bidx",
+}
+
+var ErrNoKeyring = errors.New("encrypted value but no keyring configured ( USERS_KEYRING_FILE )")
+
+type keyringFile struct {
+	Primary       string            `json:"primary"`
+	Keys          map[string]string `json:"keys"`
+	BlindIndexKey string            `json:"blind_index_key"`
+}
+
+type Keyring struct {
+	primary    string
+	keys       map[string][]byte
+	blindIndex []byte
+}
+
+// keyring is nil when field encryption is disabled
+var keyring *Keyring
+
+func init() {
+	schema.RegisterSerializer("encrypted", encryptedSerializer{})
+}
+
+// loadKeyring reads USERS_KEYRING_FILE, field encryption stays disabled when it is not set
+func loadKeyring() error {
+	fileName := os.Getenv("USERS_KEYRING_FILE")
+	if fileName == "" {
+		keyring = nil
+		return nil
+	}
+	loaded, err := readKeyring(fileName)
+	if err != nil {
+		return err
+	}
+	keyring = loaded
+	return nil
+}
+
+func readKeyring(fileName string) (*Keyring, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not read keyring : %w", err)
+	}
+	var file keyringFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyring ( %v ) : %w", fileName, err)
+	}
+
+	k := &Keyring{
+		primary: file.Primary,
+		keys:    make(map[string][]byte, len(file.Keys)),
+	}
+	for id, encoded := range file.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id ( %v ) in keyring , key ids can't be empty or contain ':'", id)
+		}
+		k.keys[id], err = decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key ( %v ) in keyring : %w", id, err)
+		}
+	}
+	if _, ok := k.keys[k.primary]; !ok {
+		return nil, fmt.Errorf("primary key ( %v ) is not in the keyring", k.primary)
+	}
+	k.blindIndex, err = decodeKey(file.BlindIndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blind_index_key in keyring : %w", err)
+	}
+	return k, nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("key is %d bytes , please use %d bytes keys", len(key), encryptionKeySize)
+	}
+	return key, nil
+}
+
+func newEncryptionKey() (string, error) {
+	key := make([]byte, encryptionKeySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// addKeyringKey adds a new key to the keyring file (creating the file if needed) and makes it the primary key
+func addKeyringKey(fileName string, keyID string) error {
+	var file keyringFile
+	data, err := os.ReadFile(fileName)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, &file)
+		if err != nil {
+			return fmt.Errorf("invalid keyring ( %v ) : %w", fileName, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		file.Keys = make(map[string]string)
+		file.BlindIndexKey, err = newEncryptionKey()
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	if keyID == "" {
+		keyID = time.Now().UTC().Format("20060102T150405")
+	}
+	if _, ok := file.Keys[keyID]; ok {
+		return fmt.Errorf("key id ( %v ) is already in the keyring", keyID)
+	}
+	file.Keys[keyID], err = newEncryptionKey()
+	if err != nil {
+		return err
+	}
+	file.Primary = keyID
+
+	data, err = json.MarshalIndent(file, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, append(data, '\n'), 0o600)
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// envelope encryption
+
+func sealGCM(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openGCM(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// encrypt returns enc:v1:<key id>:<wrapped data key>:<ciphertext> for value, column is the additional data
+func (k *Keyring) encrypt(column string, value string) (string, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := sealGCM(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealGCM(dataKey, []byte(value), []byte(column))
+	if err != nil {
+		return "", err
+	}
+	return encryptedValuePrefix + k.primary + ":" +
+		base64.RawURLEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+func (k *Keyring) decrypt(column string, value string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(value, encryptedValuePrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid encrypted value in column %v", column)
+	}
+	kek, ok := k.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("key ( %v ) of column %v is not in the keyring", parts[0], column)
+	}
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value in column %v : %w", column, err)
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value in column %v : %w", column, err)
+	}
+	dataKey, err := openGCM(kek, wrappedKey, []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("could not unwrap the data key of column %v : %w", column, err)
+	}
+	plaintext, err := openGCM(dataKey, ciphertext, []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt column %v : %w", column, err)
+	}
+	return string(plaintext), nil
+}
+
+// encryptedKeyID returns the id of the key value is encrypted with, "" for a plaintext value
+func encryptedKeyID(value string) string {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return ""
+	}
+	keyID := strings.TrimPrefix(value, encryptedValuePrefix)
+	if i := strings.Index(keyID, ":"); i >= 0 {
+		return keyID[:i]
+	}
+	return keyID
+}
+
+// encryptedSerializer encrypts the fields tagged serializer:encrypted on write and decrypts them on read
+type encryptedSerializer struct{}
+
+func (encryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("unexpected value ( %T ) for encrypted column %v", dbValue, field.DBName)
+	}
+
+	value, err := decryptStored(field.DBName, value)
+	if err != nil {
+		return err
+	}
+	field.ReflectValueOf(ctx, dst).SetString(value)
+	return nil
+}
+
+func (encryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	value, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("encrypted column %v must be a string, got ( %T )", field.DBName, fieldValue)
+	}
+	return encryptStored(field.DBName, value)
+}
+
+// encryptStored is value as it is stored in an encrypted column, for the writes that don't go through gorm (COPY)
+func encryptStored(column string, value string) (string, error) {
+	if keyring == nil {
+		return value, nil
+	}
+	return keyring.encrypt(column, value)
+}
+
+// decryptStored is the plaintext of a value read from an encrypted column without gorm
+func decryptStored(column string, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, nil
+	}
+	if keyring == nil {
+		return "", ErrNoKeyring
+	}
+	return keyring.decrypt(column, value)
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// blind indexes
+
+func normalizeForBlindIndex(column string, value string) string {
+	switch column {
+	case "phone":
+		return strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, value)
+	default:
+		return strings.ToLower(strings.TrimSpace(value))
+	}
+}
+
+// blindIndex is the value of the blind index column of column for value, "" when encryption is disabled
+func blindIndex(column string, value string) string {
+	if keyring == nil {
+		return ""
+	}
+	normalized := normalizeForBlindIndex(column, value)
+	if normalized == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, keyring.blindIndex)
+	mac.Write([]byte(column))
+	mac.Write([]byte{0})
+	mac.Write([]byte(normalized))
+	return hex.EncodeToString(mac.Sum(nil)[:blindIndexSize])
+}
+
+// blindIndexCondition matches value against the blind index of column, ok is false when column is not
+// encrypted (or encryption is disabled) and the caller should compare the column itself
+func blindIndexCondition(column string, value string) (clause.Expr, bool) {
+	indexColumn, encrypted := encryptedColumns[column]
+	if !encrypted || keyring == nil {
+		return clause.Expr{}, false
+	}
+	return clause.Expr{SQL: "? = ?", Vars: []interface{}{clause.Column{Name: indexColumn}, blindIndex(column, value)}}, true
+}
+
+// lowerColumnEquals is LOWER(column) = LOWER(value), through the blind index for an encrypted column
+func lowerColumnEquals(column string, value string) clause.Expr {
+	if condition, ok := blindIndexCondition(column, value); ok {
+		return condition
+	}
+	return clause.Expr{SQL: "LOWER(?) = LOWER(?)", Vars: []interface{}{clause.Column{Name: column}, value}}
+}
+
+// isEncryptedField reports whether the UserBasic field is tagged serializer:encrypted (and encryption is enabled)
+func isEncryptedField(field reflect.StructField) bool {
+	return keyring != nil && strings.Contains(field.Tag.Get("gorm"), "serializer:encrypted")
+}
+
+// setDerivedColumns computes string_rep and the blind indexes from UserBasic
+func (u *User) setDerivedColumns() {
+	u.StringRep = getStringRep(u.UserBasic)
+	u.EmailIndex = blindIndex("email", u.Email)
+	u.PhoneIndex = blindIndex("phone", u.Phone)
+}
+
+// blindIndexAlternatives are the blind index conditions of an exact search term (none when encryption is disabled)
+func blindIndexAlternatives(searchString string) []string {
+	if keyring == nil {
+		return nil
+	}
+
+	alternatives := make([]string, 0, 2)
+	for _, column := range []string{"email", "phone"} {
+		if index := blindIndex(column, searchString); index != "" {
+			alternatives = append(alternatives, fmt.Sprintf("%v = '%v'", encryptedColumns[column], index))
+		}
+	}
+	return alternatives
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// re-encryption
+
+type encryptedRow struct {
+	TenantID   string
+	UserID     string
+	FirstName  string
+	LastName   string
+	Email      string
+	Phone      string
+	StringRep  string
+	EmailIndex string `gorm:"column:email_bidx"`
+	PhoneIndex string `gorm:"column:phone_bidx"`
+}
+
+/*
+reencryptUsers rewrites the encrypted columns of every row whose value is in plaintext or under
+another key than the primary one, chunkSize rows at a time (keyset pagination on tenant_id, user_id).
+
+The values are read and written as they are stored (no serializer). string_rep and the blind indexes
+are rewritten with them (a plaintext row has the email / phone in string_rep and no blind index), as
+well as on the rows whose string_rep or blind indexes are not the ones of their values.
+
+Every chunk is read FOR UPDATE and written in the same transaction : a write to one of its rows waits
+for the chunk, and is not overwritten with the value read before it.
+*/
+func reencryptUsers(ctx context.Context, db *gorm.DB, chunkSize int) (int64, error) {
+	if keyring == nil {
+		return 0, errors.New("field encryption is disabled , please set USERS_KEYRING_FILE")
+	}
+	if chunkSize <= 0 {
+		chunkSize = defaultIterateChunkSize
+	}
+
+	var updated int64
+	afterTenantID, afterUserID := "", ""
+	for {
+		var chunkRead int
+		var chunkUpdated int64
+		err := withTimeout(ctx, db, OpWrite, func(tx *gorm.DB) error {
+			return tx.Transaction(func(tx *gorm.DB) error {
+				rows := make([]encryptedRow, 0, chunkSize)
+				err := tx.Table(User{}.TableName()).
+					Select("tenant_id", "user_id", "first_name", "last_name", "email", "phone", "string_rep", "email_bidx", "phone_bidx").
+					Where("(tenant_id, user_id) > (?, ?)", afterTenantID, afterUserID).
+					Order("tenant_id").Order("user_id").Limit(chunkSize).
+					Clauses(clause.Locking{Strength: "UPDATE"}).
+					Scan(&rows).Error
+				if err != nil {
+					return err
+				}
+				chunkRead = len(rows)
+				if chunkRead == 0 {
+					return nil
+				}
+				afterTenantID, afterUserID = rows[len(rows)-1].TenantID, rows[len(rows)-1].UserID
+
+				for _, row := range rows {
+					values, err := reencryptedValues(row)
+					if err != nil {
+						return err
+					}
+					if len(values) == 0 {
+						continue
+					}
+					result := tx.Table(User{}.TableName()).Where("tenant_id = ? AND user_id = ?", row.TenantID, row.UserID).UpdateColumns(values)
+					if result.Error != nil {
+						return result.Error
+					}
+					chunkUpdated += result.RowsAffected
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return updated, err
+		}
+		if chunkRead == 0 {
+			break
+		}
+		updated += chunkUpdated
+	}
+
+	appLog.Info(ctx, "encrypted columns rewritten", "rows_updated", updated, "key_id", keyring.primary)
+	return updated, nil
+}
+
+// reencryptedValues are the columns of row to rewrite, none when it is encrypted with the primary key
+// and its derived columns are up to date
+func reencryptedValues(row encryptedRow) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	plaintexts := make(map[string]string, 2)
+	for column, value := range map[string]string{"email": row.Email, "phone": row.Phone} {
+		keyID := encryptedKeyID(value)
+		plaintext := value
+		if keyID != "" {
+			var err error
+			plaintext, err = keyring.decrypt(column, value)
+			if err != nil {
+				return nil, fmt.Errorf("user %v : %w", row.UserID, err)
+			}
+		}
+		plaintexts[column] = plaintext
+		if keyID == keyring.primary {
+			continue
+		}
+
+		encrypted, err := keyring.encrypt(column, plaintext)
+		if err != nil {
+			return nil, err
+		}
+		values[column] = encrypted
+	}
+
+	user := User{UserBasic: UserBasic{
+		UserID:    row.UserID,
+		FirstName: row.FirstName,
+		LastName:  row.LastName,
+		Email:     plaintexts["email"],
+		Phone:     plaintexts["phone"],
+	}}
+	user.setDerivedColumns()
+	if len(values) == 0 && user.StringRep == row.StringRep && user.EmailIndex == row.EmailIndex && user.PhoneIndex == row.PhoneIndex {
+		return nil, nil
+	}
+
+	values["string_rep"] = user.StringRep
+	values["email_bidx"] = user.EmailIndex
+	values["phone_bidx"] = user.PhoneIndex
+	return values, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+// withTestKeyring enables field encryption with a fixed key for the test
+func withTestKeyring(t *testing.T) {
+	t.Helper()
+	key := make([]byte, encryptionKeySize)
+	keyring = &Keyring{primary: "test", keys: map[string][]byte{"test": key}, blindIndex: key}
+	t.Cleanup(func() {
+		keyring = nil
+	})
+}
+
+func TestReencryptedValuesOfPlaintextRow(t *testing.T) {
+	withTestKeyring(t)
+
+	row := encryptedRow{
+		TenantID:  defaultTenantID,
+		UserID:    "u1",
+		FirstName: "Sonia",
+		LastName:  "Livingston",
+		Email:     "sonialivingston@hinway.com",
+		Phone:     "+1 (957) 570-2414",
+		StringRep: "#u1#Sonia#Livingston#sonialivingston@hinway.com#+1 (957) 570-2414#",
+	}
+	values, err := reencryptedValues(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, column := range []string{"email", "phone"} {
+		encrypted, _ := values[column].(string)
+		if encryptedKeyID(encrypted) != "test" {
+			t.Fatalf("%v is not encrypted with the primary key ( %v )", column, encrypted)
+		}
+	}
+	if values["string_rep"] != "#u1#Sonia#Livingston#" {
+		t.Errorf("string_rep still has the encrypted fields ( %v )", values["string_rep"])
+	}
+	if values["email_bidx"] != blindIndex("email", row.Email) || values["phone_bidx"] != blindIndex("phone", row.Phone) {
+		t.Errorf("blind indexes not set ( %v , %v )", values["email_bidx"], values["phone_bidx"])
+	}
+
+	// the rewritten row is up to date
+	row.Email, row.Phone = values["email"].(string), values["phone"].(string)
+	row.StringRep, row.EmailIndex, row.PhoneIndex = values["string_rep"].(string), values["email_bidx"].(string), values["phone_bidx"].(string)
+	values, err = reencryptedValues(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Errorf("expected nothing to rewrite , got %v", values)
+	}
+}
+
+func TestReencryptedValuesOfStaleBlindIndex(t *testing.T) {
+	withTestKeyring(t)
+
+	email, err := keyring.encrypt("email", "sonialivingston@hinway.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, err := keyring.encrypt("phone", "5705552414")
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := encryptedRow{UserID: "u1", FirstName: "NA", LastName: "NA", Email: email, Phone: phone, StringRep: "#u1#NA#NA#"}
+
+	// encrypted with the primary key, but without blind indexes
+	values, err := reencryptedValues(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := values["email"]; ok {
+		t.Errorf("email re-encrypted although it is under the primary key")
+	}
+	if values["email_bidx"] != blindIndex("email", "sonialivingston@hinway.com") {
+		t.Errorf("email_bidx not filled ( %v )", values["email_bidx"])
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/*
+Generic repository
+
+Repository[T] is the CRUD part of UserRepository for any gorm model with a primary key. The table comes
+from the model's TableName (Tabler), the primary key and the columns from gorm's schema parser, so a new
+entity needs its struct and one line :
+
+	type Device struct {
+		TenantID  string `gorm:"primaryKey;column:tenant_id;default:default;not null"`
+		DeviceID  string `gorm:"primaryKey"`
+		Serial    string `gorm:"not null"`
+		Firmware  string
+	}
+
+	func (Device) TableName() string { return "devices" }
+
+	var deviceModel = registerModel[Device]()
+
+	devices := deviceModel.Repository(db)
+	device, err := devices.Create(ctx, Device{DeviceID: "d-1", Serial: "sn-0042"})
+	device, err = devices.Get(ctx, "d-1")
+	page, err := devices.List(ctx, ModelListOptions{Limit: 20, AfterKey: []interface{}{"d-1"}})
+
+Registered models are created / updated by "users migrate" (InitializeTables), and get what users get :
+
+	tenants     : a model with a tenant_id column is scoped by tenantPlugin, tenant_id is not part of the
+	              keys given to Get / Delete, it comes from the context (or ForTenant)
+	timeouts    : every call runs through withTimeout (read / write / search)
+	errors      : ErrNotFound, ErrAlreadyExists, ErrInvalidArgument, same as UserRepository
+	traces      : a span per call ("Repository[Device].Get"), errors counted per "Device.Get"
+	validation  : Validate() error (on T) is called before create / upsert, ApplyDefaults() (on *T) too
+	search      : Search works when a SearchIndex[T] is registered (see search_index.go)
+	encryption  : serializer:encrypted fields are encrypted like the user fields (see field_encryption.go)
+
+FYI : keys are given in the order of the primaryKey fields of the struct, tenant_id left out.
+    : the schema is parsed on first use, not at registration : the package variables are initialized
+      before the init functions, and the encrypted serializer is registered in one. A model without a
+      primary key fails every call with the parse error.
+*/
+
+// Validator is implemented by the models that check themselves before create / upsert
+type Validator interface {
+	Validate() error
+}
+
+// Defaulter is implemented (on the pointer) by the models that fill in defaults before create / upsert
+type Defaulter interface {
+	ApplyDefaults()
+}
+
+// Model is the schema of a model : its table, its keys and whether it has a tenant
+type Model[T Tabler] struct {
+	name string // the struct name, for spans and errors
+
+	once   sync.Once
+	err    error
+	schema *schema.Schema
+	keys   []*schema.Field // primary key fields, without tenant_id
+	tenant *schema.Field   // tenant_id, nil for models without tenants
+}
+
+var (
+	registeredModelsLock sync.RWMutex
+	registeredModels     = make([]interface{}, 0)
+)
+
+func newModel[T Tabler]() *Model[T] {
+	return &Model[T]{name: reflect.TypeOf((*T)(nil)).Elem().Name()}
+}
+
+// registerModel adds T to the tables "users migrate" creates / updates
+func registerModel[T Tabler]() *Model[T] {
+	registeredModelsLock.Lock()
+	defer registeredModelsLock.Unlock()
+	registeredModels = append(registeredModels, new(T))
+	return newModel[T]()
+}
+
+// parse parses the schema of T (once), T needs a primary key besides tenant_id
+func (m *Model[T]) parse() error {
+	m.once.Do(func() {
+		var zero T
+		modelSchema, err := schema.Parse(new(T), &sync.Map{}, schema.NamingStrategy{})
+		if err != nil {
+			m.err = fmt.Errorf("could not parse model ( %v ) : %w", m.name, err)
+			return
+		}
+		if modelSchema.Table != zero.TableName() {
+			m.err = fmt.Errorf("model ( %v ) has table ( %v ) , TableName says ( %v )", m.name, modelSchema.Table, zero.TableName())
+			return
+		}
+
+		keys := make([]*schema.Field, 0, len(modelSchema.PrimaryFields))
+		for _, field := range modelSchema.PrimaryFields {
+			if field.DBName != tenantColumn {
+				keys = append(keys, field)
+			}
+		}
+		if len(keys) == 0 {
+			m.err = fmt.Errorf("model ( %v ) has no primary key , please tag one with gorm:\"primaryKey\"", m.name)
+			return
+		}
+		m.schema, m.keys, m.tenant = modelSchema, keys, modelSchema.LookUpField(tenantColumn)
+	})
+	return m.err
+}
+
+// migrationModels are the registered models, in registration order, for AutoMigrate
+func migrationModels() []interface{} {
+	registeredModelsLock.RLock()
+	defer registeredModelsLock.RUnlock()
+	return append([]interface{}{}, registeredModels...)
+}
+
+// Repository returns the repository of the model on db
+func (m *Model[T]) Repository(db *gorm.DB) *Repository[T] {
+	return &Repository[T]{db: db, model: m}
+}
+
+// keyColumns are the db names of the keys, for error messages
+func (m *Model[T]) keyColumns() string {
+	columns := make([]string, 0, len(m.keys))
+	for _, field := range m.keys {
+		columns = append(columns, field.DBName)
+	}
+	return strings.Join(columns, ", ")
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+type Repository[T Tabler] struct {
+	db       *gorm.DB
+	model    *Model[T]
+	tenantID string // empty : the tenant of the context
+}
+
+type ModelListOptions struct {
+	Limit    int                        // defaults to 100
+	Offset   int                        // offset pagination
+	AfterKey []interface{}              // keyset pagination : only rows with a key greater than this one
+	Filter   func(db *gorm.DB) *gorm.DB // optional
+}
+
+// NewRepository parses T and returns its repository, registerModel is the way for models that need a table
+func NewRepository[T Tabler](db *gorm.DB) (*Repository[T], error) {
+	model := newModel[T]()
+	err := model.parse()
+	if err != nil {
+		return nil, err
+	}
+	return model.Repository(db), nil
+}
+
+// ForTenant returns a repository scoped to tenantID, see UserRepository.ForTenant
+func (r *Repository[T]) ForTenant(tenantID string) (*Repository[T], error) {
+	err := validateTenantID(tenantID, false)
+	if err != nil {
+		return nil, invalidArgument("%v", err.Error())
+	}
+	return &Repository[T]{db: r.db, model: r.model, tenantID: tenantID}, nil
+}
+
+func (r *Repository[T]) scope(ctx context.Context) context.Context {
+	if r.tenantID == "" {
+		return ctx
+	}
+	return contextWithTenant(ctx, r.tenantID)
+}
+
+// begin starts the span of a call and parses the model, end records the outcome of the call
+func (r *Repository[T]) begin(ctx context.Context, method string, attrs ...attribute.KeyValue) (_ context.Context, end func(err error), err error) {
+	ctx, span := startSpan(r.scope(ctx), fmt.Sprintf("Repository[%v].%v", r.model.name, method), attrs...)
+	return ctx, func(err error) { endRepositoryCall(span, r.model.name+"."+method, err) }, r.model.parse()
+}
+
+// keyCondition is the WHERE of one row, from its key values
+func (r *Repository[T]) keyCondition(keys []interface{}) (map[string]interface{}, error) {
+	if len(keys) != len(r.model.keys) {
+		return nil, invalidArgument("%v needs %v key value(s) ( %v ) , got %v", r.model.name, len(r.model.keys), r.model.keyColumns(), len(keys))
+	}
+	condition := make(map[string]interface{}, len(keys))
+	for i, field := range r.model.keys {
+		if keys[i] == nil || reflect.ValueOf(keys[i]).IsZero() {
+			return nil, invalidArgument("%v is empty", field.DBName)
+		}
+		condition[field.DBName] = keys[i]
+	}
+	return condition, nil
+}
+
+// keyValues are the key values of model
+func (r *Repository[T]) keyValues(ctx context.Context, model *T) []interface{} {
+	value := reflect.ValueOf(model).Elem()
+	keys := make([]interface{}, 0, len(r.model.keys))
+	for _, field := range r.model.keys {
+		key, _ := field.ValueOf(ctx, value)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// prepareWrite validates model, fills in its defaults and its tenant
+func (r *Repository[T]) prepareWrite(ctx context.Context, model *T) error {
+	if defaulter, ok := interface{}(model).(Defaulter); ok {
+		defaulter.ApplyDefaults()
+	}
+	if validator, ok := interface{}(*model).(Validator); ok {
+		err := validator.Validate()
+		if err != nil {
+			return invalidArgument("%v", err.Error())
+		}
+	}
+
+	value := reflect.ValueOf(model).Elem()
+	for _, field := range r.model.keys {
+		_, zero := field.ValueOf(ctx, value)
+		if zero && !field.AutoIncrement && !field.HasDefaultValue {
+			return invalidArgument("%v is empty", field.DBName)
+		}
+	}
+
+	if r.model.tenant == nil {
+		return nil
+	}
+	tenantID, err := writeTenant(ctx)
+	if err != nil {
+		return invalidArgument("%v", err.Error())
+	}
+	return r.model.tenant.Set(ctx, value, tenantID)
+}
+
+func (r *Repository[T]) Create(ctx context.Context, model T) (_ T, err error) {
+	ctx, end, err := r.begin(ctx, "Create")
+	defer func() { end(err) }()
+
+	var zero T
+	if err != nil {
+		return zero, err
+	}
+	err = r.prepareWrite(ctx, &model)
+	if err != nil {
+		return zero, err
+	}
+
+	err = withTimeout(ctx, r.db, OpWrite, func(tx *gorm.DB) error {
+		return tx.Create(&model).Error
+	})
+	keys := r.keyValues(ctx, &model)
+	if isUniqueViolation(err) {
+		return zero, fmt.Errorf("%v %w : %v", r.model.name, ErrAlreadyExists, keys)
+	}
+	if err != nil {
+		return zero, err
+	}
+
+	// read it back, so that the column defaults are filled in
+	return r.Get(ctx, keys...)
+}
+
+func (r *Repository[T]) Get(ctx context.Context, keys ...interface{}) (_ T, err error) {
+	ctx, end, err := r.begin(ctx, "Get")
+	defer func() { end(err) }()
+
+	var model T
+	if err != nil {
+		return model, err
+	}
+	condition, err := r.keyCondition(keys)
+	if err != nil {
+		return model, err
+	}
+
+	err = withTimeout(ctx, r.db, OpRead, func(tx *gorm.DB) error {
+		return tx.Where(condition).Take(&model).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return model, fmt.Errorf("%v %w : %v", r.model.name, ErrNotFound, keys)
+	}
+	return model, err
+}
+
+// Upsert creates the row, or updates all its columns when the key already exists
+func (r *Repository[T]) Upsert(ctx context.Context, model T) (_ T, err error) {
+	ctx, end, err := r.begin(ctx, "Upsert")
+	defer func() { end(err) }()
+
+	var zero T
+	if err != nil {
+		return zero, err
+	}
+	err = r.prepareWrite(ctx, &model)
+	if err != nil {
+		return zero, err
+	}
+
+	err = withTimeout(ctx, r.db, OpWrite, func(tx *gorm.DB) error {
+		return tx.Clauses(clause.OnConflict{
+			UpdateAll: true,
+		}).Create(&model).Error
+	})
+	if err != nil {
+		return zero, err
+	}
+
+	return r.Get(ctx, r.keyValues(ctx, &model)...)
+}
+
+func (r *Repository[T]) Delete(ctx context.Context, keys ...interface{}) (err error) {
+	ctx, end, err := r.begin(ctx, "Delete")
+	defer func() { end(err) }()
+
+	if err != nil {
+		return err
+	}
+	condition, err := r.keyCondition(keys)
+	if err != nil {
+		return err
+	}
+	if r.model.tenant != nil {
+		_, err = writeTenant(ctx)
+		if err != nil {
+			return invalidArgument("%v", err.Error())
+		}
+	}
+
+	var rowsAffected int64
+	err = withTimeout(ctx, r.db, OpWrite, func(tx *gorm.DB) error {
+		result := tx.Where(condition).Delete(new(T))
+		rowsAffected = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%v %w : %v", r.model.name, ErrNotFound, keys)
+	}
+	return nil
+}
+
+// List returns a page of rows ordered by key
+func (r *Repository[T]) List(ctx context.Context, opts ModelListOptions) (_ []T, err error) {
+	if opts.Limit <= 0 {
+		opts.Limit = defaultListLimit
+	}
+	ctx, end, err := r.begin(ctx, "List", attribute.Int("list.limit", opts.Limit), attribute.Int("list.offset", opts.Offset))
+	defer func() { end(err) }()
+
+	if err != nil {
+		return nil, err
+	}
+	if opts.Offset < 0 {
+		return nil, invalidArgument("offset must not be negative")
+	}
+	var after clause.Expression
+	if len(opts.AfterKey) > 0 {
+		_, err = r.keyCondition(opts.AfterKey)
+		if err != nil {
+			return nil, err
+		}
+		// row comparison, (a, b) > (x, y) is the keyset order of a composite key
+		columns := make([]string, 0, len(r.model.keys))
+		for _, field := range r.model.keys {
+			columns = append(columns, pgx.Identifier{field.DBName}.Sanitize())
+		}
+		after = clause.Expr{SQL: fmt.Sprintf("(%v) > ?", strings.Join(columns, ", ")), Vars: []interface{}{opts.AfterKey}}
+	}
+
+	models := make([]T, 0)
+	err = withTimeout(ctx, r.db, OpRead, func(tx *gorm.DB) error {
+		query := tx.Limit(opts.Limit).Offset(opts.Offset)
+		for _, field := range r.model.keys {
+			query = query.Order(clause.OrderByColumn{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}})
+		}
+		if opts.Filter != nil {
+			query = opts.Filter(query)
+		}
+		if after != nil {
+			query = query.Where(after)
+		}
+		return query.Find(&models).Error
+	})
+	return models, err
+}
+
+// Search runs a search through the SearchIndex registered for T
+func (r *Repository[T]) Search(ctx context.Context, opts SearchOptions) (_ []T, err error) {
+	ctx, end, err := r.begin(ctx, "Search", attribute.Int("search.limit", opts.Limit))
+	defer func() { end(err) }()
+
+	if err != nil {
+		return nil, err
+	}
+	searchIndexesLock.RLock()
+	idx, ok := searchIndexes[r.model.schema.ModelType].(*SearchIndex[T])
+	searchIndexesLock.RUnlock()
+	if !ok {
+		return nil, invalidArgument("%v has no search index", r.model.name)
+	}
+	return idx.Search(ctx, r.db, opts)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testDevice is a model with a tenant and a key of two columns
+type testDevice struct {
+	TenantID string `gorm:"primaryKey;column:tenant_id;default:default;not null"`
+	OwnerID  string `gorm:"primaryKey"`
+	DeviceID string `gorm:"primaryKey"`
+	Serial   string `gorm:"not null"`
+}
+
+func (testDevice) TableName() string { return "test_devices" }
+
+// testSetting is a model without tenant
+type testSetting struct {
+	Name  string `gorm:"primaryKey"`
+	Value string
+}
+
+func (testSetting) TableName() string { return "test_settings" }
+
+// testNoKey is a model without primary key
+type testNoKey struct {
+	Name string
+}
+
+func (testNoKey) TableName() string { return "test_no_keys" }
+
+// modelKeys are the key columns and the tenant column of the model of repo
+func modelKeys[T Tabler](repo *Repository[T]) (string, bool) {
+	return repo.model.keyColumns(), repo.model.tenant != nil
+}
+
+func TestRepositoryKeyDiscovery(t *testing.T) {
+	devices, err := NewRepository[testDevice](nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, tenant := modelKeys(devices); keys != "owner_id, device_id" || !tenant {
+		t.Errorf("testDevice : keys ( %v ) tenant %v , want ( owner_id, device_id ) with a tenant", keys, tenant)
+	}
+	settings, err := NewRepository[testSetting](nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, tenant := modelKeys(settings); keys != "name" || tenant {
+		t.Errorf("testSetting : keys ( %v ) tenant %v , want ( name ) without tenant", keys, tenant)
+	}
+	subscriptions, err := NewRepository[WebhookSubscription](nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, tenant := modelKeys(subscriptions); keys != "id" || !tenant {
+		t.Errorf("WebhookSubscription : keys ( %v ) tenant %v , want ( id ) with a tenant", keys, tenant)
+	}
+
+	_, err = NewRepository[testNoKey](nil)
+	if err == nil || !strings.Contains(err.Error(), "has no primary key") {
+		t.Errorf("model without primary key , got %v", err)
+	}
+
+	// the keys are given without tenant_id, in the order of the struct
+	condition, err := devices.keyCondition([]interface{}{"o1", "d1"})
+	if err != nil || len(condition) != 2 || condition["owner_id"] != "o1" || condition["device_id"] != "d1" {
+		t.Errorf("key condition ( %v , %v )", condition, err)
+	}
+	for _, keys := range [][]interface{}{{"o1"}, {"o1", "d1", "x"}, {"o1", ""}} {
+		_, err := devices.keyCondition(keys)
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("key condition of %v , got %v , want invalid argument", keys, err)
+		}
+	}
+}
+
+func TestRepositoryCompositeKey(t *testing.T) {
+	db := openTestDB(t)
+	ctx := testTenant(t, db)
+	err := db.AutoMigrate(&testDevice{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Migrator().DropTable(&testDevice{})
+	})
+	devices, err := NewRepository[testDevice](db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = devices.Create(ctx, testDevice{OwnerID: "o1", DeviceID: "d1", Serial: "sn-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = devices.Create(ctx, testDevice{OwnerID: "o2", DeviceID: "d1", Serial: "sn-2"})
+	if err != nil {
+		t.Fatalf("same device_id of another owner : %v", err)
+	}
+	_, err = devices.Create(ctx, testDevice{OwnerID: "o1", DeviceID: "d1"})
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("create of an existing key , got %v , want already exists", err)
+	}
+
+	_, err = devices.Upsert(ctx, testDevice{OwnerID: "o1", DeviceID: "d1", Serial: "sn-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := devices.Get(ctx, "o1", "d1")
+	if err != nil || device.Serial != "sn-3" {
+		t.Errorf("get after the upsert ( %+v , %v )", device, err)
+	}
+	device, err = devices.Get(ctx, "o2", "d1")
+	if err != nil || device.Serial != "sn-2" {
+		t.Errorf("upsert changed the device of another owner ( %+v , %v )", device, err)
+	}
+
+	// tenant_id comes from the context
+	_, err = devices.Get(testTenant(t, db), "o1", "d1")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("get in another tenant , got %v , want not found", err)
+	}
+
+	err = devices.Delete(ctx, "o1", "d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = devices.Get(ctx, "o1", "d1")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("get after the delete , got %v , want not found", err)
+	}
+}
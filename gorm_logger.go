@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+gorm logger
+
+gormLogger is the logger.Interface behind AppLog, it writes through appLog and gorm's own levels map
+onto ours :
+
+	silent : nothing
+	error  : failed statements (level error)
+	warn   : + slow statements, over the slow threshold (level warn)
+	info   : + every statement (level debug, so USERS_LOG_LEVEL=debug is needed to see them)
+
+Configuration (environment) :
+
+	USERS_GORM_LOG_LEVEL      : silent, error, warn (default) or info
+	USERS_GORM_SLOW_THRESHOLD : Go duration, default 1s, 0 disables the slow statement log and report
+	USERS_SLOW_QUERY_TOP_N    : size of the slow query report, default 20
+
+Level and threshold live in gormSettings and can be changed while the process runs :
+
+	kill -USR1 <pid>                   : level info (log every statement)
+	kill -USR2 <pid>                   : back to the configured level
+	PUT /admin/gorm-logger (admin.go)  : {"level": "info", "slow_threshold": "200ms"}
+
+Slow statements are logged and recorded with their parameters redacted : every literal is replaced
+with ? (and long IN / VALUES lists collapsed), so the same statement with different values is one
+entry of the report
+
+	SELECT * FROM "user_records" WHERE user_id IN (?...) ORDER BY user_id LIMIT ?
+
+The report keeps the top N statements by their slowest run (GET /admin/slow-queries).
+
+FYI : db.Debug() still works, it switches its session to info whatever the configured level.
+*/
+
+const defaultSlowQueryTopN = 20
+
+type gormLogSettings struct {
+	configured    int32 // the level from the configuration, what USR2 goes back to
+	level         int32
+	slowThreshold int64
+}
+
+var gormSettings = &gormLogSettings{
+	configured:    int32(logger.Warn),
+	level:         int32(logger.Warn),
+	slowThreshold: int64(time.Second),
+}
+
+var slowQueries = newSlowQueryReport(defaultSlowQueryTopN)
+
+func (s *gormLogSettings) Level() logger.LogLevel {
+	return logger.LogLevel(atomic.LoadInt32(&s.level))
+}
+
+func (s *gormLogSettings) SetLevel(level logger.LogLevel) {
+	atomic.StoreInt32(&s.level, int32(level))
+}
+
+func (s *gormLogSettings) ConfiguredLevel() logger.LogLevel {
+	return logger.LogLevel(atomic.LoadInt32(&s.configured))
+}
+
+func (s *gormLogSettings) SlowThreshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.slowThreshold))
+}
+
+func (s *gormLogSettings) SetSlowThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&s.slowThreshold, int64(threshold))
+}
+
+// loadGormLogSettings reads the gorm logger configuration from the environment
+func loadGormLogSettings() error {
+	if value := os.Getenv("USERS_GORM_LOG_LEVEL"); value != "" {
+		level, err := parseGormLogLevel(value)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt32(&gormSettings.configured, int32(level))
+		gormSettings.SetLevel(level)
+	}
+
+	if value := os.Getenv("USERS_GORM_SLOW_THRESHOLD"); value != "" {
+		threshold, err := time.ParseDuration(value)
+		if err != nil || threshold < 0 {
+			return fmt.Errorf("invalid duration for environment variable USERS_GORM_SLOW_THRESHOLD ( %v )", value)
+		}
+		gormSettings.SetSlowThreshold(threshold)
+	}
+
+	if value := os.Getenv("USERS_SLOW_QUERY_TOP_N"); value != "" {
+		topN, err := strconv.Atoi(value)
+		if err != nil || topN <= 0 {
+			return fmt.Errorf("invalid value for environment variable USERS_SLOW_QUERY_TOP_N ( %v )", value)
+		}
+		slowQueries = newSlowQueryReport(topN)
+	}
+	return nil
+}
+
+func parseGormLogLevel(level string) (logger.LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "silent":
+		return logger.Silent, nil
+	case "error":
+		return logger.Error, nil
+	case "warn", "warning":
+		return logger.Warn, nil
+	case "info":
+		return logger.Info, nil
+	default:
+		return logger.Warn, fmt.Errorf("invalid gorm log level ( %v ) , please use silent, error, warn or info", level)
+	}
+}
+
+func gormLogLevelName(level logger.LogLevel) string {
+	switch level {
+	case logger.Silent:
+		return "silent"
+	case logger.Error:
+		return "error"
+	case logger.Warn:
+		return "warn"
+	case logger.Info:
+		return "info"
+	default:
+		return fmt.Sprintf("level(%d)", int(level))
+	}
+}
+
+type gormLogger struct {
+	logger   *Logger
+	settings *gormLogSettings
+	report   *slowQueryReport
+	override *logger.LogLevel // set by LogMode (e.g. db.Debug()), otherwise the level comes from settings
+}
+
+func newGormLogger(l *Logger, settings *gormLogSettings, report *slowQueryReport) *gormLogger {
+	return &gormLogger{
+		logger:   l.With("component", "gorm"),
+		settings: settings,
+		report:   report,
+	}
+}
+
+func (g *gormLogger) level() logger.LogLevel {
+	if g.override != nil {
+		return *g.override
+	}
+	return g.settings.Level()
+}
+
+func (g *gormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	child := *g
+	child.override = &level
+	return &child
+}
+
+func (g *gormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if g.level() >= logger.Info {
+		g.logger.Info(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (g *gormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if g.level() >= logger.Warn {
+		g.logger.Warn(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (g *gormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if g.level() >= logger.Error {
+		g.logger.Error(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (g *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	elapsed := time.Since(begin)
+	level := g.level()
+	threshold := g.settings.SlowThreshold()
+	slow := threshold > 0 && elapsed > threshold
+
+	// slow statements are recorded whatever the level, the report is what we look at in production
+	if slow {
+		sql, rows := fc()
+		fingerprint := fingerprintSQL(sql)
+		g.report.record(fingerprint, elapsed, rows, requestIDFromContext(ctx))
+		if level >= logger.Warn {
+			g.logger.Warn(ctx, "slow statement", "sql", fingerprint, "rows", rows, "elapsed_ms", elapsedMillis(elapsed), "slow_threshold", threshold)
+		}
+	}
+
+	switch {
+	case level <= logger.Silent:
+		return
+	case err != nil && level >= logger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		sql, rows := fc()
+		g.logger.Error(ctx, "statement failed", "sql", fingerprintSQL(sql), "rows", rows, "elapsed_ms", elapsedMillis(elapsed), "error", err)
+	case !slow && level >= logger.Info && g.logger.Enabled(LevelDebug):
+		sql, rows := fc()
+		g.logger.Debug(ctx, "statement", "sql", sql, "rows", rows, "elapsed_ms", elapsedMillis(elapsed))
+	}
+}
+
+func elapsedMillis(elapsed time.Duration) float64 {
+	return float64(elapsed.Microseconds()) / 1000
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// SQL fingerprints
+
+var (
+	sqlStringLiteral = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlPlaceholder   = regexp.MustCompile(`\$\d+`)
+	sqlNumber        = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	sqlValueList     = regexp.MustCompile(`\?(?:\s*,\s*\?)+`)
+	sqlTupleList     = regexp.MustCompile(`\((?:\?|\?\.\.\.)\)(?:\s*,\s*\((?:\?|\?\.\.\.)\))+`)
+)
+
+// fingerprintSQL replaces every literal with ? so that the statement can be logged without its values
+func fingerprintSQL(sql string) string {
+	sql = sqlStringLiteral.ReplaceAllString(sql, "?")
+	sql = sqlPlaceholder.ReplaceAllString(sql, "?")
+	sql = sqlNumber.ReplaceAllString(sql, "?")
+	sql = sqlValueList.ReplaceAllString(sql, "?...")
+	sql = sqlTupleList.ReplaceAllString(sql, "(?...), ...")
+	return strings.Join(strings.Fields(sql), " ")
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// slow query report
+
+type SlowQuery struct {
+	SQL            string    `json:"sql"`
+	Count          int64     `json:"count"`
+	MaxMs          float64   `json:"max_ms"`
+	TotalMs        float64   `json:"total_ms"`
+	LastMs         float64   `json:"last_ms"`
+	LastRows       int64     `json:"last_rows"`
+	LastSeen       time.Time `json:"last_seen"`
+	SlowestRequest string    `json:"slowest_request_id,omitempty"`
+}
+
+// slowQueryReport keeps the topN slowest statements (by their slowest run), grouped by fingerprint
+type slowQueryReport struct {
+	mu      sync.Mutex
+	topN    int
+	entries map[string]*SlowQuery
+}
+
+func newSlowQueryReport(topN int) *slowQueryReport {
+	return &slowQueryReport{
+		topN:    topN,
+		entries: make(map[string]*SlowQuery),
+	}
+}
+
+func (r *slowQueryReport) record(fingerprint string, elapsed time.Duration, rows int64, requestID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ms := elapsedMillis(elapsed)
+	entry, ok := r.entries[fingerprint]
+	if !ok {
+		if len(r.entries) >= r.topN {
+			// full : the new statement only gets in if it is slower than the fastest entry
+			fastest := ""
+			for key, existing := range r.entries {
+				if fastest == "" || existing.MaxMs < r.entries[fastest].MaxMs {
+					fastest = key
+				}
+			}
+			if r.entries[fastest].MaxMs >= ms {
+				return
+			}
+			delete(r.entries, fastest)
+		}
+		entry = &SlowQuery{SQL: fingerprint}
+		r.entries[fingerprint] = entry
+	}
+
+	entry.Count++
+	entry.TotalMs += ms
+	entry.LastMs = ms
+	entry.LastRows = rows
+	entry.LastSeen = time.Now().UTC()
+	if ms >= entry.MaxMs {
+		entry.MaxMs = ms
+		entry.SlowestRequest = requestID
+	}
+}
+
+// Top returns the report, slowest first
+func (r *slowQueryReport) Top() []SlowQuery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	top := make([]SlowQuery, 0, len(r.entries))
+	for _, entry := range r.entries {
+		top = append(top, *entry)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].MaxMs > top[j].MaxMs
+	})
+	return top
+}
+
+func (r *slowQueryReport) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = make(map[string]*SlowQuery)
+}
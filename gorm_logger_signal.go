@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"gorm.io/gorm/logger"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchGormLogSignals switches the gorm log level on SIGUSR1 (info) and SIGUSR2 (configured level) until ctx is done
+func watchGormLogSignals(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-signals:
+				level := gormSettings.ConfiguredLevel()
+				if sig == syscall.SIGUSR1 {
+					level = logger.Info
+				}
+				gormSettings.SetLevel(level)
+				appLog.Info(ctx, "gorm log level changed", "signal", sig.String(), "level", gormLogLevelName(level))
+			}
+		}
+	}()
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"context"
+)
+
+// watchGormLogSignals does nothing on windows (no SIGUSR1 / SIGUSR2), use the admin endpoint
+func watchGormLogSignals(ctx context.Context) {
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+/*
+GraphQL endpoint
+
+POST /graphql with {"query": "...", "variables": {...}, "operationName": "..."} (GET /graphql?query=...
+works for queries too). The schema :
+
+	type User {
+		userId: String!
+		firstName: String!
+		lastName: String!
+		email: String!
+		phone: String!
+		active: Boolean!
+		balance: String!
+	}
+
+	type Query {
+		user(id: String!): User
+		users(filter: UserFilter, search: UserSearch, first: Int = 20, after: String): UserConnection!
+	}
+
+	type Mutation {
+		createUser(input: UserInput!): User!
+		upsertUser(input: UserInput!): User!
+		deleteUser(id: String!): Boolean!
+		migrate: Boolean!
+	}
+
+"users" is a cursor connection ordered by user_id ({ edges { cursor node { ... } } pageInfo { hasNextPage
+endCursor } }). The cursor is the base64 of the last user_id, so paging is keyset pagination and does
+not slow down on later pages. "first" is capped at 100.
+
+"search" goes through the same builders as the CLI search (getSQLQueryForExactSearch and
+getSQLQueryForNonExactPatternSearch), "filter" matches columns exactly, both can be combined.
+
+FYI : user(id) lookups are batched. Every user(id) field in a request returns a thunk, graphql-go runs
+the thunks after the fields of the same level are resolved, so
+
+	{ a: user(id: "1") { email } b: user(id: "2") { email } }
+
+is a single "SELECT ... WHERE user_id IN ('1','2')" (UserRepository.BatchGet) instead of 2 queries.
+
+The X-Request-ID header (or a new id) is the request_id of the log lines of the request, and is sent
+back in the response.
+
+Requests need an "Authorization: Bearer <jwt>" or an "X-API-Key" header (401 otherwise), every field
+checks the role of the caller (reader : user / users, editor : + createUser / upsertUser, admin : +
+deleteUser / migrate) and readers get phone and balance masked, see auth.go. Readers can't filter on
+a masked column, nor search for a phone number. migrate runs over all tenants, whatever the tenant of
+the admin calling it.
+*/
+
+const (
+	defaultGraphQLPageSize = 20
+	maxGraphQLPageSize     = 100
+	graphqlCursorPrefix    = "user_id:"
+)
+
+// userLoader batches the user(id) lookups of one request into a single BatchGet
+type userLoader struct {
+	ctx     context.Context
+	repo    *UserRepository
+	mu      sync.Mutex
+	pending []string
+	loaded  map[string]*User // nil value : user does not exist
+	failed  map[string]error // the error of the batch that was to load the user
+}
+
+type userLoaderKey struct{}
+
+func newUserLoader(ctx context.Context, repo *UserRepository) *userLoader {
+	return &userLoader{
+		ctx:    ctx,
+		repo:   repo,
+		loaded: make(map[string]*User),
+		failed: make(map[string]error),
+	}
+}
+
+// load queues userID and returns a thunk, the first thunk that runs fetches every queued user_id, a failed
+// fetch is the error of every thunk of the batch (not a null user)
+func (l *userLoader) load(userID string) func() (interface{}, error) {
+	l.mu.Lock()
+	if _, ok := l.loaded[userID]; !ok {
+		l.pending = append(l.pending, userID)
+	}
+	l.mu.Unlock()
+
+	return func() (interface{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if len(l.pending) > 0 {
+			userIDs := l.pending
+			l.pending = nil
+			users, missing, err := l.repo.BatchGet(l.ctx, userIDs)
+			if err != nil {
+				err = graphqlError(l.ctx, err)
+				for _, id := range userIDs {
+					l.failed[id] = err
+				}
+				return nil, err
+			}
+			for _, id := range userIDs {
+				delete(l.failed, id)
+			}
+			for i := range users {
+				l.loaded[users[i].UserID] = &users[i]
+			}
+			for _, id := range missing {
+				l.loaded[id] = nil
+			}
+		}
+
+		if err, ok := l.failed[userID]; ok {
+			return nil, err
+		}
+		user := l.loaded[userID]
+		if user == nil {
+			// a missing user is null, not an error
+			return nil, nil
+		}
+		return *user, nil
+	}
+}
+
+// graphqlError keeps the message of client errors and hides database errors
+func graphqlError(ctx context.Context, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrAlreadyExists), errors.Is(err, ErrInvalidArgument),
+		errors.Is(err, ErrUnauthenticated), errors.Is(err, ErrPermissionDenied), errors.Is(err, ErrStatementTimeout), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	default:
+		appLog.Error(ctx, "graphql resolver failed", "error", err)
+		return errors.New("internal error")
+	}
+}
+
+func encodeUserCursor(userID string) string {
+	return base64.StdEncoding.EncodeToString([]byte(graphqlCursorPrefix + userID))
+}
+
+func decodeUserCursor(cursor string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(decoded), graphqlCursorPrefix) {
+		return "", invalidArgument("invalid cursor ( %v )", cursor)
+	}
+	return strings.TrimPrefix(string(decoded), graphqlCursorPrefix), nil
+}
+
+func userField(value func(user User) interface{}, fieldType graphql.Output) *graphql.Field {
+	return &graphql.Field{
+		Type: graphql.NewNonNull(fieldType),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			user, ok := p.Source.(User)
+			if !ok {
+				return nil, fmt.Errorf("unexpected source ( %T )", p.Source)
+			}
+			return value(maskUser(p.Context, user)), nil
+		},
+	}
+}
+
+// userFilterScope matches the columns given in the "filter" argument exactly
+func userFilterScope(filter map[string]interface{}) func(db *gorm.DB) *gorm.DB {
+	columns := [][2]string{
+		{"firstName", "first_name"},
+		{"lastName", "last_name"},
+		{"email", "email"},
+		{"phone", "phone"},
+		{"active", "active"},
+	}
+	return func(db *gorm.DB) *gorm.DB {
+		if userIDs, ok := filter["userIds"].([]interface{}); ok {
+			db = db.Where("user_id IN ?", userIDs)
+		}
+		for _, column := range columns {
+			value, ok := filter[column[0]]
+			if !ok || value == nil {
+				continue
+			}
+			// email and phone may be encrypted, they are matched through their blind index
+			if text, isText := value.(string); isText {
+				if condition, encrypted := blindIndexCondition(column[1], text); encrypted {
+					db = db.Where(condition)
+					continue
+				}
+			}
+			db = db.Where(map[string]interface{}{column[1]: value})
+		}
+		return db
+	}
+}
+
+// userSearchScope turns the "search" argument into a searchFilter
+func userSearchScope(ctx context.Context, search map[string]interface{}) (func(db *gorm.DB) *gorm.DB, error) {
+	terms := make([]string, 0)
+	if values, ok := search["terms"].([]interface{}); ok {
+		for _, value := range values {
+			terms = append(terms, fmt.Sprintf("%v", value))
+		}
+	}
+	exact := search["mode"] != "PATTERN"
+	operator := SearchOR
+	if search["operator"] == "AND" {
+		operator = SearchAND
+	}
+
+	err := authorizeSearchTerms(ctx, terms)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := searchFilter(ctx, terms, exact, operator)
+	if err != nil {
+		return nil, invalidArgument("%v", err.Error())
+	}
+	return filter, nil
+}
+
+func userBasicFromInput(input map[string]interface{}) UserBasic {
+	userBasic := UserBasic{}
+	userBasic.UserID, _ = input["userId"].(string)
+	userBasic.FirstName, _ = input["firstName"].(string)
+	userBasic.LastName, _ = input["lastName"].(string)
+	userBasic.Email, _ = input["email"].(string)
+	userBasic.Phone, _ = input["phone"].(string)
+	userBasic.Active, _ = input["active"].(bool)
+	userBasic.Balance, _ = input["balance"].(string)
+	return userBasic
+}
+
+func newGraphQLSchema(repo *UserRepository) (graphql.Schema, error) {
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"userId":    userField(func(u User) interface{} { return u.UserID }, graphql.String),
+			"firstName": userField(func(u User) interface{} { return u.FirstName }, graphql.String),
+			"lastName":  userField(func(u User) interface{} { return u.LastName }, graphql.String),
+			"email":     userField(func(u User) interface{} { return u.Email }, graphql.String),
+			"phone":     userField(func(u User) interface{} { return u.Phone }, graphql.String),
+			"active":    userField(func(u User) interface{} { return u.Active }, graphql.Boolean),
+			"balance":   userField(func(u User) interface{} { return u.Balance }, graphql.String),
+		},
+	})
+
+	userEdgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserEdge",
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"node":   &graphql.Field{Type: graphql.NewNonNull(userType)},
+		},
+	})
+
+	pageInfoType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"endCursor":   &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	userConnectionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserConnection",
+		Fields: graphql.Fields{
+			"edges":    &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userEdgeType)))},
+			"pageInfo": &graphql.Field{Type: graphql.NewNonNull(pageInfoType)},
+		},
+	})
+
+	userFilterType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserFilter",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"userIds":   &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"firstName": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"lastName":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"email":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"phone":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"active":    &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+		},
+	})
+
+	searchModeType := graphql.NewEnum(graphql.EnumConfig{
+		Name: "SearchMode",
+		Values: graphql.EnumValueConfigMap{
+			"EXACT":   &graphql.EnumValueConfig{Value: "EXACT"},
+			"PATTERN": &graphql.EnumValueConfig{Value: "PATTERN"},
+		},
+	})
+
+	searchOperatorType := graphql.NewEnum(graphql.EnumConfig{
+		Name: "SearchOperator",
+		Values: graphql.EnumValueConfigMap{
+			"AND": &graphql.EnumValueConfig{Value: "AND"},
+			"OR":  &graphql.EnumValueConfig{Value: "OR"},
+		},
+	})
+
+	userSearchType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserSearch",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"terms":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"mode":     &graphql.InputObjectFieldConfig{Type: searchModeType, DefaultValue: "EXACT"},
+			"operator": &graphql.InputObjectFieldConfig{Type: searchOperatorType, DefaultValue: "OR"},
+		},
+	})
+
+	userInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"userId":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"firstName": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"lastName":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"email":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"phone":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"active":    &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+			"balance":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					err := authorize(p.Context, PermRead)
+					if err != nil {
+						return nil, graphqlError(p.Context, err)
+					}
+					loader, ok := p.Context.Value(userLoaderKey{}).(*userLoader)
+					if !ok {
+						loader = newUserLoader(p.Context, repo)
+					}
+					return loader.load(p.Args["id"].(string)), nil
+				},
+			},
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(userConnectionType),
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: userFilterType},
+					"search": &graphql.ArgumentConfig{Type: userSearchType},
+					"first":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultGraphQLPageSize},
+					"after":  &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return resolveUsersConnection(p, repo)
+				},
+			},
+		},
+	})
+
+	mutationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(userInputType)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					err := authorize(p.Context, PermWrite)
+					if err != nil {
+						return nil, graphqlError(p.Context, err)
+					}
+					input, _ := p.Args["input"].(map[string]interface{})
+					user, err := repo.Create(p.Context, userBasicFromInput(input))
+					if err != nil {
+						return nil, graphqlError(p.Context, err)
+					}
+					return user, nil
+				},
+			},
+			"upsertUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(userInputType)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					err := authorize(p.Context, PermWrite)
+					if err != nil {
+						return nil, graphqlError(p.Context, err)
+					}
+					input, _ := p.Args["input"].(map[string]interface{})
+					user, err := repo.Upsert(p.Context, userBasicFromInput(input))
+					if err != nil {
+						return nil, graphqlError(p.Context, err)
+					}
+					return user, nil
+				},
+			},
+			"deleteUser": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					err := authorize(p.Context, PermDelete)
+					if err != nil {
+						return nil, graphqlError(p.Context, err)
+					}
+					err = repo.Delete(p.Context, p.Args["id"].(string))
+					if errors.Is(err, ErrUserNotFound) {
+						return false, nil
+					}
+					if err != nil {
+						return nil, graphqlError(p.Context, err)
+					}
+					return true, nil
+				},
+			},
+			"migrate": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					err := authorize(p.Context, PermMigrate)
+					if err != nil {
+						return nil, graphqlError(p.Context, err)
+					}
+					// like "users migrate" : the table is shared, the rebuilds cover every tenant
+					err = repo.Migrate(contextWithTenant(p.Context, allTenants))
+					if err != nil {
+						return nil, graphqlError(p.Context, err)
+					}
+					return true, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    queryType,
+		Mutation: mutationType,
+	})
+}
+
+func resolveUsersConnection(p graphql.ResolveParams, repo *UserRepository) (interface{}, error) {
+	permission := PermRead
+	if _, ok := p.Args["search"].(map[string]interface{}); ok {
+		permission = PermSearch
+	}
+	err := authorize(p.Context, permission)
+	if err != nil {
+		return nil, err
+	}
+
+	first, _ := p.Args["first"].(int)
+	if first < 0 || first > maxGraphQLPageSize {
+		return nil, invalidArgument("first must be between 0 and %v", maxGraphQLPageSize)
+	}
+
+	scopes := make([]func(db *gorm.DB) *gorm.DB, 0, 2)
+	if filter, ok := p.Args["filter"].(map[string]interface{}); ok {
+		// filtering on a masked column would tell its value
+		if value, ok := filter["phone"]; ok && value != nil && columnMasked(p.Context, "phone") {
+			return nil, fmt.Errorf("%w : role can't filter on phone", ErrPermissionDenied)
+		}
+		scopes = append(scopes, userFilterScope(filter))
+	}
+	if search, ok := p.Args["search"].(map[string]interface{}); ok {
+		scope, err := userSearchScope(p.Context, search)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+
+	opts := ListOptions{
+		// one extra row tells whether there is a next page
+		Limit: first + 1,
+		Filter: func(db *gorm.DB) *gorm.DB {
+			return db.Scopes(scopes...)
+		},
+	}
+	if after, ok := p.Args["after"].(string); ok && after != "" {
+		afterUserID, err := decodeUserCursor(after)
+		if err != nil {
+			return nil, err
+		}
+		opts.AfterUserID = afterUserID
+	}
+
+	users, err := repo.List(p.Context, opts)
+	if err != nil {
+		return nil, graphqlError(p.Context, err)
+	}
+
+	hasNextPage := len(users) > first
+	if hasNextPage {
+		users = users[:first]
+	}
+
+	edges := make([]map[string]interface{}, 0, len(users))
+	for _, user := range users {
+		edges = append(edges, map[string]interface{}{
+			"cursor": encodeUserCursor(user.UserID),
+			"node":   user,
+		})
+	}
+
+	pageInfo := map[string]interface{}{
+		"hasNextPage": hasNextPage,
+		"endCursor":   nil,
+	}
+	if len(edges) > 0 {
+		pageInfo["endCursor"] = edges[len(edges)-1]["cursor"]
+	}
+
+	return map[string]interface{}{
+		"edges":    edges,
+		"pageInfo": pageInfo,
+	}, nil
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// hasMutation tells whether the query document contains a mutation, GET requests must not change data
+func hasMutation(query string) bool {
+	document, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		// graphql.Do reports the syntax error
+		return false
+	}
+	for _, definition := range document.Definitions {
+		if operation, ok := definition.(*ast.OperationDefinition); ok && operation.Operation == ast.OperationTypeMutation {
+			return true
+		}
+	}
+	return false
+}
+
+// graphqlHandler serves the schema on POST (json body) and GET (?query=...)
+func graphqlHandler(repo *UserRepository, auth *Authenticator) (http.Handler, error) {
+	schema, err := newGraphQLSchema(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req graphqlRequest
+		switch r.Method {
+		case http.MethodGet:
+			req.Query = r.URL.Query().Get("query")
+			req.OperationName = r.URL.Query().Get("operationName")
+			if variables := r.URL.Query().Get("variables"); variables != "" {
+				err := json.Unmarshal([]byte(variables), &req.Variables)
+				if err != nil {
+					http.Error(w, "invalid variables", http.StatusBadRequest)
+					return
+				}
+			}
+		case http.MethodPost:
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.Method == http.MethodGet && hasMutation(req.Query) {
+			http.Error(w, "mutations need a POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		ctx := contextWithRequestID(r.Context(), requestID)
+		principal, err := auth.authenticate(r.Header.Get("Authorization"), r.Header.Get("X-API-Key"))
+		if err != nil {
+			appLog.Warn(ctx, "graphql request not authenticated", "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="users"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		ctx = contextWithPrincipal(ctx, principal)
+		ctx = context.WithValue(ctx, userLoaderKey{}, newUserLoader(ctx, repo))
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			VariableValues: req.Variables,
+			OperationName:  req.OperationName,
+			Context:        ctx,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			appLog.Error(ctx, "graphql : could not write response", "error", err)
+		}
+	}), nil
+}
+
+// serveGraphQL serves /graphql, and the change feed on /changes when there is one, until ctx is done
+func serveGraphQL(ctx context.Context, repo *UserRepository, feed *ChangeFeed, auth *Authenticator, addr string) error {
+	handler, err := graphqlHandler(repo, auth)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/graphql", handler)
+	if feed != nil {
+		mux.Handle("/changes", changeFeedHandler(ctx, feed, auth))
+		appLog.Info(ctx, "change feed listening", "addr", addr, "path", "/changes")
+	}
+
+	appLog.Info(ctx, "graphql listening", "addr", addr, "path", "/graphql")
+	return serveHTTP(ctx, addr, mux)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUserLoaderBatchErrorForEveryThunk(t *testing.T) {
+	ctx := contextWithTenant(context.Background(), defaultTenantID)
+	loader := newUserLoader(ctx, NewUserRepository(unreachableDB(t)))
+
+	thunks := []func() (interface{}, error){loader.load("u1"), loader.load("u2"), loader.load("u3")}
+	for i, thunk := range thunks {
+		user, err := thunk()
+		if err == nil {
+			t.Errorf("thunk %v : the failed batch resolved to ( %v ) without an error", i, user)
+		}
+	}
+}
+
+func TestUserSearchScopeMaskedPhone(t *testing.T) {
+	reader := contextWithPrincipal(context.Background(), Principal{Role: RoleReader, Tenant: defaultTenantID})
+	editor := contextWithPrincipal(context.Background(), Principal{Role: RoleEditor, Tenant: defaultTenantID})
+
+	for _, test := range []struct {
+		ctx    context.Context
+		term   string
+		denied bool
+	}{
+		{reader, "+1 (957) 570-2414", true},
+		{reader, "570.555.2414", true},
+		{reader, "2414", true},
+		{reader, "Sonia", false},
+		{reader, "6285557743a8bdeb2aa5dc07", false},
+		{editor, "+1 (957) 570-2414", false},
+	} {
+		_, err := userSearchScope(test.ctx, map[string]interface{}{"terms": []interface{}{test.term}, "mode": "PATTERN"})
+		if denied := errors.Is(err, ErrPermissionDenied); denied != test.denied {
+			t.Errorf("search of %q : denied = %v , want %v ( %v )", test.term, denied, test.denied, err)
+		}
+	}
+}
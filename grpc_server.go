@@ -0,0 +1,428 @@
+package main
+
+//go:generate buf generate
+
+import (
+	"context"
+	"errors"
+	"go-gists/gorm-pgsql/userspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"io"
+	"net"
+	"time"
+)
+
+/*
+gRPC UserService
+
+The service is defined in userspb/users.proto (regenerate with "go generate" , needs buf,
+protoc-gen-go and protoc-gen-go-grpc in the PATH) and maps onto the UserBasic model and the
+UserRepository :
+
+	Get        -> UserRepository.Get
+	BatchGet   -> UserRepository.BatchGet
+	Create     -> UserRepository.Create
+	Upsert     -> UserRepository.Upsert
+	Delete     -> UserRepository.Delete
+	List       -> UserRepository.ListEach   (server streaming, server-side cursor)
+	Search     -> UserRepository.SearchEach (server streaming, server-side cursor)
+	BulkImport -> bulkLoadUsers             (client streaming, COPY)
+	Migrate    -> UserRepository.Migrate    (admins only, over all tenants like "users migrate")
+
+Repository errors are mapped onto status codes by grpcStatusFromError.
+
+Every call is authenticated ("authorization: Bearer <jwt>" or "x-api-key" metadata) and checked
+against grpcMethodPermissions, readers get phone and balance masked (see auth.go).
+
+Every call gets a request id (the "x-request-id" metadata of the call, or a new one), it is sent back
+in the response header and shows up as request_id in every log line of the call.
+
+Run it with :
+
+	users serve -grpc-addr :50051
+*/
+
+// maxBulkImportRejections caps the rejections sent back in a BulkImportResponse
+const maxBulkImportRejections = 1000
+
+type userServiceServer struct {
+	userspb.UnimplementedUserServiceServer
+	db   *gorm.DB
+	repo *UserRepository
+}
+
+// requestIDMetadataKey is the metadata key carrying the request id, in both directions
+const requestIDMetadataKey = "x-request-id"
+
+// grpcRequestContext adds the caller's request id (or a new one) to ctx and sends it back in the header
+func grpcRequestContext(ctx context.Context) context.Context {
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(requestIDMetadataKey); len(values) > 0 {
+			requestID = values[0]
+		}
+	}
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadataKey, requestID))
+	return contextWithRequestID(ctx, requestID)
+}
+
+func requestIDUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(grpcRequestContext(ctx), req)
+}
+
+// contextServerStream overrides Context() so that stream handlers see the request id (and the caller)
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func requestIDStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &contextServerStream{ServerStream: ss, ctx: grpcRequestContext(ss.Context())})
+}
+
+// grpcMethodPermissions is the permission needed by every method, a method missing here is denied
+var grpcMethodPermissions = map[string]Permission{
+	userspb.UserService_Get_FullMethodName:        PermRead,
+	userspb.UserService_BatchGet_FullMethodName:   PermRead,
+	userspb.UserService_List_FullMethodName:       PermRead,
+	userspb.UserService_Search_FullMethodName:     PermSearch,
+	userspb.UserService_Create_FullMethodName:     PermWrite,
+	userspb.UserService_Upsert_FullMethodName:     PermWrite,
+	userspb.UserService_BulkImport_FullMethodName: PermWrite,
+	userspb.UserService_Delete_FullMethodName:     PermDelete,
+	userspb.UserService_Migrate_FullMethodName:    PermMigrate,
+}
+
+// grpcAuthContext authenticates the caller of method and checks its permission
+func grpcAuthContext(ctx context.Context, auth *Authenticator, method string) (context.Context, error) {
+	var authorization, key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+		if values := md.Get("x-api-key"); len(values) > 0 {
+			key = values[0]
+		}
+	}
+
+	principal, err := auth.authenticate(authorization, key)
+	if err != nil {
+		appLog.Warn(ctx, "grpc call not authenticated", "method", method, "error", err)
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	}
+	ctx = contextWithPrincipal(ctx, principal)
+
+	permission, ok := grpcMethodPermissions[method]
+	if !ok {
+		return ctx, status.Error(codes.PermissionDenied, "unknown method")
+	}
+	err = authorize(ctx, permission)
+	if err != nil {
+		return ctx, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return ctx, nil
+}
+
+func authUnaryInterceptor(auth *Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := grpcAuthContext(ctx, auth, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func authStreamInterceptor(auth *Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := grpcAuthContext(ss.Context(), auth, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func newGRPCServer(db *gorm.DB, repo *UserRepository, auth *Authenticator, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(requestIDUnaryInterceptor, authUnaryInterceptor(auth)),
+		grpc.ChainStreamInterceptor(requestIDStreamInterceptor, authStreamInterceptor(auth)),
+	}, opts...)
+	server := grpc.NewServer(opts...)
+	userspb.RegisterUserServiceServer(server, &userServiceServer{
+		db:   db,
+		repo: repo,
+	})
+	return server
+}
+
+// serveGRPC serves the UserService on addr until ctx is done, then waits for the calls in flight
+// (up to serveShutdownTimeout, the remaining ones are cancelled)
+func serveGRPC(ctx context.Context, db *gorm.DB, repo *UserRepository, auth *Authenticator, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	appLog.Info(ctx, "grpc UserService listening", "addr", listener.Addr().String())
+
+	server := newGRPCServer(db, repo, auth)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(serveShutdownTimeout):
+		server.Stop()
+		<-stopped
+	}
+	return <-errs
+}
+
+func grpcStatusFromError(ctx context.Context, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrAlreadyExists), isUniqueViolation(err):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrInvalidArgument):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrStatementTimeout):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		appLog.Error(ctx, "grpc call failed", "error", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+}
+
+// userToProto masks the columns the caller in ctx may not see
+func userToProto(ctx context.Context, user User) *userspb.User {
+	user = maskUser(ctx, user)
+	return &userspb.User{
+		UserId:    user.UserID,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Email:     user.Email,
+		Phone:     user.Phone,
+		Active:    user.Active,
+		Balance:   user.Balance,
+	}
+}
+
+func userBasicFromProto(user *userspb.User) UserBasic {
+	if user == nil {
+		return UserBasic{}
+	}
+	return UserBasic{
+		UserID:    user.GetUserId(),
+		FirstName: user.GetFirstName(),
+		LastName:  user.GetLastName(),
+		Email:     user.GetEmail(),
+		Phone:     user.GetPhone(),
+		Active:    user.GetActive(),
+		Balance:   user.GetBalance(),
+	}
+}
+
+func (s *userServiceServer) Get(ctx context.Context, req *userspb.GetRequest) (*userspb.User, error) {
+	user, err := s.repo.Get(ctx, req.GetUserId())
+	if err != nil {
+		return nil, grpcStatusFromError(ctx, err)
+	}
+	return userToProto(ctx, user), nil
+}
+
+func (s *userServiceServer) BatchGet(ctx context.Context, req *userspb.BatchGetRequest) (*userspb.BatchGetResponse, error) {
+	users, missing, err := s.repo.BatchGet(ctx, req.GetUserIds())
+	if err != nil {
+		return nil, grpcStatusFromError(ctx, err)
+	}
+
+	resp := &userspb.BatchGetResponse{
+		Users:          make([]*userspb.User, 0, len(users)),
+		MissingUserIds: missing,
+	}
+	for _, user := range users {
+		resp.Users = append(resp.Users, userToProto(ctx, user))
+	}
+	return resp, nil
+}
+
+func (s *userServiceServer) Create(ctx context.Context, req *userspb.CreateRequest) (*userspb.User, error) {
+	user, err := s.repo.Create(ctx, userBasicFromProto(req.GetUser()))
+	if err != nil {
+		return nil, grpcStatusFromError(ctx, err)
+	}
+	return userToProto(ctx, user), nil
+}
+
+func (s *userServiceServer) Upsert(ctx context.Context, req *userspb.UpsertRequest) (*userspb.User, error) {
+	user, err := s.repo.Upsert(ctx, userBasicFromProto(req.GetUser()))
+	if err != nil {
+		return nil, grpcStatusFromError(ctx, err)
+	}
+	return userToProto(ctx, user), nil
+}
+
+func (s *userServiceServer) Delete(ctx context.Context, req *userspb.DeleteRequest) (*userspb.DeleteResponse, error) {
+	err := s.repo.Delete(ctx, req.GetUserId())
+	if err != nil {
+		return nil, grpcStatusFromError(ctx, err)
+	}
+	return &userspb.DeleteResponse{}, nil
+}
+
+func (s *userServiceServer) List(req *userspb.ListRequest, stream userspb.UserService_ListServer) error {
+	opts := ListOptions{
+		Limit:       int(req.GetLimit()),
+		AfterUserID: req.GetAfterUserId(),
+	}
+	err := s.repo.ListEach(stream.Context(), opts, func(user User) error {
+		return stream.Send(userToProto(stream.Context(), user))
+	})
+	return grpcStatusFromError(stream.Context(), err)
+}
+
+func (s *userServiceServer) Search(req *userspb.SearchRequest, stream userspb.UserService_SearchServer) error {
+	opts := SearchOptions{
+		Terms:    req.GetTerms(),
+		Exact:    req.GetMode() != userspb.SearchMode_SEARCH_MODE_PATTERN,
+		Operator: SearchOR,
+		Limit:    int(req.GetLimit()),
+	}
+	if req.GetOperator() == userspb.SearchOperator_SEARCH_OPERATOR_AND {
+		opts.Operator = SearchAND
+	}
+	if len(opts.Terms) == 0 {
+		return status.Error(codes.InvalidArgument, "please provide at least one search term")
+	}
+	err := authorizeSearchTerms(stream.Context(), opts.Terms)
+	if err != nil {
+		return grpcStatusFromError(stream.Context(), err)
+	}
+
+	err = s.repo.SearchEach(stream.Context(), opts, func(user User) error {
+		return stream.Send(userToProto(stream.Context(), user))
+	})
+	return grpcStatusFromError(stream.Context(), err)
+}
+
+func conflictModeFromProto(conflict userspb.ConflictMode) ConflictMode {
+	switch conflict {
+	case userspb.ConflictMode_CONFLICT_MODE_SKIP:
+		return ConflictSkip
+	case userspb.ConflictMode_CONFLICT_MODE_FAIL:
+		return ConflictFail
+	default:
+		return ConflictUpdate
+	}
+}
+
+// bulkImportStreamReader turns the client stream into a UserReader for bulkLoadUsers
+type bulkImportStreamReader struct {
+	stream  userspb.UserService_BulkImportServer
+	pending []*userspb.User
+}
+
+func (r *bulkImportStreamReader) Next() (UserBasic, error) {
+	for len(r.pending) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			// io.EOF once the client is done sending
+			return UserBasic{}, err
+		}
+		r.pending = req.GetUsers()
+	}
+	user := r.pending[0]
+	r.pending = r.pending[1:]
+	return userBasicFromProto(user), nil
+}
+
+func (s *userServiceServer) BulkImport(stream userspb.UserService_BulkImportServer) error {
+	// the first message carries the conflict mode, its users are the first ones loaded
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return stream.SendAndClose(&userspb.BulkImportResponse{})
+	}
+	if err != nil {
+		return err
+	}
+
+	resp := &userspb.BulkImportResponse{}
+	reader := &bulkImportStreamReader{
+		stream:  stream,
+		pending: first.GetUsers(),
+	}
+
+	stats, err := bulkLoadUsers(stream.Context(), s.db, reader, BulkLoadOptions{
+		Conflict: conflictModeFromProto(first.GetConflict()),
+		// COPY goes around the repository, the users of every committed chunk leave the cache here
+		OnChunk: func(userIDs []string) {
+			for _, userID := range userIDs {
+				s.repo.invalidate(stream.Context(), userID)
+			}
+		},
+		OnReject: func(user UserBasic, err error) {
+			if len(resp.Rejections) < maxBulkImportRejections {
+				resp.Rejections = append(resp.Rejections, &userspb.BulkImportRejection{
+					UserId: user.UserID,
+					Error:  err.Error(),
+				})
+			}
+		},
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return grpcStatusFromError(stream.Context(), err)
+	}
+
+	resp.Read = stats.Read
+	resp.Inserted = stats.Inserted
+	resp.Updated = stats.Updated
+	resp.Skipped = stats.Skipped
+	resp.Rejected = stats.Rejected
+	return stream.SendAndClose(resp)
+}
+
+func (s *userServiceServer) Migrate(ctx context.Context, req *userspb.MigrateRequest) (*userspb.MigrateResponse, error) {
+	// the table (and the string_rep / key rebuilds) are shared by every tenant, not only the caller's rows
+	err := s.repo.Migrate(contextWithTenant(ctx, allTenants))
+	if err != nil {
+		return nil, grpcStatusFromError(ctx, err)
+	}
+	appLog.Info(ctx, "user_records migrated through grpc")
+	return &userspb.MigrateResponse{}, nil
+}
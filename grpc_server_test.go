@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"go-gists/gorm-pgsql/userspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"io"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+/*
+The UserService runs in-process over a bufconn listener, with an api key per role. The status codes
+that don't need postgres (InvalidArgument, PermissionDenied, Unauthenticated) are checked against a
+database that is never reached, the others are skipped without USERS_TEST_DSN (see main_test.go).
+*/
+
+const bufconnSize = 1024 * 1024
+
+type grpcTestClient struct {
+	userspb.UserServiceClient
+	keys map[Role]string
+}
+
+// as is a context calling with the api key of role
+func (c grpcTestClient) as(role Role) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "x-api-key", c.keys[role])
+}
+
+// startGRPCTestServer serves the UserService of db on a bufconn listener, the api keys are of tenantID
+func startGRPCTestServer(t *testing.T, db *gorm.DB, tenantID string) grpcTestClient {
+	t.Helper()
+	return startGRPCTestServerWithRepository(t, db, NewUserRepository(db), tenantID)
+}
+
+func startGRPCTestServerWithRepository(t *testing.T, db *gorm.DB, repo *UserRepository, tenantID string) grpcTestClient {
+	t.Helper()
+	auth := &Authenticator{}
+	keys := make(map[Role]string)
+	for _, role := range []Role{RoleReader, RoleEditor, RoleAdmin} {
+		key, _, err := newAPIKey("test-"+role.String(), role, tenantID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha256.Sum256([]byte(key))
+		auth.apiKeys = append(auth.apiKeys, apiKey{name: "test-" + role.String(), hash: hash[:], role: role, tenant: tenantID})
+		keys[role] = key
+	}
+
+	listener := bufconn.Listen(bufconnSize)
+	server := newGRPCServer(db, repo, auth)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return grpcTestClient{UserServiceClient: userspb.NewUserServiceClient(conn), keys: keys}
+}
+
+// unreachableDB is a database that is never connected to, for the calls rejected before any query
+func unreachableDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 port=1 connect_timeout=1"}), &gorm.Config{DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func requireCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("expected %v , got ( %v )", code, err)
+	}
+}
+
+// receiveAll reads a server stream until io.EOF
+func receiveAll(t *testing.T, recv func() (*userspb.User, error)) []string {
+	t.Helper()
+	userIDs := make([]string, 0)
+	for {
+		user, err := recv()
+		if errors.Is(err, io.EOF) {
+			return userIDs
+		}
+		if err != nil {
+			t.Fatalf("stream failed : %v", err)
+		}
+		userIDs = append(userIDs, user.GetUserId())
+	}
+}
+
+func TestGRPCInvalidArgument(t *testing.T) {
+	client := startGRPCTestServer(t, unreachableDB(t), defaultTenantID)
+	ctx := client.as(RoleAdmin)
+
+	_, err := client.Get(ctx, &userspb.GetRequest{})
+	requireCode(t, err, codes.InvalidArgument)
+
+	_, err = client.Create(ctx, &userspb.CreateRequest{User: &userspb.User{FirstName: "no user_id"}})
+	requireCode(t, err, codes.InvalidArgument)
+
+	_, err = client.Upsert(ctx, &userspb.UpsertRequest{User: &userspb.User{UserId: " "}})
+	requireCode(t, err, codes.InvalidArgument)
+
+	_, err = client.Delete(ctx, &userspb.DeleteRequest{})
+	requireCode(t, err, codes.InvalidArgument)
+
+	stream, err := client.Search(ctx, &userspb.SearchRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	requireCode(t, err, codes.InvalidArgument)
+}
+
+func TestGRPCPermissionDenied(t *testing.T) {
+	client := startGRPCTestServer(t, unreachableDB(t), defaultTenantID)
+
+	_, err := client.Create(client.as(RoleReader), &userspb.CreateRequest{User: &userspb.User{UserId: "u1"}})
+	requireCode(t, err, codes.PermissionDenied)
+
+	_, err = client.Upsert(client.as(RoleReader), &userspb.UpsertRequest{User: &userspb.User{UserId: "u1"}})
+	requireCode(t, err, codes.PermissionDenied)
+
+	_, err = client.Delete(client.as(RoleEditor), &userspb.DeleteRequest{UserId: "u1"})
+	requireCode(t, err, codes.PermissionDenied)
+
+	_, err = client.Migrate(client.as(RoleEditor), &userspb.MigrateRequest{})
+	requireCode(t, err, codes.PermissionDenied)
+
+	importStream, err := client.BulkImport(client.as(RoleReader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = importStream.CloseAndRecv()
+	requireCode(t, err, codes.PermissionDenied)
+}
+
+func TestGRPCReaderCantSearchPhones(t *testing.T) {
+	client := startGRPCTestServer(t, unreachableDB(t), defaultTenantID)
+
+	for _, req := range []*userspb.SearchRequest{
+		{Terms: []string{"+1 (957) 570-2414"}},
+		{Terms: []string{"Sonia", "2414"}, Mode: userspb.SearchMode_SEARCH_MODE_PATTERN},
+	} {
+		stream, err := client.Search(client.as(RoleReader), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = stream.Recv()
+		requireCode(t, err, codes.PermissionDenied)
+	}
+
+	// names are fine, and editors see the phone : both get past the check (to the unreachable database)
+	for _, role := range []Role{RoleReader, RoleEditor} {
+		terms := []string{"Sonia"}
+		if role == RoleEditor {
+			terms = []string{"570-2414"}
+		}
+		stream, err := client.Search(client.as(role), &userspb.SearchRequest{Terms: terms})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = stream.Recv()
+		if status.Code(err) == codes.PermissionDenied {
+			t.Errorf("%v search of %v denied ( %v )", role, terms, err)
+		}
+	}
+}
+
+func TestGRPCUnauthenticated(t *testing.T) {
+	client := startGRPCTestServer(t, unreachableDB(t), defaultTenantID)
+
+	_, err := client.Get(context.Background(), &userspb.GetRequest{UserId: "u1"})
+	requireCode(t, err, codes.Unauthenticated)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "usr_not_a_key")
+	_, err = client.Get(ctx, &userspb.GetRequest{UserId: "u1"})
+	requireCode(t, err, codes.Unauthenticated)
+}
+
+func TestGRPCUsers(t *testing.T) {
+	db := openTestDB(t)
+	tenantID, _ := tenantFromContext(testTenant(t, db))
+	client := startGRPCTestServer(t, db, tenantID)
+	ctx := client.as(RoleEditor)
+
+	_, err := client.Get(ctx, &userspb.GetRequest{UserId: "missing"})
+	requireCode(t, err, codes.NotFound)
+
+	created, err := client.Create(ctx, &userspb.CreateRequest{User: &userspb.User{UserId: "u1", FirstName: "Sonia", Phone: "+1 (957) 570-2414"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.GetLastName() != "NA" {
+		t.Fatalf("expected the default last name , got ( %v )", created.GetLastName())
+	}
+
+	_, err = client.Create(ctx, &userspb.CreateRequest{User: &userspb.User{UserId: "u1"}})
+	requireCode(t, err, codes.AlreadyExists)
+
+	// readers get the phone masked
+	got, err := client.Get(client.as(RoleReader), &userspb.GetRequest{UserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetFirstName() != "Sonia" || got.GetPhone() == "+1 (957) 570-2414" {
+		t.Fatalf("unexpected user for a reader ( %v )", got)
+	}
+
+	_, err = client.Delete(client.as(RoleAdmin), &userspb.DeleteRequest{UserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Delete(client.as(RoleAdmin), &userspb.DeleteRequest{UserId: "u1"})
+	requireCode(t, err, codes.NotFound)
+}
+
+func TestGRPCListAndSearch(t *testing.T) {
+	db := openTestDB(t)
+	tenantID, _ := tenantFromContext(testTenant(t, db))
+	client := startGRPCTestServer(t, db, tenantID)
+	ctx := client.as(RoleEditor)
+
+	for _, user := range []*userspb.User{
+		{UserId: "u1", FirstName: "Sonia", LastName: "Livingston"},
+		{UserId: "u2", FirstName: "Wendy", LastName: "Lawson"},
+		{UserId: "u3", FirstName: "Wendy", LastName: "Livingston"},
+	} {
+		_, err := client.Create(ctx, &userspb.CreateRequest{User: user})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := client.List(ctx, &userspb.ListRequest{AfterUserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveAll(t, list.Recv); !equalStrings(got, []string{"u2", "u3"}) {
+		t.Fatalf("list after u1 : expected [u2 u3] , got %v", got)
+	}
+
+	search := func(req *userspb.SearchRequest) []string {
+		stream, err := client.Search(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		userIDs := receiveAll(t, stream.Recv)
+		sort.Strings(userIDs)
+		return userIDs
+	}
+
+	got := search(&userspb.SearchRequest{Terms: []string{"Wendy", "Livingston"}, Operator: userspb.SearchOperator_SEARCH_OPERATOR_AND})
+	if !equalStrings(got, []string{"u3"}) {
+		t.Fatalf("exact AND search : expected [u3] , got %v", got)
+	}
+	got = search(&userspb.SearchRequest{Terms: []string{"Sonia", "Lawson"}})
+	if !equalStrings(got, []string{"u1", "u2"}) {
+		t.Fatalf("exact OR search : expected [u1 u2] , got %v", got)
+	}
+	got = search(&userspb.SearchRequest{Terms: []string{"ivings"}, Mode: userspb.SearchMode_SEARCH_MODE_PATTERN})
+	if !equalStrings(got, []string{"u1", "u3"}) {
+		t.Fatalf("pattern search : expected [u1 u3] , got %v", got)
+	}
+}
+
+func TestGRPCBulkImport(t *testing.T) {
+	db := openTestDB(t)
+	tenantID, _ := tenantFromContext(testTenant(t, db))
+	// a TTL longer than the test : a stale Get can only come from a missing invalidation
+	client := startGRPCTestServerWithRepository(t, db, NewUserRepository(db).WithCache(NewLRUCache(100, time.Hour)), tenantID)
+	ctx := client.as(RoleEditor)
+
+	_, err := client.Create(ctx, &userspb.CreateRequest{User: &userspb.User{UserId: "u1", FirstName: "Before"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := client.Get(ctx, &userspb.GetRequest{UserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.GetFirstName() != "Before" {
+		t.Fatalf("unexpected first name before the import ( %v )", cached.GetFirstName())
+	}
+
+	stream, err := client.BulkImport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []*userspb.BulkImportRequest{
+		{Conflict: userspb.ConflictMode_CONFLICT_MODE_UPDATE, Users: []*userspb.User{{UserId: "u1", FirstName: "After"}, {UserId: "u2"}}},
+		{Users: []*userspb.User{{FirstName: "no user_id"}, {UserId: "u3"}}},
+	}
+	for _, req := range requests {
+		err = stream.Send(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.GetRead() != 4 || resp.GetInserted() != 2 || resp.GetUpdated() != 1 || resp.GetRejected() != 1 {
+		t.Fatalf("unexpected import counts ( %v )", resp)
+	}
+	if len(resp.GetRejections()) != 1 || resp.GetRejections()[0].GetError() == "" {
+		t.Fatalf("expected one rejection with its error , got ( %v )", resp.GetRejections())
+	}
+
+	updated, err := client.Get(ctx, &userspb.GetRequest{UserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.GetFirstName() != "After" {
+		t.Fatalf("expected the imported first name , got ( %v )", updated.GetFirstName())
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
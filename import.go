@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+Import users from JSON, NDJSON and CSV files
+
+Supported formats :
+
+	json   : a single JSON array of objects ( [ {...}, {...} ] ), decoded one element at a time
+	ndjson : one JSON object per line
+	csv    : the first row holds the field names
+
+Every input field is mapped to a user_records column through a FieldMapping, by default :
+
+	_id        -> user_id
+	first_name -> first_name
+	last_name  -> last_name
+	email      -> email
+	phone      -> phone
+	isActive   -> active
+	balance    -> balance
+
+(column names map to themselves, so an export of user_records can be imported back as-is)
+
+A record that can't be decoded or fails validation does not stop the import, it is written to the
+reject file (one JSON object per line) together with the reason and the raw record.
+
+Dry-run mode reads the whole input and compares it with what is in user_records, reporting the rows
+that would be inserted or updated (with the changed columns) without writing anything.
+
+Usage :
+
+	gorm-pgsql import -file users.csv -mapping "id=user_id,is_active=active" -reject-file rejects.ndjson
+	gorm-pgsql import -file users.ndjson -dry-run
+*/
+
+type ImportFormat string
+
+const (
+	ImportJSON   ImportFormat = "json"
+	ImportNDJSON ImportFormat = "ndjson"
+	ImportCSV    ImportFormat = "csv"
+)
+
+// FieldMapping maps input field names to user_records column names
+type FieldMapping map[string]string
+
+func defaultFieldMapping() FieldMapping {
+	return FieldMapping{
+		"_id":        "user_id",
+		"isActive":   "active",
+		"user_id":    "user_id",
+		"first_name": "first_name",
+		"last_name":  "last_name",
+		"email":      "email",
+		"phone":      "phone",
+		"active":     "active",
+		"balance":    "balance",
+	}
+}
+
+// parseFieldMapping parses "field=column,field=column" on top of the default mapping
+func parseFieldMapping(mapping string) (FieldMapping, error) {
+	fieldMapping := defaultFieldMapping()
+	if strings.TrimSpace(mapping) == "" {
+		return fieldMapping, nil
+	}
+	for _, pair := range strings.Split(mapping, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid field mapping ( %v ) , expected field=column", pair)
+		}
+		column := strings.TrimSpace(parts[1])
+		if _, ok := userColumnSetters[column]; !ok {
+			return nil, fmt.Errorf("invalid field mapping ( %v ) , unknown column ( %v )", pair, column)
+		}
+		fieldMapping[strings.TrimSpace(parts[0])] = column
+	}
+	return fieldMapping, nil
+}
+
+// RecordError is a problem with a single input record, the rest of the input can still be read
+type RecordError struct {
+	Record int    // 1-based position of the record in the input
+	Raw    string // the record as it was read
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %v : %v", e.Record, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// userColumnSetters converts an input value and sets it on the matching UserBasic field
+var userColumnSetters = map[string]func(user *UserBasic, value interface{}) error{
+	"user_id":    func(user *UserBasic, value interface{}) (err error) { user.UserID, err = toString(value); return },
+	"first_name": func(user *UserBasic, value interface{}) (err error) { user.FirstName, err = toString(value); return },
+	"last_name":  func(user *UserBasic, value interface{}) (err error) { user.LastName, err = toString(value); return },
+	"email":      func(user *UserBasic, value interface{}) (err error) { user.Email, err = toString(value); return },
+	"phone":      func(user *UserBasic, value interface{}) (err error) { user.Phone, err = toString(value); return },
+	"active":     func(user *UserBasic, value interface{}) (err error) { user.Active, err = toBool(value); return },
+	"balance":    func(user *UserBasic, value interface{}) (err error) { user.Balance, err = toString(value); return },
+}
+
+func toString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("expected a string, got ( %T )", value)
+	}
+}
+
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return false, nil
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return false, fmt.Errorf("expected a boolean, got ( %v )", v)
+		}
+		return b, nil
+	default:
+		return false, fmt.Errorf("expected a boolean, got ( %T )", value)
+	}
+}
+
+// userBasicFromRecord maps a decoded record onto UserBasic, collecting every field error
+func userBasicFromRecord(record map[string]interface{}, mapping FieldMapping) (UserBasic, error) {
+	var user UserBasic
+	fieldErrors := make([]string, 0)
+
+	for field, value := range record {
+		column, ok := mapping[field]
+		if !ok {
+			continue
+		}
+		err := userColumnSetters[column](&user, value)
+		if err != nil {
+			fieldErrors = append(fieldErrors, fmt.Sprintf("field ( %v ) : %v", field, err.Error()))
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		return user, errors.New(strings.Join(fieldErrors, " ; "))
+	}
+
+	return user, validateUserBasic(user)
+}
+
+func newImportReader(r io.Reader, format ImportFormat, mapping FieldMapping) (UserReader, error) {
+	switch format {
+	case ImportJSON:
+		return newJSONUserReader(r, mapping), nil
+	case ImportNDJSON:
+		return newNDJSONUserReader(r, mapping), nil
+	case ImportCSV:
+		return newCSVUserReader(r, mapping)
+	default:
+		return nil, fmt.Errorf("unsupported import format ( %v ) , please use json, ndjson or csv", format)
+	}
+}
+
+// importFormatFromFileName guesses the format from the file extension
+func importFormatFromFileName(fileName string) (ImportFormat, error) {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return ImportJSON, nil
+	case ".ndjson", ".jsonl":
+		return ImportNDJSON, nil
+	case ".csv":
+		return ImportCSV, nil
+	default:
+		return "", fmt.Errorf("could not guess the format of ( %v ) , please provide -format", fileName)
+	}
+}
+
+func decodeJSONRecord(raw []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	record := make(map[string]interface{})
+	err := decoder.Decode(&record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// jsonUserReader reads a JSON array one element at a time, so the whole file is never held in memory
+type jsonUserReader struct {
+	decoder *json.Decoder
+	mapping FieldMapping
+	started bool
+	record  int
+}
+
+func newJSONUserReader(r io.Reader, mapping FieldMapping) *jsonUserReader {
+	return &jsonUserReader{
+		decoder: json.NewDecoder(r),
+		mapping: mapping,
+	}
+}
+
+func (r *jsonUserReader) Next() (UserBasic, error) {
+	if !r.started {
+		token, err := r.decoder.Token()
+		if err != nil {
+			return UserBasic{}, fmt.Errorf("could not read json array : %w", err)
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return UserBasic{}, errors.New("could not read json array : input does not start with '['")
+		}
+		r.started = true
+	}
+
+	if !r.decoder.More() {
+		return UserBasic{}, io.EOF
+	}
+
+	var raw json.RawMessage
+	err := r.decoder.Decode(&raw)
+	if err != nil {
+		// a syntax error leaves the decoder somewhere in the middle of the array, there is no way to carry on
+		return UserBasic{}, fmt.Errorf("could not read json array : %w", err)
+	}
+	r.record++
+
+	record, err := decodeJSONRecord(raw)
+	if err != nil {
+		return UserBasic{}, &RecordError{Record: r.record, Raw: string(raw), Err: err}
+	}
+
+	user, err := userBasicFromRecord(record, r.mapping)
+	if err != nil {
+		return user, &RecordError{Record: r.record, Raw: string(raw), Err: err}
+	}
+	return user, nil
+}
+
+type ndjsonUserReader struct {
+	scanner *bufio.Scanner
+	mapping FieldMapping
+	record  int
+}
+
+func newNDJSONUserReader(r io.Reader, mapping FieldMapping) *ndjsonUserReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &ndjsonUserReader{
+		scanner: scanner,
+		mapping: mapping,
+	}
+}
+
+func (r *ndjsonUserReader) Next() (UserBasic, error) {
+	for r.scanner.Scan() {
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		r.record++
+
+		record, err := decodeJSONRecord(line)
+		if err != nil {
+			return UserBasic{}, &RecordError{Record: r.record, Raw: string(line), Err: err}
+		}
+
+		user, err := userBasicFromRecord(record, r.mapping)
+		if err != nil {
+			return user, &RecordError{Record: r.record, Raw: string(line), Err: err}
+		}
+		return user, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return UserBasic{}, fmt.Errorf("could not read ndjson : %w", err)
+	}
+	return UserBasic{}, io.EOF
+}
+
+type csvUserReader struct {
+	reader  *csv.Reader
+	header  []string
+	mapping FieldMapping
+	record  int
+}
+
+func newCSVUserReader(r io.Reader, mapping FieldMapping) (*csvUserReader, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = false
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read csv header : %w", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	return &csvUserReader{
+		reader:  reader,
+		header:  header,
+		mapping: mapping,
+	}, nil
+}
+
+func (r *csvUserReader) Next() (UserBasic, error) {
+	row, err := r.reader.Read()
+	if err == io.EOF {
+		return UserBasic{}, io.EOF
+	}
+	r.record++
+
+	var parseErr *csv.ParseError
+	if err != nil && errors.As(err, &parseErr) {
+		return UserBasic{}, &RecordError{Record: r.record, Raw: strings.Join(row, ","), Err: err}
+	}
+	if err != nil {
+		return UserBasic{}, fmt.Errorf("could not read csv : %w", err)
+	}
+
+	record := make(map[string]interface{}, len(r.header))
+	for i, field := range r.header {
+		record[field] = row[i]
+	}
+
+	user, err := userBasicFromRecord(record, r.mapping)
+	if err != nil {
+		return user, &RecordError{Record: r.record, Raw: strings.Join(row, ","), Err: err}
+	}
+	return user, nil
+}
+
+// ImportReject is one line of the reject file
+type ImportReject struct {
+	Record int    `json:"record,omitempty"`
+	UserID string `json:"user_id,omitempty"`
+	Error  string `json:"error"`
+	Raw    string `json:"raw,omitempty"`
+}
+
+func newImportReject(user UserBasic, err error) ImportReject {
+	reject := ImportReject{
+		UserID: user.UserID,
+		Error:  err.Error(),
+	}
+	var recordErr *RecordError
+	if errors.As(err, &recordErr) {
+		reject.Record = recordErr.Record
+		reject.Raw = recordErr.Raw
+		reject.Error = recordErr.Err.Error()
+	}
+	return reject
+}
+
+type FieldChange struct {
+	Column string
+	Old    interface{}
+	New    interface{}
+}
+
+// UserChange is what a dry-run import would do to one user
+type UserChange struct {
+	UserID string
+	Op     string // insert, update or skip
+	Fields []FieldChange
+}
+
+type ImportOptions struct {
+	Format     ImportFormat
+	Mapping    FieldMapping
+	Conflict   ConflictMode
+	ChunkSize  int
+	DryRun     bool
+	Rejects    io.Writer // reject file, one ImportReject per line (optional)
+	OnProgress func(stats BulkLoadStats)
+	OnChange   func(change UserChange) // dry-run only
+}
+
+type ImportReport struct {
+	BulkLoadStats
+	DryRun    bool
+	Unchanged int64 // dry-run only : existing rows that already hold the same values
+}
+
+func importUsers(ctx context.Context, db *gorm.DB, r io.Reader, opts ImportOptions) (ImportReport, error) {
+	report := ImportReport{DryRun: opts.DryRun}
+
+	if opts.Mapping == nil {
+		opts.Mapping = defaultFieldMapping()
+	}
+
+	reader, err := newImportReader(r, opts.Format, opts.Mapping)
+	if err != nil {
+		return report, err
+	}
+
+	var rejectEncoder *json.Encoder
+	if opts.Rejects != nil {
+		rejectEncoder = json.NewEncoder(opts.Rejects)
+	}
+	onReject := func(user UserBasic, err error) {
+		if rejectEncoder == nil {
+			return
+		}
+		if encodeErr := rejectEncoder.Encode(newImportReject(user, err)); encodeErr != nil {
+			appLog.Error(ctx, "could not write reject", "user_id", user.UserID, "error", encodeErr)
+		}
+	}
+
+	if opts.DryRun {
+		return dryRunImport(ctx, db, reader, opts, onReject)
+	}
+
+	stats, err := bulkLoadUsers(ctx, db, reader, BulkLoadOptions{
+		Conflict:   opts.Conflict,
+		ChunkSize:  opts.ChunkSize,
+		OnProgress: opts.OnProgress,
+		OnReject:   onReject,
+	})
+	report.BulkLoadStats = stats
+	return report, err
+}
+
+// dryRunImport compares the input with user_records, one chunk of user_ids at a time
+func dryRunImport(ctx context.Context, db *gorm.DB, reader UserReader, opts ImportOptions, onReject func(UserBasic, error)) (ImportReport, error) {
+	report := ImportReport{DryRun: true}
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultBulkLoadChunkSize
+	}
+
+	userSchema, err := getUserSchema(db)
+	if err != nil {
+		return report, err
+	}
+
+	// compared with the tenant the bulk loader would write to
+	tenantID, err := writeTenant(ctx)
+	if err != nil {
+		return report, invalidArgument("%v", err.Error())
+	}
+
+	// the last occurrence of a user_id wins, same as the bulk loader
+	chunk := make(map[string]UserBasic, chunkSize)
+	order := make([]string, 0, chunkSize)
+
+	flush := func() error {
+		if len(order) == 0 {
+			return nil
+		}
+
+		existingUsers := make([]User, 0, len(order))
+		err := withTimeout(ctx, db, OpRead, func(tx *gorm.DB) error {
+			return tx.Where("tenant_id = ? AND user_id IN ?", tenantID, order).Find(&existingUsers).Error
+		})
+		if err != nil {
+			return err
+		}
+		existing := make(map[string]UserBasic, len(existingUsers))
+		for _, user := range existingUsers {
+			existing[user.UserID] = user.UserBasic
+		}
+
+		for _, userID := range order {
+			incoming := chunk[userID]
+			current, found := existing[userID]
+			change := UserChange{UserID: userID}
+
+			switch {
+			case !found:
+				change.Op = "insert"
+				report.Inserted++
+			case opts.Conflict != ConflictUpdate:
+				change.Op = "skip"
+				report.Skipped++
+			default:
+				change.Fields = diffUserBasic(userSchema.Fields, current, incoming)
+				if len(change.Fields) == 0 {
+					report.Unchanged++
+					continue
+				}
+				change.Op = "update"
+				report.Updated++
+			}
+
+			if opts.OnChange != nil {
+				opts.OnChange(change)
+			}
+		}
+
+		if opts.OnProgress != nil {
+			opts.OnProgress(report.BulkLoadStats)
+		}
+
+		chunk = make(map[string]UserBasic, chunkSize)
+		order = order[:0]
+		return nil
+	}
+
+	for {
+		user, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		var recordErr *RecordError
+		if err != nil && !errors.As(err, &recordErr) {
+			return report, err
+		}
+		report.Read++
+
+		if err != nil {
+			report.Rejected++
+			onReject(user, err)
+			continue
+		}
+
+		applyUserDefaults(&user)
+		if _, seen := chunk[user.UserID]; seen {
+			report.Skipped++
+		} else {
+			order = append(order, user.UserID)
+		}
+		chunk[user.UserID] = user
+
+		if len(order) >= chunkSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	return report, flush()
+}
+
+// diffUserBasic lists the columns whose values differ between the existing and the incoming user
+func diffUserBasic(fields []*schema.Field, current UserBasic, incoming UserBasic) []FieldChange {
+	changes := make([]FieldChange, 0)
+	currentValue := reflect.ValueOf(&User{UserBasic: current}).Elem()
+	incomingValue := reflect.ValueOf(&User{UserBasic: incoming}).Elem()
+	for _, field := range fields {
+		if field.DBName == "" || field.PrimaryKey || isDerivedColumn(field.DBName) {
+			continue
+		}
+		oldValue := plainFieldValue(context.Background(), field, currentValue)
+		newValue := plainFieldValue(context.Background(), field, incomingValue)
+		if !reflect.DeepEqual(oldValue, newValue) {
+			changes = append(changes, FieldChange{Column: field.DBName, Old: oldValue, New: newValue})
+		}
+	}
+	return changes
+}
+
+func runImportCommand(ctx context.Context, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	fileName := flags.String("file", "", "input file (json, ndjson or csv), - for stdin")
+	format := flags.String("format", "", "input format : json, ndjson or csv (default : from the file extension)")
+	mapping := flags.String("mapping", "", "field mapping on top of the defaults, e.g. \"id=user_id,is_active=active\"")
+	rejectFile := flags.String("reject-file", "", "write rejected records to this file (ndjson)")
+	conflict := flags.String("conflict", "update", "what to do with existing user_ids : update, skip or fail (the chunks before the failing one stay committed)")
+	chunkSize := flags.Int("chunk-size", defaultBulkLoadChunkSize, "records per COPY / merge transaction")
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing anything")
+
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if *fileName == "" {
+		return usageErrorf("please provide -file")
+	}
+
+	importFormat := ImportFormat(strings.ToLower(*format))
+	if importFormat == "" {
+		if *fileName == "-" {
+			return usageErrorf("please provide -format when reading from stdin")
+		}
+		importFormat, err = importFormatFromFileName(*fileName)
+		if err != nil {
+			return usageErrorf("%v", err.Error())
+		}
+	}
+
+	fieldMapping, err := parseFieldMapping(*mapping)
+	if err != nil {
+		return usageErrorf("%v", err.Error())
+	}
+
+	conflictMode, err := parseConflictMode(*conflict)
+	if err != nil {
+		return usageErrorf("%v", err.Error())
+	}
+
+	input := os.Stdin
+	if *fileName != "-" {
+		input, err = os.Open(*fileName)
+		if err != nil {
+			return err
+		}
+		defer func(input *os.File) {
+			_ = input.Close()
+		}(input)
+	}
+
+	opts := ImportOptions{
+		Format:    importFormat,
+		Mapping:   fieldMapping,
+		Conflict:  conflictMode,
+		ChunkSize: *chunkSize,
+		DryRun:    *dryRun,
+		OnProgress: func(stats BulkLoadStats) {
+			appLog.Info(ctx, "import progress",
+				"read", stats.Read, "inserted", stats.Inserted, "updated", stats.Updated, "skipped", stats.Skipped, "rejected", stats.Rejected)
+		},
+		OnChange: func(change UserChange) {
+			appLog.Info(ctx, "dry-run change", "op", change.Op, "user_id", change.UserID)
+			for _, field := range change.Fields {
+				// old / new are masked the same way as the column itself
+				appLog.Info(ctx, "dry-run field change", "user_id", change.UserID, "column", field.Column,
+					"old", redactValue(field.Column, field.Old), "new", redactValue(field.Column, field.New))
+			}
+		},
+	}
+
+	if *rejectFile != "" {
+		rejects, err := os.Create(*rejectFile)
+		if err != nil {
+			return err
+		}
+		defer func(rejects *os.File) {
+			_ = rejects.Close()
+		}(rejects)
+		opts.Rejects = rejects
+	}
+
+	report, err := importUsers(ctx, db, input, opts)
+	if err != nil {
+		return err
+	}
+
+	msg := "import finished"
+	if report.DryRun {
+		msg = "import finished (dry-run, nothing written)"
+	}
+	appLog.Info(ctx, msg, "read", report.Read, "inserted", report.Inserted, "updated", report.Updated,
+		"unchanged", report.Unchanged, "skipped", report.Skipped, "rejected", report.Rejected)
+	return nil
+}
+
+func parseConflictMode(conflict string) (ConflictMode, error) {
+	switch strings.ToLower(conflict) {
+	case "update":
+		return ConflictUpdate, nil
+	case "skip":
+		return ConflictSkip, nil
+	case "fail":
+		return ConflictFail, nil
+	default:
+		return ConflictUpdate, fmt.Errorf("invalid conflict mode ( %v ) , please use update, skip or fail", conflict)
+	}
+}
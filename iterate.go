@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+)
+
+/*
+Streaming row iteration for large result sets
+
+db.Find(&users) loads every matching user into memory. UserIterator walks the same query with a
+server-side cursor instead, fetching ChunkSize rows at a time :
+
+	BEGIN READ ONLY;
+	DECLARE user_records_cursor NO SCROLL CURSOR FOR SELECT ... FROM user_records WHERE ... ORDER BY tenant_id, user_id;
+	FETCH FORWARD 1000 FROM user_records_cursor;   -- repeated until it returns no rows
+	CLOSE user_records_cursor;
+	ROLLBACK;
+
+Only one chunk is held in memory at any time, whatever the size of the table. The cursor lives in its
+own read-only transaction (so it sees one consistent snapshot) on a connection pinned for the lifetime
+of the iterator, always Close() it.
+
+Every FETCH runs with the iterator's context, cancelling the context stops the iteration and Err()
+returns the context error. Each FETCH also runs with the statement_timeout of opts.Operation.
+
+	it, err := iterateUsers(ctx, db, IterateOptions{ChunkSize: 1000})
+	if err != nil { ... }
+	defer it.Close()
+	for it.Next() {
+		user := it.User()
+		...
+	}
+	if err := it.Err(); err != nil { ... }
+*/
+
+const (
+	defaultIterateChunkSize = 1000
+	userCursorName          = "user_records_cursor"
+)
+
+type IterateOptions struct {
+	ChunkSize int                        // rows per FETCH, defaults to 1000
+	Columns   []string                   // columns to select, default : all
+	Filter    func(db *gorm.DB) *gorm.DB // optional, e.g. a search or list query
+	Operation Operation                  // statement_timeout of every FETCH, defaults to OpRead
+}
+
+type UserIterator struct {
+	ctx       context.Context
+	tx        *gorm.DB
+	chunkSize int
+	chunk     []User
+	pos       int
+	current   User
+	done      bool
+	closed    bool
+	err       error
+}
+
+func iterateUsers(ctx context.Context, db *gorm.DB, opts IterateOptions) (*UserIterator, error) {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultIterateChunkSize
+	}
+
+	userSchema, err := getUserSchema(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// build the SELECT without running it, the cursor declaration wraps it
+	query := db.Session(&gorm.Session{DryRun: true, NewDB: true}).WithContext(ctx).Model(&User{})
+	if opts.Filter != nil {
+		query = opts.Filter(query)
+	}
+	if len(opts.Columns) > 0 {
+		query = query.Select(opts.Columns)
+	}
+	for _, primaryKey := range userSchema.PrimaryFieldDBNames {
+		query = query.Order(primaryKey)
+	}
+	stmt := query.Find(&[]User{}).Statement
+	if stmt.Error != nil {
+		return nil, stmt.Error
+	}
+
+	tx := db.WithContext(ctx).Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	it := &UserIterator{
+		ctx:       ctx,
+		tx:        tx,
+		chunkSize: opts.ChunkSize,
+	}
+
+	err = tx.Exec("SET TRANSACTION READ ONLY").Error
+	if err != nil {
+		_ = it.Close()
+		return nil, err
+	}
+
+	// the timeout applies to each FETCH, not to the whole iteration
+	if timeout := statementTimeout(ctx, opts.Operation); timeout > 0 {
+		err = tx.Exec(setLocalStatementTimeout(timeout)).Error
+		if err != nil {
+			_ = it.Close()
+			return nil, err
+		}
+	}
+	err = setLocalTenant(ctx, tx)
+	if err != nil {
+		_ = it.Close()
+		return nil, err
+	}
+
+	// the SELECT already carries postgres placeholders ($1, $2 ...), so it goes straight to the transaction
+	declare := fmt.Sprintf("DECLARE %v NO SCROLL CURSOR FOR %v", userCursorName, stmt.SQL.String())
+	_, err = tx.Statement.ConnPool.ExecContext(ctx, declare, stmt.Vars...)
+	if err != nil {
+		_ = it.Close()
+		return nil, timeoutError(ctx, fmt.Errorf("could not declare cursor : %w", err))
+	}
+
+	return it, nil
+}
+
+// Next moves to the next user, fetching the next chunk from the cursor when needed
+func (it *UserIterator) Next() bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+
+	if it.pos >= len(it.chunk) {
+		if it.done {
+			return false
+		}
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			return false
+		}
+
+		it.chunk = it.chunk[:0]
+		it.pos = 0
+		err := it.tx.Raw(fmt.Sprintf("FETCH FORWARD %d FROM %v", it.chunkSize, userCursorName)).Scan(&it.chunk).Error
+		if err != nil {
+			it.err = timeoutError(it.ctx, err)
+			return false
+		}
+		if len(it.chunk) < it.chunkSize {
+			it.done = true
+		}
+		if len(it.chunk) == 0 {
+			return false
+		}
+	}
+
+	it.current = it.chunk[it.pos]
+	it.pos++
+	return true
+}
+
+func (it *UserIterator) User() User {
+	return it.current
+}
+
+func (it *UserIterator) Err() error {
+	return it.err
+}
+
+// Close releases the cursor and its connection, it is safe to call more than once
+func (it *UserIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	// rolling back a read-only transaction also closes the cursor
+	return it.tx.Rollback().Error
+}
+
+// forEachUser runs fn for every user matched by opts, stopping at the first error
+func forEachUser(ctx context.Context, db *gorm.DB, opts IterateOptions, fn func(user User) error) error {
+	it, err := iterateUsers(ctx, db, opts)
+	if err != nil {
+		return err
+	}
+	defer func(it *UserIterator) {
+		_ = it.Close()
+	}(it)
+
+	for it.Next() {
+		err = fn(it.User())
+		if err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+/*
+reindexStringRep recomputes "string_rep" and the blind indexes for every row, e.g. after changing
+getStringRep, turning field encryption on or changing the blind index key.
+
+Rows are read through a UserIterator and rewritten chunkSize rows per UPDATE, only the rows whose
+"string_rep" or blind indexes actually change are touched. The cursor only picks the rows : every chunk
+reads them again with FOR UPDATE in the transaction of its UPDATE, so an upsert that lands after the
+cursor read a row is never overwritten with derived columns of the old row.
+*/
+func reindexStringRep(ctx context.Context, db *gorm.DB, chunkSize int) (int64, error) {
+	return reindexUsers(ctx, db, chunkSize, nil)
+}
+
+// reindexUsers is reindexStringRep for the rows matched by filter (nil : every row)
+func reindexUsers(ctx context.Context, db *gorm.DB, chunkSize int, filter func(db *gorm.DB) *gorm.DB) (int64, error) {
+	var updated int64
+
+	if chunkSize <= 0 {
+		chunkSize = defaultIterateChunkSize
+	}
+
+	pending := make([][]interface{}, 0, chunkSize)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		err := withTimeout(ctx, db, OpWrite, func(tx *gorm.DB) error {
+			return tx.Transaction(func(tx *gorm.DB) error {
+				// the rows as they are now, locked : a write since the cursor read them is not overwritten
+				users := make([]User, 0, len(pending))
+				err := tx.Where("(tenant_id, user_id) IN ?", pending).Order("tenant_id").Order("user_id").
+					Clauses(clause.Locking{Strength: "UPDATE"}).Find(&users).Error
+				if err != nil || len(users) == 0 {
+					return err
+				}
+
+				placeholders := make([]string, 0, len(users))
+				values := make([]interface{}, 0, 5*len(users))
+				for _, user := range users {
+					user.setDerivedColumns()
+					placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+					values = append(values, user.TenantID, user.UserID, user.StringRep, user.EmailIndex, user.PhoneIndex)
+				}
+				sqlQuery := fmt.Sprintf(`UPDATE %v AS u SET string_rep = v.string_rep, email_bidx = v.email_bidx, phone_bidx = v.phone_bidx
+FROM (VALUES %v) AS v(tenant_id, user_id, string_rep, email_bidx, phone_bidx)
+WHERE u.tenant_id = v.tenant_id AND u.user_id = v.user_id AND (u.string_rep IS DISTINCT FROM v.string_rep
+	OR u.email_bidx IS DISTINCT FROM v.email_bidx OR u.phone_bidx IS DISTINCT FROM v.phone_bidx)`,
+					User{}.TableName(), strings.Join(placeholders, ", "))
+				result := tx.Exec(sqlQuery, values...)
+				updated += result.RowsAffected
+				return result.Error
+			})
+		})
+		if err != nil {
+			return err
+		}
+		pending = pending[:0]
+		return nil
+	}
+
+	err := forEachUser(ctx, db, IterateOptions{ChunkSize: chunkSize, Filter: filter, Operation: OpMigrate}, func(user User) error {
+		pending = append(pending, []interface{}{user.TenantID, user.UserID})
+		if len(pending) >= chunkSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return updated, err
+	}
+
+	err = flush()
+	if err != nil {
+		return updated, err
+	}
+
+	appLog.Info(ctx, "string_rep reindexed", "rows_updated", updated)
+	return updated, nil
+}
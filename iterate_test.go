@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestIterateUsersOrderAcrossChunks(t *testing.T) {
+	db := openTestDB(t)
+	first, second := testTenant(t, db), testTenant(t, db)
+
+	// created out of order, in two tenants, 23 users each : chunks of 4 split both
+	expected, tenants := make([]string, 0), make([]string, 0)
+	for _, ctx := range []context.Context{second, first} {
+		tenantID, _ := tenantFromContext(ctx)
+		tenants = append(tenants, tenantID)
+		for _, i := range rand.Perm(23) {
+			userID := fmt.Sprintf("u%02d", i)
+			_, err := NewUserRepository(db).Create(ctx, UserBasic{UserID: userID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, tenantID+"/"+userID)
+		}
+	}
+	sort.Strings(expected)
+
+	it, err := iterateUsers(contextWithTenant(context.Background(), allTenants), db, IterateOptions{
+		ChunkSize: 4,
+		Filter:    func(db *gorm.DB) *gorm.DB { return db.Where("tenant_id IN ?", tenants) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	iterated := make([]string, 0)
+	for it.Next() {
+		user := it.User()
+		iterated = append(iterated, user.TenantID+"/"+user.UserID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(iterated, expected) {
+		t.Errorf("iterated %v , want %v", iterated, expected)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Structured logging
+
+appLog is the one logger of the application, the gorm logger (AppLog) and the standard "log" package
+both write through it. Every record is one line :
+
+	{"time":"2022-05-19T10:04:05.123Z","level":"info","msg":"user created","request_id":"5f0c...","user_id":"6285..."}
+
+Call style is the same as log/slog : a message and then key / value pairs,
+
+	appLog.Info(ctx, "import finished", "read", stats.Read, "rejected", stats.Rejected)
+
+request_id and trace_id are taken from the context (see contextWithRequestID / contextWithTraceID),
+the gRPC server and the GraphQL handler put one in the context of every request, the CLI one per
+command.
+
+Configuration (environment) :
+
+	USERS_LOG_LEVEL  : debug, info (default), warn or error
+	USERS_LOG_FORMAT : json (default) or text (key=value, easier to read in a terminal)
+
+PII redaction : values are masked before they are written, whatever the call site does
+
+	email   : mandyknowles@hinway.com -> m***@hinway.com
+	phone   : +1 (926) 579-2448       -> +* (***) ***-**48
+	balance : $3,682.63               -> ***
+	string_rep                        -> [REDACTED]
+
+Keys named email / phone / balance / string_rep are always masked, UserBasic / User values are logged
+with the same masking (they implement logValuer), and emails, phone numbers and dollar amounts are
+also masked inside any free-form string (messages, SQL from the gorm logger, error text).
+
+A phone number inside free-form text needs separators or a leading '+' (570-555-2414, (957) 570-2414,
++15705552414) : a bare run of digits is an id or a timestamp far more often than a phone number.
+The identifiers (user_id, request_id, trace_id, tenant, event_id ... see logIdentifierKeys) are never
+masked, so that log lines can be correlated on them.
+*/
+
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+}
+
+func parseLogLevel(level string) (LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("invalid log level ( %v ) , please use debug, info, warn or error", level)
+	}
+}
+
+// logValuer lets a type decide how it is logged (e.g. with its PII masked)
+type logValuer interface {
+	LogValue() interface{}
+}
+
+type Logger struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level *int32
+	json  bool
+	attrs []interface{}
+}
+
+var appLog = NewLogger(os.Stderr, LevelInfo, true)
+
+func NewLogger(w io.Writer, level LogLevel, jsonFormat bool) *Logger {
+	lvl := int32(level)
+	return &Logger{
+		mu:    &sync.Mutex{},
+		w:     w,
+		level: &lvl,
+		json:  jsonFormat,
+	}
+}
+
+// With returns a logger that adds args (key / value pairs) to every record
+func (l *Logger) With(args ...interface{}) *Logger {
+	child := *l
+	child.attrs = append(append([]interface{}{}, l.attrs...), args...)
+	return &child
+}
+
+// SetLevel changes the level of l and of every logger derived from it with With
+func (l *Logger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+func (l *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(l.level))
+}
+
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.Level()
+}
+
+func (l *Logger) Debug(ctx context.Context, msg string, args ...interface{}) {
+	l.log(ctx, LevelDebug, msg, args...)
+}
+
+func (l *Logger) Info(ctx context.Context, msg string, args ...interface{}) {
+	l.log(ctx, LevelInfo, msg, args...)
+}
+
+func (l *Logger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	l.log(ctx, LevelWarn, msg, args...)
+}
+
+func (l *Logger) Error(ctx context.Context, msg string, args ...interface{}) {
+	l.log(ctx, LevelError, msg, args...)
+}
+
+func (l *Logger) log(ctx context.Context, level LogLevel, msg string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	keys := []string{"time", "level", "msg"}
+	values := []interface{}{time.Now().UTC().Format(time.RFC3339Nano), level.String(), redactString(msg)}
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		keys = append(keys, "request_id")
+		values = append(values, requestID)
+	}
+	if traceID := traceIDFromContext(ctx); traceID != "" {
+		keys = append(keys, "trace_id")
+		values = append(values, traceID)
+	}
+
+	all := append(append([]interface{}{}, l.attrs...), args...)
+	for i := 0; i < len(all); i += 2 {
+		key, ok := all[i].(string)
+		if !ok {
+			key = fmt.Sprintf("%v", all[i])
+		}
+		var value interface{} = "!MISSING"
+		if i+1 < len(all) {
+			value = all[i+1]
+		}
+		keys = append(keys, key)
+		values = append(values, redactValue(key, value))
+	}
+
+	var line []byte
+	if l.json {
+		line = encodeJSONRecord(keys, values)
+	} else {
+		line = encodeTextRecord(keys, values)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(line)
+}
+
+// encodeJSONRecord keeps the keys in call order (a map would sort them)
+func encodeJSONRecord(keys []string, values []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		keyBytes, _ := json.Marshal(key)
+		valueBytes, err := json.Marshal(values[i])
+		if err != nil {
+			valueBytes, _ = json.Marshal(fmt.Sprintf("%v", values[i]))
+		}
+		buf.Write(keyBytes)
+		buf.WriteByte(':')
+		buf.Write(valueBytes)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func encodeTextRecord(keys []string, values []interface{}) []byte {
+	var buf bytes.Buffer
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		value := fmt.Sprintf("%v", values[i])
+		if _, ok := values[i].(map[string]interface{}); ok {
+			valueBytes, _ := json.Marshal(values[i])
+			value = string(valueBytes)
+		}
+		if strings.ContainsAny(value, " \"=") || value == "" {
+			value = fmt.Sprintf("%q", value)
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// PII redaction
+
+var (
+	emailPattern   = regexp.MustCompile(`([A-Za-z0-9._%+\-])[A-Za-z0-9._%+\-]*@([A-Za-z0-9.\-]+\.[A-Za-z]{2,})`)
+	phonePattern   = regexp.MustCompile(`(?:\+\d{1,3}[\s\-.]?)?(?:\(\d{3}\)[\s\-.]?|\b\d{3}[\s\-.])\d{3}[\s\-.]\d{4}\b|\+\d{10,15}\b`)
+	balancePattern = regexp.MustCompile(`-?\$-?\d[\d,]*\.\d{2}`)
+	digitPattern   = regexp.MustCompile(`\d`)
+)
+
+const redacted = "[REDACTED]"
+
+// logIdentifierKeys are the keys logged as they are, they hold ids and never PII
+var logIdentifierKeys = map[string]bool{
+	"user_id":         true,
+	"after_user_id":   true,
+	"request_id":      true,
+	"trace_id":        true,
+	"span_id":         true,
+	"tenant":          true,
+	"tenant_id":       true,
+	"event_id":        true,
+	"delivery_id":     true,
+	"subscription_id": true,
+}
+
+func maskEmail(email string) string {
+	return emailPattern.ReplaceAllString(email, "$1***@$2")
+}
+
+// maskPhone keeps the formatting and the last 2 digits
+func maskPhone(phone string) string {
+	digits := len(digitPattern.FindAllString(phone, -1))
+	seen := 0
+	return digitPattern.ReplaceAllStringFunc(phone, func(digit string) string {
+		seen++
+		if seen > digits-2 {
+			return digit
+		}
+		return "*"
+	})
+}
+
+func maskBalance(string) string {
+	return "***"
+}
+
+// redactString masks emails, phone numbers and dollar amounts inside free-form text
+func redactString(s string) string {
+	s = emailPattern.ReplaceAllString(s, "$1***@$2")
+	s = phonePattern.ReplaceAllStringFunc(s, maskPhone)
+	s = balancePattern.ReplaceAllString(s, "***")
+	return s
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	if valuer, ok := value.(logValuer); ok {
+		value = valuer.LogValue()
+	}
+
+	if logIdentifierKeys[strings.ToLower(key)] {
+		if s, ok := value.(string); ok {
+			return s
+		}
+	}
+
+	switch strings.ToLower(key) {
+	case "email":
+		return maskEmail(fmt.Sprintf("%v", value))
+	case "phone":
+		return maskPhone(fmt.Sprintf("%v", value))
+	case "balance":
+		return maskBalance(fmt.Sprintf("%v", value))
+	case "string_rep", "stringrep":
+		return redacted
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return redactString(v)
+	case error:
+		return redactString(v.Error())
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v
+	case map[string]interface{}:
+		masked := make(map[string]interface{}, len(v))
+		for k, inner := range v {
+			masked[k] = redactValue(k, inner)
+		}
+		return masked
+	case []string:
+		masked := make([]string, 0, len(v))
+		for _, inner := range v {
+			masked = append(masked, redactString(inner))
+		}
+		return masked
+	case fmt.Stringer:
+		return redactString(v.String())
+	default:
+		return redactString(fmt.Sprintf("%v", v))
+	}
+}
+
+// LogValue logs a user with its PII masked (User gets it through UserBasic, string_rep is left out)
+func (u UserBasic) LogValue() interface{} {
+	return map[string]interface{}{
+		"user_id":    u.UserID,
+		"first_name": u.FirstName,
+		"last_name":  u.LastName,
+		"email":      u.Email,
+		"phone":      u.Phone,
+		"active":     u.Active,
+		"balance":    u.Balance,
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// request / trace ids
+
+type requestIDKey struct{}
+type traceIDKey struct{}
+
+func contextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+func contextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// traceIDFromContext prefers the trace id of the current span (tracing.go)
+func traceIDFromContext(ctx context.Context) string {
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		return spanContext.TraceID().String()
+	}
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+// newRequestID is 16 random bytes, hex encoded
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// standard "log" package
+
+// stdLogWriter sends what is still written with the standard "log" package through appLog
+type stdLogWriter struct {
+	logger *Logger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.logger.Info(context.Background(), strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRedactString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		// phone numbers : with separators or a leading '+'
+		{"call +1 (957) 570-2414 now", "call +* (***) ***-**14 now"},
+		{"phone 570-555-2414", "phone ***-***-**14"},
+		{"phone (957) 570-2414", "phone (***) ***-**14"},
+		{"phone 570.555.2414", "phone ***.***.**14"},
+		{"phone +15705552414", "phone +*********14"},
+		{"default 000-000-0000", "default ***-***-**00"},
+
+		// ids and timestamps are digit runs, not phone numbers
+		{"user 6285557743a8bdeb2aa5dc07", "user 6285557743a8bdeb2aa5dc07"},
+		{"user 628555774300000000000007", "user 628555774300000000000007"},
+		{"at 1652954645123", "at 1652954645123"},
+		{"bench0000000000000000001", "bench0000000000000000001"},
+		{"on 2022-05-19", "on 2022-05-19"},
+
+		// emails and amounts
+		{"mail sonialivingston@hinway.com", "mail s***@hinway.com"},
+		{"owes $1,174.11", "owes ***"},
+	}
+	for _, test := range tests {
+		if got := redactString(test.in); got != test.want {
+			t.Errorf("redactString(%q) = %q , want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRedactValueKeepsIdentifiers(t *testing.T) {
+	for _, key := range []string{"user_id", "request_id", "trace_id", "tenant", "event_id", "subscription_id"} {
+		for _, id := range []string{"6285557743a8bdeb2aa5dc07", "1652954645123", "570-555-2414"} {
+			if got := redactValue(key, id); got != id {
+				t.Errorf("redactValue(%q, %q) = %v , want it unchanged", key, id, got)
+			}
+		}
+	}
+
+	if got := redactValue("phone", "5705552414"); got != "********14" {
+		t.Errorf("the phone key is always masked , got %v", got)
+	}
+	if got := redactValue("error", errors.New("user 570-555-2414 not found")); got != "user ***-***-**14 not found" {
+		t.Errorf("errors are masked , got %v", got)
+	}
+}
+
+func TestLoggerRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelInfo, true)
+
+	user := UserBasic{UserID: "6285557743a8bdeb2aa5dc07", Email: "sonialivingston@hinway.com", Phone: "+1 (957) 570-2414", Balance: "$1,174.11"}
+	logger.Info(context.Background(), "user created", "user_id", user.UserID, "user", user)
+
+	var record map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &record)
+	if err != nil {
+		t.Fatalf("invalid json record ( %v ) : %v", buf.String(), err)
+	}
+	if record["user_id"] != user.UserID {
+		t.Errorf("user_id is masked ( %v )", record["user_id"])
+	}
+
+	logged, _ := record["user"].(map[string]interface{})
+	want := map[string]interface{}{
+		"user_id": user.UserID,
+		"email":   "s***@hinway.com",
+		"phone":   "+* (***) ***-**14",
+		"balance": "***",
+	}
+	for key, value := range want {
+		if logged[key] != value {
+			t.Errorf("user.%v = %v , want %v", key, logged[key], value)
+		}
+	}
+}
@@ -1,18 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 	"log"
 	"os"
-	"reflect"
 	"strings"
-	"time"
 )
 
 /*
@@ -37,7 +35,7 @@ JSON >
     "Balance": "$1,174.11",
 }
 
-To the above JSON Record, we add the "string_rep" column : which is a '#' delimited values of each column
+To the above JSON Record, we add the "string_rep" column : which is a '#' delimited values of each searchable column
 
 "string_rep" is Indexed and used for searching
 
@@ -71,7 +69,7 @@ user_id ~* '62855' AND  phone ~* '570-2414'
 
 Constructing "string_rep" before inserting the record back into the DB:
 
-"StringRep": "#6285557743a8bdeb2aa5dc07#Sonia#Livingston#sonialivingston@hinway.com#+1 (957) 570-2414#false#$1,174.11#"
+"StringRep": "#6285557743a8bdeb2aa5dc07#Sonia#Livingston#sonialivingston@hinway.com#+1 (957) 570-2414#"
 
 SQL Table Row (with strin_rep column) >
 
@@ -82,11 +80,12 @@ email      | sonialivingston@hinway.com
 phone      | +1 (957) 570-2414
 active     | f
 balance    | $1,174.11
-string_rep | #6285557743a8bdeb2aa5dc07#Sonia#Livingston#sonialivingston@hinway.com#+1 (957) 570-2414#false#$1,174.11#
+string_rep | #6285557743a8bdeb2aa5dc07#Sonia#Livingston#sonialivingston@hinway.com#+1 (957) 570-2414#
 
-FYI : For each row, the value of string_rep column is a '#' delimited string/representation of all the
-      values of other columns. This will help in searching for one or more strings which may be present
-      in any of the other columns.
+FYI : For each row, the value of string_rep column is a '#' delimited string/representation of the
+      values of the search:"include" columns (active and balance are left out). This will help in
+      searching for one or more strings which may be present in any of those columns. The values are escaped ('%' -> %25, '#' -> %23) so that they never
+      contain the delimiter, and the search terms are escaped the same way, see string_rep.go.
 
 */
 
@@ -101,18 +100,41 @@ const (
 type ExactMatch bool
 
 type User struct {
+	TenantID string `gorm:"primaryKey;column:tenant_id;default:default;not null;index:first_name,priority:1;index:last_name,priority:1;index:email,priority:1;index:phone,priority:1;index:idx_user_records_string_rep,priority:1;index:email_bidx,priority:1;index:phone_bidx,priority:1;"` // see tenant.go
 	UserBasic
-	StringRep string `gorm:"index"`
+	StringRep  string `gorm:"index:idx_user_records_string_rep"`
+	EmailIndex string `gorm:"index:email_bidx;column:email_bidx;"` // blind index of Email, see field_encryption.go
+	PhoneIndex string `gorm:"index:phone_bidx;column:phone_bidx;"` // blind index of Phone
+}
+
+// FYI : Email and Phone are encrypted at rest when USERS_KEYRING_FILE is set, see field_encryption.go
+//     : tenant_id comes first in the primary key and in every index, the user_id is unique per tenant
+//     : the search:"include" fields make up string_rep (userSearchIndex, see search_index.go)
+
+// userSearchIndex maintains and searches string_rep, exact terms also match the blind indexes
+var userSearchIndex = mustRegisterSearchIndex[User]("string_rep", blindIndexAlternatives)
+
+// userModel registers user_records for "users migrate", userModel.Repository(db) is the generic
+// Repository[User] (UserRepository has the user specific parts : batch get, email lookup, streaming)
+var userModel = registerModel[User]()
+
+// Validate and ApplyDefaults give Repository[User] the checks of UserRepository
+func (u User) Validate() error {
+	return validateUserBasic(u.UserBasic)
+}
+
+func (u *User) ApplyDefaults() {
+	applyUserDefaults(&u.UserBasic)
 }
 
 type UserBasic struct {
-	UserID    string `gorm:"primaryKey;column:user_id;"`
-	FirstName string `gorm:"index:first_name;default:NA;column:first_name;"`
-	LastName  string `gorm:"index:last_name;default:NA;column:last_name;"`
-	Email     string `gorm:"index:email;default:no-reply@none.com;column:email;"`
-	Phone     string `gorm:"index:phone;default:000-000-0000;column:phone;"`
-	Active    bool   `gorm:"default:false;column:active;"`
-	Balance   string `gorm:"default:0;column:balance;"`
+	UserID    string `gorm:"primaryKey;column:user_id;" search:"include" json:"user_id"`
+	FirstName string `gorm:"index:first_name;default:NA;column:first_name;" search:"include" json:"first_name"`
+	LastName  string `gorm:"index:last_name;default:NA;column:last_name;" search:"include" json:"last_name"`
+	Email     string `gorm:"index:email;default:no-reply@none.com;column:email;serializer:encrypted;" search:"include" json:"email"`
+	Phone     string `gorm:"index:phone;default:000-000-0000;column:phone;serializer:encrypted;" search:"include" json:"phone"`
+	Active    bool   `gorm:"default:false;column:active;" json:"active"`
+	Balance   string `gorm:"default:0;column:balance;" json:"balance"`
 }
 
 var (
@@ -121,44 +143,93 @@ var (
 	PGSQLMETADATAUSER = ""
 )
 
-func Initialize() {
+func Initialize() error {
 	PGSQLMETADATAHOST = os.Getenv("PGSQLMETADATAHOST")
 	if PGSQLMETADATAHOST == "" {
-		log.Fatal("environment variable PGSQLMETADATAHOST is not set, exiting...")
+		return errors.New("environment variable PGSQLMETADATAHOST is not set")
 	}
 
 	PGSQLMETADATAPASS = os.Getenv("PGSQLMETADATAPASS")
 	if PGSQLMETADATAPASS == "" {
-		log.Fatal("environment variable PGSQLMETADATAPASS is not set, exiting...")
+		return errors.New("environment variable PGSQLMETADATAPASS is not set")
 	}
 
 	PGSQLMETADATAUSER = os.Getenv("PGSQLMETADATAUSER")
 	if PGSQLMETADATAUSER == "" {
-		log.Fatal("environment variable PGSQLMETADATAUSER is not set, exiting...")
+		return errors.New("environment variable PGSQLMETADATAUSER is not set")
+	}
+	err := loadStatementTimeouts()
+	if err != nil {
+		return err
+	}
+	err = loadTenantSettings()
+	if err != nil {
+		return err
+	}
+	err = loadOutboxSettings()
+	if err != nil {
+		return err
+	}
+	err = loadChangeFeedSettings()
+	if err != nil {
+		return err
+	}
+	err = loadCacheSettings()
+	if err != nil {
+		return err
+	}
+	err = loadReplicaSettings()
+	if err != nil {
+		return err
+	}
+	err = loadPartitionSettings()
+	if err != nil {
+		return err
 	}
+	return loadKeyring()
 }
 
-func createRecord(user User, db *gorm.DB) (*gorm.DB, error) {
+func createRecord(ctx context.Context, user User, db *gorm.DB) (*gorm.DB, error) {
 	var result *gorm.DB
-	result = db.Create(&user)
-	if result.Error != nil {
-		log.Printf("error : could not create record : %v", result.Error.Error())
-		return result, result.Error
+	err := withTimeout(ctx, db, OpWrite, func(tx *gorm.DB) error {
+		result = tx.Create(&user)
+		return result.Error
+	})
+	if err != nil {
+		appLog.Error(ctx, "could not create record", "user_id", user.UserID, "error", err)
+		return result, err
 	}
-	log.Printf("result.RowsAffected : %v", result.RowsAffected)
+	appLog.Info(ctx, "record created", "user_id", user.UserID, "rows_affected", result.RowsAffected)
 	return result, nil
 }
 
-func InitializeLogger() {
-	AppLog = logger.New(
-		log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
-		logger.Config{
-			SlowThreshold:             time.Second,   // Slow SQL threshold
-			LogLevel:                  logger.Silent, // Log level
-			IgnoreRecordNotFoundError: true,          // Ignore ErrRecordNotFound error for logger
-			Colorful:                  false,         // Disable color
-		},
-	)
+// InitializeLogger configures appLog from the environment and routes gorm and the "log" package through it
+func InitializeLogger() error {
+	level, err := parseLogLevel(os.Getenv("USERS_LOG_LEVEL"))
+	if err != nil {
+		return err
+	}
+
+	jsonFormat := true
+	switch strings.ToLower(os.Getenv("USERS_LOG_FORMAT")) {
+	case "", "json":
+	case "text":
+		jsonFormat = false
+	default:
+		return fmt.Errorf("invalid log format ( %v ) , please use json or text", os.Getenv("USERS_LOG_FORMAT"))
+	}
+
+	appLog = NewLogger(os.Stderr, level, jsonFormat)
+
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{logger: appLog})
+
+	err = loadGormLogSettings()
+	if err != nil {
+		return err
+	}
+	AppLog = newGormLogger(appLog, gormSettings, slowQueries) // ErrRecordNotFound is never logged
+	return nil
 }
 
 func getUser() User {
@@ -173,55 +244,49 @@ func getUser() User {
 		Balance:   "$3,682.63",
 	}
 
-	stringRep := getStringRep(userBasic)
-
 	user := User{
 		UserBasic: userBasic,
-		StringRep: stringRep,
 	}
+	user.setDerivedColumns()
 
 	return user
 }
 
+// getStringRep has the search:"include" fields of user, without the encrypted fields (only when encryption
+// is enabled), the values are escaped so that they never contain the '#' delimiter (see string_rep.go)
 func getStringRep(user UserBasic) string {
-	v := reflect.ValueOf(user)
-	values := make([]interface{}, v.NumField())
-	stringRep := ""
-	stringRep += "#"
-	for i := 0; i < v.NumField(); i++ {
-		values[i] = v.Field(i).Interface()
-		stringRep += fmt.Sprintf("%v#", v.Field(i).Interface())
-	}
-	return stringRep
+	return userSearchIndex.Value(&User{UserBasic: user})
 }
 
-// this function will only update "string_rep" columns
+// this function will only update "string_rep" (and the blind index) columns
 // and return the user
 func getUserFromBasic(user UserBasic) User {
-	stringRep := getStringRep(user)
-
 	myUser := User{
 		UserBasic: user,
-		StringRep: stringRep,
 	}
+	myUser.setDerivedColumns()
 	return myUser
 }
 
-func updateStringRepForUser(db *gorm.DB, userID string) {
-	var userFromBackend User
+func updateStringRepForUser(ctx context.Context, db *gorm.DB, userID string) error {
+	return withTimeout(ctx, db, OpWrite, func(tx *gorm.DB) error {
+		var userFromBackend User
 
-	db.Where(map[string]interface{}{"user_id": userID}).Find(&userFromBackend)
-
-	log.Printf("BACKEND_QUERY : userFromBackend : %v", userFromBackend)
+		err := tx.Where(map[string]interface{}{"user_id": userID}).Find(&userFromBackend).Error
+		if err != nil {
+			return err
+		}
 
-	stringRep := getStringRep(userFromBackend.UserBasic)
+		appLog.Debug(ctx, "updating string_rep", "user", userFromBackend)
 
-	userFromBackend.StringRep = stringRep
+		userFromBackend.setDerivedColumns()
 
-	savedResult := db.Save(&userFromBackend)
+		savedResult := tx.Save(&userFromBackend)
 
-	log.Printf("userID : (%v) , savedResult.RowsAffected : (%v)", userID, savedResult.RowsAffected)
+		appLog.Info(ctx, "string_rep updated", "user_id", userID, "rows_affected", savedResult.RowsAffected)
 
+		return savedResult.Error
+	})
 }
 
 /*
@@ -232,378 +297,101 @@ It will change existing column’s type if its size, precision, nullable changed
 It WON’T delete unused columns to protect your data.
 */
 
-func InitializeTables(db *gorm.DB) error {
-	err := db.AutoMigrate(&User{})
-	if err != nil {
-		return err
-	}
-	return nil
+func InitializeTables(ctx context.Context, db *gorm.DB) error {
+	return withTimeout(ctx, db, OpMigrate, func(tx *gorm.DB) error {
+		// a new user_records is created with hash partitions when USERS_PARTITIONS is set, see partition.go
+		err := migratePartitions(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		// user_records and every model registered with registerModel (see generic_repository.go)
+		err = tx.AutoMigrate(migrationModels()...)
+		if err != nil {
+			return err
+		}
+
+		// tables created before tenant_id still have the old keys, see tenant.go
+		err = migrateTenantKeys(ctx, tx)
+		if err != nil {
+			return err
+		}
+		// NOTIFY trigger of the change feed, see change_feed.go
+		err = migrateChangeTrigger(tx)
+		if err != nil {
+			return err
+		}
+		if tenantRLS {
+			return enableTenantRLS(tx)
+		}
+		return nil
+	})
 }
 
+// Tabler is implemented by every model, the constraint of Repository[T] (see generic_repository.go)
 type Tabler interface {
 	TableName() string
 }
 
+var _ Tabler = User{}
+
 // TableName overrides the table name used by User to `users`
 func (User) TableName() string {
 	return "user_records"
 }
 
-func main() {
-	var err error
-
-	Initialize()
-	InitializeLogger()
+func connectDB() (*gorm.DB, error) {
+	return openDB(hostDSN(PGSQLMETADATAHOST), "users", false)
+}
 
-	dsn := fmt.Sprintf(
+// hostDSN is the dsn of host, with the user and password of PGSQLMETADATA*
+func hostDSN(host string) string {
+	return fmt.Sprintf(
 		"host=%v user=%v password=%v dbname=testdb port=5432 sslmode=disable TimeZone=America/Los_Angeles",
-		PGSQLMETADATAHOST,
+		host,
 		PGSQLMETADATAUSER,
 		PGSQLMETADATAPASS,
 	)
+}
+
+// openDB connects to dsn with the plugins of every connection, statsName is the db_name of its pool metrics
+// (the replicas, see replica.go, skip the ping so that one that is down doesn't stop the process)
+func openDB(dsn string, statsName string, skipPing bool) (*gorm.DB, error) {
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: AppLog,
+		Logger:               AppLog,
+		DisableAutomaticPing: skipPing,
 	})
 	if err != nil {
-		log.Fatalf("error : %v", err.Error())
-	}
-	log.Printf("%v", db)
-
-	// ----------------------------------------------------------------------------------------------------
-
-	log.Printf("---[Create/Initialize Table]---")
-
-	err = InitializeTables(db)
-	if err != nil {
-		log.Printf("error : could not create tables : %v", err.Error())
-		return
+		return nil, err
 	}
 
-	// Create a single record
-	sampleUser := getUser()
-	_, _ = createRecord(sampleUser, db)
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// Bulk Insert
-
-	log.Printf("---[Bulk Insert]---")
-	userList := GetUserRecords()
-	db.Create(userList)
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// Delete all the rows
-
-	log.Printf("---[Deleting All Rows]---")
-
-	db.Exec("DELETE FROM users")
-
-	// ----------------------------------------------------------------------------------------------------
-
-	log.Printf("---[Dropping Table]---")
-
-	err = db.Migrator().DropTable(&User{})
+	// tenant scope, spans and metrics for every statement, see tenant.go, tracing.go and metrics.go
+	err = db.Use(tenantPlugin{})
 	if err != nil {
-		log.Printf("error : could not drop table : %v", err.Error())
-	}
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// Again, re-create the table
-
-	log.Printf("---[Creating Table]---")
-
-	err = InitializeTables(db)
-	if err != nil {
-		log.Printf("error : could not create tables : %v", err.Error())
-		return
-	}
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// Insert Using Batch Pool Size
-	log.Printf("---[Insert In Batches]---")
-	db.CreateInBatches(userList, 4)
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// Get all records
-
-	log.Printf("---[Get All Records]---")
-
-	var users []User
-
-	_ = db.Find(&users)
-
-	//for _, user := range users {
-	//
-	//	log.Printf("user.UserID    : %v", user.UserID)
-	//	log.Printf("user.FirstName : %v", user.FirstName)
-	//	log.Printf("user.LastName  : %v", user.LastName)
-	//
-	//	prettyPrintData(user)
-	//}
-
-	log.Printf("Total Number of Records : %v", len(users))
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// Upsert / On Conflict
-
-	log.Printf("---[Upsert / On Conflict]---")
-
-	user1basic := UserBasic{
-		UserID:    "628555772a8b7b9926ffb917",
-		FirstName: "Wendy-1",
-		LastName:  "Lawson-1",
-		Email:     "wendylawson@hinway.com",
-		Phone:     "+1 (907) 523-2723",
-		Active:    false,
-		Balance:   "$200,000.00",
-	}
-
-	log.Printf("user1basic >")
-	prettyPrintData(user1basic)
-
-	user1 := getUserFromBasic(user1basic)
-
-	log.Printf("user1 >")
-	prettyPrintData(user1)
-
-	// Update all columns, except primary keys, to new value on conflict
-
-	result1 := db.Clauses(clause.OnConflict{
-		UpdateAll: true,
-	}).Create(&user1)
-
-	log.Printf("Upsert / On Conflict : result.RowsAffected : %v", result1.RowsAffected)
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// Upsert / On Conflict
-
-	log.Printf("---[Upsert / On Conflict]---")
-
-	user2basic := UserBasic{
-		UserID:  "628555772a8b7b9926ffb917",
-		Email:   "wendylawson@hinway.com",
-		Active:  false,
-		Balance: "$200,000.00",
-	}
-
-	log.Printf("user2basic >")
-	prettyPrintData(user2basic)
-
-	user2 := getUserFromBasic(user2basic)
-
-	log.Printf("user2 >")
-	prettyPrintData(user2)
-
-	// Update all columns, except primary keys, to new value on conflict
-
-	result2 := db.Clauses(clause.OnConflict{
-		UpdateAll: true,
-	}).Create(&user2)
-
-	log.Printf("Upsert / On Conflict : result.RowsAffected : %v", result2.RowsAffected)
-
-	//updateStringRepForUser(db, user2basic.UserID)
-
-	// ----------------------------------------------------------------------------------------------------
-
-	user3basic := UserBasic{
-		UserID:    "628555772a8b7b9926ffb917",
-		FirstName: "Wendy--2",
-		LastName:  "Lawson--2",
+		return nil, err
 	}
-
-	log.Printf("user3basic >")
-	prettyPrintData(user3basic)
-
-	user3 := getUserFromBasic(user3basic)
-
-	log.Printf("user3 >")
-	prettyPrintData(user3)
-
-	// Update specific fields
-	result3 := db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "user_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"first_name", "last_name"}),
-	}).Create(&user3)
-
-	//updateStringRepForUser(db, user3.UserID)
-
-	log.Printf("Upsert / On Conflict : result.RowsAffected : %v", result3.RowsAffected)
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// Limit and Offset
-
-	log.Printf("---[Limit / Offset]---")
-
-	var partialUsers []User
-
-	// SELECT * FROM users OFFSET 5 LIMIT 3;
-
-	db.Limit(3).Offset(5).Find(&partialUsers)
-
-	for _, user := range partialUsers {
-		prettyPrintData(user)
-	}
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// query with primary key
-
-	log.Printf("---[Query Users With List of Primary Keys]---")
-	users = make([]User, 0)
-	db.Where("user_id IN ?", []string{"628555772a8b7b9926ffb917", "6285557743a8bdeb2aa5dc07"}).Find(&users)
-	for _, user := range users {
-		prettyPrintData(user)
-	}
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// query using structs
-
-	// FYI : When querying with struct, GORM will only query with non-zero fields, that means if your field’s
-	// value is 0, '', false or other zero values, it won’t be used to build query conditions,
-
-	// for example:
-	// 		db.Where(&User{Name: "jinzhu", Age: 0}).Find(&users)
-	//		translates to >
-	// 		SELECT * FROM users WHERE name = "jinzhu";
-
-	// To include zero values in the query conditions, you can use a map, which will
-	// include all key-values as query conditions, for example:
-
-	// 		db.Where(map[string]interface{}{"Name": "jinzhu", "Age": 0}).Find(&users)
-	//		translates to >
-	// 		SELECT * FROM users WHERE name = "jinzhu" AND age = 0;
-
-	log.Printf("---[Query Using structs]---")
-	var searchData User
-	var user User
-	searchData.Email = "sonialivingston@hinway.com"
-	db.Where(&searchData).First(&user)
-	prettyPrintData(user)
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// query using maps
-
-	log.Printf("---[Query Using maps]---")
-
-	users = make([]User, 0)
-	db.Where(map[string]interface{}{"first_name": "Stacy", "last_name": "Mason"}).Find(&users)
-	for _, user := range users {
-		prettyPrintData(user)
-	}
-
-	// ----------------------------------------------------------------------------------------------------
-
-	// get columne names for model
-
-	log.Printf("---[Column names for 'User']---")
-
-	columnNames := getColumnNamesForModel(db, &User{})
-
-	prettyPrintData(columnNames)
-
-	// ----------------------------------------------------------------------------------------------------
-
-	log.Printf("---[Non Exact Search | Query Using 'string_rep' column | AND search]---")
-	searchStrings := []string{"772", "none.com"}
-	users = make([]User, 0)
-	searchType := SearchAND
-	sqlQuery, err := getSQLQueryForNonExactPatternSearch(searchStrings, searchType)
+	// search columns of the registered models, see search_index.go
+	err = db.Use(searchIndexPlugin{})
 	if err != nil {
-		log.Printf("error : %v", err.Error())
-		return
-	}
-	db.Where(sqlQuery).Find(&users)
-	for _, user := range users {
-		prettyPrintData(user)
+		return nil, err
 	}
-	if len(users) == 0 {
-		log.Printf("no record found for search type ( %v ) and search string ( %v )", searchType, searchStrings)
-	}
-
-	// ----------------------------------------------------------------------------------------------------
-
-	log.Printf("---[Non Exact Search | Query Using 'string_rep' column | OR search]---")
-	searchStrings = []string{"Marisol", "Davidson"}
-	users = make([]User, 0)
-	searchType = SearchOR
-	sqlQuery, err = getSQLQueryForNonExactPatternSearch(searchStrings, searchType)
+	err = db.Use(tracingPlugin{})
 	if err != nil {
-		log.Printf("error : %v", err.Error())
-		return
+		return nil, err
 	}
-	db.Where(sqlQuery).Find(&users)
-	for _, user := range users {
-		prettyPrintData(user)
-	}
-	if len(users) == 0 {
-		log.Printf("no record found for search type ( %v ) and search string ( %v )", searchType, searchStrings)
-	}
-
-	// ----------------------------------------------------------------------------------------------------
-
-	log.Printf("---[Exact Search | Query For Search | OR]---")
-	searchStrings = []string{"Marisol", "Davidson", "466-3255", "62855577fc3729572a693d79", "62855577fc3", "DONAcampos@hinway.COM"}
-	users = make([]User, 0)
-
-	//users, err = getRecordsForExactSearchOR(db, searchStrings)
-	//if err != nil {
-	//	log.Printf("error : %v", err.Error())
-	//	return
-	//}
-
-	searchType = SearchOR
-	sqlQuery, err = getSQLQueryForExactSearch(searchStrings, searchType)
+	err = db.Use(metricsPlugin{})
 	if err != nil {
-		log.Printf("error : %v", err.Error())
-		return
-	}
-	db.Where(sqlQuery).Find(&users)
-
-	for _, user := range users {
-		prettyPrintData(user)
-	}
-	if len(users) == 0 {
-		log.Printf("no record found for exact search for search strings ( %v )", searchStrings)
+		return nil, err
 	}
-
-	// ----------------------------------------------------------------------------------------------------
-
-	log.Printf("---[Exact Search | Query For Search | AND]---")
-	searchStrings = []string{"Wendy", "wendylawson@hinway2.com", "628555772a8b7b9926ffb919"}
-	users = make([]User, 0)
-
-	//users, err = getRecordsForExactSearchAND(db, searchStrings)
-	//if err != nil {
-	//	log.Printf("error : %v", err.Error())
-	//	return
-	//}
-
-	searchType = SearchAND
-	sqlQuery, err = getSQLQueryForExactSearch(searchStrings, searchType)
+	err = registerDBStats(db, statsName)
 	if err != nil {
-		log.Printf("error : %v", err.Error())
-		return
-	}
-	db.Where(sqlQuery).Find(&users)
-	for _, user := range users {
-		prettyPrintData(user)
-	}
-	if len(users) == 0 {
-		log.Printf("no record found for exact search for search strings ( %v )", searchStrings)
+		return nil, err
 	}
+	return db, nil
+}
 
-	// ----------------------------------------------------------------------------------------------------
-
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
 }
 
 /*
@@ -646,21 +434,27 @@ getRecordsForExactSearchOR  => Is replaced with getSQLQueryForExactSearch
 
 getRecordsForExactSearchOR : Is deprecated, but still can be used
 */
-func getRecordsForExactSearchOR(db *gorm.DB, searchStrings []string) ([]User, error) {
+func getRecordsForExactSearchOR(ctx context.Context, db *gorm.DB, searchStrings []string) ([]User, error) {
 	users := make([]User, 0)
-	for _, searchString := range searchStrings {
-		userList := make([]User, 0)
-		lowerCaseSearchString := strings.ToLower(searchString)
-		db.Where("LOWER(user_id) = LOWER(?)", lowerCaseSearchString).
-			Or("LOWER(first_name) = LOWER(?)", lowerCaseSearchString).
-			Or("LOWER(last_name) = LOWER(?)", lowerCaseSearchString).
-			Or("LOWER(phone) = LOWER(?)", lowerCaseSearchString).
-			Or("LOWER(email) = LOWER(?)", lowerCaseSearchString).Find(&userList)
-		for _, user := range userList {
-			users = append(users, user)
+	err := withTimeout(ctx, db, OpSearch, func(tx *gorm.DB) error {
+		for _, searchString := range searchStrings {
+			userList := make([]User, 0)
+			lowerCaseSearchString := strings.ToLower(searchString)
+			err := tx.Where("LOWER(user_id) = LOWER(?)", lowerCaseSearchString).
+				Or("LOWER(first_name) = LOWER(?)", lowerCaseSearchString).
+				Or("LOWER(last_name) = LOWER(?)", lowerCaseSearchString).
+				Or(lowerColumnEquals("phone", lowerCaseSearchString)).
+				Or(lowerColumnEquals("email", lowerCaseSearchString)).Find(&userList).Error
+			if err != nil {
+				return err
+			}
+			for _, user := range userList {
+				users = append(users, user)
+			}
 		}
-	}
-	return users, nil
+		return nil
+	})
+	return users, err
 }
 
 /*
@@ -668,134 +462,80 @@ getRecordsForExactSearchAND  => Is replaced with getSQLQueryForExactSearch
 
 getRecordsForExactSearchAND : Is deprecated, but still can be used
 */
-func getRecordsForExactSearchAND(db *gorm.DB, searchStrings []string) ([]User, error) {
+func getRecordsForExactSearchAND(ctx context.Context, db *gorm.DB, searchStrings []string) ([]User, error) {
 	users := make([]User, 0)
 
-	for _, searchString := range searchStrings {
-		lowerCaseSearchString := strings.ToLower(searchString)
-		db = db.Debug()
-		db = db.Where(db.Where("LOWER(user_id) = LOWER(?)", lowerCaseSearchString).
-			Or("LOWER(first_name) = LOWER(?)", lowerCaseSearchString).
-			Or("LOWER(last_name) = LOWER(?)", lowerCaseSearchString).
-			Or("LOWER(phone) = LOWER(?)", lowerCaseSearchString).
-			Or("LOWER(email) = LOWER(?)", lowerCaseSearchString))
-
-	}
-
-	err := db.Find(&users).Error
+	err := withTimeout(ctx, db, OpSearch, func(tx *gorm.DB) error {
+		query := tx.Debug()
+		for _, searchString := range searchStrings {
+			lowerCaseSearchString := strings.ToLower(searchString)
+			query = query.Where(tx.Where("LOWER(user_id) = LOWER(?)", lowerCaseSearchString).
+				Or("LOWER(first_name) = LOWER(?)", lowerCaseSearchString).
+				Or("LOWER(last_name) = LOWER(?)", lowerCaseSearchString).
+				Or(lowerColumnEquals("phone", lowerCaseSearchString)).
+				Or(lowerColumnEquals("email", lowerCaseSearchString)))
+		}
+		return query.Find(&users).Error
+	})
 	if err != nil {
-		log.Printf("error : %v", err.Error())
+		appLog.Error(ctx, "exact AND search failed", "error", err)
 		return users, err
 	}
 	return users, nil
 }
 
 // FYI : ~* makes it case-insensitive search
+//     : the terms are matched literally, escaped the same way as the string_rep values (patternSearchCondition)
 
 func getSQLQueryForNonExactPatternSearch(searchStrings []string, searchType Search) (string, error) {
-	sqlQuery := ""
-	counter := 1
-
-	if len(searchStrings) == 0 {
-		return sqlQuery, errors.New("length of searchStrings is 0 , please provide valid list")
-	}
-
-	if len(searchStrings) == 1 {
-		searchType = SearchSingle
-	}
-
-	for _, searchString := range searchStrings {
-		if searchType == SearchAND {
-			if counter == len(searchStrings) {
-				sqlQuery += fmt.Sprintf(" string_rep ~* ('%v') ", searchString)
-			} else {
-				sqlQuery += fmt.Sprintf(" string_rep ~* ('%v') AND ", searchString)
-			}
-			counter++
-		} else if searchType == SearchOR {
-			if counter == len(searchStrings) {
-				sqlQuery += fmt.Sprintf(" string_rep ~* ('%v') ", searchString)
-			} else {
-				sqlQuery += fmt.Sprintf(" string_rep ~* ('%v') OR ", searchString)
-			}
-			counter++
-		} else if searchType == SearchSingle {
-			sqlQuery = fmt.Sprintf(" string_rep ~* ('%v') ", searchStrings[0])
-		} else {
-			return sqlQuery, errors.New("please provide valid search type")
-		}
+	sqlQuery, err := userSearchIndex.Query(searchStrings, false, searchType)
+	if err != nil {
+		return sqlQuery, err
 	}
 
-	log.Printf("getSQLQueryForNonExactPatternSearch : sqlQuery >>")
-	log.Printf(sqlQuery)
+	appLog.Debug(context.Background(), "getSQLQueryForNonExactPatternSearch", "sql", sqlQuery)
 
 	return sqlQuery, nil
 }
 
 // FYI : ~* makes it case-insensitive search
-//     : string_rep ~* ('#%v#') -> makes it exact search (case insensitive)
+//     : string_rep ~* ('#%v#') -> makes it exact search (case insensitive), %v is escaped (exactSearchCondition)
+//     : with field encryption on, each term is also matched against the blind indexes (blindIndexAlternatives)
 
 func getSQLQueryForExactSearch(searchStrings []string, searchType Search) (string, error) {
-	sqlQuery := ""
-	counter := 1
-
-	if len(searchStrings) == 0 {
-		return sqlQuery, errors.New("length of searchStrings is 0 , please provide valid list")
-	}
-
-	if len(searchStrings) == 1 {
-		searchType = SearchSingle
-	}
-
-	for _, searchString := range searchStrings {
-		if searchType == SearchAND {
-			if counter == len(searchStrings) {
-				sqlQuery += fmt.Sprintf(" string_rep ~* ('#%v#') ", searchString)
-			} else {
-				sqlQuery += fmt.Sprintf(" string_rep ~* ('#%v#') AND ", searchString)
-			}
-			counter++
-		} else if searchType == SearchOR {
-			if counter == len(searchStrings) {
-				sqlQuery += fmt.Sprintf(" string_rep ~* ('#%v#') ", searchString)
-			} else {
-				sqlQuery += fmt.Sprintf(" string_rep ~* ('#%v#') OR ", searchString)
-			}
-			counter++
-		} else if searchType == SearchSingle {
-			sqlQuery = fmt.Sprintf(" string_rep ~* ('#%v#') ", searchStrings[0])
-		} else {
-			return sqlQuery, errors.New("please provide valid search type")
-		}
+	sqlQuery, err := userSearchIndex.Query(searchStrings, true, searchType)
+	if err != nil {
+		return sqlQuery, err
 	}
 
-	log.Printf("getSQLQueryForExactSearch : sqlQuery >>")
-	log.Printf(sqlQuery)
+	appLog.Debug(context.Background(), "getSQLQueryForExactSearch", "sql", sqlQuery)
 
 	return sqlQuery, nil
 }
 
-func (u User) AfterCreate(db *gorm.DB) (err error) {
-	log.Printf(">>>> [ AfterCreate() ] <<<<")
-	stringRep := getStringRep(u.UserBasic)
-	log.Printf("AfterCreate : u.UserID : %v", u.UserID)
-	u.StringRep = stringRep
-	db.Model(u).Save(u)
+/*
+BeforeCreate computes "string_rep" (and the blind indexes) on the record itself, so it goes out with the INSERT.
+
+FYI : this used to be an AfterCreate hook doing db.Model(u).Save(u), which issued an extra UPDATE
+for every inserted row (and for CreateInBatches, one UPDATE per row after every batch)
+*/
+func (u *User) BeforeCreate(db *gorm.DB) (err error) {
+	u.setDerivedColumns()
 	return nil
 }
 
 func prettyPrintData(data interface{}) {
 	dataBytes, err := json.MarshalIndent(data, "", "    ")
 	if err != nil {
-		log.Printf("error : could not MarshalIndent json : %v", err.Error())
+		appLog.Error(context.Background(), "could not MarshalIndent json", "error", err)
 		return
 	}
 	fmt.Printf("\n%v\n\n", string(dataBytes))
 }
 
-func getColumnNamesForModel(db *gorm.DB, myModel interface{}) []string {
+func getColumnNamesForModel(ctx context.Context, db *gorm.DB, myModel interface{}) []string {
 	columnNames := make([]string, 0)
-	result, _ := db.Debug().Migrator().ColumnTypes(&myModel)
+	result, _ := db.WithContext(ctx).Debug().Migrator().ColumnTypes(&myModel)
 	for _, v := range result {
 		columnNames = append(columnNames, v.Name())
 	}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"gorm.io/gorm"
+	"io"
+	"os"
+	"testing"
+)
+
+/*
+Test helpers
+
+The tests that need postgres are skipped unless USERS_TEST_DSN points to a database they can write to :
+
+	USERS_TEST_DSN="host=localhost user=postgres password=... dbname=testdb port=5432 sslmode=disable" go test ./...
+
+"users migrate" runs on it first, and every test writes to a tenant of its own (testTenant) which is
+deleted when the test ends, so the tests don't see each other's rows nor anything already there. The
+replica routing tests need two databases of their own, see replica_test.go, the partition tests one,
+see partition_test.go.
+
+The application logs are only written with -v.
+*/
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		appLog = NewLogger(io.Discard, LevelInfo, true)
+	}
+	os.Exit(m.Run())
+}
+
+// openTestDB connects to the database of the environment variable env (USERS_TEST_DSN by default) and
+// migrates it, the test is skipped when env is not set
+func openTestDB(tb testing.TB, env ...string) *gorm.DB {
+	tb.Helper()
+	name := "USERS_TEST_DSN"
+	if len(env) > 0 {
+		name = env[0]
+	}
+	dsn := os.Getenv(name)
+	if dsn == "" {
+		tb.Skipf("%v is not set", name)
+	}
+
+	db, err := openDB(dsn, "users_test", false)
+	if err != nil {
+		tb.Fatalf("could not connect to %v : %v", name, err)
+	}
+	tb.Cleanup(func() {
+		sqlDB, err := db.DB()
+		if err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+
+	err = InitializeTables(contextWithTenant(context.Background(), allTenants), db)
+	if err != nil {
+		tb.Fatalf("could not migrate %v : %v", name, err)
+	}
+	return db
+}
+
+// testTenant is a context with a new tenant, its rows are deleted when the test ends
+func testTenant(tb testing.TB, db *gorm.DB) context.Context {
+	tb.Helper()
+	random := make([]byte, 6)
+	_, err := rand.Read(random)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tenantID := "test_" + hex.EncodeToString(random)
+
+	tb.Cleanup(func() {
+		for _, table := range []string{User{}.TableName(), OutboxEvent{}.TableName(), WebhookDelivery{}.TableName(), WebhookSubscription{}.TableName()} {
+			err := db.Exec("DELETE FROM "+table+" WHERE tenant_id = ?", tenantID).Error
+			if err != nil {
+				tb.Errorf("could not delete the rows of tenant ( %v ) from %v : %v", tenantID, table, err)
+			}
+		}
+	})
+	return contextWithTenant(context.Background(), tenantID)
+}
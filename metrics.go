@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+/*
+Prometheus metrics
+
+Served on /metrics by "users serve -metrics-addr :9090" (empty : no metrics endpoint) :
+
+	users_db_query_duration_seconds{operation,table}   : every gorm create / query / update / delete / row / raw, from metricsPlugin
+	users_db_query_rows{operation,table}               : rows returned / affected per statement
+	users_db_errors_total{operation,type}              : failed statements
+	users_repository_errors_total{method,type}         : failed UserRepository calls (invalid arguments included)
+	users_searches_total{mode,operator}                : searches through UserRepository.Search / SearchEach
+	users_search_duration_seconds{mode,operator}       : from building the query to the last row
+	users_search_results{mode,operator}                : number of users found
+	users_outbox_deliveries_total{result}              : outbox events delivered / retried / failed by "users relay" (see outbox.go)
+	users_webhook_deliveries_total{result}             : webhook requests delivered / retried / dead (see webhook.go)
+	users_change_feed_subscribers                      : subscribers of the change feed, /changes clients included (see change_feed.go)
+	users_change_feed_dropped_total                    : changes dropped for subscribers that didn't keep up
+	users_cache_requests_total{result}                 : user cache lookups of Get / BatchGet, hit or miss (see cache.go)
+	users_cache_invalidations_total{source}            : users dropped from the cache by local writes, the change feed, or a resync (all)
+	users_replica_reads_total{target}                  : searches / lists / exports by replica host, or "primary" when none was usable (see replica.go)
+	users_replica_lag_seconds{replica}                 : replay lag of the replicas at the last check, -1 when the check failed
+	go_sql_open_connections{db_name="users"}, go_sql_in_use_connections, go_sql_idle_connections,
+	go_sql_wait_count_total ...                        : sql.DB pool stats (prometheus collectors.NewDBStatsCollector),
+	                                                     db_name="users_replica_1" ... for the replicas
+
+mode is exact or pattern, operator and or or. Error types :
+
+	not_found, already_exists, invalid_argument, unauthenticated, permission_denied, canceled, timeout,
+	database (any other postgres error), other
+
+The Go runtime and process metrics of the default registry (go_*, process_*) are there as well.
+*/
+
+var (
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "users_db_query_duration_seconds",
+		Help:    "Duration of the SQL statements, by gorm operation and table.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"operation", "table"})
+
+	dbQueryRows = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "users_db_query_rows",
+		Help:    "Rows returned or affected by the SQL statements, by gorm operation and table.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"operation", "table"})
+
+	dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "users_db_errors_total",
+		Help: "Failed SQL statements, by gorm operation and error type.",
+	}, []string{"operation", "type"})
+
+	repositoryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "users_repository_errors_total",
+		Help: "Failed UserRepository calls, by method and error type.",
+	}, []string{"method", "type"})
+
+	searches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "users_searches_total",
+		Help: "Searches, by mode (exact / pattern) and operator (and / or).",
+	}, []string{"mode", "operator"})
+
+	searchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "users_search_duration_seconds",
+		Help:    "Duration of the searches, by mode and operator.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"mode", "operator"})
+
+	searchResults = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "users_search_results",
+		Help:    "Number of users found by the searches, by mode and operator.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"mode", "operator"})
+
+	outboxDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "users_outbox_deliveries_total",
+		Help: "Outbox event deliveries, by result (delivered, retried, failed).",
+	}, []string{"result"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "users_webhook_deliveries_total",
+		Help: "Webhook deliveries, by result (delivered, retried, dead).",
+	}, []string{"result"})
+
+	changeFeedSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "users_change_feed_subscribers",
+		Help: "Subscribers of the change feed (server-sent events clients included).",
+	})
+
+	changeFeedDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "users_change_feed_dropped_total",
+		Help: "Changes dropped because a subscriber didn't keep up (it gets a resync instead).",
+	})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "users_cache_requests_total",
+		Help: "User cache lookups, by result (hit, miss).",
+	}, []string{"result"})
+
+	cacheInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "users_cache_invalidations_total",
+		Help: "User cache invalidations, by source (local, feed, resync).",
+	}, []string{"source"})
+
+	replicaReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "users_replica_reads_total",
+		Help: "Searches, lists and exports, by the replica host they ran on (primary : no replica was usable).",
+	}, []string{"target"})
+
+	replicaLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "users_replica_lag_seconds",
+		Help: "Replay lag of the replicas at the last check, -1 when the check failed.",
+	}, []string{"replica"})
+)
+
+// errorType is the "type" label of the error counters
+func errorType(err error) string {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, gorm.ErrRecordNotFound):
+		return "not_found"
+	case errors.Is(err, ErrAlreadyExists), isUniqueViolation(err):
+		return "already_exists"
+	case errors.Is(err, ErrInvalidArgument):
+		return "invalid_argument"
+	case errors.Is(err, ErrUnauthenticated):
+		return "unauthenticated"
+	case errors.Is(err, ErrPermissionDenied):
+		return "permission_denied"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrStatementTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &pgErr):
+		if pgErr.Code == pgQueryCanceled {
+			return "timeout"
+		}
+		return "database"
+	default:
+		return "other"
+	}
+}
+
+// endRepositoryCall ends the span of a UserRepository method and counts its error, if any
+func endRepositoryCall(span trace.Span, method string, err error) {
+	if err != nil {
+		repositoryErrors.WithLabelValues(method, errorType(err)).Inc()
+	}
+	endSpan(span, err)
+}
+
+// observeSearch records a finished search
+func observeSearch(mode string, operator string, started time.Time, results int, err error) {
+	searches.WithLabelValues(mode, operator).Inc()
+	searchDuration.WithLabelValues(mode, operator).Observe(time.Since(started).Seconds())
+	if err == nil {
+		searchResults.WithLabelValues(mode, operator).Observe(float64(results))
+	}
+}
+
+// registerDBStats exports the pool stats of db, once per process
+func registerDBStats(db *gorm.DB, dbName string) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	err = prometheus.Register(collectors.NewDBStatsCollector(sqlDB, dbName))
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if errors.As(err, &alreadyRegistered) {
+		return nil
+	}
+	return err
+}
+
+func serveMetrics(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	appLog.Info(ctx, "metrics endpoint listening", "addr", addr, "path", "/metrics")
+	return serveHTTP(ctx, addr, mux)
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// gorm plugin
+
+// metricsPlugin times every gorm callback chain, register it with db.Use
+type metricsPlugin struct{}
+
+const metricsStartKey = "users:metrics_start"
+
+func (metricsPlugin) Name() string {
+	return "users:metrics"
+}
+
+func (p metricsPlugin) Initialize(db *gorm.DB) error {
+	return registerAroundCallbacks(db, "users:metrics", p.before, p.after)
+}
+
+func (metricsPlugin) before(db *gorm.DB, _ string) {
+	db.InstanceSet(metricsStartKey, time.Now())
+}
+
+func (metricsPlugin) after(db *gorm.DB, operation string) {
+	value, ok := db.InstanceGet(metricsStartKey)
+	if !ok {
+		return
+	}
+	started, ok := value.(time.Time)
+	if !ok {
+		return
+	}
+
+	table := statementTable(db)
+	dbQueryDuration.WithLabelValues(operation, table).Observe(time.Since(started).Seconds())
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		dbErrors.WithLabelValues(operation, errorType(db.Error)).Inc()
+		return
+	}
+	dbQueryRows.WithLabelValues(operation, table).Observe(float64(db.Statement.RowsAffected))
+}
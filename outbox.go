@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+Transactional outbox
+
+Every change made through UserRepository (create, upsert, delete) or a bulk import ("users import", gRPC
+BulkImport) also writes a row to user_outbox, in the transaction of the change itself : the event exists
+if and only if the change was committed. A relay ("users relay") delivers the events afterwards :
+
+	UserRepository.Create / Upsert / Delete  -->  user_records + user_outbox  (one transaction)
+	bulkLoadUsers (every chunk)              -->  user_records + user_outbox  (one transaction)
+	                                                              |
+	                                         OutboxRelay (polls, FOR UPDATE SKIP LOCKED)
+	                                                              |
+	                                      OutboxSink : file (ndjson), HTTP webhook, channel
+
+Events are written when USERS_OUTBOX=true. What the sinks get is a ChangeEvent :
+
+	{"id": 42, "type": "user.updated", "tenant_id": "default", "user_id": "628558706b92ac31676d779b",
+	 "occurred_at": "2022-05-21T10:00:00Z", "before": {"user_id": ..., "first_name": ...}, "after": {...}}
+
+before is null for user.created, after is null for user.deleted (an upsert is a user.created or a
+user.updated, depending on whether the user existed).
+
+Writes of one user are serialized with advisory locks (a row lock can't cover a user that doesn't exist
+yet, two upserts of a new user would both see no user and both write a user.created) :
+
+	create / upsert / delete : pg_advisory_xact_lock_shared(hashtext(tenant)) + pg_advisory_xact_lock(hashtext(tenant), hashtext(user_id))
+	bulk import chunk        : pg_advisory_xact_lock(hashtext(tenant)), from the merge to the commit of the chunk
+
+so a chunk waits for the single user writes of its tenant in progress and holds the next ones back until
+it is committed (the COPY of the chunk, the slow part, runs before the lock).
+
+Delivery :
+
+	at-least-once : a short transaction claims the events (a lease : their next_attempt_at moves past the
+	                time their deliveries can take), the sink is called outside of it, a second short
+	                transaction marks them delivered. A crash in between delivers them again once the
+	                lease is over. Consumers dedupe on "id".
+	retries       : a failed delivery is retried with exponential backoff (1s, 2s, 4s ... up to 5m), an
+	                event failing MaxAttempts times is marked failed and left in the table. Once the sink
+	                fails, the rest of the claimed events wait for the same retry (without an attempt).
+	ordering      : per user : the relay only claims the oldest pending event of a user, the next one waits
+	                until it is delivered (or failed). Several relays can run side by side.
+
+Delivered events are deleted once they are older than the retention (default 24h).
+
+FYI : the payload has the email and phone, it is encrypted with the field encryption keyring when there
+is one (see field_encryption.go).
+    : a bulk import writes the events of a chunk with COPY, in the order of the merge. A user skipped
+      (ConflictSkip) has no event.
+*/
+
+type EventType string
+
+const (
+	EventUserCreated EventType = "user.created"
+	EventUserUpdated EventType = "user.updated"
+	EventUserDeleted EventType = "user.deleted"
+)
+
+type OutboxStatus string
+
+const (
+	OutboxPending   OutboxStatus = "pending"
+	OutboxDelivered OutboxStatus = "delivered"
+	OutboxFailed    OutboxStatus = "failed"
+)
+
+type OutboxEvent struct {
+	ID            int64        `gorm:"primaryKey;autoIncrement"`
+	TenantID      string       `gorm:"column:tenant_id;default:default;not null;index:idx_user_outbox_pending,priority:1,where:status = 'pending'"`
+	UserID        string       `gorm:"not null;index:idx_user_outbox_pending,priority:2"`
+	Type          EventType    `gorm:"not null"`
+	Payload       string       `gorm:"not null;serializer:encrypted"` // outboxPayload as JSON
+	Status        OutboxStatus `gorm:"not null;default:pending;index:idx_user_outbox_status,priority:1"`
+	Attempts      int          `gorm:"not null;default:0"`
+	NextAttemptAt time.Time    `gorm:"not null;index:idx_user_outbox_status,priority:2"`
+	LastError     string
+	CreatedAt     time.Time `gorm:"not null"`
+	DeliveredAt   *time.Time
+}
+
+func (OutboxEvent) TableName() string {
+	return "user_outbox"
+}
+
+// outboxModel registers user_outbox for "users migrate"
+var outboxModel = registerModel[OutboxEvent]()
+
+type outboxPayload struct {
+	Before *UserBasic `json:"before"`
+	After  *UserBasic `json:"after"`
+}
+
+// ChangeEvent is what the sinks get for every change
+type ChangeEvent struct {
+	ID         int64      `json:"id"` // increasing, the same event delivered twice has the same id
+	Type       EventType  `json:"type"`
+	TenantID   string     `json:"tenant_id"`
+	UserID     string     `json:"user_id"`
+	OccurredAt time.Time  `json:"occurred_at"`
+	Before     *UserBasic `json:"before"`
+	After      *UserBasic `json:"after"`
+}
+
+func (e OutboxEvent) changeEvent() (ChangeEvent, error) {
+	var payload outboxPayload
+	err := json.Unmarshal([]byte(e.Payload), &payload)
+	if err != nil {
+		return ChangeEvent{}, fmt.Errorf("invalid payload for outbox event ( %v ) : %w", e.ID, err)
+	}
+	return ChangeEvent{
+		ID:         e.ID,
+		Type:       e.Type,
+		TenantID:   e.TenantID,
+		UserID:     e.UserID,
+		OccurredAt: e.CreatedAt,
+		Before:     payload.Before,
+		After:      payload.After,
+	}, nil
+}
+
+// outboxEnabled is set from USERS_OUTBOX
+var outboxEnabled = false
+
+func loadOutboxSettings() error {
+	value := os.Getenv("USERS_OUTBOX")
+	if value == "" {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for environment variable USERS_OUTBOX ( %v ) , please use true or false", value)
+	}
+	outboxEnabled = enabled
+	return nil
+}
+
+// outboxTransaction runs a change in its own transaction (a savepoint within the one of withTimeout) when
+// the outbox is enabled, so that the change and its event are committed together
+func outboxTransaction(tx *gorm.DB, change func(tx *gorm.DB) error) error {
+	if !outboxEnabled {
+		return change(tx)
+	}
+	return tx.Transaction(change)
+}
+
+// the advisory locks of the changes writing events, the key of a user is (hashtext(tenant), hashtext(user_id))
+// and the one of a tenant is hashtext(tenant) (the 1 and 2 key forms never collide)
+const (
+	lockUserChangeSQL    = "SELECT pg_advisory_xact_lock_shared(hashtext(?)), pg_advisory_xact_lock(hashtext(?), hashtext(?))"
+	lockTenantChangesSQL = "SELECT pg_advisory_xact_lock(hashtext($1))"
+)
+
+// lockUserForChange locks userID (whether it exists or not) until the end of the transaction and returns
+// the user as it is before the change (nil when there is none). It only locks and reads when the outbox
+// is enabled.
+func lockUserForChange(tx *gorm.DB, userID string) (*UserBasic, error) {
+	if !outboxEnabled {
+		return nil, nil
+	}
+	tenantID, err := writeTenant(tx.Statement.Context)
+	if err != nil {
+		return nil, invalidArgument("%v", err.Error())
+	}
+	err = tx.Exec(lockUserChangeSQL, tenantID, tenantID, userID).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	err = tx.Where(map[string]interface{}{"user_id": userID}).Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user.UserBasic, nil
+}
+
+// writeOutboxEvent adds the event of a change to user_outbox, tx has to be the transaction of the change
+func writeOutboxEvent(ctx context.Context, tx *gorm.DB, eventType EventType, before *UserBasic, after *UserBasic) error {
+	if !outboxEnabled {
+		return nil
+	}
+	tenantID, err := writeTenant(ctx)
+	if err != nil {
+		return invalidArgument("%v", err.Error())
+	}
+
+	userID := ""
+	if after != nil {
+		userID = after.UserID
+	} else if before != nil {
+		userID = before.UserID
+	}
+
+	payload, err := json.Marshal(outboxPayload{Before: before, After: after})
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	event := OutboxEvent{
+		TenantID:      tenantID,
+		UserID:        userID,
+		Type:          eventType,
+		Payload:       string(payload),
+		Status:        OutboxPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+	return tx.Create(&event).Error
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// relay
+
+// OutboxSink delivers an event, an error means that the event is delivered again later
+type OutboxSink interface {
+	Deliver(ctx context.Context, event ChangeEvent) error
+}
+
+const (
+	defaultOutboxBatchSize       = 100
+	defaultOutboxPollInterval    = time.Second
+	defaultOutboxMaxAttempts     = 10
+	defaultOutboxRetention       = 24 * time.Hour
+	defaultOutboxDeliveryTimeout = 10 * time.Second
+
+	outboxMaxBackoff    = 5 * time.Minute
+	outboxPruneInterval = time.Minute
+	outboxLeaseMargin   = 30 * time.Second // added to the lease of claimed events (and webhook deliveries)
+)
+
+type OutboxRelayOptions struct {
+	BatchSize       int           // events claimed per transaction, defaults to 100
+	PollInterval    time.Duration // wait when there is nothing to deliver, defaults to 1s
+	MaxAttempts     int           // deliveries before an event is marked failed, defaults to 10
+	Retention       time.Duration // delivered events are deleted after, defaults to 24h (< 0 : never)
+	DeliveryTimeout time.Duration // per Deliver call, defaults to 10s
+}
+
+type OutboxRelay struct {
+	db   *gorm.DB
+	sink OutboxSink
+	opts OutboxRelayOptions
+}
+
+func NewOutboxRelay(db *gorm.DB, sink OutboxSink, opts OutboxRelayOptions) *OutboxRelay {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultOutboxBatchSize
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultOutboxPollInterval
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultOutboxMaxAttempts
+	}
+	if opts.Retention == 0 {
+		opts.Retention = defaultOutboxRetention
+	}
+	if opts.DeliveryTimeout <= 0 {
+		opts.DeliveryTimeout = defaultOutboxDeliveryTimeout
+	}
+	return &OutboxRelay{db: db, sink: sink, opts: opts}
+}
+
+// Run delivers events until ctx is cancelled, database errors are logged and retried after PollInterval
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	ctx = contextWithTenant(ctx, allTenants)
+	lastPrune := time.Time{}
+	for {
+		claimed, err := r.RelayOnce(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			appLog.Error(ctx, "outbox relay failed", "error", err)
+		}
+
+		if r.opts.Retention > 0 && time.Since(lastPrune) >= outboxPruneInterval {
+			err = r.prune(ctx)
+			if err != nil && ctx.Err() == nil {
+				appLog.Warn(ctx, "could not delete the delivered outbox events", "error", err)
+			}
+			lastPrune = time.Now()
+		}
+
+		// a full batch means there is probably more to deliver
+		if err == nil && claimed == r.opts.BatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.opts.PollInterval):
+		}
+	}
+}
+
+/*
+RelayOnce claims up to BatchSize deliverable events (the oldest pending event of each user) and delivers
+them, it returns the number of events claimed.
+
+The claim is a short transaction that only leases the events (next_attempt_at moves past the time their
+deliveries can take), the sink is called outside of it and the outcomes are written by a second short
+transaction : a slow sink holds no lock and no connection.
+*/
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (claimed int, err error) {
+	ctx, span := startSpan(contextWithTenant(ctx, allTenants), "OutboxRelay.RelayOnce")
+	defer func() {
+		span.SetAttributes(attribute.Int("outbox.claimed", claimed))
+		endSpan(span, err)
+	}()
+
+	events, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	claimed = len(events)
+	if claimed == 0 {
+		return 0, nil
+	}
+
+	outcomes := make([]map[string]interface{}, len(events))
+	for i := range events {
+		var sinkErr bool
+		outcomes[i], sinkErr = r.deliver(ctx, &events[i])
+		if ctx.Err() != nil {
+			// stopped, not failed : the lease puts the events back in the queue
+			return claimed, ctx.Err()
+		}
+		if sinkErr {
+			// the sink is down, the rest of the batch waits for the same retry, without an attempt
+			retryAt, ok := outcomes[i]["next_attempt_at"]
+			if !ok {
+				retryAt = time.Now().UTC()
+			}
+			for j := i + 1; j < len(events); j++ {
+				outcomes[j] = map[string]interface{}{"next_attempt_at": retryAt}
+			}
+			break
+		}
+	}
+
+	err = withTimeout(ctx, r.db, OpWrite, func(tx *gorm.DB) error {
+		return tx.Transaction(func(tx *gorm.DB) error {
+			for i, updates := range outcomes {
+				if updates == nil {
+					// the lease runs out, the event is claimed again
+					continue
+				}
+				// attempts = the claimed attempts : the outcome of a claim whose lease ran out is not written twice
+				err := tx.Model(&OutboxEvent{}).Where("id = ? AND status = ? AND attempts = ?", events[i].ID, OutboxPending, events[i].Attempts).
+					Updates(updates).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	return claimed, err
+}
+
+// claim takes the deliverable events in one short transaction, leased for the time their deliveries can take
+func (r *OutboxRelay) claim(ctx context.Context) ([]OutboxEvent, error) {
+	events := make([]OutboxEvent, 0)
+	err := withTimeout(ctx, r.db, OpWrite, func(tx *gorm.DB) error {
+		return tx.Transaction(func(tx *gorm.DB) error {
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("status = ? AND next_attempt_at <= ?", OutboxPending, time.Now().UTC()).
+				Where(`NOT EXISTS (SELECT 1 FROM user_outbox earlier WHERE earlier.status = ? AND earlier.tenant_id = user_outbox.tenant_id
+AND earlier.user_id = user_outbox.user_id AND earlier.id < user_outbox.id)`, OutboxPending).
+				Order("id").Limit(r.opts.BatchSize).Find(&events).Error
+			if err != nil || len(events) == 0 {
+				return err
+			}
+
+			ids := make([]int64, 0, len(events))
+			for _, event := range events {
+				ids = append(ids, event.ID)
+			}
+			lease := time.Now().UTC().Add(time.Duration(len(ids))*r.opts.DeliveryTimeout + outboxLeaseMargin)
+			return tx.Model(&OutboxEvent{}).Where("id IN ?", ids).Update("next_attempt_at", lease).Error
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// deliver hands event to the sink and returns the updates of its outcome, sinkErr when the sink failed
+func (r *OutboxRelay) deliver(ctx context.Context, event *OutboxEvent) (updates map[string]interface{}, sinkErr bool) {
+	changeEvent, err := event.changeEvent()
+	if err == nil {
+		deliverCtx, cancel := context.WithTimeout(ctx, r.opts.DeliveryTimeout)
+		err = r.sink.Deliver(deliverCtx, changeEvent)
+		cancel()
+		sinkErr = err != nil
+	}
+
+	now := time.Now().UTC()
+	attempts := event.Attempts + 1
+	updates = map[string]interface{}{"attempts": attempts}
+	switch {
+	case err == nil:
+		updates["status"] = OutboxDelivered
+		updates["delivered_at"] = now
+		updates["last_error"] = ""
+		outboxDeliveries.WithLabelValues("delivered").Inc()
+	case attempts >= r.opts.MaxAttempts:
+		updates["status"] = OutboxFailed
+		updates["last_error"] = err.Error()
+		outboxDeliveries.WithLabelValues("failed").Inc()
+		appLog.Error(ctx, "outbox event failed , giving up", "event_id", event.ID, "user_id", event.UserID, "attempts", attempts, "error", err)
+	default:
+		updates["next_attempt_at"] = now.Add(outboxBackoff(attempts))
+		updates["last_error"] = err.Error()
+		outboxDeliveries.WithLabelValues("retried").Inc()
+		appLog.Warn(ctx, "outbox event not delivered , retrying", "event_id", event.ID, "user_id", event.UserID, "attempts", attempts, "error", err)
+	}
+	return updates, sinkErr
+}
+
+// outboxBackoff is the wait before the next delivery of an event that failed attempts times
+func outboxBackoff(attempts int) time.Duration {
+	backoff := time.Second
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+// prune deletes the delivered events older than the retention
+func (r *OutboxRelay) prune(ctx context.Context) error {
+	before := time.Now().UTC().Add(-r.opts.Retention)
+	return withTimeout(ctx, r.db, OpWrite, func(tx *gorm.DB) error {
+		return tx.Where("status = ? AND delivered_at < ?", OutboxDelivered, before).Delete(&OutboxEvent{}).Error
+	})
+}
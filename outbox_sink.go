@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+/*
+Outbox sinks
+
+Where "users relay" delivers the change events (see outbox.go) :
+
+	file    : FileSink appends one JSON object per line, synced to disk before the event counts as delivered
+	webhook : WebhookSink POSTs the JSON of every event, any 2xx is a delivery, anything else is retried
+	channel : ChannelSink hands the events to an in-process consumer (tests, or code embedding the relay)
+
+The webhook request carries the event id and type as headers as well, for receivers that route or dedupe
+without reading the body :
+
+	POST <url>
+	Content-Type: application/json
+	X-Event-Id: 42
+	X-Event-Type: user.updated
+*/
+
+// FileSink appends the events to a file as ndjson
+type FileSink struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(fileName string) (*FileSink, error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Deliver(ctx context.Context, event ChangeEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// WebhookSink POSTs every event to a URL
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookSink(webhookURL string) (*WebhookSink, error) {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url ( %v ) , please use an http:// or https:// url", webhookURL)
+	}
+	// the relay bounds every delivery with its DeliveryTimeout through the context
+	return &WebhookSink{url: webhookURL, client: &http.Client{}}, nil
+}
+
+func (s *WebhookSink) Deliver(ctx context.Context, event ChangeEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Id", strconv.FormatInt(event.ID, 10))
+	req.Header.Set("X-Event-Type", string(event.Type))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// drain the body, so that the connection can be reused
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned ( %v )", resp.Status)
+	}
+	return nil
+}
+
+// ChannelSink sends the events to a channel, a delivery waits until the event is received
+type ChannelSink chan ChangeEvent
+
+func (s ChannelSink) Deliver(ctx context.Context, event ChangeEvent) error {
+	select {
+	case s <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
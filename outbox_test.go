@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withOutbox turns USERS_OUTBOX on for the test
+func withOutbox(t *testing.T) {
+	t.Helper()
+	outboxEnabled = true
+	t.Cleanup(func() {
+		outboxEnabled = false
+	})
+}
+
+// outboxEvents are the events of the tenant of ctx, oldest first
+func outboxEvents(t *testing.T, ctx context.Context, repo *UserRepository) []ChangeEvent {
+	t.Helper()
+	var rows []OutboxEvent
+	err := repo.db.WithContext(ctx).Order("id").Find(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make([]ChangeEvent, 0, len(rows))
+	for _, row := range rows {
+		event, err := row.changeEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestBulkImportWritesOutboxEvents(t *testing.T) {
+	db := openTestDB(t)
+	ctx := testTenant(t, db)
+	withOutbox(t)
+	repo := NewUserRepository(db)
+
+	_, err := repo.Create(ctx, UserBasic{UserID: "u1", FirstName: "Before"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := []UserBasic{{UserID: "u1", FirstName: "After"}, {UserID: "u2", FirstName: "New"}, {UserID: ""}}
+	stats, err := bulkLoadUsers(ctx, db, newSliceUserReader(users), BulkLoadOptions{Conflict: ConflictUpdate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Inserted != 1 || stats.Updated != 1 || stats.Rejected != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	events := outboxEvents(t, ctx, repo)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events (create, then the import's update and create) , got %v", len(events))
+	}
+	updated, created := events[1], events[2]
+	if events[1].UserID != "u1" {
+		updated, created = events[2], events[1]
+	}
+	if updated.Type != EventUserUpdated || updated.Before == nil || updated.Before.FirstName != "Before" || updated.After.FirstName != "After" {
+		t.Errorf("unexpected update event %+v", updated)
+	}
+	if created.Type != EventUserCreated || created.UserID != "u2" || created.Before != nil || created.After.FirstName != "New" {
+		t.Errorf("unexpected create event %+v", created)
+	}
+
+	// skipped users have no event
+	_, err = bulkLoadUsers(ctx, db, newSliceUserReader(users[:2]), BulkLoadOptions{Conflict: ConflictSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(outboxEvents(t, ctx, repo)); got != 3 {
+		t.Errorf("expected no event for skipped users , got %v events", got)
+	}
+}
+
+func TestConcurrentUpsertsOfNewUser(t *testing.T) {
+	db := openTestDB(t)
+	ctx := testTenant(t, db)
+	withOutbox(t)
+	repo := NewUserRepository(db)
+
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := repo.Upsert(ctx, UserBasic{UserID: "u1", FirstName: fmt.Sprintf("writer %v", i)})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts := make(map[EventType]int)
+	for _, event := range outboxEvents(t, ctx, repo) {
+		counts[event.Type]++
+	}
+	if counts[EventUserCreated] != 1 || counts[EventUserUpdated] != writers-1 {
+		t.Errorf("expected 1 user.created and %v user.updated , got %v", writers-1, counts)
+	}
+}
+
+// sinkFunc is an OutboxSink of a function
+type sinkFunc func(ctx context.Context, event ChangeEvent) error
+
+func (f sinkFunc) Deliver(ctx context.Context, event ChangeEvent) error {
+	return f(ctx, event)
+}
+
+func TestRelayDeliversOutsideTheClaim(t *testing.T) {
+	db := openTestDB(t)
+	ctx := testTenant(t, db)
+	withOutbox(t)
+	repo := NewUserRepository(db)
+
+	for _, userID := range []string{"u1", "u2"} {
+		_, err := repo.Create(ctx, UserBasic{UserID: userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the sink locks the event it gets : it would fail while the claim transaction holds it
+	var delivered []string
+	sinkErr := errors.New("sink down")
+	sink := sinkFunc(func(_ context.Context, event ChangeEvent) error {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return tx.Exec("SELECT id FROM user_outbox WHERE id = ? FOR UPDATE NOWAIT", event.ID).Error
+		})
+		if err != nil {
+			t.Errorf("event %v still locked while it is delivered : %v", event.ID, err)
+		}
+		delivered = append(delivered, event.UserID)
+		return sinkErr
+	})
+	relay := NewOutboxRelay(db, sink, OutboxRelayOptions{})
+
+	// the sink fails : the first event is retried, the second waits for the same retry without an attempt
+	_, err := relay.RelayOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(delivered, []string{"u1"}) {
+		t.Fatalf("expected one delivery before the sink failed , got %v", delivered)
+	}
+	var rows []OutboxEvent
+	err = db.WithContext(ctx).Order("id").Find(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Status != OutboxPending || rows[0].Attempts != 1 || rows[1].Attempts != 0 {
+		t.Fatalf("unexpected events after the failure %+v", rows)
+	}
+	if !rows[1].NextAttemptAt.Equal(rows[0].NextAttemptAt) || !rows[0].NextAttemptAt.After(time.Now()) {
+		t.Errorf("expected both events postponed to the retry , got %v and %v", rows[0].NextAttemptAt, rows[1].NextAttemptAt)
+	}
+
+	// back up : both delivered
+	sinkErr = nil
+	err = db.WithContext(ctx).Model(&OutboxEvent{}).Where("status = ?", OutboxPending).Update("next_attempt_at", time.Now().UTC().Add(-time.Second)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = relay.RelayOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WithContext(ctx).Order("id").Find(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if row.Status != OutboxDelivered || row.DeliveredAt == nil {
+			t.Errorf("event not delivered %+v", row)
+		}
+	}
+	if !equalStrings(delivered, []string{"u1", "u1", "u2"}) {
+		t.Errorf("unexpected deliveries %v", delivered)
+	}
+}
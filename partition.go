@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"gorm.io/gorm"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Hash partitioning of user_records
+
+For tables of hundreds of millions of users, user_records can be hash partitioned by user_id : vacuum,
+analyze and index rebuilds then work one partition at a time.
+
+	USERS_PARTITIONS=16 users migrate
+
+creates user_records with 16 partitions (user_records_p0 ... user_records_p15) when the table doesn't
+exist yet. Everything else goes through user_records as before : the primary key (tenant_id, user_id)
+holds the partition key, so upserts (ON CONFLICT), FOR UPDATE and the indexes work unchanged, a lookup
+by user_id reads a single partition, a search scans them all (like the single table).
+
+An existing user_records that is not partitioned is left alone by migrate (with a warning), "users
+partition" moves it online :
+
+	users partition -partitions 16 [-batch-size 5000] [-pause 0s] [-lock-timeout 5s]
+
+	1. creates user_records_partitioned (same columns, primary key and indexes) with its partitions
+	2. adds a trigger on user_records that mirrors every insert / update / delete to it from then on
+	3. copies the rows in batches of -batch-size in key order, each batch locks its rows FOR SHARE and
+	   skips the rows already there, so a row changed meanwhile keeps the version of the trigger
+	4. swaps the tables in one short transaction : user_records becomes user_records_unpartitioned, the
+	   copy becomes user_records, the change feed trigger and the row-level security policy (when on)
+	   are recreated on it
+
+Only the swap takes an exclusive lock, it gives up after -lock-timeout (instead of queuing every query
+behind it) and the command can simply be rerun : every step picks up what is already there, the copy
+skips the rows already copied.
+
+user_records_unpartitioned is kept as it was at the swap, drop it once you're happy with the result.
+
+FYI : the partition count can't be changed afterwards without another copy.
+    : the indexes of the copy are built before the rows are copied, so that no step blocks the writes
+      to user_records for longer than a batch.
+    : needs postgres 11+ (hash partitions, ON CONFLICT on partitioned tables).
+*/
+
+const (
+	maxPartitions              = 1024
+	defaultPartitionBatchSize  = 5000
+	defaultPartitionLockWait   = 5 * time.Second
+	partitionCopySuffix        = "_partitioned"
+	partitionOldSuffix         = "_unpartitioned"
+	partitionMirrorFunction    = "user_records_partition_mirror"
+	partitionProgressLogEvery  = 100 // batches
+	postgresMaxIdentifierBytes = 63
+)
+
+// userPartitions is set from USERS_PARTITIONS, 0 : user_records is a single table
+var userPartitions = 0
+
+func loadPartitionSettings() error {
+	value := os.Getenv("USERS_PARTITIONS")
+	if value == "" {
+		return nil
+	}
+	partitions, err := strconv.Atoi(value)
+	if err != nil || partitions < 0 || partitions == 1 || partitions > maxPartitions {
+		return fmt.Errorf("invalid value for environment variable USERS_PARTITIONS ( %v ) , please use 0 (no partitions) or 2 to %v", value, maxPartitions)
+	}
+	userPartitions = partitions
+	return nil
+}
+
+// partitionName is the name of partition i of table
+func partitionName(table string, i int) string {
+	return fmt.Sprintf("%v_p%v", table, i)
+}
+
+// isPartitioned tells whether table is a partitioned table
+func isPartitioned(tx *gorm.DB, table string) (bool, error) {
+	var relkind string
+	err := tx.Raw("SELECT relkind FROM pg_class WHERE oid = to_regclass(?)", table).Scan(&relkind).Error
+	return relkind == "p", err
+}
+
+// createPartitions creates the missing hash partitions of table, an existing different count is an error
+func createPartitions(tx *gorm.DB, table string, partitions int) error {
+	var existing int
+	err := tx.Raw("SELECT count(*) FROM pg_inherits WHERE inhparent = to_regclass(?)", table).Scan(&existing).Error
+	if err != nil {
+		return err
+	}
+	if existing != 0 && existing != partitions {
+		return fmt.Errorf("%v already has %v partitions , not %v , please use -partitions %v (or drop %v)", table, existing, partitions, existing, table)
+	}
+
+	for i := 0; i < partitions; i++ {
+		err := tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v PARTITION OF %v FOR VALUES WITH (MODULUS %v, REMAINDER %v)",
+			pgx.Identifier{partitionName(table, i)}.Sanitize(), pgx.Identifier{table}.Sanitize(), partitions, i)).Error
+		if err != nil {
+			return fmt.Errorf("could not create partition %v of %v : %w", i, table, err)
+		}
+	}
+	return nil
+}
+
+// migratePartitions creates user_records partitioned when USERS_PARTITIONS is set and the table doesn't exist
+func migratePartitions(ctx context.Context, tx *gorm.DB) error {
+	if userPartitions == 0 {
+		return nil
+	}
+	table := User{}.TableName()
+
+	if tx.Migrator().HasTable(table) {
+		partitioned, err := isPartitioned(tx, table)
+		if err != nil {
+			return err
+		}
+		if !partitioned {
+			appLog.Warn(ctx, "user_records is not partitioned , run \"users partition\" to move it online", "partitions", userPartitions)
+		}
+		return nil
+	}
+
+	err := tx.Set("gorm:table_options", " PARTITION BY HASH (user_id)").Migrator().CreateTable(&User{})
+	if err != nil {
+		return fmt.Errorf("could not create the partitioned %v : %w", table, err)
+	}
+	err = createPartitions(tx, table, userPartitions)
+	if err != nil {
+		return err
+	}
+	appLog.Info(ctx, "user_records created with hash partitions", "partitions", userPartitions)
+	return nil
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// online migration of an existing table
+
+type PartitionOptions struct {
+	Partitions  int
+	BatchSize   int           // rows per copy transaction
+	Pause       time.Duration // between batches, to leave room for the regular traffic
+	LockTimeout time.Duration // of the swap
+}
+
+type PartitionStats struct {
+	Scanned int64 // rows read from user_records
+	Copied  int64 // rows the copy inserted (the others were already there, through the trigger)
+	Batches int64
+}
+
+type existingIndex struct {
+	Name      string
+	IsPrimary bool
+	IsUnique  bool
+	Columns   string // quoted and comma separated, for the primary key
+	Def       string
+}
+
+// partitionUsers moves an unpartitioned user_records to hash partitions, see the steps above
+func partitionUsers(ctx context.Context, db *gorm.DB, opts PartitionOptions) (stats PartitionStats, err error) {
+	if opts.Partitions < 2 || opts.Partitions > maxPartitions {
+		return stats, fmt.Errorf("invalid partition count ( %v ) , please use 2 to %v", opts.Partitions, maxPartitions)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultPartitionBatchSize
+	}
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = defaultPartitionLockWait
+	}
+
+	table := User{}.TableName()
+	copyTable := table + partitionCopySuffix
+
+	partitioned, err := isPartitioned(db.WithContext(ctx), table)
+	if err != nil {
+		return stats, err
+	}
+	if partitioned {
+		appLog.Info(ctx, "user_records is already partitioned , nothing to do")
+		return stats, nil
+	}
+
+	indexes, err := tableIndexes(db.WithContext(ctx), table)
+	if err != nil {
+		return stats, err
+	}
+
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := createPartitionCopy(tx, table, copyTable, opts.Partitions, indexes)
+		if err != nil {
+			return err
+		}
+		return createPartitionMirror(tx, table, copyTable)
+	})
+	if err != nil {
+		return stats, err
+	}
+	appLog.Info(ctx, "partitioned copy ready , copying the rows", "table", copyTable, "partitions", opts.Partitions)
+
+	stats, err = copyToPartitions(ctx, db, table, copyTable, opts)
+	if err != nil {
+		return stats, err
+	}
+	appLog.Info(ctx, "rows copied , swapping the tables", "scanned", stats.Scanned, "copied", stats.Copied, "batches", stats.Batches)
+
+	err = swapPartitionedTable(ctx, db, table, copyTable, indexes, opts.LockTimeout)
+	if err != nil {
+		return stats, err
+	}
+	appLog.Info(ctx, "user_records is partitioned", "partitions", opts.Partitions, "old_table", table+partitionOldSuffix)
+	return stats, nil
+}
+
+// tableIndexes lists the indexes of table, primary key included
+func tableIndexes(tx *gorm.DB, table string) ([]existingIndex, error) {
+	indexes := make([]existingIndex, 0)
+	err := tx.Raw(`SELECT i.relname AS name, x.indisprimary AS is_primary, x.indisunique AS is_unique,
+	(SELECT string_agg(quote_ident(a.attname), ', ' ORDER BY k.n) FROM unnest(x.indkey) WITH ORDINALITY AS k(attnum, n)
+		JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = k.attnum) AS columns,
+	pg_get_indexdef(x.indexrelid) AS def
+FROM pg_index x
+JOIN pg_class i ON i.oid = x.indexrelid
+WHERE x.indrelid = to_regclass(?)
+ORDER BY i.relname`, table).Scan(&indexes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, index := range indexes {
+		if len(index.Name)+len(partitionCopySuffix) > postgresMaxIdentifierBytes || len(index.Name)+len(partitionOldSuffix) > postgresMaxIdentifierBytes {
+			return nil, fmt.Errorf("index name ( %v ) too long to be renamed , please rename it first", index.Name)
+		}
+	}
+	return indexes, nil
+}
+
+// createPartitionCopy creates copyTable like table, partitioned, with the same primary key and indexes
+// (named with partitionCopySuffix until the swap)
+func createPartitionCopy(tx *gorm.DB, table string, copyTable string, partitions int, indexes []existingIndex) error {
+	quotedTable, quotedCopy := pgx.Identifier{table}.Sanitize(), pgx.Identifier{copyTable}.Sanitize()
+
+	err := tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (LIKE %v INCLUDING DEFAULTS INCLUDING CONSTRAINTS) PARTITION BY HASH (user_id)",
+		quotedCopy, quotedTable)).Error
+	if err != nil {
+		return fmt.Errorf("could not create %v : %w", copyTable, err)
+	}
+	err = createPartitions(tx, copyTable, partitions)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		name := pgx.Identifier{index.Name + partitionCopySuffix}.Sanitize()
+		if index.IsPrimary {
+			var exists bool
+			err := tx.Raw("SELECT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = to_regclass(?) AND contype = 'p')", copyTable).Scan(&exists).Error
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			err = tx.Exec(fmt.Sprintf("ALTER TABLE %v ADD CONSTRAINT %v PRIMARY KEY (%v)", quotedCopy, name, index.Columns)).Error
+			if err != nil {
+				return fmt.Errorf("could not add the primary key to %v (it must contain user_id) : %w", copyTable, err)
+			}
+			continue
+		}
+
+		// pg_get_indexdef : CREATE [UNIQUE] INDEX name ON public.user_records USING btree (...)
+		using := strings.Index(index.Def, " USING ")
+		if using < 0 {
+			return fmt.Errorf("unexpected definition of index %v ( %v )", index.Name, index.Def)
+		}
+		unique := ""
+		if index.IsUnique {
+			unique = "UNIQUE "
+		}
+		err := tx.Exec(fmt.Sprintf("CREATE %vINDEX IF NOT EXISTS %v ON %v%v", unique, name, quotedCopy, index.Def[using:])).Error
+		if err != nil {
+			return fmt.Errorf("could not create index %v on %v : %w", index.Name, copyTable, err)
+		}
+	}
+	return nil
+}
+
+// createPartitionMirror adds the trigger that replays the writes of table on copyTable
+func createPartitionMirror(tx *gorm.DB, table string, copyTable string) error {
+	quotedTable, quotedCopy := pgx.Identifier{table}.Sanitize(), pgx.Identifier{copyTable}.Sanitize()
+	function := pgx.Identifier{partitionMirrorFunction}.Sanitize()
+
+	statements := []string{
+		// delete + insert : the columns are the same (LIKE), no need to list them for an update
+		fmt.Sprintf(`CREATE OR REPLACE FUNCTION %v() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP IN ('UPDATE', 'DELETE') THEN
+		DELETE FROM %v WHERE tenant_id = OLD.tenant_id AND user_id = OLD.user_id;
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		INSERT INTO %v SELECT NEW.*;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`, function, quotedCopy, quotedCopy),
+		fmt.Sprintf("DROP TRIGGER IF EXISTS %v ON %v", function, quotedTable),
+		fmt.Sprintf("CREATE TRIGGER %v AFTER INSERT OR UPDATE OR DELETE ON %v FOR EACH ROW EXECUTE FUNCTION %v()", function, quotedTable, function),
+	}
+	for _, statement := range statements {
+		err := tx.Exec(statement).Error
+		if err != nil {
+			return fmt.Errorf("could not create the mirror trigger : %w", err)
+		}
+	}
+	return nil
+}
+
+type partitionBatch struct {
+	Scanned      int64
+	Copied       int64
+	LastTenantID string
+	LastUserID   string
+}
+
+// copyToPartitions copies the rows of table to copyTable in key order, one transaction per batch
+func copyToPartitions(ctx context.Context, db *gorm.DB, table string, copyTable string, opts PartitionOptions) (PartitionStats, error) {
+	var stats PartitionStats
+	query := fmt.Sprintf(`WITH batch AS (
+	SELECT * FROM %v WHERE (tenant_id, user_id) > (?, ?) ORDER BY tenant_id, user_id LIMIT ? FOR SHARE
+), copied AS (
+	INSERT INTO %v SELECT * FROM batch ON CONFLICT DO NOTHING RETURNING 1
+), last AS (
+	SELECT tenant_id, user_id FROM batch ORDER BY tenant_id DESC, user_id DESC LIMIT 1
+)
+SELECT (SELECT count(*) FROM batch) AS scanned, (SELECT count(*) FROM copied) AS copied,
+	(SELECT tenant_id FROM last) AS last_tenant_id, (SELECT user_id FROM last) AS last_user_id`,
+		pgx.Identifier{table}.Sanitize(), pgx.Identifier{copyTable}.Sanitize())
+
+	afterTenantID, afterUserID := "", ""
+	for {
+		var batch partitionBatch
+		err := withTimeout(ctx, db, OpBulk, func(tx *gorm.DB) error {
+			return tx.Raw(query, afterTenantID, afterUserID, opts.BatchSize).Scan(&batch).Error
+		})
+		if err != nil {
+			return stats, fmt.Errorf("copy after ( %v , %v ) failed , rerun to resume : %w", afterTenantID, afterUserID, err)
+		}
+		if batch.Scanned == 0 {
+			return stats, nil
+		}
+
+		stats.Scanned += batch.Scanned
+		stats.Copied += batch.Copied
+		stats.Batches++
+		afterTenantID, afterUserID = batch.LastTenantID, batch.LastUserID
+		if stats.Batches%partitionProgressLogEvery == 0 {
+			appLog.Info(ctx, "copying to partitions", "scanned", stats.Scanned, "copied", stats.Copied, "tenant_id", afterTenantID, "user_id", afterUserID)
+		}
+
+		if opts.Pause > 0 {
+			select {
+			case <-ctx.Done():
+				return stats, ctx.Err()
+			case <-time.After(opts.Pause):
+			}
+		}
+	}
+}
+
+// swapPartitionedTable puts copyTable in place of table, in one transaction
+func swapPartitionedTable(ctx context.Context, db *gorm.DB, table string, copyTable string, indexes []existingIndex, lockTimeout time.Duration) error {
+	oldTable := table + partitionOldSuffix
+	quotedTable, quotedCopy := pgx.Identifier{table}.Sanitize(), pgx.Identifier{copyTable}.Sanitize()
+
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		statements := []string{
+			fmt.Sprintf("SET LOCAL lock_timeout = %v", lockTimeout.Milliseconds()),
+			fmt.Sprintf("LOCK TABLE %v IN ACCESS EXCLUSIVE MODE", quotedTable),
+			fmt.Sprintf("DROP TRIGGER IF EXISTS %v ON %v", pgx.Identifier{partitionMirrorFunction}.Sanitize(), quotedTable),
+			fmt.Sprintf("DROP FUNCTION IF EXISTS %v()", pgx.Identifier{partitionMirrorFunction}.Sanitize()),
+			fmt.Sprintf("DROP TRIGGER IF EXISTS %v ON %v", pgx.Identifier{userChangesFunction}.Sanitize(), quotedTable),
+			fmt.Sprintf("ALTER TABLE %v RENAME TO %v", quotedTable, pgx.Identifier{oldTable}.Sanitize()),
+		}
+		for _, index := range indexes {
+			statements = append(statements, fmt.Sprintf("ALTER INDEX %v RENAME TO %v",
+				pgx.Identifier{index.Name}.Sanitize(), pgx.Identifier{index.Name + partitionOldSuffix}.Sanitize()))
+		}
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %v RENAME TO %v", quotedCopy, quotedTable))
+		for _, index := range indexes {
+			statements = append(statements, fmt.Sprintf("ALTER INDEX %v RENAME TO %v",
+				pgx.Identifier{index.Name + partitionCopySuffix}.Sanitize(), pgx.Identifier{index.Name}.Sanitize()))
+		}
+
+		for _, statement := range statements {
+			err := tx.Exec(statement).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// the partitions keep the name of the copy, rename them after the table
+		var partitions int
+		err := tx.Raw("SELECT count(*) FROM pg_inherits WHERE inhparent = to_regclass(?)", table).Scan(&partitions).Error
+		if err != nil {
+			return err
+		}
+		for i := 0; i < partitions; i++ {
+			err := tx.Exec(fmt.Sprintf("ALTER TABLE %v RENAME TO %v",
+				pgx.Identifier{partitionName(copyTable, i)}.Sanitize(), pgx.Identifier{partitionName(table, i)}.Sanitize())).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// triggers and policies are per table
+		err = migrateChangeTrigger(tx)
+		if err != nil {
+			return err
+		}
+		if tenantRLS {
+			return enableTenantRLS(tx)
+		}
+		return nil
+	})
+	if isLockTimeout(err) {
+		return fmt.Errorf("could not lock %v within %v , the copy is kept up to date , rerun to retry the swap : %w", table, lockTimeout, err)
+	}
+	return err
+}
+
+// pgLockNotAvailable is the postgres error code of a lock_timeout
+const pgLockNotAvailable = "55P03"
+
+func isLockTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgLockNotAvailable
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+/*
+The partition tests drop and recreate user_records, they need a database of their own, skipped unless set :
+
+	USERS_TEST_PARTITION_DSN="host=localhost ... dbname=users_partition"
+*/
+
+// partitionTestDB is the USERS_TEST_PARTITION_DSN database with a new user_records, hash partitioned in
+// partitions (a single table for 0), and a tenant of its own
+func partitionTestDB(t *testing.T, partitions int) (context.Context, *gorm.DB) {
+	t.Helper()
+	db := openTestDB(t, "USERS_TEST_PARTITION_DSN")
+	table := User{}.TableName()
+	for _, statement := range []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %v, %v, %v CASCADE", table, table+partitionCopySuffix, table+partitionOldSuffix),
+		fmt.Sprintf("DROP FUNCTION IF EXISTS %v() CASCADE", partitionMirrorFunction),
+	} {
+		err := db.Exec(statement).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := userPartitions
+	userPartitions = partitions
+	err := InitializeTables(contextWithTenant(context.Background(), allTenants), db)
+	userPartitions = saved
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testTenant(t, db), db
+}
+
+// checkPartitionedUsers checks that user_records is partitioned and that create, upsert and search work on it
+func checkPartitionedUsers(t *testing.T, ctx context.Context, db *gorm.DB) {
+	t.Helper()
+	partitioned, err := isPartitioned(db, User{}.TableName())
+	if err != nil || !partitioned {
+		t.Fatalf("user_records is not partitioned ( %v )", err)
+	}
+	repo := NewUserRepository(db)
+
+	_, err = repo.Create(ctx, UserBasic{UserID: "p1", FirstName: "Partitioned"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.Create(ctx, UserBasic{UserID: "p1"})
+	if !errors.Is(err, ErrUserExists) {
+		t.Errorf("create of an existing user_id , got %v , want already exists", err)
+	}
+
+	// ON CONFLICT on the partitioned primary key
+	_, err = repo.Upsert(ctx, UserBasic{UserID: "p1", FirstName: "Sonia", Email: "sonia@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows int64
+	err = db.WithContext(ctx).Model(&User{}).Where("user_id = ?", "p1").Count(&rows).Error
+	if err != nil || rows != 1 {
+		t.Errorf("upsert of an existing user_id : ( %v , %v ) rows , want 1", rows, err)
+	}
+	user, err := repo.Get(ctx, "p1")
+	if err != nil || user.FirstName != "Sonia" {
+		t.Errorf("upsert didn't update the user ( %v , %v )", user.FirstName, err)
+	}
+
+	users, err := repo.Search(ctx, SearchOptions{Terms: []string{"sonia@example.com"}, Exact: true, Operator: SearchAND})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := userIDs(users); !equalStrings(ids, []string{"p1"}) {
+		t.Errorf("search found %v , want [p1]", ids)
+	}
+}
+
+func TestMigratePartitions(t *testing.T) {
+	ctx, db := partitionTestDB(t, 4)
+
+	var partitions int
+	err := db.Raw("SELECT count(*) FROM pg_inherits WHERE inhparent = to_regclass(?)", User{}.TableName()).Scan(&partitions).Error
+	if err != nil || partitions != 4 {
+		t.Errorf("expected 4 partitions , got ( %v , %v )", partitions, err)
+	}
+	checkPartitionedUsers(t, ctx, db)
+}
+
+func TestPartitionUsersOnline(t *testing.T) {
+	ctx, db := partitionTestDB(t, 0)
+	repo := NewUserRepository(db)
+
+	const loaded = 1000
+	users := make([]UserBasic, 0, loaded)
+	expected := make(map[string]string) // user_id : first_name
+	for i := 0; i < loaded; i++ {
+		user := UserBasic{UserID: fmt.Sprintf("u%04d", i), FirstName: "Loaded"}
+		users = append(users, user)
+		expected[user.UserID] = user.FirstName
+	}
+	_, err := bulkLoadUsers(ctx, db, newSliceUserReader(users), BulkLoadOptions{Conflict: ConflictFail})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// updates, inserts and deletes until the table is partitioned, expected follows them
+	stop, started, written := make(chan struct{}), make(chan struct{}), make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				written <- nil
+				return
+			default:
+			}
+
+			userID, firstName := fmt.Sprintf("u%04d", i%loaded), fmt.Sprintf("Updated%v", i)
+			if i%3 == 0 {
+				userID = fmt.Sprintf("w%04d", i)
+			}
+			_, err := repo.Upsert(ctx, UserBasic{UserID: userID, FirstName: firstName})
+			if err != nil {
+				written <- fmt.Errorf("upsert of %v : %w", userID, err)
+				return
+			}
+			expected[userID] = firstName
+
+			if i%15 == 0 && i > 0 {
+				userID = fmt.Sprintf("w%04d", i-3)
+				err := repo.Delete(ctx, userID)
+				if err != nil {
+					written <- fmt.Errorf("delete of %v : %w", userID, err)
+					return
+				}
+				delete(expected, userID)
+			}
+			if i == 0 {
+				close(started)
+			}
+		}
+	}()
+
+	select {
+	case <-started:
+	case err := <-written:
+		t.Fatal(err)
+	}
+	stats, err := partitionUsers(contextWithTenant(context.Background(), allTenants), db, PartitionOptions{
+		Partitions: 4,
+		BatchSize:  100,
+		Pause:      10 * time.Millisecond,
+	})
+	close(stop)
+	if writeErr := <-written; writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Scanned < loaded || stats.Batches < loaded/100 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// every row as the last write left it
+	rows := make([]User, 0)
+	err = db.WithContext(ctx).Find(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(expected) {
+		t.Errorf("%v rows after the swap , want %v", len(rows), len(expected))
+	}
+	for _, row := range rows {
+		if firstName, ok := expected[row.UserID]; !ok || row.FirstName != firstName {
+			t.Errorf("%v : first name %q after the swap , want %q (exists = %v)", row.UserID, row.FirstName, firstName, ok)
+		}
+	}
+
+	var old int64
+	err = db.WithContext(ctx).Table(User{}.TableName() + partitionOldSuffix).Count(&old).Error
+	if err != nil || old == 0 {
+		t.Errorf("user_records_unpartitioned not kept ( %v , %v )", old, err)
+	}
+
+	// a rerun has nothing to do
+	stats, err = partitionUsers(contextWithTenant(context.Background(), allTenants), db, PartitionOptions{Partitions: 4})
+	if err != nil || stats.Scanned != 0 {
+		t.Errorf("rerun on the partitioned table ( %+v , %v )", stats, err)
+	}
+
+	checkPartitionedUsers(t, ctx, db)
+}
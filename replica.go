@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Read replicas
+
+Searches (regex scans over string_rep), lists and exports can run on read replicas, so that they don't
+compete with the writes on the primary :
+
+	USERS_REPLICA_HOSTS=replica-1.internal,replica-2.internal
+	USERS_REPLICA_MAX_LAG=5s
+
+The replicas use the user, password and database of the primary (PGSQLMETADATA*). Routing :
+
+	primary  : create, upsert, delete, get, batch get, email lookups (read-your-writes), migrate, import,
+	           reindex, reencrypt, relay, the change feed
+	replica  : list, search, ListEach / SearchEach, export
+
+The lag of every replica is checked every 2s (replay lag, 0 when it has replayed all it received, 0 as
+well for a server that is not a standby). A standby whose WAL receiver is not streaming (the primary is
+unreachable, or it only restores from an archive) can't tell how far behind it is : it is not used.
+
+A search / list goes to the next replica (round robin) whose last check succeeded and is under
+USERS_REPLICA_MAX_LAG, to the primary when there is none : a replica that is down, lagging, or not
+checked for a while is skipped until it is back.
+
+contextWithPrimaryReads(ctx) sends the searches / lists of ctx to the primary, for a caller that needs
+to see its own write right away (a list just after a create).
+
+FYI : an export reads from the replica picked when it starts, for its whole cursor.
+    : a replica that is down when the process starts doesn't stop it, it is skipped until a check succeeds.
+*/
+
+const (
+	defaultReplicaMaxLag   = 5 * time.Second
+	replicaCheckInterval   = 2 * time.Second
+	replicaCheckTimeout    = time.Second
+	replicaCheckStaleAfter = 3 * replicaCheckInterval
+)
+
+/*
+replicaLagQuery is the replay lag in seconds, -1 when it can't be told (nothing replayed yet), -2 when
+the standby is not streaming from the primary : its receive and replay positions then stay equal, and it
+would report no lag however far behind it falls. The status of pg_stat_wal_receiver is only shown to
+pg_read_all_stats, for other roles a running receiver (pid) is taken as streaming.
+*/
+const replicaLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() THEN 0
+	WHEN NOT EXISTS (SELECT 1 FROM pg_stat_wal_receiver
+		WHERE pid IS NOT NULL AND COALESCE(status, 'streaming') = 'streaming') THEN -2
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), -1)
+END`
+
+// replicaHosts and replicaMaxLag are set from USERS_REPLICA_HOSTS and USERS_REPLICA_MAX_LAG
+var (
+	replicaHosts  []string
+	replicaMaxLag = defaultReplicaMaxLag
+)
+
+func loadReplicaSettings() error {
+	replicaHosts = nil
+	for _, host := range strings.Split(os.Getenv("USERS_REPLICA_HOSTS"), ",") {
+		host = strings.TrimSpace(host)
+		if host != "" {
+			replicaHosts = append(replicaHosts, host)
+		}
+	}
+
+	if value := os.Getenv("USERS_REPLICA_MAX_LAG"); value != "" {
+		maxLag, err := time.ParseDuration(value)
+		if err != nil || maxLag <= 0 {
+			return fmt.Errorf("invalid duration for environment variable USERS_REPLICA_MAX_LAG ( %v )", value)
+		}
+		replicaMaxLag = maxLag
+	}
+	return nil
+}
+
+type primaryReadsKey struct{}
+
+// contextWithPrimaryReads sends the searches / lists of ctx to the primary
+func contextWithPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+func primaryReads(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadsKey{}).(bool)
+	return primary
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// replica set
+
+type ReplicaSet struct {
+	primary  *gorm.DB
+	replicas []*replica
+	maxLag   time.Duration
+	next     uint32 // round robin
+}
+
+type replica struct {
+	host string
+	db   *gorm.DB
+
+	lock      sync.Mutex
+	lag       time.Duration
+	err       error // of the last check
+	checkedAt time.Time
+}
+
+// connectReplicas opens the replicas of hosts and checks their lag once, a replica that is down is skipped
+func connectReplicas(ctx context.Context, primary *gorm.DB, hosts []string, maxLag time.Duration) (*ReplicaSet, error) {
+	set := &ReplicaSet{primary: primary, maxLag: maxLag}
+	for i, host := range hosts {
+		db, err := openDB(hostDSN(host), fmt.Sprintf("users_replica_%d", i+1), true)
+		if err != nil {
+			return nil, fmt.Errorf("could not open replica ( %v ) : %w", host, err)
+		}
+		set.replicas = append(set.replicas, &replica{host: host, db: db})
+	}
+	set.check(ctx)
+	return set, nil
+}
+
+// Reader is the database of a search, list or export with ctx : a replica under the lag threshold, or
+// the primary
+func (s *ReplicaSet) Reader(ctx context.Context) *gorm.DB {
+	if len(s.replicas) == 0 || primaryReads(ctx) {
+		return s.primary
+	}
+
+	start := int(atomic.AddUint32(&s.next, 1))
+	for i := range s.replicas {
+		r := s.replicas[(start+i)%len(s.replicas)]
+		if r.usable(s.maxLag) {
+			replicaReads.WithLabelValues(r.host).Inc()
+			return r.db
+		}
+	}
+	replicaReads.WithLabelValues("primary").Inc()
+	return s.primary
+}
+
+// Run checks the lag of the replicas until ctx is done
+func (s *ReplicaSet) Run(ctx context.Context) {
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.check(ctx)
+		}
+	}
+}
+
+func (s *ReplicaSet) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, r := range s.replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			r.check(ctx, s.maxLag)
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (r *replica) check(ctx context.Context, maxLag time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+	defer cancel()
+
+	var seconds float64
+	err := r.db.WithContext(ctx).Raw(replicaLagQuery).Scan(&seconds).Error
+	switch {
+	case err != nil:
+	case seconds == -2:
+		err = errors.New("wal receiver not streaming , the replica is not following the primary")
+	case seconds < 0:
+		err = errors.New("replay lag unknown , nothing replayed yet")
+	}
+	lag := time.Duration(seconds * float64(time.Second))
+
+	r.lock.Lock()
+	wasUsable := r.err == nil && r.lag <= maxLag
+	r.lag, r.err, r.checkedAt = lag, err, time.Now()
+	r.lock.Unlock()
+
+	if err != nil {
+		replicaLag.WithLabelValues(r.host).Set(-1)
+	} else {
+		replicaLag.WithLabelValues(r.host).Set(lag.Seconds())
+	}
+
+	// log the transitions only, not every check
+	isUsable := err == nil && lag <= maxLag
+	switch {
+	case wasUsable && err != nil:
+		appLog.Warn(ctx, "replica check failed , reads go to the other replicas or the primary",
+			"replica", r.host, "error", err)
+	case wasUsable && !isUsable:
+		appLog.Warn(ctx, "replica lagging , reads go to the other replicas or the primary",
+			"replica", r.host, "lag", lag.String(), "max_lag", maxLag.String())
+	case !wasUsable && isUsable:
+		appLog.Info(ctx, "replica back in use", "replica", r.host, "lag", lag.String())
+	}
+}
+
+func (r *replica) usable(maxLag time.Duration) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err == nil && !r.checkedAt.IsZero() && time.Since(r.checkedAt) < replicaCheckStaleAfter && r.lag <= maxLag
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+The routing tests need two databases, skipped unless both are set :
+
+	USERS_TEST_PRIMARY="host=localhost ... dbname=users_primary" USERS_TEST_REPLICA="host=localhost ... dbname=users_replica"
+
+USERS_TEST_REPLICA stands in for a replica, it is a database of its own (not a standby : its lag is 0) so
+that the tests can write rows to it only, and tell which database a read went to.
+*/
+
+// testReplicaSet is a replica set of the USERS_TEST_PRIMARY and USERS_TEST_REPLICA databases, with the tenant
+// of ctx cleaned up on both
+func testReplicaSet(t *testing.T, maxLag time.Duration) (context.Context, *ReplicaSet) {
+	t.Helper()
+	primary := openTestDB(t, "USERS_TEST_PRIMARY")
+	replicaDB := openTestDB(t, "USERS_TEST_REPLICA")
+	ctx := testTenant(t, primary)
+	tenantID, _ := tenantFromContext(ctx)
+	t.Cleanup(func() {
+		_ = replicaDB.Exec("DELETE FROM "+User{}.TableName()+" WHERE tenant_id = ?", tenantID).Error
+	})
+
+	set := &ReplicaSet{primary: primary, maxLag: maxLag, replicas: []*replica{{host: "test-replica", db: replicaDB}}}
+	set.check(ctx)
+	if !set.replicas[0].usable(maxLag) {
+		t.Fatalf("test replica not usable ( %v )", set.replicas[0].err)
+	}
+	return ctx, set
+}
+
+// userIDs are the sorted user_ids of users
+func userIDs(users []User) []string {
+	ids := make([]string, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.UserID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// exportedUserIDs runs "users export" as the cli would, with the replicas of set
+func exportedUserIDs(t *testing.T, ctx context.Context, set *ReplicaSet) []string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "users.ndjson")
+	c := &cli{ctx: ctx, stdout: os.Stdout, stderr: os.Stderr, db: set.primary, replicas: set}
+	err := runExportCLICommand(c, []string{"-format", "ndjson", "-file", fileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		if line == "" {
+			continue
+		}
+		var user UserBasic
+		err := json.Unmarshal([]byte(line), &user)
+		if err != nil {
+			t.Fatalf("invalid export line ( %v ) : %v", line, err)
+		}
+		ids = append(ids, user.UserID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestReplicaRouting(t *testing.T) {
+	ctx, set := testReplicaSet(t, time.Minute)
+	repo := NewUserRepository(set.primary).WithReplicas(set)
+
+	// p1 is on the primary only, r1 on the replica only
+	_, err := repo.Create(ctx, UserBasic{UserID: "p1", FirstName: "Primary"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewUserRepository(set.replicas[0].db).Create(ctx, UserBasic{UserID: "r1", FirstName: "Replica"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// list, search and export read the replica
+	users, err := repo.List(ctx, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := userIDs(users); !equalStrings(ids, []string{"r1"}) {
+		t.Errorf("list read %v , want the replica", ids)
+	}
+	users, err = repo.Search(ctx, SearchOptions{Terms: []string{"Replica", "Primary"}, Exact: true, Operator: SearchOR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := userIDs(users); !equalStrings(ids, []string{"r1"}) {
+		t.Errorf("search read %v , want the replica", ids)
+	}
+	if ids := exportedUserIDs(t, ctx, set); !equalStrings(ids, []string{"r1"}) {
+		t.Errorf("export read %v , want the replica", ids)
+	}
+
+	// get and writes go to the primary
+	_, err = repo.Get(ctx, "p1")
+	if err != nil {
+		t.Errorf("get of a primary row : %v", err)
+	}
+	_, err = repo.Get(ctx, "r1")
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("get of a replica only row , got %v , want not found", err)
+	}
+	_, err = repo.Create(ctx, UserBasic{UserID: "p2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewUserRepository(set.replicas[0].db).Get(ctx, "p2")
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("create written to the replica ( %v )", err)
+	}
+
+	// reads that need their own writes stay on the primary
+	users, err = repo.List(contextWithPrimaryReads(ctx), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := userIDs(users); !equalStrings(ids, []string{"p1", "p2"}) {
+		t.Errorf("list with primary reads read %v , want the primary", ids)
+	}
+}
+
+func TestReplicaFallbackToPrimary(t *testing.T) {
+	maxLag := time.Second
+	ctx, set := testReplicaSet(t, maxLag)
+	repo := NewUserRepository(set.primary).WithReplicas(set)
+
+	_, err := repo.Create(ctx, UserBasic{UserID: "p1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewUserRepository(set.replicas[0].db).Create(ctx, UserBasic{UserID: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := func() []string {
+		t.Helper()
+		users, err := repo.List(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return userIDs(users)
+	}
+	if ids := listed(); !equalStrings(ids, []string{"r1"}) {
+		t.Fatalf("list read %v , want the replica", ids)
+	}
+
+	// lagging past the limit : the primary
+	r := set.replicas[0]
+	r.lock.Lock()
+	r.lag = 2 * maxLag
+	r.lock.Unlock()
+	if ids := listed(); !equalStrings(ids, []string{"p1"}) {
+		t.Errorf("list read %v with a lagging replica , want the primary", ids)
+	}
+	if ids := exportedUserIDs(t, ctx, set); !equalStrings(ids, []string{"p1"}) {
+		t.Errorf("export read %v with a lagging replica , want the primary", ids)
+	}
+
+	// back under the limit at the next check
+	set.check(ctx)
+	if ids := listed(); !equalStrings(ids, []string{"r1"}) {
+		t.Errorf("list read %v once the replica caught up , want the replica", ids)
+	}
+
+	// a failed check : the primary
+	replicaDB := r.db
+	r.db = unreachableDB(t)
+	set.check(ctx)
+	r.db = replicaDB
+	if ids := listed(); !equalStrings(ids, []string{"p1"}) {
+		t.Errorf("list read %v after a failed check , want the primary", ids)
+	}
+}
+
+func TestReplicaSetReader(t *testing.T) {
+	primary, replicaDB := unreachableDB(t), unreachableDB(t)
+	maxLag := time.Second
+	r := &replica{host: "test-replica", db: replicaDB}
+	set := &ReplicaSet{primary: primary, maxLag: maxLag, replicas: []*replica{r}}
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name      string
+		lag       time.Duration
+		err       error
+		checkedAt time.Time
+		ctx       context.Context
+		want      *gorm.DB
+	}{
+		{"not checked yet", 0, nil, time.Time{}, ctx, primary},
+		{"under the lag limit", maxLag / 2, nil, time.Now(), ctx, replicaDB},
+		{"primary reads", 0, nil, time.Now(), contextWithPrimaryReads(ctx), primary},
+		{"over the lag limit", 2 * maxLag, nil, time.Now(), ctx, primary},
+		{"failed check", 0, errors.New("wal receiver not streaming"), time.Now(), ctx, primary},
+		{"stale check", 0, nil, time.Now().Add(-2 * replicaCheckStaleAfter), ctx, primary},
+	} {
+		r.lag, r.err, r.checkedAt = test.lag, test.err, test.checkedAt
+		if got := set.Reader(test.ctx); got != test.want {
+			t.Errorf("%v : reads went to the %v", test.name, map[bool]string{true: "primary", false: "replica"}[got == primary])
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+/*
+UserRepository is the data-access layer for user_records used by the command-line client (and
+anything else that needs users without going through main()).
+
+Errors :
+
+	ErrUserNotFound    : no row for the given user_id
+	ErrUserExists      : create with a user_id that is already taken
+	ErrInvalidArgument : bad input (empty user_id, empty search, unknown search mode ...)
+	ErrStatementTimeout : the operation ran into its statement_timeout (see timeout.go)
+
+ErrUserNotFound / ErrUserExists wrap ErrNotFound / ErrAlreadyExists, which is what Repository[T] (see
+generic_repository.go) returns for the other models.
+
+a cancelled / expired context returns the context error, anything else is a database error and is
+returned as-is.
+
+Events : create, upsert and delete write their change event to the outbox in the same transaction, when
+USERS_OUTBOX is set (see outbox.go).
+
+Tenants : every call runs in the tenant of its context (see tenant.go), repo.ForTenant("acme") returns a
+repository whose calls always run in "acme", whatever tenant the context carries.
+
+Cache : repo.WithCache(cache) returns a repository whose Get and BatchGet read through cache, its writes
+drop the users they change from it (see cache.go).
+
+Replicas : repo.WithReplicas(replicas) returns a repository whose List, Search, ListEach and SearchEach
+run on a replica, the other calls stay on the primary (see replica.go).
+*/
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrAlreadyExists   = errors.New("already exists")
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// the user flavours, errors.Is(err, ErrNotFound) holds for ErrUserNotFound (and any Repository[T] not found)
+	ErrUserNotFound = fmt.Errorf("user %w", ErrNotFound)
+	ErrUserExists   = fmt.Errorf("user %w", ErrAlreadyExists)
+)
+
+// pgUniqueViolation is the postgres error code for a duplicate key
+const pgUniqueViolation = "23505"
+
+const defaultListLimit = 100
+
+type UserRepository struct {
+	db       *gorm.DB
+	tenantID string      // empty : the tenant of the context
+	cache    UserCache   // nil : no cache
+	replicas *ReplicaSet // nil : everything on db
+}
+
+func NewUserRepository(db *gorm.DB) *UserRepository {
+	return &UserRepository{db: db}
+}
+
+// ForTenant returns a repository scoped to tenantID, every query, create, upsert and search is filtered by it
+func (r *UserRepository) ForTenant(tenantID string) (*UserRepository, error) {
+	err := validateTenantID(tenantID, false)
+	if err != nil {
+		return nil, invalidArgument("%v", err.Error())
+	}
+	scoped := *r
+	scoped.tenantID = tenantID
+	return &scoped, nil
+}
+
+// WithCache returns a repository that reads users through cache, see cache.go
+func (r *UserRepository) WithCache(cache UserCache) *UserRepository {
+	cached := *r
+	cached.cache = cache
+	return &cached
+}
+
+// WithReplicas returns a repository that runs its lists and searches on replicas, see replica.go
+func (r *UserRepository) WithReplicas(replicas *ReplicaSet) *UserRepository {
+	routed := *r
+	routed.replicas = replicas
+	return &routed
+}
+
+// readDB is the database of the lists and searches of ctx
+func (r *UserRepository) readDB(ctx context.Context) *gorm.DB {
+	if r.replicas == nil {
+		return r.db
+	}
+	return r.replicas.Reader(ctx)
+}
+
+// scope puts the tenant of the repository (if any) into ctx
+func (r *UserRepository) scope(ctx context.Context) context.Context {
+	if r.tenantID == "" {
+		return ctx
+	}
+	return contextWithTenant(ctx, r.tenantID)
+}
+
+type ListOptions struct {
+	Limit       int                        // defaults to 100
+	Offset      int                        // offset pagination
+	AfterUserID string                     // keyset pagination : only users with a user_id greater than this one
+	Filter      func(db *gorm.DB) *gorm.DB // optional, e.g. a searchFilter
+}
+
+type SearchOptions struct {
+	Terms    []string
+	Exact    bool   // exact (whole value) search, otherwise pattern search
+	Operator Search // SearchAND or SearchOR
+	Limit    int    // 0 : no limit
+}
+
+func invalidArgument(format string, args ...interface{}) error {
+	return fmt.Errorf("%w : %v", ErrInvalidArgument, fmt.Sprintf(format, args...))
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation
+}
+
+func (r *UserRepository) Migrate(ctx context.Context) (err error) {
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.Migrate")
+	defer func() { endRepositoryCall(span, "Migrate", err) }()
+
+	err = InitializeTables(ctx, r.db)
+	if err != nil {
+		return err
+	}
+
+	// string_rep written before the '#' escaping, see string_rep.go
+	_, err = migrateStringRepEncoding(ctx, r.db, defaultIterateChunkSize)
+	return err
+}
+
+func (r *UserRepository) Create(ctx context.Context, userBasic UserBasic) (_ User, err error) {
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.Create", attribute.String("user.id", userBasic.UserID))
+	defer func() { endRepositoryCall(span, "Create", err) }()
+
+	err = validateUserBasic(userBasic)
+	if err != nil {
+		return User{}, invalidArgument("%v", err.Error())
+	}
+
+	tenantID, err := writeTenant(ctx)
+	if err != nil {
+		return User{}, invalidArgument("%v", err.Error())
+	}
+
+	applyUserDefaults(&userBasic)
+	user := User{TenantID: tenantID, UserBasic: userBasic}
+	err = withTimeout(ctx, r.db, OpWrite, func(tx *gorm.DB) error {
+		return outboxTransaction(tx, func(tx *gorm.DB) error {
+			// holds back an upsert of the same new user until the create is committed
+			_, err := lockUserForChange(tx, userBasic.UserID)
+			if err != nil {
+				return err
+			}
+			err = tx.Create(&user).Error
+			if err != nil {
+				return err
+			}
+			return writeOutboxEvent(ctx, tx, EventUserCreated, nil, &userBasic)
+		})
+	})
+	if isUniqueViolation(err) {
+		return User{}, fmt.Errorf("%w : %v", ErrUserExists, userBasic.UserID)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	r.invalidate(ctx, userBasic.UserID)
+
+	// read it back, so that the column defaults are filled in
+	return r.Get(ctx, userBasic.UserID)
+}
+
+func (r *UserRepository) Get(ctx context.Context, userID string) (_ User, err error) {
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.Get", attribute.String("user.id", userID))
+	defer func() { endRepositoryCall(span, "Get", err) }()
+
+	if strings.TrimSpace(userID) == "" {
+		return User{}, invalidArgument("user_id is empty")
+	}
+
+	tenantID, cached := r.cacheTenant(ctx)
+	if cached {
+		if user, ok := r.cache.Get(ctx, tenantID, userID); ok {
+			cacheRequests.WithLabelValues("hit").Inc()
+			span.SetAttributes(attribute.Bool("cache.hit", true))
+			return user, nil
+		}
+		cacheRequests.WithLabelValues("miss").Inc()
+		span.SetAttributes(attribute.Bool("cache.hit", false))
+	}
+
+	var user User
+	err = withTimeout(ctx, r.db, OpRead, func(tx *gorm.DB) error {
+		return tx.Where(map[string]interface{}{"user_id": userID}).Take(&user).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return User{}, fmt.Errorf("%w : %v", ErrUserNotFound, userID)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if cached {
+		r.cache.Set(ctx, user)
+	}
+	return user, nil
+}
+
+// FindByEmail returns the users with this email (case insensitive), through the blind index when email is encrypted
+func (r *UserRepository) FindByEmail(ctx context.Context, email string) (_ []User, err error) {
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.FindByEmail")
+	defer func() { endRepositoryCall(span, "FindByEmail", err) }()
+
+	if strings.TrimSpace(email) == "" {
+		return nil, invalidArgument("email is empty")
+	}
+
+	users := make([]User, 0)
+	err = withTimeout(ctx, r.db, OpRead, func(tx *gorm.DB) error {
+		return tx.Where(lowerColumnEquals("email", email)).Order("user_id").Find(&users).Error
+	})
+	return users, err
+}
+
+// BatchGet returns the users found for userIDs, in the order of userIDs, and the user_ids that were not found
+func (r *UserRepository) BatchGet(ctx context.Context, userIDs []string) (_ []User, _ []string, err error) {
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.BatchGet", attribute.Int("users.requested", len(userIDs)))
+	defer func() { endRepositoryCall(span, "BatchGet", err) }()
+
+	if len(userIDs) == 0 {
+		return nil, nil, invalidArgument("no user_ids given")
+	}
+
+	byID := make(map[string]User, len(userIDs))
+	toRead := userIDs
+	tenantID, cached := r.cacheTenant(ctx)
+	if cached {
+		toRead = make([]string, 0, len(userIDs))
+		for _, userID := range userIDs {
+			if _, ok := byID[userID]; ok {
+				continue
+			}
+			if user, ok := r.cache.Get(ctx, tenantID, userID); ok {
+				byID[userID] = user
+				cacheRequests.WithLabelValues("hit").Inc()
+			} else {
+				toRead = append(toRead, userID)
+				cacheRequests.WithLabelValues("miss").Inc()
+			}
+		}
+		span.SetAttributes(attribute.Int("cache.hits", len(byID)), attribute.Int("cache.misses", len(toRead)))
+	}
+
+	if len(toRead) > 0 {
+		found := make([]User, 0, len(toRead))
+		err = withTimeout(ctx, r.db, OpRead, func(tx *gorm.DB) error {
+			return tx.Where("user_id IN ?", toRead).Find(&found).Error
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, user := range found {
+			byID[user.UserID] = user
+			if cached {
+				r.cache.Set(ctx, user)
+			}
+		}
+	}
+
+	users := make([]User, 0, len(byID))
+	missing := make([]string, 0)
+	for _, userID := range userIDs {
+		if user, ok := byID[userID]; ok {
+			users = append(users, user)
+		} else {
+			missing = append(missing, userID)
+		}
+	}
+	span.SetAttributes(attribute.Int("users.found", len(users)), attribute.Int("users.missing", len(missing)))
+	return users, missing, nil
+}
+
+// Upsert creates the user, or updates all its columns when the user_id already exists
+func (r *UserRepository) Upsert(ctx context.Context, userBasic UserBasic) (_ User, err error) {
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.Upsert", attribute.String("user.id", userBasic.UserID))
+	defer func() { endRepositoryCall(span, "Upsert", err) }()
+
+	err = validateUserBasic(userBasic)
+	if err != nil {
+		return User{}, invalidArgument("%v", err.Error())
+	}
+
+	tenantID, err := writeTenant(ctx)
+	if err != nil {
+		return User{}, invalidArgument("%v", err.Error())
+	}
+
+	applyUserDefaults(&userBasic)
+	user := User{TenantID: tenantID, UserBasic: userBasic}
+	err = withTimeout(ctx, r.db, OpWrite, func(tx *gorm.DB) error {
+		return outboxTransaction(tx, func(tx *gorm.DB) error {
+			before, err := lockUserForChange(tx, userBasic.UserID)
+			if err != nil {
+				return err
+			}
+			err = tx.Clauses(clause.OnConflict{
+				UpdateAll: true,
+			}).Create(&user).Error
+			if err != nil {
+				return err
+			}
+			if before == nil {
+				return writeOutboxEvent(ctx, tx, EventUserCreated, nil, &userBasic)
+			}
+			return writeOutboxEvent(ctx, tx, EventUserUpdated, before, &userBasic)
+		})
+	})
+	if err != nil {
+		return User{}, err
+	}
+	r.invalidate(ctx, userBasic.UserID)
+
+	return r.Get(ctx, userBasic.UserID)
+}
+
+func (r *UserRepository) Delete(ctx context.Context, userID string) (err error) {
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.Delete", attribute.String("user.id", userID))
+	defer func() { endRepositoryCall(span, "Delete", err) }()
+
+	if strings.TrimSpace(userID) == "" {
+		return invalidArgument("user_id is empty")
+	}
+	_, err = writeTenant(ctx)
+	if err != nil {
+		return invalidArgument("%v", err.Error())
+	}
+
+	var rowsAffected int64
+	err = withTimeout(ctx, r.db, OpWrite, func(tx *gorm.DB) error {
+		return outboxTransaction(tx, func(tx *gorm.DB) error {
+			before, err := lockUserForChange(tx, userID)
+			if err != nil {
+				return err
+			}
+			result := tx.Where(map[string]interface{}{"user_id": userID}).Delete(&User{})
+			rowsAffected = result.RowsAffected
+			if result.Error != nil || rowsAffected == 0 {
+				return result.Error
+			}
+			return writeOutboxEvent(ctx, tx, EventUserDeleted, before, nil)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	r.invalidate(ctx, userID)
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w : %v", ErrUserNotFound, userID)
+	}
+	return nil
+}
+
+func (r *UserRepository) List(ctx context.Context, opts ListOptions) (_ []User, err error) {
+	if opts.Limit <= 0 {
+		opts.Limit = defaultListLimit
+	}
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.List", attribute.Int("list.limit", opts.Limit), attribute.Int("list.offset", opts.Offset))
+	defer func() { endRepositoryCall(span, "List", err) }()
+
+	if opts.Offset < 0 {
+		return nil, invalidArgument("offset must not be negative")
+	}
+
+	users := make([]User, 0)
+	err = withTimeout(ctx, r.readDB(ctx), OpRead, func(tx *gorm.DB) error {
+		query := tx.Order("user_id").Limit(opts.Limit).Offset(opts.Offset)
+		if opts.Filter != nil {
+			query = opts.Filter(query)
+		}
+		if opts.AfterUserID != "" {
+			query = query.Where("user_id > ?", opts.AfterUserID)
+		}
+		return query.Find(&users).Error
+	})
+	span.SetAttributes(attribute.Int("users.returned", len(users)))
+	return users, err
+}
+
+func (r *UserRepository) Search(ctx context.Context, opts SearchOptions) (_ []User, err error) {
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.Search", attribute.Int("search.limit", opts.Limit))
+	defer func() { endRepositoryCall(span, "Search", err) }()
+
+	users := make([]User, 0)
+	mode, operator := searchLabels(opts.Exact, opts.Operator)
+	started := time.Now()
+	defer func() { observeSearch(mode, operator, started, len(users), err) }()
+
+	filter, err := searchFilter(ctx, opts.Terms, opts.Exact, opts.Operator)
+	if err != nil {
+		return nil, invalidArgument("%v", err.Error())
+	}
+
+	err = withTimeout(ctx, r.readDB(ctx), OpSearch, func(tx *gorm.DB) error {
+		query := filter(tx).Order("user_id")
+		if opts.Limit > 0 {
+			query = query.Limit(opts.Limit)
+		}
+		return query.Find(&users).Error
+	})
+	span.SetAttributes(attribute.Int("users.returned", len(users)))
+	return users, err
+}
+
+// ListEach streams users ordered by user_id through a server-side cursor, a Limit of 0 means every user
+func (r *UserRepository) ListEach(ctx context.Context, opts ListOptions, fn func(user User) error) (err error) {
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.ListEach", attribute.Int("list.limit", opts.Limit), attribute.Int("list.offset", opts.Offset))
+	defer func() { endRepositoryCall(span, "ListEach", err) }()
+
+	if opts.Offset < 0 {
+		return invalidArgument("offset must not be negative")
+	}
+	filter := func(db *gorm.DB) *gorm.DB {
+		if opts.Filter != nil {
+			db = opts.Filter(db)
+		}
+		if opts.AfterUserID != "" {
+			db = db.Where("user_id > ?", opts.AfterUserID)
+		}
+		if opts.Offset > 0 {
+			db = db.Offset(opts.Offset)
+		}
+		return db
+	}
+	return r.each(ctx, OpRead, filter, opts.Limit, fn)
+}
+
+// SearchEach streams the search results ordered by user_id through a server-side cursor
+func (r *UserRepository) SearchEach(ctx context.Context, opts SearchOptions, fn func(user User) error) (err error) {
+	ctx, span := startSpan(r.scope(ctx), "UserRepository.SearchEach", attribute.Int("search.limit", opts.Limit))
+	defer func() { endRepositoryCall(span, "SearchEach", err) }()
+
+	results := 0
+	mode, operator := searchLabels(opts.Exact, opts.Operator)
+	started := time.Now()
+	defer func() { observeSearch(mode, operator, started, results, err) }()
+
+	filter, err := searchFilter(ctx, opts.Terms, opts.Exact, opts.Operator)
+	if err != nil {
+		return invalidArgument("%v", err.Error())
+	}
+	return r.each(ctx, OpSearch, filter, opts.Limit, func(user User) error {
+		results++
+		return fn(user)
+	})
+}
+
+func (r *UserRepository) each(ctx context.Context, op Operation, filter func(db *gorm.DB) *gorm.DB, limit int, fn func(user User) error) error {
+	if limit < 0 {
+		return invalidArgument("limit must not be negative")
+	}
+	limitedFilter := func(db *gorm.DB) *gorm.DB {
+		db = filter(db)
+		if limit > 0 {
+			db = db.Limit(limit)
+		}
+		return db
+	}
+	return forEachUser(ctx, r.readDB(ctx), IterateOptions{Filter: limitedFilter, Operation: op}, fn)
+}
+
+// searchFilter turns a search into a query scope, through userSearchIndex (same as main())
+// (the span has the number of terms, mode and operator, never the terms)
+func searchFilter(ctx context.Context, searchStrings []string, exact bool, searchType Search) (_ func(db *gorm.DB) *gorm.DB, err error) {
+	mode, operator := searchLabels(exact, searchType)
+	_, span := startSpan(ctx, "search.build_query",
+		attribute.Int("search.terms", len(searchStrings)),
+		attribute.String("search.mode", mode),
+		attribute.String("search.operator", operator),
+	)
+	defer func() { endSpan(span, err) }()
+
+	return userSearchIndex.Filter(searchStrings, exact, searchType)
+}
+
+// searchLabels are the mode (exact / pattern) and operator (and / or) of a search, for spans and metrics
+func searchLabels(exact bool, searchType Search) (string, string) {
+	mode := "pattern"
+	if exact {
+		mode = "exact"
+	}
+	operator := "or"
+	if searchType == SearchAND {
+		operator = "and"
+	}
+	return mode, operator
+}
+
+func parseSearchType(operator string) (Search, error) {
+	switch strings.ToLower(operator) {
+	case "and":
+		return SearchAND, nil
+	case "or":
+		return SearchOR, nil
+	default:
+		return SearchOR, fmt.Errorf("invalid search operator ( %v ) , please use and or or", operator)
+	}
+}
+
+// parseSearchMode returns true for exact search, false for pattern search
+func parseSearchMode(mode string) (bool, error) {
+	switch strings.ToLower(mode) {
+	case "exact":
+		return true, nil
+	case "pattern":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid search mode ( %v ) , please use exact or pattern", mode)
+	}
+}
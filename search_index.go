@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/*
+Generic search index
+
+string_rep started as a UserBasic-only thing. SearchIndex[T] does the same for any gorm model : the
+fields tagged search:"include" are escaped and joined into a search column (see string_rep.go for the
+encoding), which is kept up to date on create / save and searched with exact or pattern terms.
+
+	type Device struct {
+		DeviceID  string `gorm:"primaryKey" search:"include"`
+		Serial    string `search:"include"`
+		Owner     string `search:"include"`
+		Firmware  string
+		SearchRep string `gorm:"index"`
+	}
+
+	var deviceSearchIndex = mustRegisterSearchIndex[Device]("search_rep", nil)
+
+	devices, err := deviceSearchIndex.Search(ctx, db, SearchOptions{Terms: []string{"sn-0042"}, Exact: true})
+
+Fields of embedded structs are walked as well (User gets its fields through UserBasic), the order of the
+fields in the struct is the order in the search column. A field tagged serializer:encrypted is left out
+while field encryption is enabled, its plaintext must never end up in the search column.
+
+Registered indexes are maintained by searchIndexPlugin (connectDB registers it) :
+
+	create         : the search column of every created model (struct, slice or array) is computed
+	save           : db.Save(&model) recomputes it, from the full model
+	update columns : not touched, a partial update can't recompute it, run a reindex / Save instead
+
+FYI : the index is parsed once, at registration, a model without any search:"include" field (or without
+the search column) panics in mustRegisterSearchIndex, i.e. at start-up.
+*/
+
+const searchTag = "search"
+
+// ExactAlternatives returns other SQL conditions an exact term also matches, e.g. a blind index
+type ExactAlternatives func(searchString string) []string
+
+type SearchIndex[T any] struct {
+	column       string
+	columnField  []int                 // index path of the search column field
+	fields       [][]int               // index paths of the search:"include" fields, in struct order
+	structFields []reflect.StructField // the fields themselves, for isEncryptedField
+	alternatives ExactAlternatives
+}
+
+// searchIndexer is the non-generic view of a SearchIndex, for searchIndexPlugin
+type searchIndexer interface {
+	searchColumn() string
+	setSearchColumn(model reflect.Value)
+}
+
+var (
+	searchIndexesLock sync.RWMutex
+	searchIndexes     = map[reflect.Type]searchIndexer{}
+)
+
+/*
+NewSearchIndex parses the search:"include" fields of T, column is the db name of the search column
+(a string field of T whose gorm column, or snake_case name, is column).
+*/
+func NewSearchIndex[T any](column string, alternatives ExactAlternatives) (*SearchIndex[T], error) {
+	modelType := reflect.TypeOf((*T)(nil)).Elem()
+	if modelType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("search index needs a struct , got ( %v )", modelType)
+	}
+
+	idx := &SearchIndex[T]{column: column, alternatives: alternatives}
+	err := idx.parseFields(modelType, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(idx.fields) == 0 {
+		return nil, fmt.Errorf("no search:\"include\" field in ( %v )", modelType)
+	}
+	if idx.columnField == nil {
+		return nil, fmt.Errorf("no string field for the search column ( %v ) in ( %v )", column, modelType)
+	}
+	return idx, nil
+}
+
+// mustRegisterSearchIndex creates the index of T and registers it with searchIndexPlugin
+func mustRegisterSearchIndex[T any](column string, alternatives ExactAlternatives) *SearchIndex[T] {
+	idx, err := NewSearchIndex[T](column, alternatives)
+	if err != nil {
+		panic(err)
+	}
+
+	searchIndexesLock.Lock()
+	defer searchIndexesLock.Unlock()
+	searchIndexes[reflect.TypeOf((*T)(nil)).Elem()] = idx
+	return idx
+}
+
+func (idx *SearchIndex[T]) parseFields(structType reflect.Type, path []int) error {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldPath := append(append([]int{}, path...), i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			err := idx.parseFields(field.Type, fieldPath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if fieldColumnName(field) == idx.column && field.Type.Kind() == reflect.String {
+			idx.columnField = fieldPath
+			continue
+		}
+
+		switch tag := field.Tag.Get(searchTag); tag {
+		case "":
+		case "include":
+			idx.fields = append(idx.fields, fieldPath)
+			idx.structFields = append(idx.structFields, field)
+		default:
+			return fmt.Errorf("invalid search tag ( %v ) on %v.%v , please use search:\"include\"", tag, structType.Name(), field.Name)
+		}
+	}
+	return nil
+}
+
+// fieldColumnName is the gorm column of field : its column tag, or its name in snake_case
+func fieldColumnName(field reflect.StructField) string {
+	for _, setting := range strings.Split(field.Tag.Get("gorm"), ";") {
+		if strings.HasPrefix(strings.ToLower(setting), "column:") {
+			return strings.TrimSpace(setting[len("column:"):])
+		}
+	}
+	return schema.NamingStrategy{}.ColumnName("", field.Name)
+}
+
+func (idx *SearchIndex[T]) searchColumn() string {
+	return idx.column
+}
+
+// Value is the search column of model : '#' + the escaped included fields, each followed by '#'
+func (idx *SearchIndex[T]) Value(model *T) string {
+	return idx.value(reflect.ValueOf(model).Elem())
+}
+
+func (idx *SearchIndex[T]) value(model reflect.Value) string {
+	var value strings.Builder
+	value.WriteString("#")
+	for i, path := range idx.fields {
+		if isEncryptedField(idx.structFields[i]) {
+			continue
+		}
+		value.WriteString(escapeStringRepValue(fmt.Sprintf("%v", model.FieldByIndex(path).Interface())))
+		value.WriteString("#")
+	}
+	return value.String()
+}
+
+func (idx *SearchIndex[T]) setSearchColumn(model reflect.Value) {
+	model.FieldByIndex(idx.columnField).SetString(idx.value(model))
+}
+
+// Condition is the SQL condition of one search term
+func (idx *SearchIndex[T]) Condition(searchString string, exact bool) string {
+	if !exact {
+		return patternSearchCondition(idx.column, searchString)
+	}
+
+	condition := exactSearchCondition(idx.column, searchString)
+	if idx.alternatives == nil {
+		return condition
+	}
+	alternatives := append([]string{condition}, idx.alternatives(searchString)...)
+	if len(alternatives) == 1 {
+		return condition
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")"
+}
+
+// Query is the WHERE condition of a search, the terms joined with AND (SearchAND) or OR (SearchOR)
+func (idx *SearchIndex[T]) Query(searchStrings []string, exact bool, searchType Search) (string, error) {
+	if len(searchStrings) == 0 {
+		return "", errors.New("length of searchStrings is 0 , please provide valid list")
+	}
+
+	operator := ""
+	switch searchType {
+	case SearchAND:
+		operator = " AND "
+	case SearchOR, SearchSingle:
+		operator = " OR "
+	default:
+		return "", errors.New("please provide valid search type")
+	}
+
+	conditions := make([]string, 0, len(searchStrings))
+	for _, searchString := range searchStrings {
+		conditions = append(conditions, idx.Condition(searchString, exact))
+	}
+	return " " + strings.Join(conditions, operator) + " ", nil
+}
+
+// Filter is Query as a query scope
+func (idx *SearchIndex[T]) Filter(searchStrings []string, exact bool, searchType Search) (func(db *gorm.DB) *gorm.DB, error) {
+	sqlQuery, err := idx.Query(searchStrings, exact, searchType)
+	if err != nil {
+		return nil, err
+	}
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(sqlQuery)
+	}, nil
+}
+
+// Search returns the models matching opts, ordered by primary key
+func (idx *SearchIndex[T]) Search(ctx context.Context, db *gorm.DB, opts SearchOptions) ([]T, error) {
+	filter, err := idx.Filter(opts.Terms, opts.Exact, opts.Operator)
+	if err != nil {
+		return nil, invalidArgument("%v", err.Error())
+	}
+
+	stmt := &gorm.Statement{DB: db}
+	err = stmt.Parse(new(T))
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]T, 0)
+	err = withTimeout(ctx, db, OpSearch, func(tx *gorm.DB) error {
+		query := filter(tx.Model(new(T)))
+		for _, primaryKey := range stmt.Schema.PrimaryFieldDBNames {
+			query = query.Order(clause.OrderByColumn{Column: clause.Column{Table: clause.CurrentTable, Name: primaryKey}})
+		}
+		if opts.Limit > 0 {
+			query = query.Limit(opts.Limit)
+		}
+		return query.Find(&results).Error
+	})
+	return results, err
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// gorm plugin
+
+// searchIndexPlugin maintains the search column of the registered models, register it with db.Use
+type searchIndexPlugin struct{}
+
+func (searchIndexPlugin) Name() string {
+	return "users:search_index"
+}
+
+func (p searchIndexPlugin) Initialize(db *gorm.DB) error {
+	err := db.Callback().Create().Before("gorm:create").Register("users:search_index_create", p.create)
+	if err != nil {
+		return err
+	}
+	return db.Callback().Update().Before("gorm:update").Register("users:search_index_save", p.save)
+}
+
+func statementSearchIndex(db *gorm.DB) (searchIndexer, bool) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return nil, false
+	}
+	searchIndexesLock.RLock()
+	defer searchIndexesLock.RUnlock()
+	idx, ok := searchIndexes[db.Statement.Schema.ModelType]
+	return idx, ok
+}
+
+func (searchIndexPlugin) create(db *gorm.DB) {
+	idx, ok := statementSearchIndex(db)
+	if !ok {
+		return
+	}
+	setSearchColumns(idx, db.Statement.ReflectValue)
+}
+
+// save only handles db.Save (every column is written), not the partial updates
+func (searchIndexPlugin) save(db *gorm.DB) {
+	idx, ok := statementSearchIndex(db)
+	if !ok || len(db.Statement.Selects) != 1 || db.Statement.Selects[0] != "*" {
+		return
+	}
+	setSearchColumns(idx, db.Statement.ReflectValue)
+}
+
+func setSearchColumns(idx searchIndexer, value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			setSearchColumns(idx, reflect.Indirect(value.Index(i)))
+		}
+	case reflect.Struct:
+		if value.CanAddr() {
+			idx.setSearchColumn(value)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"strings"
+)
+
+/*
+string_rep encoding
+
+string_rep (and the search column of any SearchIndex, see search_index.go) joins the values of the
+search:"include" fields with '#', so a value must never contain a bare '#' : "Tom#1" would read as two
+values and the exact search "#Tom#" would match it. Every value is percent-encoded before it is joined,
+for the two characters that matter :
+
+	'%' -> %25
+	'#' -> %23
+
+	{FirstName: "Tom#1", LastName: "100%"}  ->  #...#Tom%231#100%25#...#
+
+Search terms go through the same encoding, then through regexQuote, so that a term is always matched
+literally ("+1 (957) 570-2414" has three regex metacharacters) :
+
+	exact   : string_rep ~* ('#<quoted term>#')                 the whole value of one field
+	pattern : string_rep ~* ('(?<!%)(?<!%2)<quoted term>')     a substring of the value of one field
+
+and the resulting pattern is written as a SQL string literal (quotes doubled), so a term can't end the
+literal either.
+
+The lookbehinds of the pattern search keep a match from starting inside an escape : without them "23"
+would match "a#b" (stored as a%23b). A '%' of string_rep always starts an escape, so a match preceded
+by '%' or '%2' would start on its 2nd or 3rd character. A match that starts on a boundary ends on one,
+the escaped term never ends halfway through an escape.
+
+FYI : string_rep values written before this encoding are rewritten by "users migrate"
+(migrateStringRepEncoding), only the rows that may contain an encoded character are looked at.
+*/
+
+var stringRepEscaper = strings.NewReplacer("%", "%25", "#", "%23")
+
+// escapeBoundary keeps a pattern search match from starting inside an escape (lookbehinds, postgres 9.6+)
+const escapeBoundary = "(?<!%)(?<!%2)"
+
+// escapeStringRepValue encodes value so that it contains no '#'
+func escapeStringRepValue(value string) string {
+	return stringRepEscaper.Replace(value)
+}
+
+// regexQuote escapes the metacharacters of a postgres (ARE) regular expression
+func regexQuote(s string) string {
+	var quoted strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\^$.|?*+()[]{}`, r) {
+			quoted.WriteRune('\\')
+		}
+		quoted.WriteRune(r)
+	}
+	return quoted.String()
+}
+
+// quoteSQLString quotes s as a SQL string literal (standard_conforming_strings : backslashes are literal)
+func quoteSQLString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// exactSearchCondition matches searchString against the whole value of any field of the search column
+func exactSearchCondition(column string, searchString string) string {
+	return fmt.Sprintf("%v ~* (%v)", column, quoteSQLString("#"+regexQuote(escapeStringRepValue(searchString))+"#"))
+}
+
+// patternSearchCondition matches searchString anywhere within the value of a field of the search column
+func patternSearchCondition(column string, searchString string) string {
+	return fmt.Sprintf("%v ~* (%v)", column, quoteSQLString(escapeBoundary+regexQuote(escapeStringRepValue(searchString))))
+}
+
+/*
+migrateStringRepEncoding rewrites the string_rep values written before the encoding (or before a change
+of the search:"include" fields). A row can only be out of date if its string_rep has a '%' or another
+number of '#' than fields, the other rows read the same in both encodings.
+*/
+func migrateStringRepEncoding(ctx context.Context, db *gorm.DB, chunkSize int) (int64, error) {
+	delimiters := strings.Count(getStringRep(UserBasic{}), "#")
+	filter := func(db *gorm.DB) *gorm.DB {
+		return db.Where("string_rep IS NULL OR strpos(string_rep, '%') > 0 OR length(string_rep) - length(replace(string_rep, '#', '')) <> ?", delimiters)
+	}
+	return reindexUsers(ctx, db, chunkSize, filter)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+/*
+Properties of the string_rep encoding and of the search conditions built on it. The values are short
+strings over an alphabet of the characters that matter ('%', '#', the digits and letters of the escapes,
+regex metacharacters, quotes), so that collisions between values, escapes and terms are frequent.
+
+Go's regexp has no lookbehind : postgresMatches runs the pattern of a condition the way postgres does,
+checking escapeBoundary at every start position and the rest of the pattern with regexp.
+*/
+
+const searchAlphabet = `%#2355aA.*+?()[]{}^$|\' -é`
+
+type searchValue string
+
+func (searchValue) Generate(rand *rand.Rand, size int) reflect.Value {
+	alphabet := []rune(searchAlphabet)
+	runes := make([]rune, rand.Intn(6))
+	for i := range runes {
+		runes[i] = alphabet[rand.Intn(len(alphabet))]
+	}
+	return reflect.ValueOf(searchValue(string(runes)))
+}
+
+type searchFields [5]searchValue
+
+func (f searchFields) user() UserBasic {
+	return UserBasic{UserID: string(f[0]), FirstName: string(f[1]), LastName: string(f[2]), Email: string(f[3]), Phone: string(f[4])}
+}
+
+var quickConfig = &quick.Config{MaxCount: 5000}
+
+var stringRepUnescaper = strings.NewReplacer("%25", "%", "%23", "#")
+
+// postgresMatches tells whether the search condition matches stringRep
+func postgresMatches(t *testing.T, condition string, stringRep string) bool {
+	t.Helper()
+	literal := strings.TrimSuffix(strings.TrimPrefix(condition, "string_rep ~* ("), ")")
+	if len(literal) < 2 || literal[0] != '\'' || literal[len(literal)-1] != '\'' {
+		t.Fatalf("unexpected condition ( %v )", condition)
+	}
+	pattern := strings.ReplaceAll(literal[1:len(literal)-1], "''", "'")
+
+	boundary := strings.HasPrefix(pattern, escapeBoundary)
+	re, err := regexp.Compile(`^(?i:` + strings.TrimPrefix(pattern, escapeBoundary) + `)`)
+	if err != nil {
+		t.Fatalf("invalid pattern ( %v ) : %v", pattern, err)
+	}
+
+	starts := make([]int, 0, len(stringRep)+1)
+	for i := range stringRep {
+		starts = append(starts, i)
+	}
+	starts = append(starts, len(stringRep))
+	for _, i := range starts {
+		if boundary && (strings.HasSuffix(stringRep[:i], "%") || strings.HasSuffix(stringRep[:i], "%2")) {
+			continue
+		}
+		if re.MatchString(stringRep[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldsMatch is what a search means : term is (exact) or is in (pattern) one of the fields, ignoring case
+func fieldsMatch(fields searchFields, term string, exact bool) bool {
+	quoted := regexp.QuoteMeta(term)
+	if exact {
+		quoted = "^" + quoted + "$"
+	}
+	re := regexp.MustCompile("(?i)" + quoted)
+	for _, field := range fields {
+		if re.MatchString(string(field)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStringRepEscapeRoundTrip(t *testing.T) {
+	property := func(fields searchFields) bool {
+		stringRep := getStringRep(fields.user())
+		values := strings.Split(stringRep, "#")
+		if len(values) != len(fields)+2 || values[0] != "" || values[len(values)-1] != "" {
+			return false
+		}
+		for i, field := range fields {
+			if stringRepUnescaper.Replace(values[i+1]) != string(field) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPatternSearchCondition(t *testing.T) {
+	property := func(fields searchFields, term searchValue) bool {
+		stringRep := getStringRep(fields.user())
+		return postgresMatches(t, patternSearchCondition("string_rep", string(term)), stringRep) == fieldsMatch(fields, string(term), false)
+	}
+	if err := quick.Check(property, quickConfig); err != nil {
+		t.Error(err)
+	}
+
+	// every substring of a field is found
+	substring := func(fields searchFields, field uint8, start uint8, end uint8) bool {
+		value := []rune(string(fields[int(field)%len(fields)]))
+		i, j := int(start)%(len(value)+1), int(end)%(len(value)+1)
+		if i > j {
+			i, j = j, i
+		}
+		return postgresMatches(t, patternSearchCondition("string_rep", string(value[i:j])), getStringRep(fields.user()))
+	}
+	if err := quick.Check(substring, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExactSearchCondition(t *testing.T) {
+	property := func(fields searchFields, term searchValue, field uint8) bool {
+		stringRep := getStringRep(fields.user())
+		if postgresMatches(t, exactSearchCondition("string_rep", string(term)), stringRep) != fieldsMatch(fields, string(term), true) {
+			return false
+		}
+		// a whole field always matches
+		return postgresMatches(t, exactSearchCondition("string_rep", string(fields[int(field)%len(fields)])), stringRep)
+	}
+	if err := quick.Check(property, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPatternSearchInsideEscapes(t *testing.T) {
+	stringRep := getStringRep(UserBasic{UserID: "a#b", FirstName: "100%", LastName: "%2", Email: "x", Phone: "y"})
+	for term, want := range map[string]bool{
+		"23": false, "%23": false, "5": false, "25": false, "52": false,
+		"#": true, "a#b": true, "%": true, "0%": true, "%2": true, "2": true,
+	} {
+		if got := postgresMatches(t, patternSearchCondition("string_rep", term), stringRep); got != want {
+			t.Errorf("pattern search %q on %q : got %v , want %v", term, stringRep, got, want)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Multi-tenancy
+
+Every row of user_records belongs to a tenant, tenant_id leads the primary key and every index :
+
+	PRIMARY KEY (tenant_id, user_id)
+	first_name (tenant_id, first_name), last_name (tenant_id, last_name) ... string_rep, email_bidx, phone_bidx
+
+so the same user_id can exist once per tenant. Rows created before tenant_id existed belong to the
+"default" tenant, "users migrate" rebuilds the primary key and the indexes of an existing table.
+
+The tenant travels in the context (contextWithTenant), like the request id :
+
+	gRPC / GraphQL : the tenant of the caller (api key "tenant", jwt "tenant" claim, default : "default")
+	CLI            : USERS_TENANT (default : "default"), migrate, reindex and reencrypt run over all tenants
+	UserRepository : repo.ForTenant("acme") pins the tenant, whatever the context says
+
+tenantPlugin (gorm) adds "tenant_id = <tenant>" to every query, update and delete of user_records (and of
+any other model with a tenant_id column, see generic_repository.go) and sets TenantID on every created /
+upserted row. "*" (allTenants) is the cross-tenant scope of the admin jobs, and the only one : a context
+without any tenant reads (and writes) the "default" tenant, like the rows it creates.
+
+The row-level security covers the SQL that doesn't go through tenantPlugin (raw SQL, other clients) :
+
+	USERS_TENANT_RLS=true
+
+"users migrate" then enables (and forces, so that the table owner is subject to it) a policy on user_records :
+
+	CREATE POLICY tenant_isolation ON user_records
+		USING (tenant_id = current_setting('users.tenant_id', true) OR current_setting('users.tenant_id', true) = '*')
+		WITH CHECK (...same...)
+
+and every operation sets users.tenant_id for its own transaction (set_config(..., true), so it never leaks
+to the next user of the pooled connection), "default" without a tenant in its context. A connection that
+never sets users.tenant_id sees no rows and can't write any, instead of seeing every tenant.
+
+FYI : superusers and roles with BYPASSRLS are never subject to row-level security, connect as a plain role.
+Raw SQL (db.Raw / db.Exec) is not filtered by tenantPlugin, only by the policy.
+*/
+
+const (
+	defaultTenantID = "default"
+	allTenants      = "*"
+
+	tenantColumn  = "tenant_id"
+	tenantSetting = "users.tenant_id"
+	tenantPolicy  = "tenant_isolation"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// tenantRLS is set from USERS_TENANT_RLS
+var tenantRLS = false
+
+func loadTenantSettings() error {
+	value := os.Getenv("USERS_TENANT_RLS")
+	if value == "" {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for environment variable USERS_TENANT_RLS ( %v ) , please use true or false", value)
+	}
+	tenantRLS = enabled
+	return nil
+}
+
+// validateTenantID accepts lower case letters, digits, '-' and '_' (and "*" when all is true)
+func validateTenantID(tenantID string, all bool) error {
+	if all && tenantID == allTenants {
+		return nil
+	}
+	if !tenantIDPattern.MatchString(tenantID) {
+		return fmt.Errorf("invalid tenant ( %v ) , please use up to 63 lower case letters, digits, '-' or '_'", tenantID)
+	}
+	return nil
+}
+
+type tenantKey struct{}
+
+func contextWithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+func tenantFromContext(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	tenantID, ok := ctx.Value(tenantKey{}).(string)
+	return tenantID, ok && tenantID != ""
+}
+
+// scopeTenant is the tenant the statements of ctx run in : its tenant, "default" without one, or allTenants
+func scopeTenant(ctx context.Context) string {
+	tenantID, ok := tenantFromContext(ctx)
+	if !ok {
+		return defaultTenantID
+	}
+	return tenantID
+}
+
+// writeTenant is the tenant new rows of ctx go to
+func writeTenant(ctx context.Context) (string, error) {
+	tenantID, ok := tenantFromContext(ctx)
+	switch {
+	case !ok:
+		return defaultTenantID, nil
+	case tenantID == allTenants:
+		return "", errors.New("writes need a single tenant , not all tenants")
+	default:
+		return tenantID, nil
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// row-level security
+
+// setLocalTenant sets the tenant of the policy (scopeTenant) for the current transaction, when the policy
+// is enabled
+func setLocalTenant(ctx context.Context, tx *gorm.DB) error {
+	if !tenantRLS {
+		return nil
+	}
+	return tx.Exec("SELECT set_config(?, ?, true)", tenantSetting, scopeTenant(ctx)).Error
+}
+
+// setLocalTenantPgx is setLocalTenant for the pgx transactions of the bulk loader
+func setLocalTenantPgx(ctx context.Context, tx pgx.Tx) error {
+	if !tenantRLS {
+		return nil
+	}
+	_, err := tx.Exec(ctx, "SELECT set_config($1, $2, true)", tenantSetting, scopeTenant(ctx))
+	return err
+}
+
+// needsTenantTransaction tells whether an operation of ctx has to run in a transaction for setLocalTenant
+func needsTenantTransaction(context.Context) bool {
+	return tenantRLS
+}
+
+// enableTenantRLS (re)creates the tenant_isolation policy on user_records
+func enableTenantRLS(tx *gorm.DB) error {
+	table := pgx.Identifier{User{}.TableName()}.Sanitize()
+	check := fmt.Sprintf("%v = current_setting('%v', true) OR current_setting('%v', true) = '%v'",
+		tenantColumn, tenantSetting, tenantSetting, allTenants)
+
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %v ENABLE ROW LEVEL SECURITY", table),
+		fmt.Sprintf("ALTER TABLE %v FORCE ROW LEVEL SECURITY", table),
+		fmt.Sprintf("DROP POLICY IF EXISTS %v ON %v", tenantPolicy, table),
+		fmt.Sprintf("CREATE POLICY %v ON %v USING (%v) WITH CHECK (%v)", tenantPolicy, table, check, check),
+	}
+	for _, statement := range statements {
+		err := tx.Exec(statement).Error
+		if err != nil {
+			return fmt.Errorf("could not enable row-level security : %w", err)
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// migration of the tables created before tenant_id
+
+type tenantlessIndex struct {
+	Name      string
+	IsPrimary bool
+}
+
+/*
+migrateTenantKeys rebuilds the primary key and the indexes of user_records that don't include tenant_id
+yet. AutoMigrate adds the tenant_id column (every existing row gets "default") but leaves existing keys
+and indexes alone.
+*/
+func migrateTenantKeys(ctx context.Context, tx *gorm.DB) error {
+	userSchema, err := getUserSchema(tx)
+	if err != nil {
+		return err
+	}
+
+	indexes := make([]tenantlessIndex, 0)
+	err = tx.Raw(`SELECT i.relname AS name, x.indisprimary AS is_primary
+FROM pg_index x
+JOIN pg_class i ON i.oid = x.indexrelid
+WHERE x.indrelid = to_regclass(?)
+AND NOT EXISTS (SELECT 1 FROM pg_attribute a WHERE a.attrelid = x.indrelid AND a.attname = ? AND a.attnum = ANY (x.indkey))`,
+		userSchema.Table, tenantColumn).Scan(&indexes).Error
+	if err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	schemaIndexes := userSchema.ParseIndexes()
+	table := pgx.Identifier{userSchema.Table}.Sanitize()
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		for _, index := range indexes {
+			_, ours := schemaIndexes[index.Name]
+			switch {
+			case index.IsPrimary:
+				primaryKeys := make([]string, 0, len(userSchema.PrimaryFieldDBNames))
+				for _, name := range userSchema.PrimaryFieldDBNames {
+					primaryKeys = append(primaryKeys, pgx.Identifier{name}.Sanitize())
+				}
+				err := tx.Exec(fmt.Sprintf("ALTER TABLE %v DROP CONSTRAINT %v, ADD PRIMARY KEY (%v)",
+					table, pgx.Identifier{index.Name}.Sanitize(), strings.Join(primaryKeys, ", "))).Error
+				if err != nil {
+					return fmt.Errorf("could not rebuild the primary key : %w", err)
+				}
+			case ours:
+				err := tx.Migrator().DropIndex(&User{}, index.Name)
+				if err != nil {
+					return err
+				}
+				err = tx.Migrator().CreateIndex(&User{}, index.Name)
+				if err != nil {
+					return fmt.Errorf("could not rebuild index ( %v ) : %w", index.Name, err)
+				}
+			default:
+				appLog.Warn(ctx, "index without tenant_id left alone , it is not part of the User model", "index", index.Name)
+				continue
+			}
+			appLog.Info(ctx, "index rebuilt with tenant_id", "index", index.Name, "primary_key", index.IsPrimary)
+		}
+		return nil
+	})
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// gorm plugin
+
+// tenantPlugin scopes every statement on a tenant table to the tenant of its context, register it with db.Use
+type tenantPlugin struct{}
+
+func (tenantPlugin) Name() string {
+	return "users:tenant"
+}
+
+func (p tenantPlugin) Initialize(db *gorm.DB) error {
+	err := db.Callback().Create().Before("gorm:create").Register("users:tenant_create", p.create)
+	if err != nil {
+		return err
+	}
+	err = db.Callback().Query().Before("gorm:query").Register("users:tenant_query", p.filter)
+	if err != nil {
+		return err
+	}
+	err = db.Callback().Update().Before("gorm:update").Register("users:tenant_update", p.filter)
+	if err != nil {
+		return err
+	}
+	err = db.Callback().Delete().Before("gorm:delete").Register("users:tenant_delete", p.filter)
+	if err != nil {
+		return err
+	}
+	return db.Callback().Row().Before("gorm:row").Register("users:tenant_row", p.filter)
+}
+
+// isTenantTable tells whether the statement is on user_records, or on another model with a tenant_id column
+func isTenantTable(db *gorm.DB) bool {
+	table := statementTable(db)
+	if table == (User{}).TableName() {
+		return true
+	}
+	modelSchema := db.Statement.Schema
+	return modelSchema != nil && modelSchema.Table == table && modelSchema.LookUpField(tenantColumn) != nil
+}
+
+// statementTenant is the single tenant a statement on a tenant table is scoped to
+func statementTenant(db *gorm.DB) (string, bool) {
+	if db.Error != nil || !isTenantTable(db) {
+		return "", false
+	}
+	tenantID := scopeTenant(db.Statement.Context)
+	if tenantID == allTenants {
+		return "", false
+	}
+	return tenantID, true
+}
+
+func (tenantPlugin) filter(db *gorm.DB) {
+	tenantID, ok := statementTenant(db)
+	if !ok {
+		return
+	}
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: tenantColumn}, Value: tenantID},
+	}})
+}
+
+func (tenantPlugin) create(db *gorm.DB) {
+	tenantID, ok := statementTenant(db)
+	if !ok || db.Statement.Schema == nil {
+		return
+	}
+	field := db.Statement.Schema.LookUpField(tenantColumn)
+	if field == nil {
+		return
+	}
+
+	setTenant := func(value reflect.Value) {
+		current, zero := field.ValueOf(db.Statement.Context, value)
+		if !zero && current != tenantID {
+			_ = db.AddError(fmt.Errorf("%w : row of tenant ( %v ) created as tenant ( %v )", ErrPermissionDenied, current, tenantID))
+			return
+		}
+		_ = field.Set(db.Statement.Context, value, tenantID)
+	}
+
+	value := db.Statement.ReflectValue
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			setTenant(reflect.Indirect(value.Index(i)))
+		}
+	case reflect.Struct:
+		setTenant(value)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"strings"
+	"testing"
+)
+
+func TestTenantScopeOfStatements(t *testing.T) {
+	db, err := openDB("host=127.0.0.1 port=1 connect_timeout=1", "users_test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dryRun := db.Session(&gorm.Session{DryRun: true})
+
+	for _, test := range []struct {
+		name   string
+		ctx    context.Context
+		tenant interface{} // nil : no tenant filter
+	}{
+		{"no tenant", context.Background(), defaultTenantID},
+		{"tenant", contextWithTenant(context.Background(), "acme"), "acme"},
+		{"all tenants", contextWithTenant(context.Background(), allTenants), nil},
+	} {
+		var user User
+		stmt := dryRun.WithContext(test.ctx).Where("user_id = ?", "u1").Take(&user).Statement
+		vars := stmt.Vars
+		var tenant interface{}
+		if strings.Contains(stmt.SQL.String(), tenantColumn) {
+			tenant = vars[len(vars)-1]
+		}
+		if tenant != test.tenant {
+			t.Errorf("%v : %v %v , want tenant %v", test.name, stmt.SQL.String(), vars, test.tenant)
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	db := openTestDB(t)
+	acme, globex := testTenant(t, db), testTenant(t, db)
+	repo := NewUserRepository(db)
+
+	for ctx, name := range map[context.Context]string{acme: "Acme", globex: "Globex"} {
+		_, err := repo.Create(ctx, UserBasic{UserID: "u1", FirstName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(t *testing.T) {
+		for ctx, name := range map[context.Context]string{acme: "Acme", globex: "Globex"} {
+			user, err := repo.Get(ctx, "u1")
+			if err != nil || user.FirstName != name {
+				t.Errorf("get in the tenant of %v : ( %v , %v )", name, user.FirstName, err)
+			}
+			users, err := repo.List(ctx, ListOptions{})
+			if err != nil || len(users) != 1 || users[0].FirstName != name {
+				t.Errorf("list in the tenant of %v : ( %v , %v )", name, users, err)
+			}
+		}
+
+		// a context without tenant is the default tenant, not every tenant
+		_, err := repo.Get(context.Background(), "u1")
+		if !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("get without tenant , got %v , want not found", err)
+		}
+
+		// writes stay in their tenant
+		_, err = repo.Upsert(acme, UserBasic{UserID: "u1", FirstName: "Acme"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.Delete(contextWithTenant(context.Background(), "test_other"), "u1")
+		if !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("delete in another tenant , got %v , want not found", err)
+		}
+		user, err := repo.Get(globex, "u1")
+		if err != nil || user.FirstName != "Globex" {
+			t.Errorf("write of another tenant changed globex ( %v , %v )", user.FirstName, err)
+		}
+	}
+
+	t.Run("plugin", check)
+
+	t.Run("rls", func(t *testing.T) {
+		var bypass bool
+		err := db.Raw("SELECT rolsuper OR rolbypassrls FROM pg_roles WHERE rolname = current_user").Scan(&bypass).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bypass {
+			t.Skip("the role of USERS_TEST_DSN bypasses row-level security")
+		}
+
+		err = enableTenantRLS(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tenantRLS = true
+		t.Cleanup(func() {
+			tenantRLS = false
+			table := User{}.TableName()
+			for _, statement := range []string{
+				"DROP POLICY IF EXISTS " + tenantPolicy + " ON " + table,
+				"ALTER TABLE " + table + " NO FORCE ROW LEVEL SECURITY",
+				"ALTER TABLE " + table + " DISABLE ROW LEVEL SECURITY",
+			} {
+				if err := db.Exec(statement).Error; err != nil {
+					t.Errorf("could not disable row-level security : %v", err)
+				}
+			}
+		})
+
+		check(t)
+
+		// raw SQL is only filtered by the policy : the tenant of the context, nothing without one
+		var rows int64
+		err = withTimeout(acme, db, OpRead, func(tx *gorm.DB) error {
+			return tx.Raw("SELECT count(*) FROM user_records WHERE user_id = 'u1'").Scan(&rows).Error
+		})
+		if err != nil || rows != 1 {
+			t.Errorf("raw count in the tenant of acme : ( %v , %v ) , want 1", rows, err)
+		}
+		err = db.Raw("SELECT count(*) FROM user_records WHERE user_id = 'u1'").Scan(&rows).Error
+		if err != nil || rows != 0 {
+			t.Errorf("raw count without users.tenant_id : ( %v , %v ) , want 0", rows, err)
+		}
+	})
+}
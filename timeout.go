@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+	"os"
+	"time"
+)
+
+/*
+Context propagation and statement timeouts
+
+Every data-access entry point takes a context.Context and runs its queries with db.WithContext(ctx).
+Cancelling the context (Ctrl-C in the CLI, a client going away in gRPC / GraphQL) cancels the running
+statement, pgx sends a cancel request to postgres for it.
+
+On top of that every operation runs with a server-side statement_timeout, which depends on the kind of
+operation :
+
+	read     5s  USERS_STATEMENT_TIMEOUT_READ     get, batch get, list, export
+	search  30s  USERS_STATEMENT_TIMEOUT_SEARCH   regex scans over string_rep
+	write    5s  USERS_STATEMENT_TIMEOUT_WRITE    create, upsert, delete, string_rep updates
+	bulk     0   USERS_STATEMENT_TIMEOUT_BULK     COPY + merge, per chunk
+	migrate  0   USERS_STATEMENT_TIMEOUT_MIGRATE  AutoMigrate, reindex scan
+
+The environment variables take Go durations ("500ms", "2m"), 0 means no statement_timeout. When the
+context has a deadline that is closer than the operation's timeout, the deadline wins.
+
+The timeout is set with "SET LOCAL statement_timeout" inside the operation's transaction, so it never
+leaks to the next user of the pooled connection.
+
+FYI : a statement stopped by statement_timeout returns ErrStatementTimeout, a statement stopped because
+the context was cancelled / expired returns the context error (context.Canceled / DeadlineExceeded).
+*/
+
+type Operation int
+
+const (
+	OpRead Operation = iota
+	OpSearch
+	OpWrite
+	OpBulk
+	OpMigrate
+)
+
+var ErrStatementTimeout = errors.New("statement timeout")
+
+// pgQueryCanceled is the postgres error code for a statement stopped by statement_timeout or a cancel request
+const pgQueryCanceled = "57014"
+
+var statementTimeoutEnv = map[Operation]string{
+	OpRead:    "USERS_STATEMENT_TIMEOUT_READ",
+	OpSearch:  "USERS_STATEMENT_TIMEOUT_SEARCH",
+	OpWrite:   "USERS_STATEMENT_TIMEOUT_WRITE",
+	OpBulk:    "USERS_STATEMENT_TIMEOUT_BULK",
+	OpMigrate: "USERS_STATEMENT_TIMEOUT_MIGRATE",
+}
+
+var statementTimeouts = map[Operation]time.Duration{
+	OpRead:    5 * time.Second,
+	OpSearch:  30 * time.Second,
+	OpWrite:   5 * time.Second,
+	OpBulk:    0,
+	OpMigrate: 0,
+}
+
+// loadStatementTimeouts overrides the default timeouts from the environment
+func loadStatementTimeouts() error {
+	for op, name := range statementTimeoutEnv {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("invalid duration for environment variable %v ( %v )", name, value)
+		}
+		statementTimeouts[op] = timeout
+	}
+	return nil
+}
+
+// statementTimeout is the timeout of op, shortened to the context deadline if there is one
+func statementTimeout(ctx context.Context, op Operation) time.Duration {
+	timeout := statementTimeouts[op]
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining < time.Millisecond {
+			remaining = time.Millisecond
+		}
+		if timeout <= 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	return timeout
+}
+
+// setLocalStatementTimeout is the statement that applies timeout to the current transaction
+func setLocalStatementTimeout(timeout time.Duration) string {
+	return fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout.Milliseconds())
+}
+
+/*
+withTimeout runs fn as one operation of type op : in a transaction with its statement_timeout (and the
+tenant of the row-level security policy, see tenant.go) when there is one, directly on db.WithContext(ctx)
+otherwise.
+*/
+func withTimeout(ctx context.Context, db *gorm.DB, op Operation, fn func(tx *gorm.DB) error) error {
+	timeout := statementTimeout(ctx, op)
+	if timeout <= 0 && !needsTenantTransaction(ctx) {
+		return timeoutError(ctx, fn(db.WithContext(ctx)))
+	}
+
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if timeout > 0 {
+			err := tx.Exec(setLocalStatementTimeout(timeout)).Error
+			if err != nil {
+				return err
+			}
+		}
+		err := setLocalTenant(ctx, tx)
+		if err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+	return timeoutError(ctx, err)
+}
+
+// timeoutError tells a statement_timeout apart from a cancelled context
+func timeoutError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if errors.Is(err, ctxErr) {
+			return err
+		}
+		return fmt.Errorf("%w : %v", ctxErr, err.Error())
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgQueryCanceled {
+		return fmt.Errorf("%w : %v", ErrStatementTimeout, pgErr.Message)
+	}
+	return err
+}
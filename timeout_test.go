@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func TestStatementTimeout(t *testing.T) {
+	db := openTestDB(t)
+	// one connection : the SET LOCAL must not outlive its operation on it
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	var before string
+	err = db.Raw("SHOW statement_timeout").Scan(&before).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := statementTimeouts[OpRead]
+	statementTimeouts[OpRead] = 100 * time.Millisecond
+	defer func() { statementTimeouts[OpRead] = saved }()
+
+	sleep := func(tx *gorm.DB) error { return tx.Exec("SELECT pg_sleep(2)").Error }
+	err = withTimeout(context.Background(), db, OpRead, sleep)
+	if !errors.Is(err, ErrStatementTimeout) {
+		t.Errorf("statement over the read timeout , got %v , want ErrStatementTimeout", err)
+	}
+
+	var after string
+	err = db.Raw("SHOW statement_timeout").Scan(&after).Error
+	if err != nil || after != before {
+		t.Errorf("statement_timeout leaked to the pooled connection ( %v , was %v , %v )", after, before, err)
+	}
+
+	// a cancelled context is not a statement timeout
+	statementTimeouts[OpRead] = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err = withTimeout(ctx, db, OpRead, sleep)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrStatementTimeout) {
+		t.Errorf("statement of a cancelled context , got %v , want context.Canceled", err)
+	}
+}
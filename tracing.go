@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"os"
+	"strings"
+)
+
+/*
+OpenTelemetry tracing
+
+Spans :
+
+	UserRepository.<Method>   : every repository method (user.id / counts as attributes, never PII)
+	search.build_query        : searchFilter, around userSearchIndex.Filter (exact / pattern query)
+	gorm.<operation>          : every gorm create / query / update / delete / row / raw callback, from tracingPlugin
+
+so a slow search shows up as UserRepository.Search -> search.build_query + gorm.query, with the time
+spent in postgres on the gorm span.
+
+gorm spans carry db.system, db.sql.table, db.operation, db.rows_affected and db.statement. The
+statement is the fingerprint from gorm_logger.go (every literal replaced with ?), the values of a
+statement never end up in a trace.
+
+Configuration (environment) :
+
+	USERS_TRACES_EXPORTER : none (default), otlp, stdout or file
+	USERS_TRACES_FILE     : the file for the "file" exporter (one JSON span per line), default traces.json
+
+the otlp exporter (gRPC) takes the standard OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_HEADERS ...
+variables, e.g. OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4317 for a local collector / Jaeger.
+
+The trace id of the current span is the trace_id of the log lines (see logging.go).
+*/
+
+const tracerName = "go-gists/gorm-pgsql"
+
+var tracer = otel.Tracer(tracerName)
+
+// initTracing installs the tracer provider from the environment, shutdown flushes the exporter
+func initTracing(ctx context.Context) (func(ctx context.Context) error, error) {
+	noop := func(ctx context.Context) error { return nil }
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	var file *os.File
+
+	switch strings.ToLower(os.Getenv("USERS_TRACES_EXPORTER")) {
+	case "", "none":
+		return noop, nil
+	case "otlp":
+		exporter, err = otlptracegrpc.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr), stdouttrace.WithPrettyPrint())
+	case "file":
+		fileName := os.Getenv("USERS_TRACES_FILE")
+		if fileName == "" {
+			fileName = "traces.json"
+		}
+		file, err = os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return noop, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return noop, fmt.Errorf("invalid traces exporter ( %v ) , please use none, otlp, stdout or file", os.Getenv("USERS_TRACES_EXPORTER"))
+	}
+	if err != nil {
+		return noop, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String("users"),
+	))
+	if err != nil {
+		return noop, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			_ = file.Close()
+		}
+		return err
+	}, nil
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err (not found is not an error for a span) and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// gorm plugin
+
+// tracingPlugin starts a span before every gorm callback chain and ends it after, register it with db.Use
+type tracingPlugin struct{}
+
+const tracingSpanKey = "users:tracing_span"
+
+func (tracingPlugin) Name() string {
+	return "users:tracing"
+}
+
+func (p tracingPlugin) Initialize(db *gorm.DB) error {
+	return registerAroundCallbacks(db, "users:tracing", p.before, p.after)
+}
+
+// registerAroundCallbacks registers before / after around the gorm callback of every operation
+// (create, query, update, delete, row, raw), as name_before_<operation> and name_after_<operation>
+func registerAroundCallbacks(db *gorm.DB, name string, before func(db *gorm.DB, operation string), after func(db *gorm.DB, operation string)) error {
+	callbacks := []struct {
+		operation string
+		before    func(name string, fn func(*gorm.DB)) error
+		after     func(name string, fn func(*gorm.DB)) error
+	}{
+		{"create", db.Callback().Create().Before("gorm:create").Register, db.Callback().Create().After("gorm:create").Register},
+		{"query", db.Callback().Query().Before("gorm:query").Register, db.Callback().Query().After("gorm:query").Register},
+		{"update", db.Callback().Update().Before("gorm:update").Register, db.Callback().Update().After("gorm:update").Register},
+		{"delete", db.Callback().Delete().Before("gorm:delete").Register, db.Callback().Delete().After("gorm:delete").Register},
+		{"row", db.Callback().Row().Before("gorm:row").Register, db.Callback().Row().After("gorm:row").Register},
+		{"raw", db.Callback().Raw().Before("gorm:raw").Register, db.Callback().Raw().After("gorm:raw").Register},
+	}
+
+	for _, callback := range callbacks {
+		operation := callback.operation
+		err := callback.before(name+"_before_"+operation, func(db *gorm.DB) {
+			before(db, operation)
+		})
+		if err != nil {
+			return err
+		}
+		err = callback.after(name+"_after_"+operation, func(db *gorm.DB) {
+			after(db, operation)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tracingPlugin) before(db *gorm.DB, operation string) {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracer.Start(ctx, "gorm."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationKey.String(operation),
+		),
+	)
+	db.Statement.Context = ctx
+	db.InstanceSet(tracingSpanKey, span)
+}
+
+func (tracingPlugin) after(db *gorm.DB, _ string) {
+	value, ok := db.InstanceGet(tracingSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+
+	span.SetAttributes(
+		semconv.DBSQLTableKey.String(statementTable(db)),
+		semconv.DBStatementKey.String(fingerprintSQL(db.Statement.SQL.String())),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	endSpan(span, db.Error)
+}
+
+func statementTable(db *gorm.DB) string {
+	table := db.Statement.Table
+	if table == "" && db.Statement.Schema != nil {
+		table = db.Statement.Schema.Table
+	}
+	return table
+}
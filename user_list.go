@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 )
 
 /*
@@ -236,21 +236,13 @@ func GetUserRecords() []User {
 	users := make([]User, 0)
 
 	userList := GetUserList()
-	for _, user := range userList {
-		myUserBasic := UserBasic{
-			UserID:    user["_id"].(string),
-			FirstName: user["first_name"].(string),
-			LastName:  user["last_name"].(string),
-			Email:     user["email"].(string),
-			Phone:     user["phone"].(string),
-			Active:    user["isActive"].(bool),
-			Balance:   user["balance"].(string),
+	for i, user := range userList {
+		myUserBasic, err := userBasicFromRecord(user, defaultFieldMapping())
+		if err != nil {
+			appLog.Warn(context.Background(), "skipping seed user", "index", i+1, "error", err)
+			continue
 		}
 
-		stringRep := getStringRep(myUserBasic)
-
-		log.Printf("stringRep : %v", stringRep)
-
 		myUser := getUserFromBasic(myUserBasic)
 
 		users = append(users, myUser)
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Webhook subscriptions
+
+Partner systems subscribe to the change events of the outbox (see outbox.go) with a URL, a secret and
+filters. WebhookDispatcher is the outbox sink of "users relay -sink webhooks" : it queues one delivery per
+matching subscription (webhook_deliveries), then delivers the queue, each subscription at its own pace :
+
+	outbox relay --> WebhookDispatcher.Deliver --> webhook_deliveries (one row per subscription and event)
+	                                                     |
+	                                     WebhookDispatcher.Run : signed POST, retries, dead letters
+
+Filters ("users webhook add -filter ...") are key=value pairs joined with ",", a subscription gets an
+event when every key matches one of its values :
+
+	op=create|update|delete   the kind of change
+	field=balance             the value of this field changed (any field for create / delete)
+	user=628558706b92ac31     this user only
+
+	-filter op=delete                    every deleted user
+	-filter op=update,field=balance      the balance updates
+	-filter user=6285...,user=6286...    these two users, any change
+
+Every request is signed with the secret of the subscription (HMAC-SHA256 over "<timestamp>.<body>") :
+
+	POST <url>
+	Content-Type: application/json
+	X-Webhook-Id: wh_3f2a...
+	X-Event-Id: 42
+	X-Event-Type: user.updated
+	X-Webhook-Timestamp: 1653127200
+	X-Webhook-Signature: sha256=<hex>
+
+receivers check it with VerifyWebhookSignature (and reject old timestamps, against replays of the request).
+
+A 2xx is a delivery, anything else is retried with exponential backoff (1s, 2s ... up to 5m), in order per
+subscription and user. After MaxAttempts the delivery is dead : it stays in webhook_deliveries, "users webhook
+dead" and GET /admin/webhooks/dead-letters list them, "users webhook replay" and POST /admin/webhooks/replay
+put them back in the queue.
+
+Run claims the due deliveries in one short transaction, which only leases them (next_attempt_at moves past
+the time their requests can take), then sends them outside of it, one goroutine per subscription, and
+records each outcome on its own. A slow or dead receiver only holds up its own subscription : once it
+doesn't answer (or answers a 5xx), the rest of its claimed deliveries wait for the same retry. The
+deliveries of a dispatcher that stops before recording are claimed again when their lease is over.
+
+FYI : the secret is encrypted at rest with the field encryption keyring when there is one, it is shown
+once, when the subscription is created.
+    : subscriptions belong to a tenant and only get the events of their tenant.
+*/
+
+const (
+	webhookSecretPrefix      = "whsec_"
+	webhookSignatureHeader   = "X-Webhook-Signature"
+	webhookTimestampHeader   = "X-Webhook-Timestamp"
+	defaultWebhookTolerance  = 5 * time.Minute
+	defaultWebhookDeadLimit  = 100
+	webhookResponseBodyLimit = 64 << 10
+)
+
+type WebhookSubscription struct {
+	TenantID  string    `gorm:"primaryKey;column:tenant_id;default:default;not null" json:"tenant_id"`
+	ID        string    `gorm:"primaryKey;column:id" json:"id"`
+	URL       string    `gorm:"not null" json:"url"`
+	Secret    string    `gorm:"not null;serializer:encrypted" json:"-"`
+	Filters   string    `gorm:"not null" json:"filters"` // key=value pairs joined with ","
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (WebhookSubscription) TableName() string {
+	return "webhook_subscriptions"
+}
+
+func (s WebhookSubscription) Validate() error {
+	parsed, err := url.Parse(s.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid webhook url ( %v ) , please use an http:// or https:// url", s.URL)
+	}
+	if s.Secret == "" {
+		return errors.New("webhook secret is empty")
+	}
+	_, err = parseWebhookFilters(s.Filters)
+	return err
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookPending   WebhookDeliveryStatus = "pending"
+	WebhookDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDead      WebhookDeliveryStatus = "dead"
+)
+
+type WebhookDelivery struct {
+	ID             int64                 `gorm:"primaryKey;autoIncrement" json:"id"`
+	TenantID       string                `gorm:"column:tenant_id;default:default;not null;index:idx_webhook_deliveries_pending,priority:1,where:status = 'pending'" json:"tenant_id"`
+	SubscriptionID string                `gorm:"not null;uniqueIndex:idx_webhook_deliveries_event,priority:1;index:idx_webhook_deliveries_pending,priority:2" json:"subscription_id"`
+	EventID        int64                 `gorm:"not null;uniqueIndex:idx_webhook_deliveries_event,priority:2" json:"event_id"`
+	UserID         string                `gorm:"not null;index:idx_webhook_deliveries_pending,priority:3" json:"user_id"`
+	Payload        string                `gorm:"not null;serializer:encrypted" json:"-"` // the ChangeEvent, as it is signed and sent
+	Status         WebhookDeliveryStatus `gorm:"not null;index:idx_webhook_deliveries_status,priority:1" json:"status"`
+	Attempts       int                   `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  time.Time             `gorm:"not null;index:idx_webhook_deliveries_status,priority:2" json:"next_attempt_at"`
+	LastError      string                `json:"last_error,omitempty"`
+	LastStatusCode int                   `json:"last_status_code,omitempty"`
+	CreatedAt      time.Time             `gorm:"not null" json:"created_at"`
+	DeliveredAt    *time.Time            `json:"delivered_at,omitempty"`
+}
+
+func (WebhookDelivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+// webhookSubscriptionModel and webhookDeliveryModel register the tables for "users migrate"
+var (
+	webhookSubscriptionModel = registerModel[WebhookSubscription]()
+	webhookDeliveryModel     = registerModel[WebhookDelivery]()
+)
+
+// newWebhookSubscription fills in the id (and the secret, when secret is empty) of a new subscription
+func newWebhookSubscription(webhookURL string, secret string, filters string) (WebhookSubscription, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	if secret == "" {
+		secret = webhookSecretPrefix + hex.EncodeToString(b[:24])
+	}
+	subscription := WebhookSubscription{
+		ID:      "wh_" + hex.EncodeToString(b[24:]),
+		URL:     webhookURL,
+		Secret:  secret,
+		Filters: filters,
+	}
+	return subscription, subscription.Validate()
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// filters
+
+type webhookFilter struct {
+	ops    map[EventType]bool
+	fields map[string]bool
+	users  map[string]bool
+}
+
+var webhookOps = map[string]EventType{
+	"create": EventUserCreated,
+	"update": EventUserUpdated,
+	"delete": EventUserDeleted,
+}
+
+// userEventFields are the UserBasic fields by their json name, for field=...
+var userEventFields = func() map[string][]int {
+	fields := make(map[string][]int)
+	userBasicType := reflect.TypeOf(UserBasic{})
+	for i := 0; i < userBasicType.NumField(); i++ {
+		name := strings.Split(userBasicType.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = []int{i}
+		}
+	}
+	return fields
+}()
+
+func parseWebhookFilters(filters string) (webhookFilter, error) {
+	filter := webhookFilter{}
+	for _, pair := range strings.Split(filters, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || value == "" {
+			return filter, fmt.Errorf("invalid webhook filter ( %v ) , please use op=..., field=... or user=...", pair)
+		}
+		switch key {
+		case "op":
+			op, ok := webhookOps[value]
+			if !ok {
+				return filter, fmt.Errorf("invalid webhook filter ( %v ) , please use op=create, op=update or op=delete", pair)
+			}
+			if filter.ops == nil {
+				filter.ops = make(map[EventType]bool)
+			}
+			filter.ops[op] = true
+		case "field":
+			if _, ok := userEventFields[value]; !ok {
+				names := make([]string, 0, len(userEventFields))
+				for name := range userEventFields {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				return filter, fmt.Errorf("invalid webhook filter ( %v ) , please use one of field=%v", pair, strings.Join(names, ", field="))
+			}
+			if filter.fields == nil {
+				filter.fields = make(map[string]bool)
+			}
+			filter.fields[value] = true
+		case "user":
+			if filter.users == nil {
+				filter.users = make(map[string]bool)
+			}
+			filter.users[value] = true
+		default:
+			return filter, fmt.Errorf("invalid webhook filter ( %v ) , please use op=..., field=... or user=...", pair)
+		}
+	}
+	return filter, nil
+}
+
+func (f webhookFilter) matches(event ChangeEvent) bool {
+	if f.ops != nil && !f.ops[event.Type] {
+		return false
+	}
+	if f.users != nil && !f.users[event.UserID] {
+		return false
+	}
+	if f.fields == nil {
+		return true
+	}
+	if event.Before == nil || event.After == nil {
+		return true
+	}
+	before, after := reflect.ValueOf(*event.Before), reflect.ValueOf(*event.After)
+	for name := range f.fields {
+		index := userEventFields[name]
+		if before.FieldByIndex(index).Interface() != after.FieldByIndex(index).Interface() {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// signatures
+
+func webhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks the signature of a webhook request, and that it is not older than tolerance
+// (defaults to 5m)
+func VerifyWebhookSignature(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	if tolerance <= 0 {
+		tolerance = defaultWebhookTolerance
+	}
+	timestamp, err := strconv.ParseInt(header.Get(webhookTimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %v header", webhookTimestampHeader)
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return fmt.Errorf("webhook timestamp too old ( %v )", age.Round(time.Second))
+	}
+	expected := webhookSignature(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(header.Get(webhookSignatureHeader))) {
+		return errors.New("invalid webhook signature")
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// dispatcher
+
+type WebhookOptions struct {
+	BatchSize       int           // deliveries claimed per transaction, defaults to 100
+	PollInterval    time.Duration // wait when there is nothing to deliver, defaults to 1s
+	MaxAttempts     int           // attempts before a delivery is dead, defaults to 10
+	DeliveryTimeout time.Duration // per request, defaults to 10s
+}
+
+type WebhookDispatcher struct {
+	db     *gorm.DB
+	client *http.Client
+	opts   WebhookOptions
+}
+
+func NewWebhookDispatcher(db *gorm.DB, opts WebhookOptions) *WebhookDispatcher {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultOutboxBatchSize
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultOutboxPollInterval
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultOutboxMaxAttempts
+	}
+	if opts.DeliveryTimeout <= 0 {
+		opts.DeliveryTimeout = defaultOutboxDeliveryTimeout
+	}
+	return &WebhookDispatcher{db: db, client: &http.Client{}, opts: opts}
+}
+
+/*
+Deliver queues event for every subscription of its tenant whose filters match, it is the OutboxSink of
+the dispatcher. The same event queued twice (the outbox delivers at least once) is queued once.
+*/
+func (d *WebhookDispatcher) Deliver(ctx context.Context, event ChangeEvent) error {
+	ctx = contextWithTenant(ctx, event.TenantID)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return withTimeout(ctx, d.db, OpWrite, func(tx *gorm.DB) error {
+		subscriptions := make([]WebhookSubscription, 0)
+		err := tx.Order("id").Find(&subscriptions).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		deliveries := make([]WebhookDelivery, 0)
+		for _, subscription := range subscriptions {
+			filter, err := parseWebhookFilters(subscription.Filters)
+			if err != nil {
+				appLog.Warn(ctx, "webhook subscription with invalid filters skipped", "subscription_id", subscription.ID, "error", err)
+				continue
+			}
+			if !filter.matches(event) {
+				continue
+			}
+			deliveries = append(deliveries, WebhookDelivery{
+				SubscriptionID: subscription.ID,
+				EventID:        event.ID,
+				UserID:         event.UserID,
+				Payload:        string(payload),
+				Status:         WebhookPending,
+				NextAttemptAt:  now,
+				CreatedAt:      now,
+			})
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&deliveries).Error
+	})
+}
+
+// Run delivers the queued webhooks until ctx is cancelled, database errors are logged and retried
+func (d *WebhookDispatcher) Run(ctx context.Context) error {
+	ctx = contextWithTenant(ctx, allTenants)
+	for {
+		claimed, err := d.DeliverOnce(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			appLog.Error(ctx, "webhook delivery failed", "error", err)
+		}
+		if err == nil && claimed == d.opts.BatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(d.opts.PollInterval):
+		}
+	}
+}
+
+// webhookBatch are the claimed deliveries of one subscription, oldest first
+type webhookBatch struct {
+	subscription *WebhookSubscription // nil once it is deleted
+	deliveries   []WebhookDelivery
+}
+
+// DeliverOnce claims up to BatchSize due deliveries (the oldest pending one per subscription and user) and
+// sends them, one goroutine per subscription, it returns the number of deliveries claimed
+func (d *WebhookDispatcher) DeliverOnce(ctx context.Context) (claimed int, err error) {
+	ctx, span := startSpan(contextWithTenant(ctx, allTenants), "WebhookDispatcher.DeliverOnce")
+	defer func() {
+		span.SetAttributes(attribute.Int("webhook.claimed", claimed))
+		endSpan(span, err)
+	}()
+
+	batches, err := d.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	done := make(chan error, len(batches))
+	for _, batch := range batches {
+		claimed += len(batch.deliveries)
+		go func(batch webhookBatch) {
+			done <- d.deliverBatch(ctx, batch)
+		}(batch)
+	}
+	for range batches {
+		batchErr := <-done
+		if batchErr != nil && err == nil {
+			err = batchErr
+		}
+	}
+	return claimed, err
+}
+
+/*
+claim takes the due deliveries in one short transaction : it leases them (their next_attempt_at moves past
+the time their requests can take, so that no other dispatcher claims them meanwhile) and loads their
+subscriptions. No lock is held while the requests are sent.
+*/
+func (d *WebhookDispatcher) claim(ctx context.Context) ([]webhookBatch, error) {
+	batches := make([]webhookBatch, 0)
+	err := withTimeout(ctx, d.db, OpWrite, func(tx *gorm.DB) error {
+		return tx.Transaction(func(tx *gorm.DB) error {
+			deliveries := make([]WebhookDelivery, 0)
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("status = ? AND next_attempt_at <= ?", WebhookPending, time.Now().UTC()).
+				Where(`NOT EXISTS (SELECT 1 FROM webhook_deliveries earlier WHERE earlier.status = ? AND earlier.tenant_id = webhook_deliveries.tenant_id
+AND earlier.subscription_id = webhook_deliveries.subscription_id AND earlier.user_id = webhook_deliveries.user_id AND earlier.id < webhook_deliveries.id)`, WebhookPending).
+				Order("id").Limit(d.opts.BatchSize).Find(&deliveries).Error
+			if err != nil {
+				return err
+			}
+
+			bySubscription := make(map[string]int)
+			for _, delivery := range deliveries {
+				key := delivery.TenantID + "/" + delivery.SubscriptionID
+				i, ok := bySubscription[key]
+				if !ok {
+					subscription, err := d.subscription(ctx, tx, delivery.TenantID, delivery.SubscriptionID)
+					if err != nil {
+						return err
+					}
+					i = len(batches)
+					bySubscription[key] = i
+					batches = append(batches, webhookBatch{subscription: subscription})
+				}
+				batches[i].deliveries = append(batches[i].deliveries, delivery)
+			}
+
+			now := time.Now().UTC()
+			for _, batch := range batches {
+				ids := make([]int64, 0, len(batch.deliveries))
+				for _, delivery := range batch.deliveries {
+					ids = append(ids, delivery.ID)
+				}
+				lease := now.Add(time.Duration(len(ids))*d.opts.DeliveryTimeout + outboxLeaseMargin)
+				err := tx.Model(&WebhookDelivery{}).Where("id IN ?", ids).Update("next_attempt_at", lease).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// subscription is the subscription of a delivery, nil once it is deleted
+func (d *WebhookDispatcher) subscription(ctx context.Context, tx *gorm.DB, tenantID string, subscriptionID string) (*WebhookSubscription, error) {
+	var subscription WebhookSubscription
+	err := tx.WithContext(contextWithTenant(ctx, tenantID)).Where("id = ?", subscriptionID).Take(&subscription).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+/*
+deliverBatch sends the deliveries of one subscription in order and records the outcome of each. Once the
+receiver is down (no response or a 5xx), the rest of the batch waits for the same retry, without an
+attempt : a dead receiver costs one DeliveryTimeout per retry, not one per delivery.
+*/
+func (d *WebhookDispatcher) deliverBatch(ctx context.Context, batch webhookBatch) error {
+	for i := range batch.deliveries {
+		delivery := &batch.deliveries[i]
+		statusCode := 0
+		var sendErr error
+		if batch.subscription == nil {
+			sendErr = errors.New("subscription deleted")
+		} else {
+			statusCode, sendErr = d.send(ctx, batch.subscription, delivery)
+		}
+		if ctx.Err() != nil {
+			// the lease puts the deliveries back in the queue
+			return ctx.Err()
+		}
+
+		retryAt, err := d.record(ctx, batch.subscription, delivery, statusCode, sendErr)
+		if err != nil {
+			return err
+		}
+		if sendErr != nil && batch.subscription != nil && (statusCode == 0 || statusCode >= 500) {
+			return d.postpone(ctx, batch.deliveries[i+1:], retryAt)
+		}
+	}
+	return nil
+}
+
+// record writes the outcome of an attempt, it returns when the delivery is retried (zero when it is not)
+func (d *WebhookDispatcher) record(ctx context.Context, subscription *WebhookSubscription, delivery *WebhookDelivery, statusCode int, sendErr error) (time.Time, error) {
+	now := time.Now().UTC()
+	var retryAt time.Time
+	attempts := delivery.Attempts + 1
+	updates := map[string]interface{}{"attempts": attempts, "last_status_code": statusCode}
+	switch {
+	case sendErr == nil:
+		updates["status"] = WebhookDelivered
+		updates["delivered_at"] = now
+		updates["last_error"] = ""
+		webhookDeliveries.WithLabelValues("delivered").Inc()
+	case attempts >= d.opts.MaxAttempts || subscription == nil:
+		updates["status"] = WebhookDead
+		updates["last_error"] = sendErr.Error()
+		webhookDeliveries.WithLabelValues("dead").Inc()
+		appLog.Error(ctx, "webhook delivery is dead", "delivery_id", delivery.ID, "subscription_id", delivery.SubscriptionID, "attempts", attempts, "error", sendErr)
+	default:
+		retryAt = now.Add(outboxBackoff(attempts))
+		updates["next_attempt_at"] = retryAt
+		updates["last_error"] = sendErr.Error()
+		webhookDeliveries.WithLabelValues("retried").Inc()
+		appLog.Warn(ctx, "webhook not delivered , retrying", "delivery_id", delivery.ID, "subscription_id", delivery.SubscriptionID, "attempts", attempts, "error", sendErr)
+	}
+
+	// attempts = the claimed attempts : the outcome of a claim whose lease ran out is not written twice
+	err := withTimeout(ctx, d.db, OpWrite, func(tx *gorm.DB) error {
+		return tx.Model(&WebhookDelivery{}).Where("id = ? AND status = ? AND attempts = ?", delivery.ID, WebhookPending, delivery.Attempts).
+			Updates(updates).Error
+	})
+	return retryAt, err
+}
+
+// postpone gives back the unsent deliveries of a batch, for retryAt (now when it is zero)
+func (d *WebhookDispatcher) postpone(ctx context.Context, deliveries []WebhookDelivery, retryAt time.Time) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if retryAt.IsZero() {
+		retryAt = time.Now().UTC()
+	}
+	ids := make([]int64, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		ids = append(ids, delivery.ID)
+	}
+	return withTimeout(ctx, d.db, OpWrite, func(tx *gorm.DB) error {
+		return tx.Model(&WebhookDelivery{}).Where("id IN ? AND status = ?", ids, WebhookPending).Update("next_attempt_at", retryAt).Error
+	})
+}
+
+// send POSTs the signed payload, a 2xx is a delivery
+func (d *WebhookDispatcher) send(ctx context.Context, subscription *WebhookSubscription, delivery *WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.opts.DeliveryTimeout)
+	defer cancel()
+
+	body := []byte(delivery.Payload)
+	var event ChangeEvent
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return 0, fmt.Errorf("invalid payload for webhook delivery ( %v ) : %w", delivery.ID, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", subscription.ID)
+	req.Header.Set("X-Event-Id", strconv.FormatInt(event.ID, 10))
+	req.Header.Set("X-Event-Type", string(event.Type))
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhookSignatureHeader, webhookSignature(subscription.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, webhookResponseBodyLimit))
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook returned ( %v )", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// ----------------------------------------------------------------------------------------------------
+
+// dead letters
+
+// DeadLetters lists the dead deliveries of the tenant of ctx, of one subscription when subscriptionID is set
+func (d *WebhookDispatcher) DeadLetters(ctx context.Context, subscriptionID string, limit int) (_ []WebhookDelivery, err error) {
+	if limit <= 0 {
+		limit = defaultWebhookDeadLimit
+	}
+	ctx, span := startSpan(ctx, "WebhookDispatcher.DeadLetters", attribute.Int("list.limit", limit))
+	defer func() { endSpan(span, err) }()
+
+	deliveries := make([]WebhookDelivery, 0)
+	err = withTimeout(ctx, d.db, OpRead, func(tx *gorm.DB) error {
+		query := tx.Where("status = ?", WebhookDead).Order("id").Limit(limit)
+		if subscriptionID != "" {
+			query = query.Where("subscription_id = ?", subscriptionID)
+		}
+		return query.Find(&deliveries).Error
+	})
+	return deliveries, err
+}
+
+/*
+Replay puts dead deliveries back in the queue, with their attempts reset : the deliveries in ids, or
+every dead delivery of subscriptionID (in the tenant of ctx). It returns the number of deliveries queued.
+*/
+func (d *WebhookDispatcher) Replay(ctx context.Context, subscriptionID string, ids []int64) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "WebhookDispatcher.Replay", attribute.Int("webhook.ids", len(ids)))
+	defer func() { endSpan(span, err) }()
+
+	if subscriptionID == "" && len(ids) == 0 {
+		return 0, invalidArgument("please provide a subscription id or delivery ids")
+	}
+
+	var replayed int64
+	err = withTimeout(ctx, d.db, OpWrite, func(tx *gorm.DB) error {
+		query := tx.Model(&WebhookDelivery{}).Where("status = ?", WebhookDead)
+		if subscriptionID != "" {
+			query = query.Where("subscription_id = ?", subscriptionID)
+		}
+		if len(ids) > 0 {
+			query = query.Where("id IN ?", ids)
+		}
+		result := query.Updates(map[string]interface{}{
+			"status":          WebhookPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now().UTC(),
+		})
+		replayed = result.RowsAffected
+		return result.Error
+	})
+	if err == nil {
+		appLog.Info(ctx, "webhook deliveries replayed", "subscription_id", subscriptionID, "deliveries", replayed)
+	}
+	return replayed, err
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	secret, body := "whsec_test", []byte(`{"id":42}`)
+	signed := func(secret string, timestamp int64, body []byte) http.Header {
+		header := http.Header{}
+		header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+		header.Set(webhookSignatureHeader, webhookSignature(secret, timestamp, body))
+		return header
+	}
+	now := time.Now().Unix()
+
+	if err := VerifyWebhookSignature(secret, signed(secret, now, body), body, 0); err != nil {
+		t.Errorf("valid signature rejected : %v", err)
+	}
+	for name, header := range map[string]http.Header{
+		"other secret":  signed("whsec_other", now, body),
+		"other body":    signed(secret, now, []byte(`{"id":43}`)),
+		"old timestamp": signed(secret, now-int64((10*time.Minute).Seconds()), body),
+		"no timestamp":  {webhookSignatureHeader: []string{webhookSignature(secret, now, body)}},
+	} {
+		if err := VerifyWebhookSignature(secret, header, body, 0); err == nil {
+			t.Errorf("%v : signature accepted", name)
+		}
+	}
+}
+
+// webhookReceiver is an httptest receiver that checks the signature of every request and answers status
+type webhookReceiver struct {
+	server *httptest.Server
+	secret string
+
+	mu       sync.Mutex
+	status   int
+	requests []http.Header
+	bodies   []string
+}
+
+func newWebhookReceiver(t *testing.T, ctx context.Context, db *gorm.DB, status int) *webhookReceiver {
+	t.Helper()
+	receiver := &webhookReceiver{status: status}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := VerifyWebhookSignature(receiver.secret, r.Header, body, 0); err != nil {
+			t.Errorf("webhook request rejected : %v", err)
+		}
+		receiver.mu.Lock()
+		receiver.requests = append(receiver.requests, r.Header)
+		receiver.bodies = append(receiver.bodies, string(body))
+		status := receiver.status
+		receiver.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(receiver.server.Close)
+
+	subscription, err := newWebhookSubscription(receiver.server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WithContext(ctx).Create(&subscription).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.secret = subscription.Secret
+	return receiver
+}
+
+func (r *webhookReceiver) answer(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *webhookReceiver) received() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func (r *webhookReceiver) subscriptionID() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests[0].Get("X-Webhook-Id")
+}
+
+// testEvent is an update of userID in the tenant of ctx
+func testEvent(t *testing.T, ctx context.Context, id int64, userID string) ChangeEvent {
+	t.Helper()
+	tenantID, _ := tenantFromContext(ctx)
+	return ChangeEvent{
+		ID:         id,
+		Type:       EventUserUpdated,
+		TenantID:   tenantID,
+		UserID:     userID,
+		OccurredAt: time.Now().UTC(),
+		Before:     &UserBasic{UserID: userID, Balance: "$1.00"},
+		After:      &UserBasic{UserID: userID, Balance: "$2.00"},
+	}
+}
+
+// deliveries are the deliveries of the tenant of ctx, oldest first
+func deliveries(t *testing.T, ctx context.Context, db *gorm.DB) []WebhookDelivery {
+	t.Helper()
+	rows := make([]WebhookDelivery, 0)
+	err := db.WithContext(ctx).Order("id").Find(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// makeDue moves the retries of the tenant of ctx to now
+func makeDue(t *testing.T, ctx context.Context, db *gorm.DB) {
+	t.Helper()
+	err := db.WithContext(ctx).Model(&WebhookDelivery{}).Where("status = ?", WebhookPending).
+		Update("next_attempt_at", time.Now().UTC().Add(-time.Second)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookDeliveryRetriesDeadLettersAndReplay(t *testing.T) {
+	db := openTestDB(t)
+	ctx := testTenant(t, db)
+	receiver := newWebhookReceiver(t, ctx, db, http.StatusInternalServerError)
+	dispatcher := NewWebhookDispatcher(db, WebhookOptions{MaxAttempts: 2})
+
+	// the same event delivered twice by the outbox is queued once
+	event := testEvent(t, ctx, 42, "u1")
+	for i := 0; i < 2; i++ {
+		if err := dispatcher.Deliver(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rows := deliveries(t, ctx, db); len(rows) != 1 {
+		t.Fatalf("expected 1 delivery , got %v", len(rows))
+	}
+
+	// a 500 is retried after the backoff
+	start := time.Now()
+	if _, err := dispatcher.DeliverOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.received() != 1 {
+		t.Fatalf("expected 1 request , got %v", receiver.received())
+	}
+	header := receiver.requests[0]
+	if header.Get("X-Event-Id") != "42" || header.Get("X-Event-Type") != string(EventUserUpdated) || header.Get("X-Webhook-Id") == "" {
+		t.Errorf("unexpected headers %v", header)
+	}
+	delivery := deliveries(t, ctx, db)[0]
+	if delivery.Status != WebhookPending || delivery.Attempts != 1 || delivery.LastStatusCode != http.StatusInternalServerError {
+		t.Fatalf("unexpected delivery after a 500 %+v", delivery)
+	}
+	if retry := delivery.NextAttemptAt.Sub(start); retry < outboxBackoff(1)/2 || retry > outboxBackoff(1)+5*time.Second {
+		t.Errorf("retry in %v , want about %v", retry, outboxBackoff(1))
+	}
+	if _, err := dispatcher.DeliverOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.received() != 1 {
+		t.Errorf("delivery retried before its backoff")
+	}
+
+	// MaxAttempts failures : dead
+	makeDue(t, ctx, db)
+	if _, err := dispatcher.DeliverOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := dispatcher.DeadLetters(ctx, receiver.subscriptionID(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Attempts != 2 || dead[0].LastError == "" {
+		t.Fatalf("expected the delivery in the dead letters , got %+v", dead)
+	}
+	makeDue(t, ctx, db)
+	if _, err := dispatcher.DeliverOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.received() != 2 {
+		t.Errorf("dead delivery sent again ( %v requests )", receiver.received())
+	}
+
+	// replayed : delivered as it was signed the first time
+	receiver.answer(http.StatusNoContent)
+	replayed, err := dispatcher.Replay(ctx, receiver.subscriptionID(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 {
+		t.Fatalf("expected 1 delivery replayed , got %v", replayed)
+	}
+	if _, err := dispatcher.DeliverOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	delivery = deliveries(t, ctx, db)[0]
+	if delivery.Status != WebhookDelivered || delivery.DeliveredAt == nil || delivery.Attempts != 1 {
+		t.Errorf("unexpected delivery after the replay %+v", delivery)
+	}
+	if receiver.received() != 3 || receiver.bodies[2] != receiver.bodies[0] {
+		t.Errorf("unexpected requests %v", receiver.bodies)
+	}
+	dead, err = dispatcher.DeadLetters(ctx, receiver.subscriptionID(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 0 {
+		t.Errorf("delivered delivery still in the dead letters %+v", dead)
+	}
+}
+
+func TestWebhookDeliveryOrderPerUser(t *testing.T) {
+	db := openTestDB(t)
+	ctx := testTenant(t, db)
+	receiver := newWebhookReceiver(t, ctx, db, http.StatusOK)
+	dispatcher := NewWebhookDispatcher(db, WebhookOptions{})
+
+	for i, userID := range []string{"u1", "u1", "u2"} {
+		if err := dispatcher.Deliver(ctx, testEvent(t, ctx, int64(i+1), userID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the second event of u1 waits for the first one
+	claimed, err := dispatcher.DeliverOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed != 2 {
+		t.Errorf("expected the first event of each user to be claimed , got %v", claimed)
+	}
+	if _, err := dispatcher.DeliverOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for _, header := range receiver.requests {
+		ids = append(ids, header.Get("X-Event-Id"))
+	}
+	if !equalStrings(ids, []string{"1", "3", "2"}) {
+		t.Errorf("unexpected delivery order %v", ids)
+	}
+}
+
+func TestWebhookDeadReceiverOnlyHoldsUpItsSubscription(t *testing.T) {
+	db := openTestDB(t)
+	ctx := testTenant(t, db)
+
+	// the slow receiver answers once the fast one got its event (or after 5s)
+	fastReceived := make(chan struct{})
+	var fastOnce sync.Once
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastOnce.Do(func() { close(fastReceived) })
+	}))
+	defer fast.Close()
+	concurrent := make(chan bool, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-fastReceived:
+			concurrent <- true
+		case <-time.After(5 * time.Second):
+			concurrent <- false
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer slow.Close()
+
+	for _, url := range []string{slow.URL, fast.URL} {
+		subscription, err := newWebhookSubscription(url, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.WithContext(ctx).Create(&subscription).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dispatcher := NewWebhookDispatcher(db, WebhookOptions{})
+	for i, userID := range []string{"u1", "u2"} {
+		if err := dispatcher.Deliver(ctx, testEvent(t, ctx, int64(i+1), userID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := dispatcher.DeliverOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !<-concurrent {
+		t.Errorf("the fast subscription waited for the slow one")
+	}
+
+	// the slow receiver got one request, its other delivery waits for the same retry without an attempt
+	slowRows := make(map[int]WebhookDelivery)
+	for _, delivery := range deliveries(t, ctx, db) {
+		switch delivery.Status {
+		case WebhookDelivered:
+		case WebhookPending:
+			slowRows[delivery.Attempts] = delivery
+		default:
+			t.Errorf("unexpected delivery %+v", delivery)
+		}
+	}
+	attempted, postponed := slowRows[1], slowRows[0]
+	if len(slowRows) != 2 || attempted.LastStatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected one attempted and one postponed delivery , got %+v", slowRows)
+	}
+	if !postponed.NextAttemptAt.Equal(attempted.NextAttemptAt) {
+		t.Errorf("postponed until %v , want %v", postponed.NextAttemptAt, attempted.NextAttemptAt)
+	}
+}